@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"flag"
 	"os"
 	"sync"
@@ -54,7 +55,7 @@ func main() {
 		go func() {
 			defer wg.Done()
 			for fp_in := range chan_fp {
-				info, e := ffprobe.StreamInfoJSON(fp_in)
+				info, e := ffprobe.StreamInfoJSON(context.Background(), nil, fp_in)
 				if e != nil {
 					logrus.Warnf("%v", fp_in)
 					continue
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/keys"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/util"
+)
+
+// keygen makes the CURVE keypair of a master or a worker. The keypair file is
+// given to -curve-key; the printed public key goes to the -curve-allow file of
+// the master for a worker, or to the -curve-server file of the workers for the master.
+
+var (
+	PATH_OUT                        string
+	FORCE                           bool
+	LOG_LEVEL, LOG_FILE, LOG_FORMAT string
+)
+
+func init() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	// log options
+	flag.StringVar(&LOG_LEVEL, "loglevel", "info", "panic, fatal, error, warn, info, debug, trace")
+	flag.StringVar(&LOG_FILE, "logfile", "", "log file location")
+	flag.StringVar(&LOG_FORMAT, "logformat", "text", "text, json")
+
+	// key options
+	flag.StringVar(&PATH_OUT, "out", "./curve.key", "Keypair file to write, readable only by the owner")
+	flag.BoolVar(&FORCE, "force", false, "Overwrite an existing keypair file")
+
+	flag.Parse()
+
+	logrus.WithFields(logrus.Fields{"name": "loglevel", "value": LOG_LEVEL}).Debug("Argument")
+	logrus.WithFields(logrus.Fields{"name": "logfile", "value": LOG_FILE}).Debug("Argument")
+	logrus.WithFields(logrus.Fields{"name": "logformat", "value": LOG_FORMAT}).Debug("Argument")
+	logrus.WithFields(logrus.Fields{"name": "out", "value": PATH_OUT}).Debug("Argument")
+	logrus.WithFields(logrus.Fields{"name": "force", "value": FORCE}).Debug("Argument")
+
+	util.InitLogrus(LOG_FILE, LOG_LEVEL, LOG_FORMAT)
+
+	PATH_OUT = util.PathSanitize(PATH_OUT)
+	if util.PathIsFile(PATH_OUT) && !FORCE {
+		logrus.WithFields(logrus.Fields{"path": PATH_OUT}).Panicf("The keypair file exists; use -force to replace it")
+	}
+}
+
+func main() {
+	k, e := keys.Generate()
+	if e != nil {
+		logrus.WithFields(logrus.Fields{"error": e}).Panicf("Unable to generate a keypair")
+	}
+	if e := k.Save(PATH_OUT); e != nil {
+		logrus.WithFields(logrus.Fields{"path": PATH_OUT, "error": e}).Panicf("Unable to write the keypair")
+	}
+	logrus.WithFields(logrus.Fields{"path": PATH_OUT}).Infof("Keypair written")
+
+	// the public key alone, to be handed out
+	fmt.Println(k.Public)
+}
@@ -1,23 +1,46 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"os"
-	"path/filepath"
+	"os/signal"
 	"strconv"
 	"strings"
-	"sync"
+	"syscall"
+	"time"
 
-	"github.com/pebbe/zmq4"
 	"github.com/sirupsen/logrus"
 
+	"github.com/sunrise2575/dist-ffmpeg/pkg/keys"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/master"
 	"github.com/sunrise2575/dist-ffmpeg/pkg/util"
 )
 
+// how long an idle worker waits before asking again in the watch mode
+const WATCH_IDLE_WAIT = 10 * time.Second
+
 var (
-	SERVER_PORT, DIRECTORY          string
-	MY_HOSTNAME, MY_PID             string
-	LOG_LEVEL, LOG_FILE, LOG_FORMAT string
+	SERVER_PORT, DIRECTORY           string
+	NOTIFY_PORT, NOTIFY_ENDPOINT     string
+	HTTP_ADDR                        string
+	PATH_CURVE_KEY, PATH_CURVE_ALLOW string
+	PATH_LEDGER                      string
+	PATH_PROFILES                    string
+	PATH_ROUTES                      string
+	LEASE_TTL                        time.Duration
+	RETRY_MAX                        int
+	RETRY_BACKOFF                    time.Duration
+	RETRY_OTHER_WORKER               bool
+	SEGMENT_MIN_SIZE                 int64
+	SPECULATE                        bool
+	SPECULATE_AFTER                  time.Duration
+	ORDER, DIR_PRIORITY              string
+	PROBE                            bool
+	WATCH                            bool
+	WATCH_SETTLE, WATCH_RESCAN       time.Duration
+	MY_HOSTNAME, MY_PID              string
+	LOG_LEVEL, LOG_FILE, LOG_FORMAT  string
 )
 
 func init() {
@@ -32,6 +55,46 @@ func init() {
 	// distributed processing options
 	flag.StringVar(&SERVER_PORT, "port", "5000", "master port")
 	flag.StringVar(&DIRECTORY, "dir", ".", "File root directory")
+	flag.StringVar(&NOTIFY_PORT, "notify-port", "5001", "port announcing new work to idle workers; empty to disable")
+
+	// security options
+	flag.StringVar(&PATH_CURVE_KEY, "curve-key", "", "CURVE keypair file of the master (see keygen); empty to disable encryption")
+	flag.StringVar(&PATH_CURVE_ALLOW, "curve-allow", "", "Public keys of the workers let in, one per line, needed with -curve-key")
+
+	// monitoring options
+	flag.StringVar(&HTTP_ADDR, "http", "localhost:8080", "HTTP status API and dashboard address, e.g. \":8080\" for other hosts; empty to disable")
+
+	// job state options
+	flag.StringVar(&PATH_LEDGER, "ledger", "./ledger.jsonl", "Job ledger file for resuming after restart")
+	flag.DurationVar(&LEASE_TTL, "lease", time.Minute, "Job lease duration; workers renew it with heartbeats")
+
+	// transcoding profile options
+	flag.StringVar(&PATH_PROFILES, "profiles", "", "Transcoding profiles and the rules selecting them; empty to let workers use their -conf")
+
+	// routing options
+	flag.StringVar(&PATH_ROUTES, "routes", "", "Routes of the files to the workers by their -labels; empty to let any worker run any file")
+
+	// retry options
+	flag.IntVar(&RETRY_MAX, "retry-max", 3, "Max attempts of a file failed by a transient error")
+	flag.DurationVar(&RETRY_BACKOFF, "retry-backoff", 30*time.Second, "Delay before the first retry, doubled on every retry")
+	flag.BoolVar(&RETRY_OTHER_WORKER, "retry-other-worker", true, "Retry on a different machine if there is one")
+
+	// segment options
+	flag.Int64Var(&SEGMENT_MIN_SIZE, "segment-min-size", 0, "Videos of at least this many MiB are split into segments transcoded by several workers; 0 to disable")
+
+	// speculation options
+	flag.BoolVar(&SPECULATE, "speculate", false, "Once the queue is empty, give idle workers copies of long running jobs and keep the first to finish")
+	flag.DurationVar(&SPECULATE_AFTER, "speculate-after", time.Minute, "Only jobs running for this long are copied")
+
+	// ordering options
+	flag.StringVar(&ORDER, "order", "walk", "Order the files are handed out in: walk, longest, smallest, newest, dir")
+	flag.StringVar(&DIR_PRIORITY, "dir-priority", "", "Comma separated directories served first with -order dir, relative to -dir")
+	flag.BoolVar(&PROBE, "probe", false, "Estimate the cost of the files with ffprobe on the master instead of by their size")
+
+	// watch options
+	flag.BoolVar(&WATCH, "watch", false, "Keep watching the directory for new or modified files")
+	flag.DurationVar(&WATCH_SETTLE, "settle", time.Minute, "A new file is picked up after its size and mtime stay the same for this long")
+	flag.DurationVar(&WATCH_RESCAN, "rescan", 10*time.Minute, "Periodic rescan interval of the watch mode")
 
 	flag.Parse()
 
@@ -43,158 +106,97 @@ func init() {
 	logrus.WithFields(logrus.Fields{"name": "logformat", "value": LOG_FORMAT}).Debug("Argument")
 	logrus.WithFields(logrus.Fields{"name": "port", "value": SERVER_PORT}).Debug("Argument")
 	logrus.WithFields(logrus.Fields{"name": "dir", "value": DIRECTORY}).Debug("Argument")
+	logrus.WithFields(logrus.Fields{"name": "notify-port", "value": NOTIFY_PORT}).Debug("Argument")
+	logrus.WithFields(logrus.Fields{"name": "curve-key", "value": PATH_CURVE_KEY}).Debug("Argument")
+	logrus.WithFields(logrus.Fields{"name": "curve-allow", "value": PATH_CURVE_ALLOW}).Debug("Argument")
+	logrus.WithFields(logrus.Fields{"name": "http", "value": HTTP_ADDR}).Debug("Argument")
+	logrus.WithFields(logrus.Fields{"name": "ledger", "value": PATH_LEDGER}).Debug("Argument")
+	logrus.WithFields(logrus.Fields{"name": "lease", "value": LEASE_TTL}).Debug("Argument")
+	logrus.WithFields(logrus.Fields{"name": "profiles", "value": PATH_PROFILES}).Debug("Argument")
+	logrus.WithFields(logrus.Fields{"name": "routes", "value": PATH_ROUTES}).Debug("Argument")
+	logrus.WithFields(logrus.Fields{"name": "retry-max", "value": RETRY_MAX}).Debug("Argument")
+	logrus.WithFields(logrus.Fields{"name": "retry-backoff", "value": RETRY_BACKOFF}).Debug("Argument")
+	logrus.WithFields(logrus.Fields{"name": "retry-other-worker", "value": RETRY_OTHER_WORKER}).Debug("Argument")
+	logrus.WithFields(logrus.Fields{"name": "segment-min-size", "value": SEGMENT_MIN_SIZE}).Debug("Argument")
+	logrus.WithFields(logrus.Fields{"name": "speculate", "value": SPECULATE}).Debug("Argument")
+	logrus.WithFields(logrus.Fields{"name": "speculate-after", "value": SPECULATE_AFTER}).Debug("Argument")
+	logrus.WithFields(logrus.Fields{"name": "order", "value": ORDER}).Debug("Argument")
+	logrus.WithFields(logrus.Fields{"name": "dir-priority", "value": DIR_PRIORITY}).Debug("Argument")
+	logrus.WithFields(logrus.Fields{"name": "probe", "value": PROBE}).Debug("Argument")
+	logrus.WithFields(logrus.Fields{"name": "watch", "value": WATCH}).Debug("Argument")
+	logrus.WithFields(logrus.Fields{"name": "settle", "value": WATCH_SETTLE}).Debug("Argument")
+	logrus.WithFields(logrus.Fields{"name": "rescan", "value": WATCH_RESCAN}).Debug("Argument")
 
 	util.InitLogrus(LOG_FILE, LOG_LEVEL, LOG_FORMAT)
 
-	DIRECTORY = util.PathSanitize(DIRECTORY)
-	if !util.PathIsDir(DIRECTORY) {
-		logrus.WithFields(logrus.Fields{"path": DIRECTORY}).Panicf("Unable to find the directory")
+	PATH_LEDGER = util.PathSanitize(PATH_LEDGER)
+	if PATH_PROFILES != "" {
+		PATH_PROFILES = util.PathSanitize(PATH_PROFILES)
+	}
+	if PATH_ROUTES != "" {
+		PATH_ROUTES = util.PathSanitize(PATH_ROUTES)
+	}
+	if NOTIFY_PORT != "" {
+		NOTIFY_ENDPOINT = "tcp://*:" + NOTIFY_PORT
+	}
+	if (PATH_CURVE_KEY == "") != (PATH_CURVE_ALLOW == "") {
+		logrus.Panicf("-curve-key and -curve-allow go together")
 	}
 }
 
 func main() {
-	// create zeromq socket
-	ENDPOINT := "tcp://*:" + SERVER_PORT
-	ctx, e := zmq4.NewContext()
-	if e != nil {
-		logrus.WithFields(logrus.Fields{"error": e}).Panicf("Unable to create ZeroMQ context")
+	dir_priority := []string{}
+	for _, dp := range strings.Split(DIR_PRIORITY, ",") {
+		if dp = strings.TrimSpace(dp); dp != "" {
+			dir_priority = append(dir_priority, dp)
+		}
 	}
-	sock, e := ctx.NewSocket(zmq4.REP)
-	if e != nil {
-		logrus.WithFields(logrus.Fields{"error": e}).Panicf("Unable to create ZeroMQ socket")
+
+	curve_keys, curve_allowed := keys.Keypair{}, []string(nil)
+	if PATH_CURVE_KEY != "" {
+		var e error
+		if curve_keys, e = keys.LoadKeypair(PATH_CURVE_KEY); e != nil {
+			logrus.WithFields(logrus.Fields{"error": e}).Panicf("Unable to read the CURVE keypair")
+		}
+		if curve_allowed, e = keys.LoadAllowList(PATH_CURVE_ALLOW); e != nil {
+			logrus.WithFields(logrus.Fields{"error": e}).Panicf("Unable to read the public keys of the workers")
+		}
 	}
-	e = sock.Bind("tcp://*:" + SERVER_PORT)
+
+	srv, e := master.New(master.Options{
+		Endpoint:         "tcp://*:" + SERVER_PORT,
+		NotifyEndpoint:   NOTIFY_ENDPOINT,
+		CurveKeys:        curve_keys,
+		CurveAllowed:     curve_allowed,
+		Directory:        DIRECTORY,
+		LedgerPath:       PATH_LEDGER,
+		ProfilesPath:     PATH_PROFILES,
+		RoutesPath:       PATH_ROUTES,
+		HTTPAddr:         HTTP_ADDR,
+		LeaseTTL:         LEASE_TTL,
+		RetryMax:         RETRY_MAX,
+		RetryBackoff:     RETRY_BACKOFF,
+		RetryOtherWorker: RETRY_OTHER_WORKER,
+		SegmentMinSize:   SEGMENT_MIN_SIZE << 20,
+		Speculate:        SPECULATE,
+		SpeculateAfter:   SPECULATE_AFTER,
+		Order:            ORDER,
+		DirPriority:      dir_priority,
+		Probe:            PROBE,
+		Watch:            WATCH,
+		WatchSettle:      WATCH_SETTLE,
+		WatchRescan:      WATCH_RESCAN,
+		IdleWait:         WATCH_IDLE_WAIT,
+		Hostname:         MY_HOSTNAME,
+		PID:              MY_PID,
+	})
 	if e != nil {
-		logrus.WithFields(logrus.Fields{"error": e}).Panicf("Unable to bind ZeroMQ socket")
+		logrus.WithFields(logrus.Fields{"error": e}).Panicf("Unable to start the master")
 	}
-	logrus.WithFields(logrus.Fields{"endpoint": ENDPOINT}).Debugf("Bind")
-
-	// iterate files and transcode
-	{
-		chan_fp := make(chan string, 16)
-
-		ext_exclude := util.Slice2Map([]string{".7z", ".rar", ".zip", ".tar", ".lzh", ".bin", ".cue", ".md5", ".mds", ".mdf", ".log", ".txt", ".lrc", ".exe", ".md", ".py", ".sample", ".go", ".mod", ".sum", ".json", ".sh", ".gitignore"})
-		ext_subtitle := util.Slice2Map([]string{".smi", ".srt", ".vtt", ".ass"})
-		ext_video := util.Slice2Map([]string{".webm"})
-		ext_audio := util.Slice2Map([]string{".ogg"})
-		ext_image := util.Slice2Map([]string{".png"})
-
-		// search files recursively
-		var wg sync.WaitGroup
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-
-			logrus.WithFields(logrus.Fields{"path": DIRECTORY}).
-				Infof("Start to seek files recursively in the directory")
-
-			filepath.Walk(DIRECTORY, func(fp_in string, f_info os.FileInfo, err error) error {
-				if f_info.IsDir() {
-					return nil
-				}
-				// file path sanity check
-				_, name, ext := util.PathSplit(fp_in)
-				if len(ext) < 2 {
-					return nil
-				}
-
-				if len(name) > 0 && name[0] == '.' {
-					return nil
-				}
-
-				ext = strings.ToLower(ext)
-
-				if ext_exclude[ext] || ext_subtitle[ext] {
-					return nil
-				}
-
-				if ext_video[ext] || ext_audio[ext] || ext_image[ext] {
-					return nil
-				}
-
-				chan_fp <- fp_in
-				return nil
-			})
-
-			logrus.WithFields(logrus.Fields{"path": DIRECTORY}).
-				Infof("Complete to seek files recursively in the directory")
-		}()
-
-		// request handling server
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-
-			for {
-				// Must Recv
-				recv_json, _ := sock.Recv(0)
-				recv := util.JSON2Map(recv_json)
-
-				// Prepare response
-				send_payload := map[string]string{}
-				send_payload["hostname"] = MY_HOSTNAME
-				send_payload["pid"] = MY_PID
-
-				switch recv["req"] {
-				case "job_want":
-					select {
-					case fp := <-chan_fp:
-						send_payload["res"] = "true"
-						send_payload["path"] = fp
-						logrus.WithFields(logrus.Fields{
-							"hostname": recv["hostname"],
-							"pid":      recv["pid"],
-							"path":     fp,
-						}).Infof("Start")
-					default:
-						send_payload["res"] = "false"
-						logrus.WithFields(logrus.Fields{
-							"hostname": recv["hostname"],
-							"pid":      recv["pid"],
-						}).Warnf("Got job request, but no more job")
-					}
-
-				case "job_done":
-					logrus.WithFields(logrus.Fields{
-						"hostname":     recv["hostname"],
-						"pid":          recv["pid"],
-						"path":         recv["path"],
-						"elapsed_time": recv["elapsed_time"],
-					}).Infof("Complete")
-
-				case "job_fail":
-					logrus.WithFields(logrus.Fields{
-						"hostname":     recv["hostname"],
-						"pid":          recv["pid"],
-						"path":         recv["path"],
-						"elapsed_time": recv["elapsed_time"],
-					}).Warnf("Failed")
-
-				case "job_skip":
-					logrus.WithFields(logrus.Fields{
-						"hostname":     recv["hostname"],
-						"pid":          recv["pid"],
-						"path":         recv["path"],
-						"elapsed_time": recv["elapsed_time"],
-					}).Warnf("Skipped")
-
-				case "killed":
-					logrus.WithFields(logrus.Fields{
-						"hostname":     recv["hostname"],
-						"pid":          recv["pid"],
-						"path":         recv["path"],
-						"elapsed_time": recv["elapsed_time"],
-					}).Warnf("Incomplete")
-
-				default:
-					// ignore
-					//send_payload["res"] = "wrong_req"
-				}
-
-				// Must Send
-				sock.Send(util.Map2JSON(send_payload), 0)
-			}
-		}()
-		wg.Wait()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if e := srv.Run(ctx); e != nil {
+		logrus.WithFields(logrus.Fields{"error": e}).Panicf("Master stopped")
 	}
 }
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/profile"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/transcode"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/util"
+	"github.com/tidwall/pretty"
+)
+
+// showconf prints the effective transcoding config of the given files,
+// i.e. the profile or base config with every sidecar override merged in.
+// Without files it prints the configs themselves with "extends" and "include" resolved.
+
+var (
+	PATH_CONFIG, PATH_PROFILES      string
+	LOG_LEVEL, LOG_FILE, LOG_FORMAT string
+)
+
+func init() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] [<file>...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	// log options
+	flag.StringVar(&LOG_LEVEL, "loglevel", "info", "panic, fatal, error, warn, info, debug, trace")
+	flag.StringVar(&LOG_FILE, "logfile", "", "log file location")
+	flag.StringVar(&LOG_FORMAT, "logformat", "text", "text, json")
+
+	// transcoding options
+	flag.StringVar(&PATH_CONFIG, "conf", "./config-anime.json", "Base config file, the same as the worker's")
+	flag.StringVar(&PATH_PROFILES, "profiles", "", "Profiles file, the same as the master's; overrides -conf when a profile is selected")
+
+	flag.Parse()
+
+	logrus.WithFields(logrus.Fields{"name": "loglevel", "value": LOG_LEVEL}).Debug("Argument")
+	logrus.WithFields(logrus.Fields{"name": "logfile", "value": LOG_FILE}).Debug("Argument")
+	logrus.WithFields(logrus.Fields{"name": "logformat", "value": LOG_FORMAT}).Debug("Argument")
+	logrus.WithFields(logrus.Fields{"name": "conf", "value": PATH_CONFIG}).Debug("Argument")
+	logrus.WithFields(logrus.Fields{"name": "profiles", "value": PATH_PROFILES}).Debug("Argument")
+
+	util.InitLogrus(LOG_FILE, LOG_LEVEL, LOG_FORMAT)
+}
+
+func printConfig(conf *transcode.Config, comments ...string) {
+	for _, comment := range comments {
+		fmt.Printf("# %v\n", comment)
+	}
+	fmt.Print(string(pretty.Pretty([]byte(conf.Raw.Raw))))
+}
+
+func main() {
+	conf, e := transcode.LoadConfig(util.PathSanitize(PATH_CONFIG))
+	if e != nil {
+		logrus.WithFields(logrus.Fields{"path": PATH_CONFIG, "error": e}).Fatalf("Unable to parse the configure file")
+	}
+
+	var profiles *profile.Set
+	if PATH_PROFILES != "" {
+		profiles, e = profile.Load(util.PathSanitize(PATH_PROFILES))
+		if e != nil {
+			logrus.WithFields(logrus.Fields{"path": PATH_PROFILES, "error": e}).Fatalf("Unable to load the profiles")
+		}
+	}
+
+	if flag.NArg() == 0 {
+		printConfig(conf, PATH_CONFIG)
+		if profiles != nil {
+			names := []string{}
+			for name := range profiles.Profiles {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				printConfig(profiles.Profiles[name], "profile "+name)
+			}
+		}
+		return
+	}
+
+	for _, fp := range flag.Args() {
+		fp = util.PathSanitize(fp)
+
+		base, source := conf, PATH_CONFIG
+		if profiles != nil {
+			name, e := profiles.Resolve(context.Background(), nil, fp)
+			if e != nil {
+				logrus.WithFields(logrus.Fields{"path": fp, "error": e}).Warnf("Unable to resolve the profile, use the default")
+				name = profiles.Default
+			}
+			if profile_conf, ok := profiles.Config(name); ok {
+				base, source = profile_conf, "profile "+name
+			}
+		}
+
+		merged, sidecars, e := transcode.EffectiveConfig(fp, base)
+		if e != nil {
+			logrus.WithFields(logrus.Fields{"path": fp, "error": e}).Errorf("Unable to merge the sidecar configs")
+			continue
+		}
+
+		comments := []string{fp, "base: " + source}
+		for _, sidecar := range sidecars {
+			comments = append(comments, "override: "+sidecar)
+		}
+		printConfig(merged, comments...)
+	}
+}
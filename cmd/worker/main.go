@@ -3,23 +3,35 @@ package main
 import (
 	"context"
 	"flag"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
+	"syscall"
 	"time"
 
-	"github.com/pebbe/zmq4"
 	"github.com/sirupsen/logrus"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/keys"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/routing"
 	"github.com/sunrise2575/dist-ffmpeg/pkg/transcode"
 	"github.com/sunrise2575/dist-ffmpeg/pkg/util"
-	"github.com/tidwall/gjson"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/worker"
 )
 
 var (
-	SERVER_IP, SERVER_PORT          string
-	MY_HOSTNAME, MY_PID             string
-	PATH_CONFIG, PATH_TEMP          string
-	LOG_LEVEL, LOG_FILE, LOG_FORMAT string
+	SERVER_IP, SERVER_PORT            string
+	NOTIFY_PORT                       string
+	POLL_MIN, POLL_MAX                time.Duration
+	REQUEST_TIMEOUT                   time.Duration
+	PATH_CURVE_KEY, PATH_CURVE_SERVER string
+	LABELS                            string
+	MY_LABELS                         routing.Labels
+	EXIT_WHEN_EMPTY                   bool
+	METRICS_ADDR                      string
+	MY_HOSTNAME, MY_PID               string
+	PATH_CONFIG, PATH_TEMP            string
+	LOG_LEVEL, LOG_FILE, LOG_FORMAT   string
 )
 
 func init() {
@@ -33,12 +45,27 @@ func init() {
 	flag.StringVar(&LOG_FORMAT, "logformat", "text", "text, json")
 
 	// transcoding options
-	flag.StringVar(&PATH_CONFIG, "conf", "./config-anime.json", "Config file")
+	flag.StringVar(&PATH_CONFIG, "conf", "./config-anime.json", "Fallback config file, used when the master sends no profile")
 	flag.StringVar(&PATH_TEMP, "temp", filepath.Join(my_home, ".temp/"), "Temporary directory for transcoding")
 
 	// distributed processing options
 	flag.StringVar(&SERVER_IP, "ip", "localhost", "master port")
 	flag.StringVar(&SERVER_PORT, "port", "5000", "master port")
+	flag.StringVar(&NOTIFY_PORT, "notify-port", "5001", "master port announcing new work; empty to disable")
+	flag.DurationVar(&REQUEST_TIMEOUT, "request-timeout", 10*time.Second, "Reconnect and send a request again when the master does not answer in this time")
+	flag.StringVar(&LABELS, "labels", "", "Labels the master routes files by, e.g. cores=64,switch=b")
+
+	// security options
+	flag.StringVar(&PATH_CURVE_KEY, "curve-key", "", "CURVE keypair file of this worker (see keygen); empty to disable encryption")
+	flag.StringVar(&PATH_CURVE_SERVER, "curve-server", "", "Public key file of the master, needed with -curve-key")
+
+	// idle options
+	flag.DurationVar(&POLL_MIN, "poll-min", 5*time.Second, "First polling interval while the master has no job")
+	flag.DurationVar(&POLL_MAX, "poll-max", 2*time.Minute, "Polling interval is doubled up to this while idle")
+	flag.BoolVar(&EXIT_WHEN_EMPTY, "exit-when-empty", false, "Exit when the master has no more job instead of waiting")
+
+	// monitoring options
+	flag.StringVar(&METRICS_ADDR, "metrics", ":9101", "Prometheus metrics address; empty to disable")
 
 	flag.Parse()
 
@@ -49,6 +76,15 @@ func init() {
 	logrus.WithFields(logrus.Fields{"name": "logfile", "value": LOG_FILE}).Debug("Argument")
 	logrus.WithFields(logrus.Fields{"name": "logformat", "value": LOG_FORMAT}).Debug("Argument")
 	logrus.WithFields(logrus.Fields{"name": "port", "value": SERVER_PORT}).Debug("Argument")
+	logrus.WithFields(logrus.Fields{"name": "notify-port", "value": NOTIFY_PORT}).Debug("Argument")
+	logrus.WithFields(logrus.Fields{"name": "request-timeout", "value": REQUEST_TIMEOUT}).Debug("Argument")
+	logrus.WithFields(logrus.Fields{"name": "labels", "value": LABELS}).Debug("Argument")
+	logrus.WithFields(logrus.Fields{"name": "curve-key", "value": PATH_CURVE_KEY}).Debug("Argument")
+	logrus.WithFields(logrus.Fields{"name": "curve-server", "value": PATH_CURVE_SERVER}).Debug("Argument")
+	logrus.WithFields(logrus.Fields{"name": "poll-min", "value": POLL_MIN}).Debug("Argument")
+	logrus.WithFields(logrus.Fields{"name": "poll-max", "value": POLL_MAX}).Debug("Argument")
+	logrus.WithFields(logrus.Fields{"name": "exit-when-empty", "value": EXIT_WHEN_EMPTY}).Debug("Argument")
+	logrus.WithFields(logrus.Fields{"name": "metrics", "value": METRICS_ADDR}).Debug("Argument")
 	logrus.WithFields(logrus.Fields{"name": "conf", "value": PATH_CONFIG}).Debug("Argument")
 	logrus.WithFields(logrus.Fields{"name": "temp", "value": PATH_TEMP}).Debug("Argument")
 
@@ -58,157 +94,75 @@ func init() {
 	if !util.PathIsFile(PATH_CONFIG) {
 		logrus.WithFields(logrus.Fields{"path": PATH_CONFIG}).Panicf("Unable to find the configure file")
 	}
-
-	PATH_TEMP = util.PathSanitize(PATH_TEMP)
-	e := os.MkdirAll(PATH_TEMP, 0755)
-	if e != nil {
-		logrus.WithFields(logrus.Fields{"path": PATH_TEMP}).Panicf("Unable to create/open the temporary directory")
+	var e error
+	if MY_LABELS, e = routing.ParseLabels(LABELS); e != nil {
+		logrus.WithFields(logrus.Fields{"labels": LABELS, "error": e}).Panicf("Invalid labels")
+	}
+	if (PATH_CURVE_KEY == "") != (PATH_CURVE_SERVER == "") {
+		logrus.Panicf("-curve-key and -curve-server go together")
 	}
 }
 
-func SendRecv(sock *zmq4.Socket, send_payload map[string]string) map[string]string {
-	// Must Send
-	send_payload["hostname"] = MY_HOSTNAME
-	send_payload["pid"] = MY_PID
-	sock.Send(util.Map2JSON(send_payload), 0)
+// serveMetrics exposes /metrics; a busy port only disables the metrics,
+// since several workers may run on one machine
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", worker.MetricsHandler())
 
-	// Must Recv
-	recv_json, _ := sock.Recv(0)
-	return util.JSON2Map(recv_json)
+	logrus.WithFields(logrus.Fields{"address": addr}).Debugf("Serve metrics")
+	if e := http.ListenAndServe(addr, mux); e != nil {
+		logrus.WithFields(logrus.Fields{"address": addr, "error": e}).Warnf("Unable to serve metrics")
+	}
 }
 
 func main() {
-	ENDPOINT := "tcp://" + SERVER_IP + ":" + SERVER_PORT
-
 	// Read config file
-	conf, e := util.ReadJSONFile(PATH_CONFIG)
-	if e != nil {
-		logrus.WithFields(logrus.Fields{"path": PATH_CONFIG}).Panicf("Unable to parse the configure file")
-	}
-
-	ctx, e := zmq4.NewContext()
-	if e != nil {
-		logrus.WithFields(logrus.Fields{"error": e}).Panicf("Unable to create ZeroMQ context")
-	}
-	sock, e := ctx.NewSocket(zmq4.REQ)
+	conf, e := transcode.LoadConfig(PATH_CONFIG)
 	if e != nil {
-		logrus.WithFields(logrus.Fields{"error": e}).Panicf("Unable to create ZeroMQ socket")
+		logrus.WithFields(logrus.Fields{"path": PATH_CONFIG, "error": e}).Panicf("Unable to parse the configure file")
 	}
-	e = sock.Connect(ENDPOINT)
-	if e != nil {
-		logrus.WithFields(logrus.Fields{"error": e}).Panicf("Unable to connect ZeroMQ socket")
-	}
-	logrus.WithFields(logrus.Fields{"endpoint": ENDPOINT}).Debugf("Connect")
 
-	current_fp := ""
-
-	defer func() {
-		if current_fp != "" {
-			logrus.WithFields(logrus.Fields{"path": current_fp}).Warnf("Incomplete")
-			SendRecv(sock, map[string]string{"req": "killed", "path": current_fp})
-			logrus.WithFields(logrus.Fields{"path": current_fp}).Debugf("Report to master")
+	curve_server, curve_keys := "", keys.Keypair{}
+	if PATH_CURVE_KEY != "" {
+		if curve_keys, e = keys.LoadKeypair(PATH_CURVE_KEY); e != nil {
+			logrus.WithFields(logrus.Fields{"error": e}).Panicf("Unable to read the CURVE keypair")
+		}
+		if curve_server, e = keys.LoadPublic(PATH_CURVE_SERVER); e != nil {
+			logrus.WithFields(logrus.Fields{"error": e}).Panicf("Unable to read the public key of the master")
 		}
-	}()
-
-	for {
-		func() {
-			defer func() {
-				if p := recover(); p != nil {
-					logrus.WithFields(logrus.Fields{"recover_msg": p}).Warnf("Recovered from panic")
-				}
-			}()
-
-			// Query to master server
-			recv := SendRecv(sock, map[string]string{"req": "job_want"})
-
-			if recv["res"] == "false" {
-				logrus.Warnf("No more avaialbe job. Bye.")
-				os.Exit(0)
-			}
-
-			current_fp = recv["path"]
-			logrus.WithFields(logrus.Fields{"path": current_fp}).Debugf("Received a job")
-
-			start := time.Now()
-
-			status, e := work(current_fp, conf, PATH_TEMP)
-
-			elapsed := time.Since(start)
-
-			// Report to master server
-			switch status {
-			case "success":
-				logrus.WithFields(logrus.Fields{"path": current_fp}).Infof("Success")
-				SendRecv(sock, map[string]string{
-					"req":          "job_done",
-					"path":         current_fp,
-					"elapsed_time": util.Atof(elapsed.Seconds()),
-				})
-				logrus.WithFields(logrus.Fields{"path": current_fp}).Debugf("Report complete job")
-
-			case "skip":
-				logrus.WithFields(logrus.Fields{"path": current_fp}).Warnf("Skip")
-				SendRecv(sock, map[string]string{
-					"req":          "job_skip",
-					"path":         current_fp,
-					"elapsed_time": util.Atof(elapsed.Seconds()),
-				})
-				logrus.WithFields(logrus.Fields{"path": current_fp}).Debugf("Report skipped job")
-
-			case "fail":
-				//logrus.WithFields(logrus.Fields{"path": current_fp}).Warnf("Failed")
-				logrus.WithFields(logrus.Fields{"path": current_fp}).Warnf("Failed")
-				SendRecv(sock, map[string]string{
-					"req":          "job_fail",
-					"path":         current_fp,
-					"elapsed_time": util.Atof(elapsed.Seconds()),
-					"error":        e.Error(),
-				})
-				logrus.WithFields(logrus.Fields{"path": current_fp}).Debugf("Report failed job")
-			}
-
-			current_fp = ""
-		}()
 	}
-}
-
-type CtxKey string
 
-func work(fp_in string, conf gjson.Result, temp_dir string) (string, error) {
-	meta := transcode.Metadata{}
-	meta.Init(fp_in, conf, temp_dir)
-	if meta.FileType == "" {
-		return "skip", nil
+	notify_endpoint := ""
+	if NOTIFY_PORT != "" {
+		notify_endpoint = "tcp://" + SERVER_IP + ":" + NOTIFY_PORT
 	}
-
-	ctx := context.Background()
-
-	var e error
-	// transcode
-	switch meta.FileType {
-	case "image":
-		fallthrough
-	case "audio":
-		fallthrough
-	case "video":
-		e = transcode.SingleStreamOnly(ctx, &meta)
-		if e != nil {
-			logrus.Errorln(e)
-		}
-	case "video_and_audio":
-		e = transcode.VideoAndAudio(ctx, &meta)
-		if e != nil {
-			logrus.Errorln(e)
-		}
-	case "image_animated":
-		fallthrough
-	default:
-		return "skip", nil
+	w, e := worker.New(worker.Options{
+		Endpoint:       "tcp://" + SERVER_IP + ":" + SERVER_PORT,
+		NotifyEndpoint: notify_endpoint,
+		Config:         conf,
+		TempDir:        PATH_TEMP,
+		PollMin:        POLL_MIN,
+		PollMax:        POLL_MAX,
+		RequestTimeout: REQUEST_TIMEOUT,
+		CurveServerKey: curve_server,
+		CurveKeys:      curve_keys,
+		ExitWhenEmpty:  EXIT_WHEN_EMPTY,
+		Hostname:       MY_HOSTNAME,
+		PID:            MY_PID,
+		Labels:         MY_LABELS,
+	})
+	if e != nil {
+		logrus.WithFields(logrus.Fields{"error": e}).Panicf("Unable to start the worker")
 	}
 
-	if e != nil {
-		return "fail", e
+	if METRICS_ADDR != "" {
+		go serveMetrics(METRICS_ADDR)
 	}
 
-	return "success", nil
+	// the job in progress is reported as killed on Ctrl+C or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if e := w.Run(ctx); e != nil {
+		logrus.WithFields(logrus.Fields{"error": e}).Panicf("Worker stopped")
+	}
 }
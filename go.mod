@@ -7,12 +7,12 @@ require (
 	github.com/pebbe/zmq4 v1.2.9
 	github.com/sirupsen/logrus v1.8.1
 	github.com/tidwall/gjson v1.14.0
+	github.com/tidwall/pretty v1.2.0
 	github.com/tidwall/sjson v1.2.4
 )
 
 require (
 	github.com/antonfisher/nested-logrus-formatter v1.3.1
 	github.com/tidwall/match v1.1.1 // indirect
-	github.com/tidwall/pretty v1.2.0 // indirect
 	golang.org/x/sys v0.0.0-20191026070338-33540a1f6037 // indirect
 )
@@ -1,26 +1,31 @@
 package ffprobe
 
 import (
+	"context"
 	"fmt"
-	"os/exec"
 
 	"strconv"
 	"strings"
 
 	"github.com/sirupsen/logrus"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/runner"
 	"github.com/sunrise2575/dist-ffmpeg/pkg/util"
 
 	"github.com/tidwall/gjson"
 )
 
-func StreamInfoJSON(fp_in string) ([]gjson.Result, error) {
+// The functions below run ffprobe through r, the real one if r is nil, and
+// kill it when ctx is done
+
+func StreamInfoJSON(ctx context.Context, r runner.Runner, fp_in string) ([]gjson.Result, error) {
 	fp_in = util.PathSanitize(fp_in)
-	arg := strings.Fields("-v quiet -print_format json -show_streams")
+	arg := strings.Fields("-v error -print_format json -show_streams")
 	arg = append(arg, fp_in)
 
-	out, e := exec.Command("ffprobe", arg...).CombinedOutput()
+	// keep stderr apart, otherwise the warnings break the JSON
+	out, stderr, e := runner.Or(r).Run(ctx, "ffprobe", arg)
 	if e != nil {
-		return nil, fmt.Errorf("error message: %v, ffprobe output: %v", e, string(out))
+		return nil, fmt.Errorf("error message: %v, ffprobe output: %v", e, string(stderr))
 	}
 
 	logrus.WithFields(
@@ -36,13 +41,14 @@ func StreamInfoJSON(fp_in string) ([]gjson.Result, error) {
 	return gjson.Get(string(out), "streams").Array(), nil
 }
 
-func VideoTime(fp_in string) (float64, error) {
+func VideoTime(ctx context.Context, r runner.Runner, fp_in string) (float64, error) {
 	fp_in = util.PathSanitize(fp_in)
 	arg := strings.Fields("-v error -select_streams v:0 -show_entries format=duration -of default=noprint_wrappers=1:nokey=1")
 	arg = append(arg, fp_in)
 
-	out, e := exec.Command("ffprobe", arg...).CombinedOutput()
+	out, stderr, e := runner.Or(r).Run(ctx, "ffprobe", arg)
 	if e != nil {
+		out = append(out, stderr...)
 		return 0.0, fmt.Errorf("error message: %v, ffprobe output: %v", e, string(out))
 	}
 
@@ -67,13 +73,14 @@ func VideoTime(fp_in string) (float64, error) {
 	return time, nil
 }
 
-func VideoFrame(fp_in string) (int, error) {
+func VideoFrame(ctx context.Context, r runner.Runner, fp_in string) (int, error) {
 	fp_in = util.PathSanitize(fp_in)
 	arg := strings.Fields("-v error -select_streams v:0 -count_packets -show_entries stream=nb_read_packets -of csv=p=0")
 	arg = append(arg, fp_in)
 
-	out, e := exec.Command("ffprobe", arg...).CombinedOutput()
+	out, stderr, e := runner.Or(r).Run(ctx, "ffprobe", arg)
 	if e != nil {
+		out = append(out, stderr...)
 		return 0, fmt.Errorf("error message: %v, ffprobe output: %v", e, string(out))
 	}
 
@@ -0,0 +1,121 @@
+// Package keys reads and writes the CURVE keys of the master and the workers.
+//
+// A keypair file is JSON with the Z85 encoded keys:
+//
+//	{"public_key": "...", "secret_key": "..."}
+//
+// It stays on its machine. The public key is handed out as a text file with
+// the key on one line, or in an allow-list file with one key per line and an
+// optional name after it. Lines starting with # are comments.
+package keys
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pebbe/zmq4"
+)
+
+// Z85 encoded CURVE keys are this long
+const key_length = 40
+
+const z85_chars = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ.-:+=^!/*?&<>()[]{}@%$#"
+
+// Keypair is a CURVE keypair, Z85 encoded
+type Keypair struct {
+	Public string `json:"public_key"`
+	Secret string `json:"secret_key"`
+}
+
+// Check fails unless the key looks like a Z85 encoded CURVE key
+func Check(key string) error {
+	if len(key) != key_length {
+		return fmt.Errorf("a key is %v characters long, not %v: %q", key_length, len(key), key)
+	}
+	for _, c := range key {
+		if !strings.ContainsRune(z85_chars, c) {
+			return fmt.Errorf("a key has no %q: %q", c, key)
+		}
+	}
+	return nil
+}
+
+// Generate makes a new keypair
+func Generate() (Keypair, error) {
+	if !zmq4.HasCurve() {
+		return Keypair{}, fmt.Errorf("the ZeroMQ library is built without CURVE")
+	}
+	public, secret, e := zmq4.NewCurveKeypair()
+	if e != nil {
+		return Keypair{}, e
+	}
+	return Keypair{Public: public, Secret: secret}, nil
+}
+
+// Save writes the keypair to a file only the owner can read
+func (k Keypair) Save(fp string) error {
+	data, _ := json.MarshalIndent(k, "", "  ")
+	return os.WriteFile(fp, append(data, '\n'), 0600)
+}
+
+// LoadKeypair reads a keypair file
+func LoadKeypair(fp string) (Keypair, error) {
+	data, e := os.ReadFile(fp)
+	if e != nil {
+		return Keypair{}, e
+	}
+	k := Keypair{}
+	if e := json.Unmarshal(data, &k); e != nil {
+		return Keypair{}, fmt.Errorf("%v is not a keypair file: %w", fp, e)
+	}
+	if e := Check(k.Public); e != nil {
+		return Keypair{}, fmt.Errorf("%v: public_key: %w", fp, e)
+	}
+	if e := Check(k.Secret); e != nil {
+		return Keypair{}, fmt.Errorf("%v: secret_key: %w", fp, e)
+	}
+	return k, nil
+}
+
+// LoadPublic reads a public key file, or the public key of a keypair file
+func LoadPublic(fp string) (string, error) {
+	if k, e := LoadKeypair(fp); e == nil {
+		return k.Public, nil
+	}
+	list, e := LoadAllowList(fp)
+	if e != nil {
+		return "", e
+	}
+	if len(list) != 1 {
+		return "", fmt.Errorf("%v has %v keys, not one", fp, len(list))
+	}
+	return list[0], nil
+}
+
+// LoadAllowList reads the public keys of an allow-list file
+func LoadAllowList(fp string) ([]string, error) {
+	f, e := os.Open(fp)
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+
+	result := []string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// the key, then an optional name
+		key := strings.Fields(line)[0]
+		if e := Check(key); e != nil {
+			return nil, fmt.Errorf("%v:%v: %w", fp, n, e)
+		}
+		result = append(result, key)
+	}
+	return result, scanner.Err()
+}
@@ -0,0 +1,69 @@
+package keys
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestKeypairRoundTrip(t *testing.T) {
+	k, e := Generate()
+	if e != nil {
+		t.Fatal(e)
+	}
+	fp := filepath.Join(t.TempDir(), "worker.key")
+	if e := k.Save(fp); e != nil {
+		t.Fatal(e)
+	}
+	if info, _ := os.Stat(fp); info.Mode().Perm() != 0600 {
+		t.Errorf("mode %v", info.Mode().Perm())
+	}
+
+	got, e := LoadKeypair(fp)
+	if e != nil || got != k {
+		t.Errorf("loaded %+v, %v", got, e)
+	}
+	// a keypair file works as a public key file
+	if public, e := LoadPublic(fp); e != nil || public != k.Public {
+		t.Errorf("public %v, %v", public, e)
+	}
+}
+
+func TestLoadAllowList(t *testing.T) {
+	key_a := strings.Repeat("a", 40)
+	key_b := "rq:rM>}U?@Lns47E1%kR.o@n%FcmmsL/@{H8]yf7"
+	fp := filepath.Join(t.TempDir(), "workers.txt")
+	os.WriteFile(fp, []byte("# transcoding farm\n"+key_a+"  worker-01\n\n  "+key_b+"\n"), 0644)
+
+	list, e := LoadAllowList(fp)
+	if e != nil || !reflect.DeepEqual(list, []string{key_a, key_b}) {
+		t.Errorf("%v, %v", list, e)
+	}
+	if _, e := LoadPublic(fp); e == nil {
+		t.Error("read one public key out of two")
+	}
+}
+
+func TestLoadRejectsBadKeys(t *testing.T) {
+	cases := map[string]string{
+		"short":    "abc worker-01\n",
+		"bad char": strings.Repeat("a", 39) + "~\n",
+	}
+	for name, content := range cases {
+		t.Run(name, func(t *testing.T) {
+			fp := filepath.Join(t.TempDir(), "workers.txt")
+			os.WriteFile(fp, []byte("# comment\n"+content), 0644)
+			if _, e := LoadAllowList(fp); e == nil || !strings.Contains(e.Error(), ":2:") {
+				t.Errorf("error %v", e)
+			}
+		})
+	}
+
+	fp := filepath.Join(t.TempDir(), "worker.key")
+	os.WriteFile(fp, []byte(`{"public_key": "`+strings.Repeat("a", 40)+`", "secret_key": ""}`), 0600)
+	if _, e := LoadKeypair(fp); e == nil || !strings.Contains(e.Error(), "secret_key") {
+		t.Errorf("error %v", e)
+	}
+}
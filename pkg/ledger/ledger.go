@@ -0,0 +1,238 @@
+package ledger
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/util"
+)
+
+type State string
+
+const (
+	StateQueued   State = "queued"
+	StateAssigned State = "assigned"
+	StateDone     State = "done"
+	StateFailed   State = "failed"
+	StateSkipped  State = "skipped"
+	StateKilled   State = "killed"
+)
+
+// IsTerminal reports whether a path in this state must not be handed out again
+func (s State) IsTerminal() bool {
+	switch s {
+	case StateDone, StateFailed, StateSkipped:
+		return true
+	}
+	return false
+}
+
+type Entry struct {
+	Path        string    `json:"path"`
+	State       State     `json:"state"`
+	Hostname    string    `json:"hostname,omitempty"`
+	PID         string    `json:"pid,omitempty"`
+	QueuedAt    time.Time `json:"queued_at"`
+	AssignedAt  time.Time `json:"assigned_at"`
+	FinishedAt  time.Time `json:"finished_at"`
+	ElapsedTime float64   `json:"elapsed_time,omitempty"`
+	Attempts    int       `json:"attempts,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	ErrorClass  string    `json:"error_class,omitempty"`
+	Profile     string    `json:"profile,omitempty"`
+	// of a done job, its cost in seconds of 1080p media; the master measures
+	// the speed of the worker with it and ElapsedTime
+	Work float64 `json:"work,omitempty"`
+}
+
+// Ledger is an append-only journal of job states kept in a single file.
+// Every update is appended as one JSON line; the latest line of a path wins.
+// The journal is compacted to one line per path whenever it is opened.
+type Ledger struct {
+	mu      sync.Mutex
+	fp      string
+	f       *os.File
+	entries map[string]*Entry
+}
+
+func Open(fp string) (*Ledger, error) {
+	fp = util.PathSanitize(fp)
+	l := &Ledger{
+		fp:      fp,
+		entries: map[string]*Entry{},
+	}
+
+	if e := l.load(); e != nil {
+		return nil, e
+	}
+
+	if e := l.compact(); e != nil {
+		return nil, e
+	}
+
+	f, e := os.OpenFile(fp, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if e != nil {
+		return nil, e
+	}
+	l.f = f
+
+	return l, nil
+}
+
+func (l *Ledger) load() error {
+	f, e := os.Open(l.fp)
+	if os.IsNotExist(e) {
+		return nil
+	}
+	if e != nil {
+		return e
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line_no := 0
+	for scanner.Scan() {
+		line_no++
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		entry := Entry{}
+		if e := json.Unmarshal(line, &entry); e != nil || entry.Path == "" {
+			// a torn write from a crash can only be the last line, so just skip it
+			logrus.WithFields(logrus.Fields{
+				"path":  l.fp,
+				"line":  line_no,
+				"error": e,
+			}).Warnf("Ignore broken ledger line")
+			continue
+		}
+		l.entries[entry.Path] = &entry
+	}
+
+	return scanner.Err()
+}
+
+func (l *Ledger) compact() error {
+	fp_temp := l.fp + ".tmp"
+	f, e := os.OpenFile(fp_temp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if e != nil {
+		return e
+	}
+
+	w := bufio.NewWriter(f)
+	for _, entry := range l.sorted() {
+		b, e := json.Marshal(entry)
+		if e != nil {
+			f.Close()
+			return e
+		}
+		w.Write(b)
+		w.WriteByte('\n')
+	}
+
+	if e := w.Flush(); e != nil {
+		f.Close()
+		return e
+	}
+	if e := f.Sync(); e != nil {
+		f.Close()
+		return e
+	}
+	if e := f.Close(); e != nil {
+		return e
+	}
+
+	return os.Rename(fp_temp, l.fp)
+}
+
+func (l *Ledger) sorted() []Entry {
+	result := make([]Entry, 0, len(l.entries))
+	for _, entry := range l.entries {
+		result = append(result, *entry)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Path < result[j].Path
+	})
+	return result
+}
+
+func (l *Ledger) Get(path string) (Entry, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry, ok := l.entries[path]
+	if !ok {
+		return Entry{}, false
+	}
+	return *entry, true
+}
+
+// Entries returns a snapshot of every entry ordered by path
+func (l *Ledger) Entries() []Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.sorted()
+}
+
+// Counts returns the number of entries in each state
+func (l *Ledger) Counts() map[State]int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	result := map[State]int{}
+	for _, entry := range l.entries {
+		result[entry.State]++
+	}
+	return result
+}
+
+// Update applies fn to the entry of the path (a zero entry if unknown) and
+// appends the result to the journal
+func (l *Ledger) Update(path string, fn func(entry *Entry)) (Entry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return Entry{}, fmt.Errorf("ledger is closed: %v", l.fp)
+	}
+
+	entry := Entry{}
+	if old, ok := l.entries[path]; ok {
+		entry = *old
+	}
+	fn(&entry)
+	entry.Path = path
+
+	b, e := json.Marshal(entry)
+	if e != nil {
+		return Entry{}, e
+	}
+	if _, e := l.f.Write(append(b, '\n')); e != nil {
+		return Entry{}, e
+	}
+
+	l.entries[path] = &entry
+	return entry, nil
+}
+
+func (l *Ledger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return nil
+	}
+	e := l.f.Close()
+	l.f = nil
+	return e
+}
@@ -0,0 +1,208 @@
+package ledger
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openLedger(t *testing.T, fp string) *Ledger {
+	t.Helper()
+	l, e := Open(fp)
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func update(t *testing.T, l *Ledger, path string, fn func(entry *Entry)) Entry {
+	t.Helper()
+	entry, e := l.Update(path, fn)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return entry
+}
+
+// countStates counts the entries in each state
+func countStates(l *Ledger) map[State]int {
+	result := map[State]int{}
+	for _, entry := range l.Entries() {
+		result[entry.State]++
+	}
+	return result
+}
+
+// lines reads the journal
+func lines(t *testing.T, fp string) []string {
+	t.Helper()
+	b, e := os.ReadFile(fp)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+}
+
+func TestUpdateGet(t *testing.T) {
+	l := openLedger(t, filepath.Join(t.TempDir(), "ledger.jsonl"))
+
+	if _, ok := l.Get("/data/a.mkv"); ok {
+		t.Errorf("unknown path found")
+	}
+	queued_at := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	got := update(t, l, "/data/a.mkv", func(entry *Entry) {
+		entry.State = StateQueued
+		entry.QueuedAt = queued_at
+		entry.Hostname = "host-0"
+		// the path is the one updated
+		entry.Path = "/data/other.mkv"
+	})
+	want := Entry{Path: "/data/a.mkv", State: StateQueued, QueuedAt: queued_at, Hostname: "host-0"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("update returned\n%+v\nwant\n%+v", got, want)
+	}
+	if entry, ok := l.Get("/data/a.mkv"); !ok || !reflect.DeepEqual(entry, want) {
+		t.Errorf("get\n%+v\nwant\n%+v", entry, want)
+	}
+	if _, ok := l.Get("/data/other.mkv"); ok {
+		t.Errorf("entry stored under the path set by fn")
+	}
+
+	// the returned entry is a copy
+	got.State = StateDone
+	if entry, _ := l.Get("/data/a.mkv"); entry.State != StateQueued {
+		t.Errorf("state changed through the returned entry: %v", entry.State)
+	}
+}
+
+func TestStateTransitions(t *testing.T) {
+	l := openLedger(t, filepath.Join(t.TempDir(), "ledger.jsonl"))
+	const path = "/data/a.mkv"
+
+	queued_at := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	update(t, l, path, func(entry *Entry) { entry.State = StateQueued; entry.QueuedAt = queued_at })
+	update(t, l, "/data/b.mkv", func(entry *Entry) { entry.State = StateQueued })
+	update(t, l, path, func(entry *Entry) {
+		entry.State = StateAssigned
+		entry.Hostname, entry.PID = "host-0", "100"
+	})
+	if counts := countStates(l); !reflect.DeepEqual(counts, map[State]int{StateQueued: 1, StateAssigned: 1}) {
+		t.Errorf("counts %v", counts)
+	}
+
+	// a failed attempt goes back to the queue, then another worker finishes it
+	update(t, l, path, func(entry *Entry) { entry.State = StateQueued; entry.Error = "exit status 1" })
+	entry := update(t, l, path, func(entry *Entry) {
+		entry.State = StateAssigned
+		entry.Hostname, entry.PID = "host-1", "200"
+	})
+	if !entry.QueuedAt.Equal(queued_at) || entry.Error != "exit status 1" {
+		t.Errorf("fields not carried over: %+v", entry)
+	}
+	entry = update(t, l, path, func(entry *Entry) { entry.State = StateDone; entry.Error = "" })
+	if entry.State != StateDone || entry.Hostname != "host-1" || entry.PID != "200" {
+		t.Errorf("done entry %+v", entry)
+	}
+	if counts := countStates(l); !reflect.DeepEqual(counts, map[State]int{StateQueued: 1, StateDone: 1}) {
+		t.Errorf("counts %v", counts)
+	}
+
+	entries := l.Entries()
+	if len(entries) != 2 || entries[0].Path != path || entries[1].Path != "/data/b.mkv" {
+		t.Errorf("entries not ordered by path: %+v", entries)
+	}
+
+	terminal := map[State]bool{
+		StateQueued:   false,
+		StateAssigned: false,
+		StateKilled:   false,
+		StateDone:     true,
+		StateFailed:   true,
+		StateSkipped:  true,
+	}
+	for state, want := range terminal {
+		if state.IsTerminal() != want {
+			t.Errorf("%v terminal: %v, want %v", state, state.IsTerminal(), want)
+		}
+	}
+}
+
+func TestReopenReplays(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "ledger.jsonl")
+	l, e := Open(fp)
+	if e != nil {
+		t.Fatal(e)
+	}
+	update(t, l, "/data/b.mkv", func(entry *Entry) { entry.State = StateQueued })
+	update(t, l, "/data/a.mkv", func(entry *Entry) { entry.State = StateQueued })
+	update(t, l, "/data/a.mkv", func(entry *Entry) { entry.State = StateAssigned; entry.Hostname = "host-0" })
+	update(t, l, "/data/a.mkv", func(entry *Entry) { entry.State = StateDone; entry.ElapsedTime = 12.5 })
+	want := l.Entries()
+	if e := l.Close(); e != nil {
+		t.Fatal(e)
+	}
+	if n := len(lines(t, fp)); n != 4 {
+		t.Errorf("%v lines before reopening, want one per update", n)
+	}
+	if _, e := l.Update("/data/c.mkv", func(entry *Entry) {}); e == nil {
+		t.Errorf("update after close")
+	}
+
+	l = openLedger(t, fp)
+	if got := l.Entries(); !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed\n%+v\nwant\n%+v", got, want)
+	}
+	// compacted to the latest line of every path
+	if got := lines(t, fp); len(got) != 2 || !strings.Contains(got[0], `"/data/a.mkv"`) || !strings.Contains(got[0], `"done"`) {
+		t.Errorf("compacted journal %q", got)
+	}
+
+	// the replayed entries are updated as before
+	update(t, l, "/data/b.mkv", func(entry *Entry) { entry.State = StateSkipped })
+	if counts := countStates(l); !reflect.DeepEqual(counts, map[State]int{StateDone: 1, StateSkipped: 1}) {
+		t.Errorf("counts %v", counts)
+	}
+}
+
+func TestTruncatedLastLine(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "ledger.jsonl")
+	l, e := Open(fp)
+	if e != nil {
+		t.Fatal(e)
+	}
+	update(t, l, "/data/a.mkv", func(entry *Entry) { entry.State = StateQueued })
+	update(t, l, "/data/b.mkv", func(entry *Entry) { entry.State = StateQueued })
+	update(t, l, "/data/a.mkv", func(entry *Entry) { entry.State = StateAssigned; entry.Hostname = "host-0" })
+	l.Close()
+
+	// the crash tore the write of the next update of b
+	f, e := os.OpenFile(fp, os.O_WRONLY|os.O_APPEND, 0644)
+	if e != nil {
+		t.Fatal(e)
+	}
+	f.WriteString(`{"path":"/data/b.mkv","state":"do`)
+	f.Close()
+
+	l = openLedger(t, fp)
+	if entry, _ := l.Get("/data/a.mkv"); entry.State != StateAssigned || entry.Hostname != "host-0" {
+		t.Errorf("a: %+v", entry)
+	}
+	if entry, _ := l.Get("/data/b.mkv"); entry.State != StateQueued {
+		t.Errorf("b: %+v, want the state before the torn line", entry)
+	}
+	if got := lines(t, fp); len(got) != 2 {
+		t.Errorf("torn line kept in the journal: %q", got)
+	}
+
+	// the next update starts on a line of its own
+	update(t, l, "/data/b.mkv", func(entry *Entry) { entry.State = StateDone })
+	l.Close()
+	l = openLedger(t, fp)
+	if entry, _ := l.Get("/data/b.mkv"); entry.State != StateDone {
+		t.Errorf("b after reopening: %+v", entry)
+	}
+}
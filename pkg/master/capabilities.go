@@ -0,0 +1,94 @@
+package master
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"github.com/sunrise2575/dist-ffmpeg/pkg/protocol"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/routing"
+)
+
+// registration is what a worker said hello with
+type registration struct {
+	// nil when unknown, letting the worker run anything
+	caps   *protocol.Capabilities
+	labels routing.Labels
+}
+
+// register keeps the capabilities and the labels the worker said hello with
+func (srv *Server) register(worker protocol.Peer, reg registration) {
+	srv.mu.Lock()
+	srv.workers[worker.String()] = reg
+	srv.mu.Unlock()
+	srv.board.register(worker.Hostname, worker.PID, reg.caps, reg.labels)
+}
+
+// registered returns the registration of the worker; false if it did not say
+// hello to this master
+func (srv *Server) registered(worker protocol.Peer) (registration, bool) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	reg, ok := srv.workers[worker.String()]
+	return reg, ok
+}
+
+// queuedFile is what canRun needs of a file, recorded when the file is queued
+// because assign calls canRun under the lock of the scheduler
+type queuedFile struct {
+	profile string
+	size    int64
+}
+
+// queuedAs returns what was recorded of the file when it was queued
+func (srv *Server) queuedAs(fp string) queuedFile {
+	return srv.estimateOf(fp).queuedFile
+}
+
+// canRun tells whether the file is routed to the labels of the worker, and
+// the worker has the encoders of the profile of the file and enough temporary
+// space for it. A worker lacking encoders is reported once per profile, and
+// the files of the profile are left to the other workers. A segment goes by
+// its file.
+func (srv *Server) canRun(worker protocol.Peer, reg registration, fp string) bool {
+	source := fp
+	if segment_source, ok := segmentSource(fp); ok {
+		source = segment_source
+	}
+	if srv.route_table != nil && !srv.route_table.Resolve(source).Matches(reg.labels) {
+		return false
+	}
+
+	caps := reg.caps
+	if caps == nil {
+		return true
+	}
+
+	queued := srv.queuedAs(fp)
+	if queued.profile != "" {
+		if missing := caps.MissingEncoders(srv.encoders[queued.profile]); len(missing) > 0 {
+			if srv.board.lacking(worker.Hostname, worker.PID, queued.profile, missing) {
+				logrus.WithFields(logrus.Fields{
+					"hostname": worker.Hostname,
+					"pid":      worker.PID,
+					"profile":  queued.profile,
+					"missing":  missing,
+				}).Warnf("Worker lacks encoders of the profile, leave its files to other workers")
+			}
+			return false
+		}
+	}
+
+	// the segments and the output take about the size of the original
+	if caps.TempFree > 0 {
+		if queued.size > caps.TempFree {
+			logrus.WithFields(logrus.Fields{
+				"hostname":  worker.Hostname,
+				"pid":       worker.PID,
+				"path":      fp,
+				"size":      queued.size,
+				"temp_free": caps.TempFree,
+			}).Debugf("Not enough temporary space on the worker")
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,1384 @@
+package master_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pebbe/zmq4"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/keys"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/ledger"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/master"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/protocol"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/runner"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/transcode"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/worker"
+	"github.com/tidwall/gjson"
+)
+
+// The tests run a master and several workers in one process over inproc://
+// endpoints. The transcoding is replaced by fakeWork, which behaves according
+// to the prefix of the file name.
+
+var cluster_id int32
+
+// attempt is one run of the fake work
+type attempt struct {
+	path, hostname string
+}
+
+type cluster struct {
+	t           *testing.T
+	dir         string
+	ledger_path string
+	zctx        *zmq4.Context
+	endpoint    string
+	notify      string
+
+	// of the workers by hostname; one core and no encoder if not given
+	capabilities map[string]*worker.Capabilities
+	labels       map[string]map[string]string
+
+	mu       sync.Mutex
+	attempts []attempt
+	events   []master.Event
+
+	cancel      context.CancelFunc
+	master_done chan error
+}
+
+func newCluster(t *testing.T, files ...string) *cluster {
+	t.Helper()
+	zctx, e := zmq4.NewContext()
+	if e != nil {
+		t.Fatal(e)
+	}
+	id := atomic.AddInt32(&cluster_id, 1)
+	c := &cluster{
+		t:           t,
+		dir:         t.TempDir(),
+		ledger_path: filepath.Join(t.TempDir(), "ledger.jsonl"),
+		zctx:        zctx,
+		endpoint:    fmt.Sprintf("inproc://master-%v", id),
+		notify:      fmt.Sprintf("inproc://notify-%v", id),
+
+		capabilities: map[string]*worker.Capabilities{},
+		labels:       map[string]map[string]string{},
+	}
+	for _, name := range files {
+		if e := os.WriteFile(filepath.Join(c.dir, name), []byte(name), 0644); e != nil {
+			t.Fatal(e)
+		}
+	}
+	return c
+}
+
+// startMaster runs a master until stop is called; configure changes the defaults of the tests
+func (c *cluster) startMaster(configure ...func(*master.Options)) *master.Server {
+	c.t.Helper()
+	opts := master.Options{
+		Endpoint:         c.endpoint,
+		NotifyEndpoint:   c.notify,
+		ZMQ:              c.zctx,
+		Directory:        c.dir,
+		LedgerPath:       c.ledger_path,
+		LeaseTTL:         2 * time.Second,
+		RetryMax:         3,
+		RetryBackoff:     10 * time.Millisecond,
+		RetryOtherWorker: true,
+		IdleWait:         20 * time.Millisecond,
+		Hostname:         "master",
+		PID:              "0",
+		OnEvent: func(ev master.Event) {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.events = append(c.events, ev)
+		},
+	}
+	for _, fn := range configure {
+		fn(&opts)
+	}
+	srv, e := master.New(opts)
+	if e != nil {
+		c.t.Fatal(e)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	c.master_done = make(chan error, 1)
+	go func() { c.master_done <- srv.Run(ctx) }()
+	return srv
+}
+
+// stop stops the master and returns the ledger entries by file name
+func (c *cluster) stop() map[string]ledger.Entry {
+	c.t.Helper()
+	c.cancel()
+	select {
+	case e := <-c.master_done:
+		if e != nil {
+			c.t.Fatal(e)
+		}
+	case <-time.After(10 * time.Second):
+		c.t.Fatal("the master did not stop")
+	}
+
+	ldg, e := ledger.Open(c.ledger_path)
+	if e != nil {
+		c.t.Fatal(e)
+	}
+	defer ldg.Close()
+	result := map[string]ledger.Entry{}
+	for _, entry := range ldg.Entries() {
+		result[filepath.Base(entry.Path)] = entry
+	}
+	return result
+}
+
+var test_config, _ = transcode.ParseConfig(gjson.Parse(`{"video": {"ffmpeg_param": "-c:v libvpx-vp9", "target_ext": "webm"}}`))
+
+// fakeWork behaves by the prefix of the file name:
+//
+//	ok_     succeeds
+//	skip_   is not a media file
+//	broken_ fails permanently
+//	flaky_  fails transiently on the first attempt
+//	panic_  panics
+//	hang_   runs until the worker is stopped
+func (c *cluster) fakeWork(hostname string) worker.HandlerFunc {
+	return func(ctx context.Context, job worker.Job, stats *worker.Stats) (worker.Status, error) {
+		name := filepath.Base(job.Path)
+		c.mu.Lock()
+		c.attempts = append(c.attempts, attempt{path: name, hostname: hostname})
+		tries := 0
+		for _, a := range c.attempts {
+			if a.path == name {
+				tries++
+			}
+		}
+		c.mu.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+		switch {
+		case strings.HasPrefix(name, "skip_"):
+			return worker.StatusSkip, nil
+		case strings.HasPrefix(name, "broken_"):
+			return worker.StatusFail, errors.New("Invalid data found when processing input")
+		case strings.HasPrefix(name, "flaky_") && tries == 1:
+			return worker.StatusFail, errors.New("read: input/output error")
+		case strings.HasPrefix(name, "panic_"):
+			panic("fake encoder crashed")
+		case strings.HasPrefix(name, "hang_"):
+			<-ctx.Done()
+			return worker.StatusFail, ctx.Err()
+		}
+		stats.FileType = "video"
+		return worker.StatusSuccess, nil
+	}
+}
+
+// startWorker runs a worker which returns when the master has no more job;
+// configure changes the defaults of the tests
+func (c *cluster) startWorker(ctx context.Context, hostname string, handler worker.Handler, configure ...func(*worker.Options)) <-chan error {
+	c.t.Helper()
+	caps := c.capabilities[hostname]
+	if caps == nil {
+		caps = &worker.Capabilities{Cores: 1}
+	}
+	opts := worker.Options{
+		Endpoint:       c.endpoint,
+		NotifyEndpoint: c.notify,
+		ZMQ:            c.zctx,
+		Config:         test_config,
+		TempDir:        c.t.TempDir(),
+		PollMin:        10 * time.Millisecond,
+		PollMax:        50 * time.Millisecond,
+		RequestTimeout: 500 * time.Millisecond,
+		ExitWhenEmpty:  true,
+		Hostname:       hostname,
+		PID:            "1",
+		Capabilities:   caps,
+		Labels:         c.labels[hostname],
+		Handler:        handler,
+	}
+	for _, fn := range configure {
+		fn(&opts)
+	}
+	w, e := worker.New(opts)
+	if e != nil {
+		c.t.Fatal(e)
+	}
+	done := make(chan error, 1)
+	go func() { done <- w.Run(ctx) }()
+	return done
+}
+
+// runWorkers runs n workers with fakeWork until the master runs out of jobs
+func (c *cluster) runWorkers(n int) {
+	c.t.Helper()
+	dones := []<-chan error{}
+	for i := 0; i < n; i++ {
+		hostname := fmt.Sprintf("host-%v", i)
+		dones = append(dones, c.startWorker(context.Background(), hostname, c.fakeWork(hostname)))
+	}
+	c.wait(dones...)
+}
+
+func (c *cluster) wait(dones ...<-chan error) {
+	c.t.Helper()
+	timeout := time.After(20 * time.Second)
+	for _, done := range dones {
+		select {
+		case e := <-done:
+			if e != nil {
+				c.t.Errorf("worker: %v", e)
+			}
+		case <-timeout:
+			c.t.Fatal("the workers did not finish")
+		}
+	}
+}
+
+func (c *cluster) attemptsOf(name string) []attempt {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result := []attempt{}
+	for _, a := range c.attempts {
+		if a.path == name {
+			result = append(result, a)
+		}
+	}
+	return result
+}
+
+// eventsOf returns the kinds of the events of a file in order
+func (c *cluster) eventsOf(name string) []master.EventKind {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result := []master.EventKind{}
+	for _, ev := range c.events {
+		if filepath.Base(ev.Path) == name {
+			result = append(result, ev.Kind)
+		}
+	}
+	return result
+}
+
+func TestClusterDrainsQueue(t *testing.T) {
+	files := []string{}
+	for i := 0; i < 30; i++ {
+		files = append(files, fmt.Sprintf("ok_%02d.mkv", i))
+	}
+	// not media files, never handed out
+	files = append(files, "notes.txt", ".hidden.mkv")
+	c := newCluster(t, files...)
+	c.startMaster()
+	c.runWorkers(4)
+	entries := c.stop()
+
+	if len(c.attempts) != 30 {
+		t.Errorf("%v attempts for 30 files", len(c.attempts))
+	}
+	for _, name := range files[:30] {
+		entry := entries[name]
+		if entry.State != ledger.StateDone || entry.Attempts != 1 {
+			t.Errorf("%v: %v after %v attempts", name, entry.State, entry.Attempts)
+		}
+		if n := len(c.attemptsOf(name)); n != 1 {
+			t.Errorf("%v handled %v times", name, n)
+		}
+	}
+	if _, ok := entries["notes.txt"]; ok {
+		t.Error("notes.txt was queued")
+	}
+}
+
+func TestClusterRetriesTransientFailureElsewhere(t *testing.T) {
+	c := newCluster(t, "flaky_a.mkv", "ok_1.mkv", "ok_2.mkv", "ok_3.mkv")
+	c.startMaster()
+	c.runWorkers(2)
+	entries := c.stop()
+
+	entry := entries["flaky_a.mkv"]
+	if entry.State != ledger.StateDone || entry.Attempts != 2 {
+		t.Errorf("flaky: %v after %v attempts", entry.State, entry.Attempts)
+	}
+	attempts := c.attemptsOf("flaky_a.mkv")
+	if len(attempts) != 2 || attempts[0].hostname == attempts[1].hostname {
+		t.Errorf("flaky attempts %v, want a retry on the other worker", attempts)
+	}
+}
+
+func TestClusterPermanentFailureSkipAndPanic(t *testing.T) {
+	c := newCluster(t, "broken_a.mkv", "skip_a.mkv", "panic_a.mkv", "ok_1.mkv", "ok_2.mkv")
+	c.startMaster()
+	c.runWorkers(2)
+	entries := c.stop()
+
+	cases := []struct {
+		name        string
+		state       ledger.State
+		error_class string
+		error       string
+	}{
+		{"broken_a.mkv", ledger.StateFailed, transcode.FailPermanent, "Invalid data"},
+		{"skip_a.mkv", ledger.StateSkipped, "", ""},
+		// a crashing job is reported instead of taking the worker down
+		{"panic_a.mkv", ledger.StateFailed, transcode.FailUnknown, "panic: fake encoder crashed"},
+		{"ok_1.mkv", ledger.StateDone, "", ""},
+		{"ok_2.mkv", ledger.StateDone, "", ""},
+	}
+	for _, tc := range cases {
+		entry := entries[tc.name]
+		if entry.State != tc.state || entry.ErrorClass != tc.error_class || !strings.Contains(entry.Error, tc.error) {
+			t.Errorf("%v: %v %q %q", tc.name, entry.State, entry.ErrorClass, entry.Error)
+		}
+		if entry.Attempts != 1 {
+			t.Errorf("%v: %v attempts", tc.name, entry.Attempts)
+		}
+	}
+}
+
+func TestClusterKilledJobMovesToAnotherWorker(t *testing.T) {
+	c := newCluster(t, "hang_a.mkv")
+	c.startMaster()
+
+	// the first worker hangs on the file until it is stopped
+	started := make(chan struct{})
+	hang := c.fakeWork("host-a")
+	ctx_a, stop_a := context.WithCancel(context.Background())
+	defer stop_a()
+	done_a := c.startWorker(ctx_a, "host-a", worker.HandlerFunc(func(ctx context.Context, job worker.Job, stats *worker.Stats) (worker.Status, error) {
+		close(started)
+		return hang(ctx, job, stats)
+	}))
+	select {
+	case <-started:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the job was not started")
+	}
+
+	// the second one waits while the job is in flight, then gets the retry
+	done_b := c.startWorker(context.Background(), "host-b", worker.HandlerFunc(func(ctx context.Context, job worker.Job, stats *worker.Stats) (worker.Status, error) {
+		return worker.StatusSuccess, nil
+	}))
+	stop_a()
+	c.wait(done_a, done_b)
+	entries := c.stop()
+
+	entry := entries["hang_a.mkv"]
+	if entry.State != ledger.StateDone || entry.Hostname != "host-b" || entry.Attempts != 2 {
+		t.Errorf("%v by %v after %v attempts", entry.State, entry.Hostname, entry.Attempts)
+	}
+}
+
+func TestClusterResumesFromLedger(t *testing.T) {
+	c := newCluster(t, "ok_1.mkv", "ok_2.mkv", "broken_a.mkv")
+	c.startMaster()
+	c.runWorkers(1)
+	c.stop()
+
+	// a restarted master does not hand out what is already done or failed
+	c.attempts = nil
+	c.startMaster()
+	c.runWorkers(1)
+	entries := c.stop()
+
+	if len(c.attempts) != 0 {
+		t.Errorf("handled again: %v", c.attempts)
+	}
+	if entries["ok_1.mkv"].State != ledger.StateDone || entries["broken_a.mkv"].State != ledger.StateFailed {
+		t.Errorf("ledger %v", entries)
+	}
+}
+
+func TestClusterEvents(t *testing.T) {
+	c := newCluster(t, "ok_1.mkv", "broken_a.mkv", "flaky_a.mkv")
+	c.startMaster()
+	c.runWorkers(2)
+	c.stop()
+
+	cases := map[string]string{
+		"ok_1.mkv":     "queued assigned done",
+		"broken_a.mkv": "queued assigned failed",
+		"flaky_a.mkv":  "queued assigned failed assigned done",
+	}
+	for name, want := range cases {
+		got := fmt.Sprint(c.eventsOf(name))
+		if got != "["+want+"]" {
+			t.Errorf("%v: events %v, want [%v]", name, got, want)
+		}
+	}
+
+	for _, ev := range c.events {
+		if ev.Kind == master.EventDone && ev.Stats.FileType != "video" {
+			t.Errorf("done without the stats of the worker: %+v", ev)
+		}
+		if ev.Kind != master.EventFailed {
+			continue
+		}
+		switch filepath.Base(ev.Path) {
+		case "broken_a.mkv":
+			if ev.Retry || ev.ErrorClass != transcode.FailPermanent || ev.Hostname == "" {
+				t.Errorf("broken: %+v", ev)
+			}
+		case "flaky_a.mkv":
+			if !ev.Retry || ev.RetryAfter <= 0 || ev.ErrorClass != transcode.FailTransient {
+				t.Errorf("flaky: %+v", ev)
+			}
+		}
+	}
+}
+
+func TestClusterEnqueueWithoutDirectory(t *testing.T) {
+	c := newCluster(t, "ok_1.mkv", "ok_2.mkv", "ok_3.mkv")
+	done := make(chan string, 3)
+	srv := c.startMaster(func(opts *master.Options) {
+		opts.Directory = ""
+		on_event := opts.OnEvent
+		opts.OnEvent = func(ev master.Event) {
+			on_event(ev)
+			if ev.Kind == master.EventDone {
+				done <- filepath.Base(ev.Path)
+			}
+		}
+	})
+
+	// only the enqueued files are handed out
+	for _, name := range []string{"ok_1.mkv", "ok_2.mkv", "ok_1.mkv"} {
+		srv.Enqueue(context.Background(), filepath.Join(c.dir, name))
+	}
+	if snap := srv.Scheduler().Snapshot(); snap.Queued != 2 {
+		t.Errorf("%v queued, want 2", snap.Queued)
+	}
+
+	// the worker waits for more instead of exiting when the queue is empty
+	ctx, stop_worker := context.WithCancel(context.Background())
+	defer stop_worker()
+	worker_done := c.startWorker(ctx, "host-0", c.fakeWork("host-0"))
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatal("the enqueued files were not handled")
+		}
+	}
+	select {
+	case e := <-worker_done:
+		t.Fatalf("the worker exited: %v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+	stop_worker()
+	c.wait(worker_done)
+	entries := c.stop()
+
+	if len(entries) != 2 || entries["ok_1.mkv"].State != ledger.StateDone || entries["ok_2.mkv"].State != ledger.StateDone {
+		t.Errorf("ledger %v", entries)
+	}
+	if len(c.attemptsOf("ok_3.mkv")) != 0 {
+		t.Error("a file not enqueued was handled")
+	}
+}
+
+func TestClusterRejectsOtherProtocolVersion(t *testing.T) {
+	c := newCluster(t, "ok_1.mkv")
+	srv := c.startMaster()
+	waitQueued(t, srv, 1)
+
+	// a worker of a newer build
+	sock, e := c.zctx.NewSocket(zmq4.DEALER)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer sock.Close()
+	sock.SetRcvtimeo(5 * time.Second)
+	if e := sock.Connect(c.endpoint); e != nil {
+		t.Fatal(e)
+	}
+	req := protocol.Request{Version: protocol.Version + 1, ID: 1, Kind: protocol.KindHello, Worker: protocol.Peer{Hostname: "host-new", PID: "1"}}
+	payload, _ := protocol.Encode(req)
+	if _, e := sock.Send(payload, 0); e != nil {
+		t.Fatal(e)
+	}
+	recv_json, e := sock.Recv(0)
+	if e != nil {
+		t.Fatal(e)
+	}
+	res, _ := protocol.DecodeResponse(recv_json)
+	if res.OK || res.ID != 1 || !strings.Contains(res.Error, "unsupported protocol version") {
+		t.Errorf("response %+v", res)
+	}
+
+	// nothing was handed out to it
+	entries := c.stop()
+	if entries["ok_1.mkv"].State != ledger.StateQueued {
+		t.Errorf("ledger %v", entries)
+	}
+}
+
+func TestClusterRequeuesExpiredLease(t *testing.T) {
+	c := newCluster(t, "ok_1.mkv", "ok_2.mkv", "ok_3.mkv")
+	srv := c.startMaster(func(opts *master.Options) { opts.LeaseTTL = 300 * time.Millisecond })
+	waitQueued(t, srv, 3)
+
+	// a worker takes a job and goes silent without a heartbeat
+	silent := protocol.Peer{Hostname: "host-silent", PID: "1"}
+	c.request(t, "host-silent/1/conn", protocol.Request{ID: 1, Kind: protocol.KindHello, Worker: silent, Capabilities: &worker.Capabilities{Cores: 1}})
+	res := c.request(t, "host-silent/1/conn", protocol.Request{ID: 2, Kind: protocol.KindJobWant, Worker: silent})
+	if !res.OK || res.Job == nil {
+		t.Fatalf("response %+v", res)
+	}
+	name := filepath.Base(res.Job.Path)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for len(srv.Scheduler().Snapshot().Leases) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the lease did not expire")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if queued := srv.Scheduler().Snapshot().Queued; queued != 3 {
+		t.Errorf("%v queued after the lease expired, want 3", queued)
+	}
+
+	// another worker gets it first, before the files which were waiting
+	c.runWorkers(1)
+	entries := c.stop()
+	if handled := c.handled(); len(handled) != 3 || handled[0] != name {
+		t.Errorf("handled %v, want %v first", handled, name)
+	}
+	if attempts := c.attemptsOf(name); len(attempts) != 1 || attempts[0].hostname != "host-0" {
+		t.Errorf("attempts %v", attempts)
+	}
+	if entry := entries[name]; entry.State != ledger.StateDone || entry.Hostname != "host-0" {
+		t.Errorf("%v by %v", entry.State, entry.Hostname)
+	}
+	if kinds := fmt.Sprint(c.eventsOf(name)); kinds != "[queued assigned lease_expired assigned done]" {
+		t.Errorf("events %v", kinds)
+	}
+}
+
+func TestClusterRepliesResentRequestOnce(t *testing.T) {
+	c := newCluster(t, "ok_1.mkv", "ok_2.mkv")
+	srv := c.startMaster()
+	waitQueued(t, srv, 2)
+
+	// a worker whose reply got lost sends the request again over a new socket
+	worker_peer := protocol.Peer{Hostname: "host-a", PID: "1"}
+	send := func(req protocol.Request) protocol.Response {
+		t.Helper()
+		req.Worker = worker_peer
+		return c.request(t, "host-a/1/conn", req)
+	}
+
+	send(protocol.Request{ID: 1, Kind: protocol.KindHello, Capabilities: &worker.Capabilities{Cores: 1}})
+	first := send(protocol.Request{ID: 2, Kind: protocol.KindJobWant})
+	again := send(protocol.Request{ID: 2, Kind: protocol.KindJobWant})
+	if !first.OK || !again.OK || first.Job.Path != again.Job.Path {
+		t.Fatalf("responses %+v and %+v", first.Job, again.Job)
+	}
+	if leases := srv.Scheduler().Snapshot().Leases; len(leases) != 1 {
+		t.Errorf("%v leases, want 1", len(leases))
+	}
+
+	// and the report is recorded once
+	report := &protocol.Report{Path: first.Job.Path, Elapsed: protocol.Duration(time.Second)}
+	for i := 0; i < 2; i++ {
+		if res := send(protocol.Request{ID: 3, Kind: protocol.KindJobDone, Report: report}); !res.OK {
+			t.Errorf("report %+v", res)
+		}
+	}
+	name := filepath.Base(first.Job.Path)
+	entries := c.stop()
+	if entry := entries[name]; entry.State != ledger.StateDone || entry.Attempts != 1 {
+		t.Errorf("%v after %v attempts", entry.State, entry.Attempts)
+	}
+	if kinds := fmt.Sprint(c.eventsOf(name)); kinds != "[queued assigned done]" {
+		t.Errorf("events %v", kinds)
+	}
+}
+
+func TestWorkerRejectsOtherProtocolVersion(t *testing.T) {
+	c := newCluster(t)
+
+	// a master of a newer build
+	sock, e := c.zctx.NewSocket(zmq4.ROUTER)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer sock.Close()
+	if e := sock.Bind(c.endpoint); e != nil {
+		t.Fatal(e)
+	}
+	go func() {
+		frames, e := sock.RecvMessage(0)
+		if e != nil {
+			return
+		}
+		req, _ := protocol.DecodeRequest(frames[1])
+		payload, _ := protocol.Encode(protocol.Response{Version: protocol.Version + 1, ID: req.ID, OK: true})
+		sock.SendMessage(frames[0], payload)
+	}()
+
+	w, e := worker.New(worker.Options{Endpoint: c.endpoint, ZMQ: c.zctx, Config: test_config, TempDir: t.TempDir()})
+	if e != nil {
+		t.Fatal(e)
+	}
+	done := make(chan error, 1)
+	go func() { done <- w.Run(context.Background()) }()
+	select {
+	case e := <-done:
+		if !errors.Is(e, protocol.ErrVersion) {
+			t.Errorf("error %v", e)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the worker did not give up")
+	}
+}
+
+func TestClusterReportsUnencodableStats(t *testing.T) {
+	c := newCluster(t, "ok_1.mkv")
+	c.startMaster()
+	done := c.startWorker(context.Background(), "host-a", worker.HandlerFunc(func(ctx context.Context, job worker.Job, stats *worker.Stats) (worker.Status, error) {
+		stats.FileType = "video"
+		stats.MediaDuration = math.NaN()
+		return worker.StatusSuccess, nil
+	}))
+	c.wait(done)
+	entries := c.stop()
+
+	// reported without the stats, and neither side crashed
+	if entry := entries["ok_1.mkv"]; entry.State != ledger.StateDone || entry.Attempts != 1 {
+		t.Errorf("%v after %v attempts", entry.State, entry.Attempts)
+	}
+}
+
+func TestClusterCancel(t *testing.T) {
+	c := newCluster(t, "hang_a.mkv")
+	srv := c.startMaster()
+
+	if srv.Cancel(filepath.Join(c.dir, "hang_a.mkv")) {
+		t.Error("cancelled a file nobody works on")
+	}
+
+	started := make(chan struct{})
+	hang := c.fakeWork("host-a")
+	done := c.startWorker(context.Background(), "host-a", worker.HandlerFunc(func(ctx context.Context, job worker.Job, stats *worker.Stats) (worker.Status, error) {
+		close(started)
+		return hang(ctx, job, stats)
+	}))
+	select {
+	case <-started:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the job was not started")
+	}
+
+	// the worker stops the job, and nobody runs it again
+	if !srv.Cancel(filepath.Join(c.dir, "hang_a.mkv")) {
+		t.Fatal("unable to cancel")
+	}
+	c.wait(done)
+	entries := c.stop()
+
+	entry := entries["hang_a.mkv"]
+	if entry.State != ledger.StateKilled || entry.Attempts != 1 {
+		t.Errorf("%v after %v attempts", entry.State, entry.Attempts)
+	}
+	if kinds := fmt.Sprint(c.eventsOf("hang_a.mkv")); kinds != "[queued assigned killed]" {
+		t.Errorf("events %v", kinds)
+	}
+}
+
+func TestClusterUpdateConfig(t *testing.T) {
+	c := newCluster(t, "ok_1.mkv", "ok_2.mkv", "ok_3.mkv", "ok_4.mkv", "ok_5.mkv")
+	srv := c.startMaster(func(opts *master.Options) { opts.Directory = "" })
+
+	target_ext := make(chan string, 5)
+	ctx, stop_worker := context.WithCancel(context.Background())
+	defer stop_worker()
+	done := c.startWorker(ctx, "host-a", worker.HandlerFunc(func(ctx context.Context, job worker.Job, stats *worker.Stats) (worker.Status, error) {
+		target_ext <- job.Config.Section("video").TargetExt
+		return worker.StatusSuccess, nil
+	}))
+
+	handle := func(name string) string {
+		t.Helper()
+		srv.Enqueue(context.Background(), filepath.Join(c.dir, name))
+		select {
+		case ext := <-target_ext:
+			return ext
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%v was not handled", name)
+		}
+		return ""
+	}
+	if ext := handle("ok_1.mkv"); ext != "webm" {
+		t.Fatalf("target_ext %v before the update", ext)
+	}
+
+	if _, e := srv.UpdateConfig([]byte(`{"video": {"ffmpeg_param": "{{"}}`)); e == nil {
+		t.Error("sent an invalid config")
+	}
+	n, e := srv.UpdateConfig([]byte(`{"video": {"ffmpeg_param": "-c:v libx265", "target_ext": "mp4"}}`))
+	if e != nil || n != 1 {
+		t.Fatalf("sent to %v workers: %v", n, e)
+	}
+
+	// the push races with the next job request
+	ext := ""
+	for _, name := range []string{"ok_2.mkv", "ok_3.mkv", "ok_4.mkv", "ok_5.mkv"} {
+		if ext = handle(name); ext == "mp4" {
+			break
+		}
+	}
+	if ext != "mp4" {
+		t.Errorf("target_ext %v after the update", ext)
+	}
+	stop_worker()
+	c.wait(done)
+	c.stop()
+}
+
+func TestClusterWorkerOutlivesMaster(t *testing.T) {
+	c := newCluster(t, "ok_1.mkv", "ok_2.mkv")
+
+	// the worker starts first and keeps asking
+	done := c.startWorker(context.Background(), "host-a", c.fakeWork("host-a"))
+	time.Sleep(300 * time.Millisecond)
+
+	// a master without the directory goes away while the worker waits for work
+	c.startMaster(func(opts *master.Options) { opts.Directory = "" })
+	time.Sleep(300 * time.Millisecond)
+	c.stop()
+
+	// and the one coming back has the files
+	c.startMaster()
+	c.wait(done)
+	entries := c.stop()
+
+	for _, name := range []string{"ok_1.mkv", "ok_2.mkv"} {
+		if entries[name].State != ledger.StateDone || entries[name].Attempts != 1 {
+			t.Errorf("%v: %v after %v attempts", name, entries[name].State, entries[name].Attempts)
+		}
+	}
+}
+
+func TestMasterChecksCurveKeys(t *testing.T) {
+	server_keys := keys.Keypair{Public: strings.Repeat("p", 40), Secret: strings.Repeat("s", 40)}
+	worker_key := strings.Repeat("w", 40)
+	cases := map[string]func(*master.Options){
+		"no worker keys":  func(opts *master.Options) {},
+		"bad worker key":  func(opts *master.Options) { opts.CurveAllowed = []string{"abc"} },
+		"bad secret key":  func(opts *master.Options) { opts.CurveAllowed, opts.CurveKeys.Secret = []string{worker_key}, "abc" },
+		"own ZMQ context": func(opts *master.Options) { opts.CurveAllowed, opts.ZMQ = []string{worker_key}, &zmq4.Context{} },
+	}
+	for name, configure := range cases {
+		t.Run(name, func(t *testing.T) {
+			opts := master.Options{
+				Endpoint:   "tcp://*:0",
+				LedgerPath: filepath.Join(t.TempDir(), "ledger.jsonl"),
+				CurveKeys:  server_keys,
+			}
+			configure(&opts)
+			if _, e := master.New(opts); e == nil {
+				t.Error("started")
+			}
+		})
+	}
+}
+
+func TestClusterCurveOverTCP(t *testing.T) {
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	endpoint := "tcp://" + l.Addr().String()
+	l.Close()
+
+	keypair := func() keys.Keypair {
+		k, e := keys.Generate()
+		if e != nil {
+			t.Fatal(e)
+		}
+		return k
+	}
+	server_keys, allowed_keys, other_keys := keypair(), keypair(), keypair()
+
+	// CURVE runs in the default ZeroMQ context
+	c := newCluster(t, "ok_a.mkv")
+	c.endpoint, c.notify, c.zctx = endpoint, "", nil
+	c.startMaster(func(opts *master.Options) {
+		opts.CurveKeys = server_keys
+		opts.CurveAllowed = []string{allowed_keys.Public}
+	})
+	secure := func(k keys.Keypair) func(*worker.Options) {
+		return func(opts *worker.Options) {
+			opts.CurveServerKey, opts.CurveKeys = server_keys.Public, k
+		}
+	}
+
+	// ZAP drops the worker whose key is not on the list: it never gets an answer
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	refused := c.startWorker(ctx, "host-other", c.fakeWork("host-other"), secure(other_keys))
+	select {
+	case <-refused:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the refused worker did not stop")
+	}
+	if attempts := c.attemptsOf("ok_a.mkv"); len(attempts) != 0 {
+		t.Fatalf("attempts %v by a worker not allowed", attempts)
+	}
+
+	c.wait(c.startWorker(context.Background(), "host-allowed", c.fakeWork("host-allowed"), secure(allowed_keys)))
+	entries := c.stop()
+	if entry := entries["ok_a.mkv"]; entry.State != ledger.StateDone || entry.Hostname != "host-allowed" {
+		t.Errorf("entry %+v, want done by the allowed worker", entry)
+	}
+}
+
+func TestClusterAssignsByCapabilities(t *testing.T) {
+	c := newCluster(t, "ok_1.mkv", "ok_2.mkv", "ok_3.mkv")
+	if e := os.Mkdir(filepath.Join(c.dir, "av1"), 0755); e != nil {
+		t.Fatal(e)
+	}
+	av1_files := []string{"av1/ok_4.mkv", "av1/ok_5.mkv", "av1/ok_6.mkv"}
+	for _, name := range av1_files {
+		os.WriteFile(filepath.Join(c.dir, name), []byte(name), 0644)
+	}
+	profiles_path := filepath.Join(t.TempDir(), "profiles.json")
+	os.WriteFile(profiles_path, []byte(`{
+		"profiles": {
+			"vp9": {"video": {"ffmpeg_param": "-c:v libvpx-vp9", "target_ext": "webm"}},
+			"av1": {"video": {"ffmpeg_param": "-c:v libsvtav1", "target_ext": "mkv"}}
+		},
+		"rules": [{"profile": "av1", "dir": "`+filepath.Join(c.dir, "av1")+`"}],
+		"default": "vp9"
+	}`), 0644)
+
+	c.capabilities["host-0"] = &worker.Capabilities{Cores: 8, Encoders: []string{"libopus", "libsvtav1", "libvpx-vp9"}}
+	c.capabilities["host-1"] = &worker.Capabilities{Cores: 4, Encoders: []string{"libopus", "libvpx-vp9"}}
+	srv := c.startMaster(func(opts *master.Options) { opts.ProfilesPath = profiles_path })
+	c.runWorkers(2)
+
+	// the worker lacking the encoder is reported
+	rec := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/api/workers", nil))
+	workers := gjson.Parse(rec.Body.String())
+	if missing := workers.Get(`#(hostname=="host-1").missing_encoders.av1`).String(); missing != `["libsvtav1"]` {
+		t.Errorf("missing encoders of host-1: %v", missing)
+	}
+	if cores := workers.Get(`#(hostname=="host-0").capabilities.cores`).Int(); cores != 8 {
+		t.Errorf("cores of host-0: %v", cores)
+	}
+	entries := c.stop()
+
+	for _, name := range av1_files {
+		attempts := c.attemptsOf(filepath.Base(name))
+		if len(attempts) != 1 || attempts[0].hostname != "host-0" {
+			t.Errorf("%v attempts %v, want one on host-0", name, attempts)
+		}
+	}
+	for _, entry := range entries {
+		if entry.State != ledger.StateDone {
+			t.Errorf("%v: %v", entry.Path, entry.State)
+		}
+	}
+}
+
+func TestClusterAssignsByTempSpace(t *testing.T) {
+	c := newCluster(t, "ok_1.mkv", "ok_2.mkv", "ok_3.mkv")
+	os.WriteFile(filepath.Join(c.dir, "ok_big.mkv"), make([]byte, 4096), 0644)
+
+	c.capabilities["host-0"] = &worker.Capabilities{Cores: 8, TempFree: 1024}
+	c.capabilities["host-1"] = &worker.Capabilities{Cores: 4, TempFree: 1 << 30}
+	c.startMaster()
+	c.runWorkers(2)
+	entries := c.stop()
+
+	if attempts := c.attemptsOf("ok_big.mkv"); len(attempts) != 1 || attempts[0].hostname != "host-1" {
+		t.Errorf("ok_big.mkv attempts %v, want one on host-1", attempts)
+	}
+	for _, entry := range entries {
+		if entry.State != ledger.StateDone {
+			t.Errorf("%v: %v", entry.Path, entry.State)
+		}
+	}
+}
+
+func TestClusterRoutesByLabels(t *testing.T) {
+	c := newCluster(t, "ok_1.mkv", "ok_2.mkv", "ok_3.bmp", "ok_4.jpg")
+	os.Mkdir(filepath.Join(c.dir, "4k"), 0755)
+	for _, name := range []string{"4k/ok_5.mkv", "4k/ok_6.mkv"} {
+		os.WriteFile(filepath.Join(c.dir, name), []byte(name), 0644)
+	}
+	routes_path := filepath.Join(t.TempDir(), "routes.json")
+	os.WriteFile(routes_path, []byte(`{
+		"routes": [
+			{"dir": "`+filepath.Join(c.dir, "4k")+`", "workers": "cores=64"},
+			{"file_type": "image", "workers": "size=small"}
+		],
+		"fallback": "pool=general"
+	}`), 0644)
+
+	c.labels["host-0"] = map[string]string{"cores": "64"}
+	c.labels["host-1"] = map[string]string{"size": "small"}
+	c.labels["host-2"] = map[string]string{"pool": "general"}
+	c.startMaster(func(opts *master.Options) { opts.RoutesPath = routes_path })
+	c.runWorkers(3)
+	entries := c.stop()
+
+	want := map[string]string{
+		"ok_1.mkv": "host-2",
+		"ok_2.mkv": "host-2",
+		"ok_3.bmp": "host-1",
+		"ok_4.jpg": "host-1",
+		"ok_5.mkv": "host-0",
+		"ok_6.mkv": "host-0",
+	}
+	for name, hostname := range want {
+		attempts := c.attemptsOf(name)
+		if len(attempts) != 1 || attempts[0].hostname != hostname {
+			t.Errorf("%v attempts %v, want one on %v", name, attempts, hostname)
+		}
+		if entries[name].State != ledger.StateDone {
+			t.Errorf("%v: %v", name, entries[name].State)
+		}
+	}
+}
+
+// splitWork fakes the tasks of the files split across workers: a split cuts
+// 3 segments, the segment 1 of a flaky_ file fails transiently once and the
+// one of a broken_ file fails permanently. The attempts are named after the
+// task, e.g. "segment big_ok.mkv 1".
+func (c *cluster) splitWork(hostname string) worker.HandlerFunc {
+	whole := c.fakeWork(hostname)
+	return func(ctx context.Context, job worker.Job, stats *worker.Stats) (worker.Status, error) {
+		task := job.Task
+		if task == nil {
+			return whole(ctx, job, stats)
+		}
+		source := filepath.Base(job.Path)
+		if task.Kind == protocol.TaskSegment {
+			source = filepath.Base(task.Source)
+		}
+		name := fmt.Sprintf("%v %v", task.Kind, source)
+		if task.Kind == protocol.TaskSegment {
+			name += fmt.Sprintf(" %v", task.Index)
+		}
+		c.mu.Lock()
+		c.attempts = append(c.attempts, attempt{path: name, hostname: hostname})
+		c.mu.Unlock()
+
+		switch task.Kind {
+		case protocol.TaskSplit:
+			os.MkdirAll(transcode.WorkDir(job.Path), 0755)
+			for i := 0; i < 3; i++ {
+				os.WriteFile(transcode.SegmentPath(job.Path, i), []byte("segment"), 0644)
+			}
+			stats.Segments = 3
+		case protocol.TaskSegment:
+			// long enough for every worker to take a segment
+			time.Sleep(100 * time.Millisecond)
+			if task.Index == 1 && strings.HasPrefix(source, "broken_") {
+				return worker.StatusFail, errors.New("Invalid data found when processing input")
+			}
+			if task.Index == 1 && strings.HasPrefix(source, "flaky_") && len(c.attemptsOf(name)) == 1 {
+				return worker.StatusFail, errors.New("read: input/output error")
+			}
+		case protocol.TaskMerge:
+			os.RemoveAll(transcode.WorkDir(job.Path))
+		}
+		return worker.StatusSuccess, nil
+	}
+}
+
+func TestClusterSplitsAcrossWorkers(t *testing.T) {
+	c := newCluster(t, "ok_small.mkv")
+	for _, name := range []string{"flaky_big.mkv", "broken_big.mkv"} {
+		os.WriteFile(filepath.Join(c.dir, name), make([]byte, 1000), 0644)
+	}
+	// left by an earlier master
+	orphan := filepath.Join(c.dir, ".gone.mkv.segments")
+	os.Mkdir(orphan, 0755)
+	os.WriteFile(filepath.Join(orphan, "segment_0.mkv"), []byte("segment"), 0644)
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(orphan, old, old)
+
+	c.startMaster(func(opts *master.Options) { opts.SegmentMinSize = 100 })
+	dones := []<-chan error{}
+	for i := 0; i < 3; i++ {
+		hostname := fmt.Sprintf("host-%v", i)
+		dones = append(dones, c.startWorker(context.Background(), hostname, c.splitWork(hostname)))
+	}
+	c.wait(dones...)
+	entries := c.stop()
+
+	if entries["ok_small.mkv"].State != ledger.StateDone || len(c.attemptsOf("ok_small.mkv")) != 1 {
+		t.Errorf("small file: %v, attempts %v", entries["ok_small.mkv"].State, c.attemptsOf("ok_small.mkv"))
+	}
+
+	// every segment is encoded, the flaky one twice, and then merged once
+	if entry := entries["flaky_big.mkv"]; entry.State != ledger.StateDone {
+		t.Errorf("flaky_big.mkv: %v", entry.State)
+	}
+	hosts := map[string]bool{}
+	for i, want := range []int{1, 2, 1} {
+		attempts := c.attemptsOf(fmt.Sprintf("segment flaky_big.mkv %v", i))
+		if len(attempts) != want {
+			t.Errorf("segment %v: attempts %v, want %v", i, attempts, want)
+		}
+		for _, a := range attempts {
+			hosts[a.hostname] = true
+		}
+	}
+	if len(hosts) < 2 {
+		t.Errorf("the segments ran on %v only", hosts)
+	}
+	if n, m := len(c.attemptsOf("split flaky_big.mkv")), len(c.attemptsOf("merge flaky_big.mkv")); n != 1 || m != 1 {
+		t.Errorf("%v splits and %v merges", n, m)
+	}
+	// the segments are followed through their file
+	if kinds := fmt.Sprint(c.eventsOf("flaky_big.mkv")); kinds != "[queued assigned assigned done]" {
+		t.Errorf("events %v", kinds)
+	}
+
+	// a segment failing for good fails its file, which is not merged
+	entry := entries["broken_big.mkv"]
+	if entry.State != ledger.StateFailed || entry.ErrorClass != transcode.FailPermanent {
+		t.Errorf("broken_big.mkv: %v %v", entry.State, entry.ErrorClass)
+	}
+	if n := len(c.attemptsOf("merge broken_big.mkv")); n != 0 {
+		t.Errorf("%v merges of a failed file", n)
+	}
+	if _, e := os.Stat(transcode.WorkDir(filepath.Join(c.dir, "broken_big.mkv"))); !os.IsNotExist(e) {
+		t.Errorf("segments of the failed file left: %v", e)
+	}
+
+	if _, e := os.Stat(orphan); !os.IsNotExist(e) {
+		t.Errorf("orphaned segments left: %v", e)
+	}
+	for _, name := range []string{"segment_0.mkv", "segment_1.mkv", "segment_2.mkv"} {
+		if _, ok := entries[name]; ok {
+			t.Errorf("%v in the ledger", name)
+		}
+	}
+}
+
+func TestClusterSpeculatesStragglers(t *testing.T) {
+	c := newCluster(t, "slow_a.mkv")
+	c.startMaster(func(opts *master.Options) {
+		opts.Speculate = true
+		opts.SpeculateAfter = 50 * time.Millisecond
+	})
+
+	// host-0 hangs on the file until it is cancelled; host-1 finishes it at once
+	var swaps []string
+	started := make(chan struct{})
+	straggler := func(hostname string) worker.HandlerFunc {
+		return func(ctx context.Context, job worker.Job, stats *worker.Stats) (worker.Status, error) {
+			c.mu.Lock()
+			c.attempts = append(c.attempts, attempt{path: filepath.Base(job.Path), hostname: hostname})
+			c.mu.Unlock()
+			if hostname == "host-0" {
+				close(started)
+				<-ctx.Done()
+				return worker.StatusFail, ctx.Err()
+			}
+			if e := job.Commit(); e != nil {
+				return worker.StatusFail, e
+			}
+			c.mu.Lock()
+			swaps = append(swaps, hostname)
+			c.mu.Unlock()
+			return worker.StatusSuccess, nil
+		}
+	}
+	dones := []<-chan error{c.startWorker(context.Background(), "host-0", straggler("host-0"))}
+	select {
+	case <-started:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the job was not started")
+	}
+	dones = append(dones, c.startWorker(context.Background(), "host-1", straggler("host-1")))
+	c.wait(dones...)
+	entries := c.stop()
+
+	// the copy won, the straggler was cancelled and its report dropped
+	if fmt.Sprint(swaps) != "[host-1]" {
+		t.Errorf("swapped by %v", swaps)
+	}
+	entry := entries["slow_a.mkv"]
+	if entry.State != ledger.StateDone || entry.Hostname != "host-1" || entry.Attempts != 1 {
+		t.Errorf("%v by %v after %v attempts", entry.State, entry.Hostname, entry.Attempts)
+	}
+	if n := len(c.attemptsOf("slow_a.mkv")); n != 2 {
+		t.Errorf("%v attempts", n)
+	}
+	if kinds := fmt.Sprint(c.eventsOf("slow_a.mkv")); kinds != "[queued assigned speculated done]" {
+		t.Errorf("events %v", kinds)
+	}
+}
+
+// request sends a request to the master from a raw socket with the identity
+func (c *cluster) request(t *testing.T, identity string, req protocol.Request) protocol.Response {
+	t.Helper()
+	sock, e := c.zctx.NewSocket(zmq4.DEALER)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer sock.Close()
+	sock.SetIdentity(identity)
+	sock.SetRcvtimeo(5 * time.Second)
+	if e := sock.Connect(c.endpoint); e != nil {
+		t.Fatal(e)
+	}
+	req.Version = protocol.Version
+	payload, _ := protocol.Encode(req)
+	if _, e := sock.Send(payload, 0); e != nil {
+		t.Fatal(e)
+	}
+	recv_json, e := sock.Recv(0)
+	if e != nil {
+		t.Fatal(e)
+	}
+	res, e := protocol.DecodeResponse(recv_json)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return res
+}
+
+// waitQueued waits until the master found n files
+func waitQueued(t *testing.T, srv *master.Server, n int) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for srv.Scheduler().Snapshot().Queued < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v files queued, want %v", srv.Scheduler().Snapshot().Queued, n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// handled returns the file names in the order the workers got them
+func (c *cluster) handled() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result := []string{}
+	for _, a := range c.attempts {
+		result = append(result, a.path)
+	}
+	return result
+}
+
+// get serves a GET request with the HTTP handler of the master
+func get(t *testing.T, srv *master.Server, path string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	return rec
+}
+
+// getJSON serves a GET request of the JSON API
+func getJSON(t *testing.T, srv *master.Server, path string) gjson.Result {
+	t.Helper()
+	rec := get(t, srv, path)
+	if rec.Code != 200 || rec.Header().Get("Content-Type") != "application/json" || !gjson.Valid(rec.Body.String()) {
+		t.Fatalf("%v: %v %v %q", path, rec.Code, rec.Header(), rec.Body.String())
+	}
+	return gjson.Parse(rec.Body.String())
+}
+
+func TestClusterHTTP(t *testing.T) {
+	c := newCluster(t, "broken_a.mkv", "hang_a.mkv", "ok_1.mkv")
+	srv := c.startMaster()
+	waitQueued(t, srv, 3)
+
+	status := getJSON(t, srv, "/api/status")
+	if status.Get("hostname").String() != "master" || status.Get("pid").String() != "0" || status.Get("dir").String() != c.dir {
+		t.Errorf("status %v", status)
+	}
+	if status.Get("queue_length").Int() != 3 || status.Get("in_flight").Int() != 0 || status.Get("active_workers").Int() != 0 ||
+		status.Get("counts.queued").Int() != 3 || status.Get("eta_seconds").Type != gjson.Null {
+		t.Errorf("status before the workers %v", status)
+	}
+	if jobs := getJSON(t, srv, "/api/jobs"); !jobs.IsArray() || len(jobs.Array()) != 0 {
+		t.Errorf("jobs %v", jobs)
+	}
+	if workers := getJSON(t, srv, "/api/workers"); !workers.IsArray() || len(workers.Array()) != 0 {
+		t.Errorf("workers %v", workers)
+	}
+
+	// the worker fails the first file, then keeps the second
+	ctx, cancel := context.WithCancel(context.Background())
+	done := c.startWorker(ctx, "host-0", c.fakeWork("host-0"))
+	deadline := time.Now().Add(10 * time.Second)
+	for getJSON(t, srv, "/api/status").Get("counts.failed").Int() == 0 || len(getJSON(t, srv, "/api/jobs").Array()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the second job was not assigned")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	job := getJSON(t, srv, "/api/jobs").Array()[0]
+	if filepath.Base(job.Get("path").String()) != "hang_a.mkv" || job.Get("hostname").String() != "host-0" || job.Get("pid").String() != "1" ||
+		job.Get("speculative").Bool() || !job.Get("lease_deadline").Time().After(job.Get("started_at").Time()) {
+		t.Errorf("job %v", job)
+	}
+	status = getJSON(t, srv, "/api/status")
+	if status.Get("queue_length").Int() != 1 || status.Get("in_flight").Int() != 1 || status.Get("active_workers").Int() != 1 ||
+		status.Get("counts.failed").Int() != 1 || status.Get("counts.assigned").Int() != 1 || status.Get("counts.queued").Int() != 1 {
+		t.Errorf("status with a job running %v", status)
+	}
+	workers := getJSON(t, srv, "/api/workers").Array()
+	if len(workers) != 1 || workers[0].Get("hostname").String() != "host-0" || !workers[0].Get("active").Bool() ||
+		workers[0].Get("in_flight").Int() != 1 || workers[0].Get("failed").Int() != 1 || workers[0].Get("done").Int() != 0 {
+		t.Errorf("workers %v", workers)
+	}
+
+	// the dashboard is served from the binary
+	for _, path := range []string{"/", "/index.html"} {
+		rec := get(t, srv, path)
+		if rec.Code != 200 || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") ||
+			!strings.Contains(rec.Body.String(), "<title>dist-ffmpeg</title>") || !strings.Contains(rec.Body.String(), `"/api/status"`) {
+			t.Errorf("%v: %v %v", path, rec.Code, rec.Header())
+		}
+	}
+	if rec := get(t, srv, "/favicon.ico"); rec.Code != 404 {
+		t.Errorf("unknown page: %v", rec.Code)
+	}
+	if rec := get(t, srv, "/metrics"); rec.Code != 200 || !strings.Contains(rec.Body.String(), "# TYPE ") {
+		t.Errorf("metrics: %v %q", rec.Code, rec.Body.String())
+	}
+
+	cancel()
+	c.wait(done)
+	c.stop()
+}
+
+func TestClusterOrdersQueue(t *testing.T) {
+	now := time.Now()
+	files := []struct {
+		name     string
+		size     int
+		mod_time time.Time
+	}{
+		{"a/ok_1.mkv", 100 << 10, now.Add(-2 * time.Hour)},
+		{"a/ok_2.mkv", 400 << 10, now.Add(-4 * time.Hour)},
+		{"b/ok_3.mkv", 300 << 10, now.Add(-1 * time.Hour)},
+		{"b/ok_4.mkv", 200 << 10, now.Add(-3 * time.Hour)},
+	}
+	for _, tc := range []struct {
+		order string
+		want  string
+	}{
+		{master.OrderWalk, "[ok_1.mkv ok_2.mkv ok_3.mkv ok_4.mkv]"},
+		{master.OrderLongest, "[ok_2.mkv ok_3.mkv ok_4.mkv ok_1.mkv]"},
+		{master.OrderSmallest, "[ok_1.mkv ok_4.mkv ok_3.mkv ok_2.mkv]"},
+		{master.OrderNewest, "[ok_3.mkv ok_1.mkv ok_4.mkv ok_2.mkv]"},
+		{master.OrderDirectory, "[ok_3.mkv ok_4.mkv ok_1.mkv ok_2.mkv]"},
+	} {
+		t.Run(tc.order, func(t *testing.T) {
+			c := newCluster(t)
+			for _, f := range files {
+				fp := filepath.Join(c.dir, f.name)
+				os.MkdirAll(filepath.Dir(fp), 0755)
+				if e := os.WriteFile(fp, make([]byte, f.size), 0644); e != nil {
+					t.Fatal(e)
+				}
+				os.Chtimes(fp, f.mod_time, f.mod_time)
+			}
+			srv := c.startMaster(func(opts *master.Options) {
+				opts.Order = tc.order
+				opts.DirPriority = []string{"b"}
+			})
+
+			// one worker, started once every file is queued
+			waitQueued(t, srv, len(files))
+			c.runWorkers(1)
+			c.stop()
+
+			if handled := fmt.Sprint(c.handled()); handled != tc.want {
+				t.Errorf("handled %v, want %v", handled, tc.want)
+			}
+		})
+	}
+
+	if _, e := master.New(master.Options{Order: "random"}); e == nil {
+		t.Error("an unknown order was accepted")
+	}
+}
+
+func TestClusterOrdersByProbe(t *testing.T) {
+	c := newCluster(t, "ok_1.mkv", "ok_2.mkv", "ok_3.mkv")
+
+	// the same size, but 60s of 1080p, 30s of 2160p and 90s of 720p
+	probed := map[string][2]string{
+		"ok_1.mkv": {"60", `{"streams": [{"codec_type": "video", "width": 1920, "height": 1080}]}`},
+		"ok_2.mkv": {"30", `{"streams": [{"codec_type": "audio"}, {"codec_type": "video", "width": 3840, "height": 2160}]}`},
+		"ok_3.mkv": {"90", `{"streams": [{"codec_type": "video", "width": 1280, "height": 720}]}`},
+	}
+	script := &runner.Script{}
+	for name, out := range probed {
+		name := name
+		ofFile := func(c runner.Call) bool { return filepath.Base(c.Last()) == name }
+		script.Steps = append(script.Steps,
+			runner.Step{Name: "ffprobe", Has: []string{"format=duration"}, Match: ofFile, Stdout: out[0] + "\n"},
+			runner.Step{Name: "ffprobe", Has: []string{"-show_streams"}, Match: ofFile, Stdout: out[1]})
+	}
+	srv := c.startMaster(func(opts *master.Options) {
+		opts.Order = master.OrderLongest
+		opts.Probe = true
+		opts.ProbeRunner = script
+	})
+	waitQueued(t, srv, 3)
+
+	// 120 + 60 + 40 seconds of 1080p, and nobody to run them yet
+	rec := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/api/status", nil))
+	status := gjson.Parse(rec.Body.String())
+	if remaining := status.Get("remaining_work").Float(); remaining < 219.9 || remaining > 220.1 {
+		t.Errorf("remaining work %v, want 220", remaining)
+	}
+	if eta := status.Get("eta_seconds"); eta.Type != gjson.Null {
+		t.Errorf("ETA %v before any job is done", eta)
+	}
+
+	c.runWorkers(1)
+
+	// every job is done at the measured speed
+	rec = httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/api/status", nil))
+	status = gjson.Parse(rec.Body.String())
+	if eta := status.Get("eta_seconds"); eta.Type != gjson.Number || eta.Float() != 0 || status.Get("remaining_work").Float() != 0 {
+		t.Errorf("ETA %v with %v work left after the jobs", eta, status.Get("remaining_work"))
+	}
+	rec = httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/api/workers", nil))
+	if speed := gjson.Get(rec.Body.String(), `#(hostname=="host-0").speed`).Float(); speed <= 0 {
+		t.Errorf("speed of host-0: %v", speed)
+	}
+	entries := c.stop()
+
+	// the work done is kept to measure the workers again after a restart
+	for name, work := range map[string]float64{"ok_1.mkv": 60, "ok_2.mkv": 120, "ok_3.mkv": 40} {
+		if got := entries[name].Work; math.Abs(got-work) > 1e-6 {
+			t.Errorf("%v: work %v, want %v", name, got, work)
+		}
+	}
+
+	if handled := fmt.Sprint(c.handled()); handled != "[ok_2.mkv ok_1.mkv ok_3.mkv]" {
+		t.Errorf("handled %v", handled)
+	}
+}
@@ -0,0 +1,66 @@
+package master
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/pebbe/zmq4"
+	"github.com/sirupsen/logrus"
+
+	"github.com/sunrise2575/dist-ffmpeg/pkg/keys"
+)
+
+// the ZAP handler checking the keys of the workers is one per process
+var (
+	auth_once  sync.Once
+	auth_error error
+)
+
+// checkCurve validates the keys of the options
+func (opts *Options) checkCurve() error {
+	if opts.CurveKeys.Secret == "" {
+		return nil
+	}
+	if e := keys.Check(opts.CurveKeys.Secret); e != nil {
+		return fmt.Errorf("master secret key: %w", e)
+	}
+	// the ZAP handler lives in the default context; a socket of another one
+	// would let every worker in
+	if opts.ZMQ != nil {
+		return fmt.Errorf("CURVE needs the default ZeroMQ context")
+	}
+	if len(opts.CurveAllowed) == 0 {
+		return fmt.Errorf("CURVE needs the public keys of the workers")
+	}
+	for _, key := range opts.CurveAllowed {
+		if e := keys.Check(key); e != nil {
+			return fmt.Errorf("worker public key: %w", e)
+		}
+	}
+	return nil
+}
+
+// startCurve lets only the allowed workers in; the returned func stops it
+func (srv *Server) startCurve() (func(), error) {
+	auth_once.Do(func() { auth_error = zmq4.AuthStart() })
+	if auth_error != nil {
+		return nil, fmt.Errorf("unable to start ZeroMQ authentication: %w", auth_error)
+	}
+
+	// the bound endpoint is unique in the process
+	domain := srv.opts.Endpoint
+	zmq4.AuthCurveAdd(domain, srv.opts.CurveAllowed...)
+	logrus.WithFields(logrus.Fields{"workers": len(srv.opts.CurveAllowed)}).Infof("CURVE enabled")
+	return func() { zmq4.AuthCurveRemove(domain, srv.opts.CurveAllowed...) }, nil
+}
+
+// secure makes the socket a CURVE server, if enabled
+func (srv *Server) secure(sock *zmq4.Socket) error {
+	if srv.opts.CurveKeys.Secret == "" {
+		return nil
+	}
+	if e := sock.ServerAuthCurve(srv.opts.Endpoint, srv.opts.CurveKeys.Secret); e != nil {
+		return fmt.Errorf("unable to set up CURVE: %w", e)
+	}
+	return nil
+}
@@ -0,0 +1,330 @@
+package master
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/sunrise2575/dist-ffmpeg/pkg/ffprobe"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/ledger"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/protocol"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/runner"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/transcode"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/util"
+)
+
+// The queued files are ordered by Options.Order with an estimate of their cost:
+// the media duration in seconds of 1080p, so a 4K video costs four times its
+// duration. Without Options.Probe the duration is guessed from the size of the
+// file. The speed of every worker is measured on the files it finished, also
+// before a restart of the master through the ledger, and the cost left over
+// the speed of the workers is the ETA of the cluster.
+
+// the orders of Options.Order
+const (
+	// the order the files are found in
+	OrderWalk = "walk"
+	// the most costly first, so that no long file is left to run alone at the end
+	OrderLongest = "longest"
+	// the least costly first, for quick results
+	OrderSmallest = "smallest"
+	// the files modified last first, e.g. the latest downloads
+	OrderNewest = "newest"
+	// the files of Options.DirPriority first, in its order
+	OrderDirectory = "dir"
+)
+
+// bytes per second, to guess the duration of a file which is not probed
+var guess_bitrate = map[string]float64{
+	"video": 1 << 20,
+	"audio": 32 << 10,
+}
+
+// weight of the last job in the speed of a worker
+const speed_alpha = 0.3
+
+// estimate is what is known of a queued file
+type estimate struct {
+	queuedFile
+	file_type string
+	mod_time  time.Time
+	// in seconds; guessed from the size unless probed
+	duration      float64
+	width, height int
+	probed        bool
+}
+
+// work is the cost of the file in seconds of 1080p media
+func (e estimate) work() float64 {
+	if e.width <= 0 || e.height <= 0 {
+		return e.duration
+	}
+	return e.duration * float64(e.width*e.height) / (1920 * 1080)
+}
+
+// estimator keeps the estimates of the files being handled and the speeds of the workers
+type estimator struct {
+	// probe the files with ffprobe through runner
+	probe  bool
+	runner runner.Runner
+
+	mu    sync.Mutex
+	files map[string]estimate
+	// Peer.String() -> cost done per second of wall time, averaged over its jobs
+	speeds map[string]float64
+}
+
+func newEstimator(probe bool, r runner.Runner) *estimator {
+	return &estimator{
+		probe:  probe,
+		runner: r,
+		files:  map[string]estimate{},
+		speeds: map[string]float64{},
+	}
+}
+
+// add estimates the file of the profile, again if it was before; a file which
+// is gone costs nothing
+func (est *estimator) add(ctx context.Context, fp, profile_name string) estimate {
+	result := estimate{
+		queuedFile: queuedFile{profile: profile_name},
+		file_type:  transcode.ExtFileType(strings.ToLower(filepath.Ext(fp))),
+	}
+	if info, e := os.Stat(fp); e == nil {
+		result.size = info.Size()
+		result.mod_time = info.ModTime()
+	}
+
+	switch {
+	case result.file_type == "image":
+		result.duration = 1
+	case est.probe && result.file_type != "":
+		est.probeFile(ctx, fp, &result)
+	}
+	if bitrate, ok := guess_bitrate[result.file_type]; ok && !result.probed {
+		result.duration = float64(result.size) / bitrate
+	}
+
+	est.mu.Lock()
+	defer est.mu.Unlock()
+	est.files[fp] = result
+	return result
+}
+
+// probeFile reads the duration and the resolution of the file with ffprobe
+func (est *estimator) probeFile(ctx context.Context, fp string, result *estimate) {
+	duration, e := ffprobe.VideoTime(ctx, est.runner, fp)
+	if e != nil || duration <= 0 {
+		logrus.WithFields(logrus.Fields{"path": fp, "error": e}).Debugf("Unable to probe, estimate by the size")
+		return
+	}
+	result.duration, result.probed = duration, true
+
+	streams, e := ffprobe.StreamInfoJSON(ctx, est.runner, fp)
+	if e != nil {
+		logrus.WithFields(logrus.Fields{"path": fp, "error": e}).Debugf("Unable to probe the resolution")
+		return
+	}
+	for _, stream := range streams {
+		if stream.Get("codec_type").String() == "video" {
+			result.width, result.height = int(stream.Get("width").Int()), int(stream.Get("height").Int())
+			break
+		}
+	}
+}
+
+// get returns the estimate of the file; zero if it is not estimated
+func (est *estimator) get(fp string) estimate {
+	est.mu.Lock()
+	defer est.mu.Unlock()
+	return est.files[fp]
+}
+
+// forget drops the estimate of a file which is not handled anymore
+func (est *estimator) forget(fp string) {
+	est.mu.Lock()
+	defer est.mu.Unlock()
+	delete(est.files, fp)
+}
+
+// observe measures the speed of the worker on a file it finished and returns
+// the work done, 0 if unknown. The media duration reported by the worker
+// replaces the estimated one.
+func (est *estimator) observe(worker, fp string, media_duration, elapsed float64) float64 {
+	est.mu.Lock()
+	defer est.mu.Unlock()
+
+	e, ok := est.files[fp]
+	if !ok || elapsed <= 0 {
+		return 0
+	}
+	if media_duration > 0 && e.file_type != "image" {
+		e.duration = media_duration
+	}
+	work := e.work()
+	if work <= 0 {
+		return 0
+	}
+	est.learn(worker, work/elapsed)
+	return work
+}
+
+// learn averages the speed of the worker with the one of its last job; it
+// must be called with the lock held
+func (est *estimator) learn(worker string, speed float64) {
+	if last, ok := est.speeds[worker]; ok {
+		speed = last + speed_alpha*(speed-last)
+	}
+	est.speeds[worker] = speed
+}
+
+// seed measures the speeds of the workers on the jobs done before a restart,
+// in the order they finished, and returns the number of jobs measured
+func (est *estimator) seed(entries []ledger.Entry) int {
+	done := []ledger.Entry{}
+	for _, entry := range entries {
+		if entry.State == ledger.StateDone && entry.Work > 0 && entry.ElapsedTime > 0 {
+			done = append(done, entry)
+		}
+	}
+	sort.SliceStable(done, func(i, j int) bool { return done[i].FinishedAt.Before(done[j].FinishedAt) })
+
+	est.mu.Lock()
+	defer est.mu.Unlock()
+	for _, entry := range done {
+		worker := protocol.Peer{Hostname: entry.Hostname, PID: entry.PID}
+		est.learn(worker.String(), entry.Work/entry.ElapsedTime)
+	}
+	return len(done)
+}
+
+// speedsOf copies the measured speeds of the workers
+func (est *estimator) speedsOf() map[string]float64 {
+	est.mu.Lock()
+	defer est.mu.Unlock()
+
+	result := make(map[string]float64, len(est.speeds))
+	for worker, speed := range est.speeds {
+		result[worker] = speed
+	}
+	return result
+}
+
+// orderBy returns the order of the queue; nil for OrderWalk
+func (est *estimator) orderBy(order string, dir_priority []string) (func(a, b string) bool, error) {
+	switch order {
+	case "", OrderWalk:
+		return nil, nil
+	case OrderLongest:
+		return func(a, b string) bool { return est.get(a).work() > est.get(b).work() }, nil
+	case OrderSmallest:
+		return func(a, b string) bool { return est.get(a).work() < est.get(b).work() }, nil
+	case OrderNewest:
+		return func(a, b string) bool { return est.get(a).mod_time.After(est.get(b).mod_time) }, nil
+	case OrderDirectory:
+		if len(dir_priority) == 0 {
+			return nil, fmt.Errorf("order %q needs the directories to serve first", order)
+		}
+		rank := func(fp string) int {
+			for i, dp := range dir_priority {
+				if strings.HasPrefix(fp, dp+string(filepath.Separator)) {
+					return i
+				}
+			}
+			return len(dir_priority)
+		}
+		return func(a, b string) bool { return rank(a) < rank(b) }, nil
+	}
+	return nil, fmt.Errorf("unknown order %q", order)
+}
+
+// estimateOf returns the estimate of a queued or leased path. A segment has its
+// share of the size and the duration of its file.
+func (srv *Server) estimateOf(fp string) estimate {
+	srv.mu.Lock()
+	ref, is_segment := srv.segment_of[fp]
+	segments := 0
+	if is_segment {
+		segments = len(srv.splits[ref.source].segments)
+	}
+	srv.mu.Unlock()
+
+	if !is_segment || segments <= 0 {
+		return srv.estimates.get(fp)
+	}
+	result := srv.estimates.get(ref.source)
+	result.size /= int64(segments)
+	result.duration /= float64(segments)
+	return result
+}
+
+// workOf is the cost of a queued or leased path. A segment costs its share of
+// its file; the merge of a split file is not counted.
+func (srv *Server) workOf(fp string) float64 {
+	if srv.splitting(fp) {
+		return 0
+	}
+	return srv.estimateOf(fp).work()
+}
+
+// eta estimates how long the active workers take to finish the queued and the
+// running jobs at their measured speed, and the cost left. A worker not
+// measured yet is taken as fast as the average. False until a job is done.
+func (srv *Server) eta(now time.Time) (float64, float64, bool) {
+	speeds := srv.estimates.speedsOf()
+	mean := 0.0
+	for _, speed := range speeds {
+		mean += speed / float64(len(speeds))
+	}
+	speedOf := func(worker string) float64 {
+		if speed, ok := speeds[worker]; ok {
+			return speed
+		}
+		return mean
+	}
+
+	remaining := 0.0
+	for _, fp := range srv.sched.pending() {
+		remaining += srv.workOf(fp)
+	}
+	for _, l := range srv.sched.Snapshot().Leases {
+		// the copies run the same jobs again
+		if l.Speculative {
+			continue
+		}
+		done := now.Sub(l.Start).Seconds() * speedOf(l.Hostname+"/"+l.PID)
+		if left := srv.workOf(l.Path) - done; left > 0 {
+			remaining += left
+		}
+	}
+
+	total := 0.0
+	for _, ws := range srv.board.snapshot() {
+		if now.Sub(ws.LastSeen) <= srv.sched.ttl {
+			total += speedOf(ws.Hostname + "/" + ws.PID)
+		}
+	}
+	if total <= 0 {
+		return 0, remaining, false
+	}
+	return remaining / total, remaining, true
+}
+
+// sanitizeDirs makes the directories absolute, relative to the root directory
+func sanitizeDirs(root string, dirs []string) []string {
+	result := make([]string, 0, len(dirs))
+	for _, dp := range dirs {
+		if !filepath.IsAbs(dp) && root != "" {
+			dp = filepath.Join(root, dp)
+		}
+		result = append(result, util.PathSanitize(dp))
+	}
+	return result
+}
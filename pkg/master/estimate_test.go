@@ -0,0 +1,52 @@
+package master
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sunrise2575/dist-ffmpeg/pkg/ledger"
+)
+
+func TestSpeedsFromLedger(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "ledger.jsonl")
+	ldg, e := ledger.Open(fp)
+	if e != nil {
+		t.Fatal(e)
+	}
+	start := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	for _, entry := range []ledger.Entry{
+		// listed by path, measured in the order they finished: 2, then 6
+		{Path: "/data/a.mkv", State: ledger.StateDone, Hostname: "host-0", PID: "1", FinishedAt: start.Add(2 * time.Minute), ElapsedTime: 20, Work: 120},
+		{Path: "/data/b.mkv", State: ledger.StateDone, Hostname: "host-0", PID: "1", FinishedAt: start.Add(time.Minute), ElapsedTime: 30, Work: 60},
+		{Path: "/data/c.mkv", State: ledger.StateDone, Hostname: "host-1", PID: "2", FinishedAt: start, ElapsedTime: 10, Work: 40},
+		// not measured: failed, or the merge of a split file
+		{Path: "/data/d.mkv", State: ledger.StateFailed, Hostname: "host-2", PID: "3", ElapsedTime: 10, Work: 40},
+		{Path: "/data/e.mkv", State: ledger.StateDone, Hostname: "host-3", PID: "4", ElapsedTime: 10},
+	} {
+		entry := entry
+		if _, e := ldg.Update(entry.Path, func(got *ledger.Entry) { *got = entry }); e != nil {
+			t.Fatal(e)
+		}
+	}
+	ldg.Close()
+
+	// a restarted master keeps the speeds for the ETA
+	srv, e := New(Options{Endpoint: "inproc://speeds-test", LedgerPath: fp})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer srv.ldg.Close()
+
+	speeds := srv.estimates.speedsOf()
+	want := map[string]float64{"host-0/1": 2 + speed_alpha*(6-2), "host-1/2": 4}
+	if len(speeds) != len(want) {
+		t.Errorf("speeds %v, want %v", speeds, want)
+	}
+	for worker, speed := range want {
+		if math.Abs(speeds[worker]-speed) > 1e-9 {
+			t.Errorf("speed of %v: %v, want %v", worker, speeds[worker], speed)
+		}
+	}
+}
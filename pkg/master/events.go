@@ -0,0 +1,82 @@
+package master
+
+import (
+	"time"
+
+	"github.com/sunrise2575/dist-ffmpeg/pkg/protocol"
+)
+
+// EventKind tells what happened to a job
+type EventKind string
+
+const (
+	// the path joined the queue
+	EventQueued EventKind = "queued"
+	// a worker took the path
+	EventAssigned EventKind = "assigned"
+	// the worker reported success
+	EventDone EventKind = "done"
+	// the worker reported a failure; Retry tells whether the path runs again
+	EventFailed EventKind = "failed"
+	// the worker reported it is not a media file worth transcoding
+	EventSkipped EventKind = "skipped"
+	// the worker was stopped in the middle of the job
+	EventKilled EventKind = "killed"
+	// the worker went silent, the path is back in the queue
+	EventLeaseExpired EventKind = "lease_expired"
+	// an idle worker took a copy of a straggling path; the first copy to finish wins
+	EventSpeculated EventKind = "speculated"
+)
+
+// Event is passed to Options.OnEvent
+type Event struct {
+	Kind EventKind
+	Time time.Time
+	Path string
+	// the worker; empty for EventQueued
+	Hostname, PID string
+	// the profile chosen for the path, if any
+	Profile string
+
+	// wall time of the job, for the reports of a worker and EventLeaseExpired
+	Elapsed time.Duration
+	// the file as described by the worker report
+	Stats protocol.Stats
+	// of EventFailed
+	Error, ErrorClass string
+	// of EventFailed and EventKilled
+	Retry      bool
+	RetryAfter time.Duration
+}
+
+// emit calls the OnEvent callback, if any
+func (srv *Server) emit(ev Event) {
+	if srv.opts.OnEvent == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	if ev.Profile == "" {
+		entry, _ := srv.ldg.Get(ev.Path)
+		ev.Profile = entry.Profile
+	}
+	srv.opts.OnEvent(ev)
+}
+
+// reportEvent builds the event of a job report of a worker
+func reportEvent(kind EventKind, req protocol.Request) Event {
+	report := req.Report
+	ev := Event{
+		Kind:     kind,
+		Path:     report.Path,
+		Hostname: req.Worker.Hostname,
+		PID:      req.Worker.PID,
+		Elapsed:  time.Duration(report.Elapsed),
+		Stats:    report.Stats,
+	}
+	if report.Error != nil {
+		ev.Error, ev.ErrorClass = report.Error.Message, report.Error.Class
+	}
+	return ev
+}
@@ -0,0 +1,164 @@
+package master
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/ledger"
+)
+
+//go:embed dashboard.html
+var dashboard_html []byte
+
+type statusResponse struct {
+	Hostname      string               `json:"hostname"`
+	PID           string               `json:"pid"`
+	Directory     string               `json:"dir"`
+	Watch         bool                 `json:"watch"`
+	StartedAt     time.Time            `json:"started_at"`
+	UptimeSeconds float64              `json:"uptime_seconds"`
+	QueueLength   int                  `json:"queue_length"`
+	RetryWaiting  int                  `json:"retry_waiting"`
+	InFlight      int                  `json:"in_flight"`
+	ActiveWorkers int                  `json:"active_workers"`
+	Counts        map[ledger.State]int `json:"counts"`
+	// the estimated cost left in seconds of 1080p media, and how long the
+	// active workers take for it; null until a job is done
+	RemainingWork float64  `json:"remaining_work"`
+	ETASeconds    *float64 `json:"eta_seconds"`
+}
+
+type jobResponse struct {
+	Path           string    `json:"path"`
+	Hostname       string    `json:"hostname"`
+	PID            string    `json:"pid"`
+	StartedAt      time.Time `json:"started_at"`
+	Deadline       time.Time `json:"lease_deadline"`
+	ElapsedSeconds float64   `json:"elapsed_seconds"`
+	Speculative    bool      `json:"speculative"`
+}
+
+type workerResponse struct {
+	workerStats
+	Active      bool    `json:"active"`
+	InFlight    int     `json:"in_flight"`
+	JobsPerHour float64 `json:"jobs_per_hour"`
+	BusyRatio   float64 `json:"busy_ratio"`
+	// seconds of 1080p media encoded per second, measured on the finished jobs
+	Speed float64 `json:"speed"`
+}
+
+// Handler serves the cluster progress as JSON, a dashboard page and Prometheus metrics
+func (srv *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", srv.handleDashboard)
+	mux.HandleFunc("/api/status", srv.handleStatus)
+	mux.HandleFunc("/api/jobs", srv.handleJobs)
+	mux.HandleFunc("/api/workers", srv.handleWorkers)
+	mux.Handle("/metrics", srv.metrics.registry.Handler())
+	return mux
+}
+
+// serveHTTP runs the Handler on the address until the context is done
+func (srv *Server) serveHTTP(ctx context.Context, addr string) error {
+	hs := &http.Server{Addr: addr, Handler: srv.Handler()}
+	go func() {
+		<-ctx.Done()
+		hs.Close()
+	}()
+
+	logrus.WithFields(logrus.Fields{"address": addr}).Infof("Serve HTTP status")
+	if e := hs.ListenAndServe(); e != http.ErrServerClosed {
+		return e
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if e := json.NewEncoder(w).Encode(v); e != nil {
+		logrus.WithFields(logrus.Fields{"error": e}).Warnf("Unable to write HTTP response")
+	}
+}
+
+func (srv *Server) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" && r.URL.Path != "/index.html" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboard_html)
+}
+
+func (srv *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	snap := srv.sched.Snapshot()
+
+	result := statusResponse{
+		Hostname:      srv.opts.Hostname,
+		PID:           srv.opts.PID,
+		Directory:     srv.opts.Directory,
+		Watch:         srv.opts.Watch,
+		StartedAt:     srv.board.started,
+		UptimeSeconds: now.Sub(srv.board.started).Seconds(),
+		QueueLength:   snap.Queued,
+		RetryWaiting:  snap.Retrying,
+		InFlight:      len(snap.Leases),
+		ActiveWorkers: srv.board.active(now, srv.sched.ttl),
+		Counts:        srv.ldg.Counts(),
+	}
+	eta, remaining, ok := srv.eta(now)
+	result.RemainingWork = remaining
+	if ok {
+		result.ETASeconds = &eta
+	}
+	writeJSON(w, result)
+}
+
+func (srv *Server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	result := []jobResponse{}
+	for _, l := range srv.sched.Snapshot().Leases {
+		result = append(result, jobResponse{
+			Path:           l.Path,
+			Hostname:       l.Hostname,
+			PID:            l.PID,
+			StartedAt:      l.Start,
+			Deadline:       l.Deadline,
+			ElapsedSeconds: now.Sub(l.Start).Seconds(),
+			Speculative:    l.Speculative,
+		})
+	}
+	writeJSON(w, result)
+}
+
+func (srv *Server) handleWorkers(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+
+	in_flight := map[string]int{}
+	for _, l := range srv.sched.Snapshot().Leases {
+		in_flight[l.Hostname+"/"+l.PID]++
+	}
+
+	speeds := srv.estimates.speedsOf()
+	result := []workerResponse{}
+	for _, ws := range srv.board.snapshot() {
+		wr := workerResponse{
+			workerStats: ws,
+			Active:      now.Sub(ws.LastSeen) <= srv.sched.ttl,
+			InFlight:    in_flight[ws.Hostname+"/"+ws.PID],
+			Speed:       speeds[ws.Hostname+"/"+ws.PID],
+		}
+		if lifetime := now.Sub(ws.FirstSeen).Seconds(); lifetime > 0 {
+			wr.JobsPerHour = float64(ws.Done) / lifetime * 3600
+			wr.BusyRatio = ws.BusySeconds / lifetime
+		}
+		result = append(result, wr)
+	}
+	writeJSON(w, result)
+}
@@ -0,0 +1,117 @@
+package master
+
+import (
+	"math"
+	"time"
+
+	"github.com/sunrise2575/dist-ffmpeg/pkg/metrics"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/protocol"
+)
+
+// serverMetrics belong to one Server, so several of them can live in one process
+type serverMetrics struct {
+	registry *metrics.Registry
+
+	jobs         *metrics.CounterVec
+	speculative  *metrics.CounterVec
+	job_duration *metrics.HistogramVec
+	bytes_in     *metrics.CounterVec
+	bytes_out    *metrics.CounterVec
+	speed        *metrics.HistogramVec
+}
+
+func newServerMetrics() *serverMetrics {
+	r := metrics.NewRegistry()
+	return &serverMetrics{
+		registry: r,
+		jobs: r.NewCounter(
+			"distffmpeg_jobs_total",
+			"Job reports and lease expiries by outcome",
+			"outcome"),
+		speculative: r.NewCounter(
+			"distffmpeg_speculative_jobs_total",
+			"Copies of straggling jobs started, and copies cancelled since another one finished first",
+			"outcome"),
+		job_duration: r.NewHistogram(
+			"distffmpeg_job_duration_seconds",
+			"Wall time of successful jobs by file type",
+			metrics.DurationBuckets,
+			"file_type"),
+		bytes_in: r.NewCounter(
+			"distffmpeg_bytes_in_total",
+			"Size of the original files of successful jobs"),
+		bytes_out: r.NewCounter(
+			"distffmpeg_bytes_out_total",
+			"Size of the transcoded files of successful jobs"),
+		speed: r.NewHistogram(
+			"distffmpeg_encode_speed_ratio",
+			"Media duration divided by wall time of successful jobs",
+			metrics.RatioBuckets,
+			"file_type"),
+	}
+}
+
+// registerScheduler adds the gauges read from the live state on every scrape
+func (m *serverMetrics) registerScheduler(sched *Scheduler, board *statsBoard) {
+	m.registry.NewGaugeFunc(
+		"distffmpeg_queue_depth",
+		"Paths waiting to be assigned",
+		func() float64 { return float64(sched.Snapshot().Queued) })
+	m.registry.NewGaugeFunc(
+		"distffmpeg_retry_waiting",
+		"Failed paths waiting for their retry backoff",
+		func() float64 { return float64(sched.Snapshot().Retrying) })
+	m.registry.NewGaugeFunc(
+		"distffmpeg_in_flight_jobs",
+		"Paths leased to workers",
+		func() float64 { return float64(len(sched.Snapshot().Leases)) })
+	m.registry.NewGaugeFunc(
+		"distffmpeg_connected_workers",
+		"Workers heard from within the lease duration",
+		func() float64 { return float64(board.active(time.Now(), sched.ttl)) })
+}
+
+// registerETA adds the gauges of the estimated work left
+func (m *serverMetrics) registerETA(eta func(now time.Time) (float64, float64, bool)) {
+	m.registry.NewGaugeFunc(
+		"distffmpeg_eta_seconds",
+		"Estimated time until the queued and running jobs are done, NaN until a job is done",
+		func() float64 {
+			seconds, _, ok := eta(time.Now())
+			if !ok {
+				return math.NaN()
+			}
+			return seconds
+		})
+	m.registry.NewGaugeFunc(
+		"distffmpeg_remaining_work_seconds",
+		"Estimated cost of the queued and running jobs in seconds of 1080p media",
+		func() float64 {
+			_, remaining, _ := eta(time.Now())
+			return remaining
+		})
+}
+
+// observeReport feeds a job report of a worker to the metrics
+func (m *serverMetrics) observeReport(kind protocol.Kind, report *protocol.Report) {
+	outcome := map[protocol.Kind]string{
+		protocol.KindJobDone: "done",
+		protocol.KindJobFail: "failed",
+		protocol.KindJobSkip: "skipped",
+		protocol.KindKilled:  "killed",
+	}[kind]
+	m.jobs.Inc(outcome)
+
+	if kind != protocol.KindJobDone {
+		return
+	}
+
+	stats := report.Stats
+	elapsed := time.Duration(report.Elapsed).Seconds()
+	m.job_duration.Observe(elapsed, stats.FileType)
+	m.bytes_in.Add(float64(stats.BytesIn))
+	m.bytes_out.Add(float64(stats.BytesOut))
+	if stats.MediaDuration > 0 && elapsed > 0 {
+		m.speed.Observe(stats.MediaDuration/elapsed, stats.FileType)
+	}
+}
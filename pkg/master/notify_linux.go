@@ -0,0 +1,129 @@
+//go:build linux
+// +build linux
+
+package master
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/sirupsen/logrus"
+)
+
+const inotify_mask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_CREATE | syscall.IN_MODIFY
+
+// notifier reports changed files under a directory tree with inotify.
+// Changes made by other NFS clients are not reported; the periodic rescan covers them.
+type notifier struct {
+	fd int
+	// reads fd through the runtime poller, so that closing it stops a read;
+	// closing a blocking fd does not wake up a read on it
+	file   *os.File
+	mu     sync.Mutex
+	wd2dir map[int32]string
+}
+
+func newNotifier() (*notifier, error) {
+	fd, e := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if e != nil {
+		return nil, e
+	}
+	return &notifier{
+		fd:     fd,
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		wd2dir: map[int32]string{},
+	}, nil
+}
+
+// addTree watches the directory and all of its subdirectories
+func (n *notifier) addTree(dir string) {
+	filepath.Walk(dir, func(fp string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		wd, e := syscall.InotifyAddWatch(n.fd, fp, inotify_mask)
+		if e != nil {
+			// usually fs.inotify.max_user_watches
+			logrus.WithFields(logrus.Fields{"path": fp, "error": e}).Warnf("Unable to watch the directory")
+			return nil
+		}
+		n.mu.Lock()
+		n.wd2dir[int32(wd)] = fp
+		n.mu.Unlock()
+		return nil
+	})
+}
+
+// run calls changed for every created or written file and overflow when
+// events were dropped, until the context is done. The inotify fd is closed
+// when it returns.
+func (n *notifier) run(ctx context.Context, dir string, changed func(fp string), overflow func()) {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stop:
+		}
+		n.file.Close()
+	}()
+
+	n.addTree(dir)
+
+	buf := make([]byte, 64*1024)
+	for {
+		size, e := n.file.Read(buf)
+		if e != nil {
+			if errors.Is(e, os.ErrClosed) || errors.Is(e, syscall.EBADF) {
+				return
+			}
+			logrus.WithFields(logrus.Fields{"error": e}).Errorf("Unable to read file system events")
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= size; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			name_bytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+			if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				overflow()
+				continue
+			}
+
+			n.mu.Lock()
+			parent, ok := n.wd2dir[event.Wd]
+			n.mu.Unlock()
+			if !ok {
+				continue
+			}
+
+			name := string(name_bytes)
+			for len(name) > 0 && name[len(name)-1] == 0 {
+				name = name[:len(name)-1]
+			}
+			fp := filepath.Join(parent, name)
+
+			if event.Mask&syscall.IN_ISDIR != 0 {
+				if event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+					// a new directory may already contain files
+					n.addTree(fp)
+					filepath.Walk(fp, func(sub string, info os.FileInfo, err error) error {
+						if err == nil && !info.IsDir() {
+							changed(sub)
+						}
+						return nil
+					})
+				}
+				continue
+			}
+
+			changed(fp)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+//go:build linux
+// +build linux
+
+package master
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNotifierStopsWithContext(t *testing.T) {
+	dir := t.TempDir()
+	n, e := newNotifier()
+	if e != nil {
+		t.Skip(e)
+	}
+
+	changed := make(chan string, 16)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n.run(ctx, dir, func(fp string) { changed <- fp }, func() {})
+	}()
+
+	// the watch is added by run, so write until an event shows up
+	fp := filepath.Join(dir, "a.mkv")
+	deadline := time.After(10 * time.Second)
+wait:
+	for {
+		os.WriteFile(fp, []byte("a"), 0644)
+		select {
+		case got := <-changed:
+			if got != fp {
+				t.Errorf("changed %v, want %v", got, fp)
+			}
+			break wait
+		case <-time.After(50 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("no event of the written file")
+		}
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("run did not return once the context is done")
+	}
+}
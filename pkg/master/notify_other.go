@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package master
+
+import (
+	"context"
+	"fmt"
+)
+
+type notifier struct{}
+
+func newNotifier() (*notifier, error) {
+	return nil, fmt.Errorf("inotify is only available on linux")
+}
+
+func (n *notifier) run(ctx context.Context, dir string, changed func(fp string), overflow func()) {}
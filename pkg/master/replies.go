@@ -0,0 +1,72 @@
+package master
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/sunrise2575/dist-ffmpeg/pkg/protocol"
+)
+
+// A worker whose reply does not come in time sends the request again with the
+// same ID, maybe after the master handled it. The reply is kept for a lease
+// duration and sent again instead, so that a resent job_want does not lease a
+// second file and a resent report is not recorded twice.
+
+// replyKey is a request of a worker
+type replyKey struct {
+	worker protocol.Peer
+	id     uint64
+}
+
+// sentReply is the response to a request; done is closed once res is set
+type sentReply struct {
+	// the connection of the worker; another one is a restarted worker counting
+	// its IDs from the start
+	identity string
+	at       time.Time
+	done     chan struct{}
+	res      protocol.Response
+}
+
+// once handles the request unless the worker sent it before over the same
+// connection, in which case the response of the first one is returned again
+func (srv *Server) once(identity string, req protocol.Request) protocol.Response {
+	if req.ID == 0 {
+		return srv.handle(req)
+	}
+
+	key := replyKey{worker: req.Worker, id: req.ID}
+	srv.mu.Lock()
+	sent, ok := srv.replies[key]
+	if ok && sent.identity == identity {
+		srv.mu.Unlock()
+		// the first one may be still handled
+		<-sent.done
+		logrus.WithFields(logrus.Fields{
+			"hostname": req.Worker.Hostname,
+			"pid":      req.Worker.PID,
+			"req":      req.Kind,
+			"id":       req.ID,
+		}).Debugf("Got a request again, reply the same")
+		return sent.res
+	}
+	sent = &sentReply{identity: identity, at: time.Now(), done: make(chan struct{})}
+	srv.replies[key] = sent
+	srv.mu.Unlock()
+
+	sent.res = srv.handle(req)
+	close(sent.done)
+	return sent.res
+}
+
+// forgetReplies drops the replies kept for longer than a lease
+func (srv *Server) forgetReplies(now time.Time) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for key, sent := range srv.replies {
+		if now.Sub(sent.at) > srv.opts.LeaseTTL {
+			delete(srv.replies, key)
+		}
+	}
+}
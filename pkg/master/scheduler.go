@@ -0,0 +1,460 @@
+package master
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Lease is a path assigned to a worker
+type Lease struct {
+	Path          string
+	Hostname, PID string
+	Start         time.Time
+	// the path goes back to the queue unless the worker renews the lease by then
+	Deadline time.Time
+	// a copy of a straggling job, run by another worker at the same time
+	Speculative bool
+}
+
+type retry struct {
+	path       string
+	avoid      string
+	not_before time.Time
+}
+
+// Scheduler owns the pending paths and the leases of the assigned ones.
+// It is shared by the file walker, the request handler and the lease reaper.
+type Scheduler struct {
+	mu     sync.Mutex
+	queue  []string
+	queued map[string]bool
+	// the paths put at the head of the queue, which keep their place; the
+	// rest of the queue is in the order of less
+	head int
+	// the order of the queue; nil to keep the order the paths are pushed in
+	less func(a, b string) bool
+
+	leases map[string]*Lease
+	// path -> the speculative copy of its lease
+	copies  map[string]*Lease
+	retries []retry
+	// path -> hostname which failed it last time
+	avoid map[string]string
+	// hostname -> last time the worker asked for a job
+	seen map[string]time.Time
+
+	ttl                time.Duration
+	retry_other_worker bool
+
+	// signaled whenever a path becomes available
+	wake chan struct{}
+}
+
+func newScheduler(ttl time.Duration, retry_other_worker bool, less func(a, b string) bool) *Scheduler {
+	return &Scheduler{
+		queue:              []string{},
+		queued:             map[string]bool{},
+		less:               less,
+		leases:             map[string]*Lease{},
+		copies:             map[string]*Lease{},
+		retries:            []retry{},
+		avoid:              map[string]string{},
+		seen:               map[string]time.Time{},
+		ttl:                ttl,
+		retry_other_worker: retry_other_worker,
+		wake:               make(chan struct{}, 1),
+	}
+}
+
+// signal must be called with the lock held
+func (s *Scheduler) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Push queues the path in the order of the scheduler, after the paths it does
+// not come before
+func (s *Scheduler) Push(fp string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	index := len(s.queue)
+	if s.less != nil {
+		ordered := s.queue[s.head:]
+		index = s.head + sort.Search(len(ordered), func(i int) bool { return s.less(fp, ordered[i]) })
+	}
+	s.queue = append(s.queue, "")
+	copy(s.queue[index+1:], s.queue[index:])
+	s.queue[index] = fp
+	s.queued[fp] = true
+	s.signal()
+}
+
+// pushFront must be called with the lock held
+func (s *Scheduler) pushFront(fp string) {
+	s.queue = append([]string{fp}, s.queue...)
+	s.queued[fp] = true
+	s.head++
+	s.signal()
+}
+
+// removeAt must be called with the lock held
+func (s *Scheduler) removeAt(index int) {
+	delete(s.queued, s.queue[index])
+	s.queue = append(s.queue[:index], s.queue[index+1:]...)
+	if index < s.head {
+		s.head--
+	}
+}
+
+// pushHead puts the paths at the head of the queue, in their order
+func (s *Scheduler) pushHead(fps ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(fps) - 1; i >= 0; i-- {
+		s.pushFront(fps[i])
+	}
+}
+
+// drop forgets the path, whether it is queued, leased or waiting for a retry
+func (s *Scheduler) drop(fp string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.queued[fp] {
+		for i, queued := range s.queue {
+			if queued == fp {
+				s.removeAt(i)
+				break
+			}
+		}
+	}
+	delete(s.leases, fp)
+	delete(s.copies, fp)
+	delete(s.avoid, fp)
+	waiting := []retry{}
+	for _, r := range s.retries {
+		if r.path != fp {
+			waiting = append(waiting, r)
+		}
+	}
+	s.retries = waiting
+}
+
+// Contains reports whether the path is queued, leased or waiting for a retry
+func (s *Scheduler) Contains(fp string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.leases[fp]; ok || s.queued[fp] {
+		return true
+	}
+	for _, r := range s.retries {
+		if r.path == fp {
+			return true
+		}
+	}
+	return false
+}
+
+// pending returns the queued paths in order, then the ones waiting for a retry
+func (s *Scheduler) pending() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := append(make([]string, 0, len(s.queue)+len(s.retries)), s.queue...)
+	for _, r := range s.retries {
+		result = append(result, r.path)
+	}
+	return result
+}
+
+// retryLater puts the path back to the queue after the delay
+func (s *Scheduler) retryLater(fp, failed_hostname string, delay time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := retry{
+		path:       fp,
+		not_before: time.Now().Add(delay),
+	}
+	if s.retry_other_worker {
+		r.avoid = failed_hostname
+	}
+	s.retries = append(s.retries, r)
+}
+
+// promote moves the retries whose backoff is over to the head of the queue
+func (s *Scheduler) promote(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.promoteRetries(now)
+}
+
+// promoteRetries must be called with the lock held
+func (s *Scheduler) promoteRetries(now time.Time) {
+	waiting := []retry{}
+	for _, r := range s.retries {
+		if now.Before(r.not_before) {
+			waiting = append(waiting, r)
+			continue
+		}
+		s.pushFront(r.path)
+		if r.avoid != "" {
+			s.avoid[r.path] = r.avoid
+		}
+	}
+	s.retries = waiting
+}
+
+// nextRetry tells how long until the earliest pending retry is due
+func (s *Scheduler) nextRetry() (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.retries) == 0 {
+		return 0, false
+	}
+	earliest := s.retries[0].not_before
+	for _, r := range s.retries[1:] {
+		if r.not_before.Before(earliest) {
+			earliest = r.not_before
+		}
+	}
+
+	wait := time.Until(earliest)
+	if wait < time.Second {
+		wait = time.Second
+	}
+	return wait, true
+}
+
+// otherWorkerAlive reports whether a worker on another machine asked for a job recently
+func (s *Scheduler) otherWorkerAlive(hostname string, now time.Time) bool {
+	for h, t := range s.seen {
+		if h != hostname && now.Sub(t) <= s.ttl {
+			return true
+		}
+	}
+	return false
+}
+
+// assign pops the next path the worker is eligible for and leases it to the worker.
+// A retried path is kept for another machine as long as one is around.
+func (s *Scheduler) assign(hostname, pid string, eligible func(fp string) bool) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.seen[hostname] = now
+	s.promoteRetries(now)
+
+	index := -1
+	for i, fp := range s.queue {
+		if s.avoid[fp] == hostname && s.otherWorkerAlive(hostname, now) {
+			continue
+		}
+		if !eligible(fp) {
+			continue
+		}
+		index = i
+		break
+	}
+	if index < 0 {
+		return "", false
+	}
+
+	fp := s.queue[index]
+	s.removeAt(index)
+	delete(s.avoid, fp)
+
+	s.leases[fp] = &Lease{
+		Path:     fp,
+		Hostname: hostname,
+		PID:      pid,
+		Start:    now,
+		Deadline: now.Add(s.ttl),
+	}
+	return fp, true
+}
+
+// speculate leases a copy of the longest running path to the worker, once
+// nothing is queued or waiting for a retry. Only paths running for at least
+// after, held by another worker and without a copy yet are copied.
+func (s *Scheduler) speculate(hostname, pid string, after time.Duration, eligible func(fp string) bool) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.queue) > 0 || len(s.retries) > 0 {
+		return "", false
+	}
+
+	now := time.Now()
+	var straggler *Lease
+	for fp, l := range s.leases {
+		if s.copies[fp] != nil || (l.Hostname == hostname && l.PID == pid) || now.Sub(l.Start) < after {
+			continue
+		}
+		if straggler != nil && !l.Start.Before(straggler.Start) {
+			continue
+		}
+		if eligible(fp) {
+			straggler = l
+		}
+	}
+	if straggler == nil {
+		return "", false
+	}
+
+	s.copies[straggler.Path] = &Lease{
+		Path:        straggler.Path,
+		Hostname:    hostname,
+		PID:         pid,
+		Start:       now,
+		Deadline:    now.Add(s.ttl),
+		Speculative: true,
+	}
+	return straggler.Path, true
+}
+
+// holders returns the lease of the path and its speculative copy, if any
+func (s *Scheduler) holders(fp string) []Lease {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := []Lease{}
+	if l, ok := s.leases[fp]; ok {
+		result = append(result, *l)
+	}
+	if c, ok := s.copies[fp]; ok {
+		result = append(result, *c)
+	}
+	return result
+}
+
+// holder must be called with the lock held
+func (s *Scheduler) holder(fp, hostname, pid string) *Lease {
+	for _, l := range []*Lease{s.leases[fp], s.copies[fp]} {
+		if l != nil && l.Hostname == hostname && l.PID == pid {
+			return l
+		}
+	}
+	return nil
+}
+
+// LeaseOf returns the lease of the path, if it is leased
+func (s *Scheduler) LeaseOf(fp string) (Lease, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l, ok := s.leases[fp]
+	if !ok {
+		return Lease{}, false
+	}
+	return *l, true
+}
+
+// InFlight counts the leased paths
+func (s *Scheduler) InFlight() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.leases)
+}
+
+// renew extends the lease; false means the worker does not hold it anymore
+func (s *Scheduler) renew(fp, hostname, pid string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l := s.holder(fp, hostname, pid)
+	if l == nil {
+		return false
+	}
+	l.Deadline = time.Now().Add(s.ttl)
+	return true
+}
+
+// release drops the lease, or the copy of it; false means the worker did not hold it.
+// The copy of a released lease goes on as the lease of the path.
+func (s *Scheduler) release(fp, hostname, pid string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch s.holder(fp, hostname, pid) {
+	case nil:
+		return false
+	case s.copies[fp]:
+		delete(s.copies, fp)
+	default:
+		delete(s.leases, fp)
+		if c, ok := s.copies[fp]; ok {
+			delete(s.copies, fp)
+			s.leases[fp] = c
+		}
+	}
+	return true
+}
+
+// expire drops every overdue lease and puts its path back at the head of the
+// queue, unless a copy of the lease goes on. Overdue copies are dropped.
+func (s *Scheduler) expire(now time.Time) []Lease {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for fp, c := range s.copies {
+		if now.After(c.Deadline) {
+			delete(s.copies, fp)
+		}
+	}
+	expired := []Lease{}
+	for fp, l := range s.leases {
+		if !now.After(l.Deadline) {
+			continue
+		}
+		delete(s.leases, fp)
+		if c, ok := s.copies[fp]; ok {
+			delete(s.copies, fp)
+			s.leases[fp] = c
+			continue
+		}
+		expired = append(expired, *l)
+	}
+
+	for _, l := range expired {
+		s.pushFront(l.Path)
+	}
+	return expired
+}
+
+// SchedulerSnapshot is the state of a Scheduler at one moment
+type SchedulerSnapshot struct {
+	// paths waiting to be assigned, and failed ones waiting for their retry backoff
+	Queued, Retrying int
+	// oldest first, with the speculative copies
+	Leases []Lease
+}
+
+// Snapshot copies the state of the queue and the leases
+func (s *Scheduler) Snapshot() SchedulerSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := SchedulerSnapshot{
+		Queued:   len(s.queue),
+		Retrying: len(s.retries),
+		Leases:   make([]Lease, 0, len(s.leases)+len(s.copies)),
+	}
+	for _, l := range s.leases {
+		result.Leases = append(result.Leases, *l)
+	}
+	for _, c := range s.copies {
+		result.Leases = append(result.Leases, *c)
+	}
+	sort.Slice(result.Leases, func(i, j int) bool {
+		return result.Leases[i].Start.Before(result.Leases[j].Start)
+	})
+	return result
+}
@@ -0,0 +1,267 @@
+package master
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/sunrise2575/dist-ffmpeg/pkg/ledger"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/protocol"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/transcode"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/util"
+)
+
+// A video of at least Options.SegmentMinSize is transcoded by several workers:
+// a split job cuts it into segments in a work directory next to it, the
+// segments are queued as jobs of their own, and once all of them are encoded a
+// merge job puts the file together. The segments are not in the ledger; a
+// master restarted in the middle splits the file again.
+
+// split is a file whose segments are being encoded
+type split struct {
+	segments []string
+	done     map[string]bool
+	// failed attempts of every segment
+	attempts map[string]int
+	// every segment is encoded, the merge job is queued or running
+	merging bool
+}
+
+// segmentRef is a segment of a split file
+type segmentRef struct {
+	source string
+	index  int
+}
+
+// segmentSource returns the file of a segment path; false if the path is not in
+// the work directory of a split file
+func segmentSource(fp string) (string, bool) {
+	return transcode.SourceOfWorkDir(filepath.Dir(fp))
+}
+
+// splitting tells whether the segments of the file are being encoded or merged
+func (srv *Server) splitting(fp string) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	_, ok := srv.splits[fp]
+	return ok
+}
+
+// task decides what the worker does with the path it was assigned; nil to
+// transcode it whole. The size is the one recorded when the file was queued,
+// as speculate asks under the lock of the scheduler.
+func (srv *Server) task(fp string) *protocol.Task {
+	size := srv.queuedAs(fp).size
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if ref, ok := srv.segment_of[fp]; ok {
+		return &protocol.Task{Kind: protocol.TaskSegment, Index: ref.index, Source: ref.source}
+	}
+	if s, ok := srv.splits[fp]; ok && s.merging {
+		return &protocol.Task{Kind: protocol.TaskMerge}
+	}
+
+	if srv.opts.SegmentMinSize <= 0 || transcode.ExtFileType(strings.ToLower(filepath.Ext(fp))) != "video" {
+		return nil
+	}
+	if size < srv.opts.SegmentMinSize {
+		return nil
+	}
+	// a few segments for every worker, so a slow one does not hold the merge back
+	segments := 2 * len(srv.workers)
+	if segments < 2 {
+		segments = 2
+	}
+	return &protocol.Task{Kind: protocol.TaskSplit, Segments: segments}
+}
+
+// startSegments queues the segments of a file a worker split
+func (srv *Server) startSegments(source string, segments int) {
+	s := &split{
+		segments: make([]string, segments),
+		done:     map[string]bool{},
+		attempts: map[string]int{},
+	}
+	srv.mu.Lock()
+	for i := range s.segments {
+		s.segments[i] = transcode.SegmentPath(source, i)
+		srv.segment_of[s.segments[i]] = segmentRef{source: source, index: i}
+	}
+	srv.splits[source] = s
+	srv.mu.Unlock()
+
+	// the files started first are finished first
+	srv.sched.pushHead(s.segments...)
+	logrus.WithFields(logrus.Fields{"path": source, "segments": segments}).Infof("Split, queue the segments")
+}
+
+// segmentReport handles the report of a segment job. A failed segment is
+// retried like a file; when it fails for good, the whole file fails.
+func (srv *Server) segmentReport(req protocol.Request, fields logrus.Fields) {
+	fp := req.Report.Path
+	srv.mu.Lock()
+	_, ok := srv.segment_of[fp]
+	srv.mu.Unlock()
+	if !ok {
+		// the file failed or was cancelled in the meantime
+		logrus.WithFields(fields).Debugf("Got the report of a segment of an abandoned file")
+		return
+	}
+	cancelled := srv.finish(req)
+
+	srv.mu.Lock()
+	ref, ok := srv.segment_of[fp]
+	if !ok {
+		srv.mu.Unlock()
+		return
+	}
+	s := srv.splits[ref.source]
+	complete := false
+	if req.Kind == protocol.KindJobDone {
+		s.done[fp] = true
+		if complete = len(s.done) == len(s.segments); complete {
+			s.merging = true
+			for _, segment := range s.segments {
+				delete(srv.segment_of, segment)
+			}
+		}
+	} else {
+		s.attempts[fp]++
+	}
+	attempts := s.attempts[fp]
+	srv.mu.Unlock()
+
+	if req.Kind == protocol.KindJobDone {
+		logrus.WithFields(fields).Infof("Segment complete")
+		if complete {
+			srv.sched.pushHead(ref.source)
+			logrus.WithFields(logrus.Fields{"path": ref.source}).Infof("Every segment is encoded, queue the merge")
+		}
+		return
+	}
+
+	// the worker is gone, not the segment, so it is worth another try
+	error_class := transcode.FailTransient
+	if req.Kind != protocol.KindKilled {
+		error_class = ""
+		if req.Report.Error != nil {
+			error_class = req.Report.Error.Class
+		}
+	}
+	if error_class == transcode.FailTransient && attempts < srv.opts.RetryMax && !cancelled {
+		delay := srv.opts.RetryBackoff * time.Duration(1<<uint(attempts-1))
+		srv.sched.retryLater(fp, req.Worker.Hostname, delay)
+		fields["retry_after"] = delay
+		logrus.WithFields(fields).Warnf("Segment failed, retry later")
+		return
+	}
+
+	logrus.WithFields(fields).Warnf("Segment failed, give up the file")
+	srv.abandonSplit(ref.source)
+
+	// the file fails with the error of its segment
+	report := *req.Report
+	report.Path = ref.source
+	req.Report = &report
+	if cancelled {
+		srv.record(ledger.StateKilled, req)
+		srv.emit(reportEvent(EventKilled, req))
+		return
+	}
+	srv.record(ledger.StateFailed, req)
+	srv.emit(reportEvent(EventFailed, req))
+}
+
+// abandonSplit forgets the segments of the file, cancels the ones being
+// encoded and removes the work directory
+func (srv *Server) abandonSplit(source string) {
+	srv.mu.Lock()
+	s, ok := srv.splits[source]
+	delete(srv.splits, source)
+	if ok {
+		for _, segment := range s.segments {
+			delete(srv.segment_of, segment)
+		}
+	}
+	srv.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	for _, segment := range s.segments {
+		l, leased := srv.sched.LeaseOf(segment)
+		srv.sched.drop(segment)
+		if leased {
+			srv.push(protocol.Peer{Hostname: l.Hostname, PID: l.PID}, &protocol.Push{Kind: protocol.PushCancel, Path: segment})
+		}
+	}
+	if e := os.RemoveAll(transcode.WorkDir(source)); e != nil {
+		logrus.WithFields(logrus.Fields{"path": source, "error": e}).Warnf("Unable to remove the segments")
+	}
+}
+
+// forgetSplit drops the state of a file once its merge job is over
+func (srv *Server) forgetSplit(source string) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	delete(srv.splits, source)
+}
+
+// segmentExpired handles a segment whose worker went silent; its path is back in the queue
+func (srv *Server) segmentExpired(l Lease, now time.Time) {
+	srv.mu.Lock()
+	_, ok := srv.segment_of[l.Path]
+	srv.mu.Unlock()
+	if !ok {
+		srv.sched.drop(l.Path)
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"hostname":     l.Hostname,
+		"pid":          l.PID,
+		"path":         l.Path,
+		"elapsed_time": util.Atof(now.Sub(l.Start).Seconds()),
+	}).Warnf("Lease of a segment expired, re-queue")
+	srv.metrics.jobs.Inc("lease_expired")
+}
+
+// cleanWorkDir removes the segments of a file nobody works on, e.g. left by a
+// master stopped in the middle. A work directory changed within the lease TTL
+// may belong to a split job just assigned, so it is left for the next scan.
+func (srv *Server) cleanWorkDir(dp string, info os.FileInfo) {
+	source, _ := transcode.SourceOfWorkDir(dp)
+	if srv.splitting(source) || srv.sched.Contains(source) || time.Since(info.ModTime()) < srv.opts.LeaseTTL {
+		return
+	}
+	if e := os.RemoveAll(dp); e != nil {
+		logrus.WithFields(logrus.Fields{"path": dp, "error": e}).Warnf("Unable to remove orphaned segments")
+		return
+	}
+	logrus.WithFields(logrus.Fields{"path": dp}).Infof("Removed orphaned segments")
+}
+
+// cancelSplit stops every segment job of the file; false if it is not split
+func (srv *Server) cancelSplit(fp string) bool {
+	if !srv.splitting(fp) {
+		return false
+	}
+	srv.abandonSplit(fp)
+	// the merge job may be queued
+	srv.sched.drop(fp)
+
+	_, e := srv.ldg.Update(fp, func(entry *ledger.Entry) {
+		entry.State = ledger.StateKilled
+		entry.FinishedAt = time.Now()
+	})
+	if e != nil {
+		logrus.WithFields(logrus.Fields{"path": fp, "error": e}).Errorf("Unable to update the ledger")
+	}
+	logrus.WithFields(logrus.Fields{"path": fp}).Infof("Cancel the segments")
+	srv.emit(Event{Kind: EventKilled, Path: fp})
+	return true
+}
@@ -0,0 +1,43 @@
+package master
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/sunrise2575/dist-ffmpeg/pkg/protocol"
+)
+
+func TestTaskFromQueuedSize(t *testing.T) {
+	dir := t.TempDir()
+	srv, e := New(Options{
+		Endpoint:       "inproc://task-test",
+		LedgerPath:     filepath.Join(dir, "ledger.jsonl"),
+		SegmentMinSize: 1000,
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer srv.ldg.Close()
+
+	// the files are gone from the disk; only what was recorded when they were
+	// queued is used
+	big, small := filepath.Join(dir, "big.mkv"), filepath.Join(dir, "small.mkv")
+	srv.estimates.files[big] = estimate{queuedFile: queuedFile{size: 4000}, file_type: "video"}
+	srv.estimates.files[small] = estimate{queuedFile: queuedFile{size: 999}, file_type: "video"}
+
+	if task := srv.task(big); task == nil || task.Kind != protocol.TaskSplit || task.Segments != 2 {
+		t.Errorf("task of the big file %+v", task)
+	}
+	if task := srv.task(small); task != nil {
+		t.Errorf("task of the small file %+v", task)
+	}
+
+	srv.startSegments(big, 2)
+	segment := srv.splits[big].segments[1]
+	if task := srv.task(segment); task == nil || task.Kind != protocol.TaskSegment || task.Index != 1 || task.Source != big {
+		t.Errorf("task of the segment %+v", task)
+	}
+	if queued := srv.queuedAs(segment); queued.size != 2000 {
+		t.Errorf("segment size %v, want its share of the file", queued.size)
+	}
+}
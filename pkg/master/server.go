@@ -0,0 +1,990 @@
+// Package master hands the media files of a directory out to workers, keeps the
+// leases and retries of the jobs, and records their outcome in a ledger.
+//
+// A program embedding a Server may leave Options.Directory empty and feed it
+// with Server.Enqueue instead, and follow the jobs through Options.OnEvent:
+//
+//	srv, e := master.New(master.Options{
+//		Endpoint:   "tcp://*:5000",
+//		LedgerPath: "ledger.jsonl",
+//		OnEvent:    func(ev master.Event) { log.Println(ev.Kind, ev.Path) },
+//	})
+//	go srv.Run(ctx)
+//	srv.Enqueue(ctx, "/media/new/movie.mkv")
+package master
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pebbe/zmq4"
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+
+	"github.com/sunrise2575/dist-ffmpeg/pkg/keys"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/ledger"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/profile"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/protocol"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/routing"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/runner"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/transcode"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/util"
+)
+
+// Options configures a Server. Durations left zero get the defaults of cmd/master.
+type Options struct {
+	// ZeroMQ endpoints to bind, e.g. "tcp://*:5000" or "inproc://master";
+	// an empty NotifyEndpoint disables the announcements to idle workers.
+	// Endpoint is a ROUTER socket, NotifyEndpoint a PUB socket.
+	Endpoint, NotifyEndpoint string
+	// the ZeroMQ context; inproc:// endpoints need the one of the workers. nil for
+	// the default one, which CURVE needs since the ZAP handler runs there
+	ZMQ *zmq4.Context
+
+	// encrypt the connections with CURVE and let only the workers of the allowed
+	// public keys in. Disabled without a secret key.
+	CurveKeys    keys.Keypair
+	CurveAllowed []string
+
+	// the file root directory; empty to get the paths only through Server.Enqueue
+	Directory string
+	// job ledger file for resuming after restart
+	LedgerPath string
+	// transcoding profiles; empty to let workers use their own config
+	ProfilesPath string
+	// routes of the files to the workers by their labels; empty to let any worker run any file
+	RoutesPath string
+	// HTTP status API and dashboard address; empty to disable
+	HTTPAddr string
+
+	LeaseTTL         time.Duration
+	RetryMax         int
+	RetryBackoff     time.Duration
+	RetryOtherWorker bool
+
+	// split the videos of at least this many bytes into segments transcoded by
+	// several workers, on storage every worker shares; zero to transcode every
+	// file on one worker
+	SegmentMinSize int64
+
+	// once the queue is empty, hand idle workers copies of the jobs running for
+	// at least SpeculateAfter, and keep the copy which finishes first
+	Speculate      bool
+	SpeculateAfter time.Duration
+
+	// the order the queued files are handed out in, OrderWalk by default.
+	// DirPriority are the directories served first with OrderDirectory, relative
+	// to Directory unless absolute.
+	Order       string
+	DirPriority []string
+	// estimate the cost of the files with ffprobe instead of by their size;
+	// ProbeRunner runs it and the probe rules of the profiles, nil for the real one
+	Probe       bool
+	ProbeRunner runner.Runner
+
+	// keep watching the directory for new or modified files
+	Watch                    bool
+	WatchSettle, WatchRescan time.Duration
+	// how long an idle worker waits before asking again while more jobs may come
+	IdleWait time.Duration
+
+	// identify the master in its replies; the process' by default
+	Hostname, PID string
+
+	// called on every change of a job state. It runs on the goroutine handling
+	// the request of a worker, so it must return quickly, and it may be called
+	// for several workers at the same time.
+	OnEvent func(Event)
+}
+
+func (opts *Options) fill() {
+	if opts.LeaseTTL <= 0 {
+		opts.LeaseTTL = time.Minute
+	}
+	if opts.WatchSettle <= 0 {
+		opts.WatchSettle = time.Minute
+	}
+	if opts.WatchRescan <= 0 {
+		opts.WatchRescan = 10 * time.Minute
+	}
+	if opts.SpeculateAfter <= 0 {
+		opts.SpeculateAfter = time.Minute
+	}
+	if opts.IdleWait <= 0 {
+		opts.IdleWait = 10 * time.Second
+	}
+	if opts.Hostname == "" {
+		opts.Hostname, _ = os.Hostname()
+	}
+	if opts.PID == "" {
+		opts.PID = strconv.Itoa(os.Getpid())
+	}
+}
+
+// Server is a master. It runs once.
+type Server struct {
+	opts Options
+
+	ldg      *ledger.Ledger
+	profiles *profile.Set
+	// nil without Options.RoutesPath
+	route_table *routing.Table
+	sched       *Scheduler
+	estimates   *estimator
+	board       *statsBoard
+	metrics     *serverMetrics
+
+	// 1 while the first walk of the directory is going on
+	scanning int32
+
+	// replies and pushes to the ROUTER socket
+	out chan outgoing
+
+	mu sync.Mutex
+	// Peer.String() -> ROUTER identity of the worker
+	routes map[string]string
+	// paths cancelled by Cancel, not to be retried
+	cancelled map[string]bool
+	// Peer.String() -> what the worker said hello with
+	workers map[string]registration
+	// the files whose segments are being encoded or merged, and their segment paths
+	splits     map[string]*split
+	segment_of map[string]segmentRef
+	// path -> the worker allowed to replace the original, and the copies of
+	// jobs another worker finished first
+	committed map[string]protocol.Peer
+	lost      map[lostCopy]bool
+	// the last responses to the requests of the workers, to answer a resent one
+	replies map[replyKey]*sentReply
+
+	// profile -> the encoders its config uses
+	encoders map[string][]string
+}
+
+// New opens the ledger and loads the profiles
+func New(opts Options) (*Server, error) {
+	opts.fill()
+	if e := opts.checkCurve(); e != nil {
+		return nil, e
+	}
+
+	if opts.Directory != "" {
+		opts.Directory = util.PathSanitize(opts.Directory)
+		if !util.PathIsDir(opts.Directory) {
+			return nil, fmt.Errorf("unable to find the directory: %v", opts.Directory)
+		}
+	}
+
+	opts.DirPriority = sanitizeDirs(opts.Directory, opts.DirPriority)
+	estimates := newEstimator(opts.Probe, opts.ProbeRunner)
+	less, e := estimates.orderBy(opts.Order, opts.DirPriority)
+	if e != nil {
+		return nil, e
+	}
+
+	srv := &Server{
+		opts:       opts,
+		sched:      newScheduler(opts.LeaseTTL, opts.RetryOtherWorker, less),
+		estimates:  estimates,
+		board:      newStatsBoard(),
+		metrics:    newServerMetrics(),
+		out:        make(chan outgoing, 1024),
+		routes:     map[string]string{},
+		cancelled:  map[string]bool{},
+		workers:    map[string]registration{},
+		splits:     map[string]*split{},
+		segment_of: map[string]segmentRef{},
+		committed:  map[string]protocol.Peer{},
+		lost:       map[lostCopy]bool{},
+		replies:    map[replyKey]*sentReply{},
+		encoders:   map[string][]string{},
+	}
+	srv.metrics.registerScheduler(srv.sched, srv.board)
+	srv.metrics.registerETA(srv.eta)
+
+	// load job states of the previous runs
+	srv.ldg, e = ledger.Open(opts.LedgerPath)
+	if e != nil {
+		return nil, fmt.Errorf("unable to open the ledger: %w", e)
+	}
+	entries := srv.ldg.Entries()
+	logrus.WithFields(logrus.Fields{
+		"path":     opts.LedgerPath,
+		"entries":  len(entries),
+		"measured": srv.estimates.seed(entries),
+	}).Infof("Ledger loaded")
+
+	// load transcoding profiles
+	if opts.ProfilesPath != "" {
+		srv.profiles, e = profile.Load(opts.ProfilesPath)
+		if e != nil {
+			srv.ldg.Close()
+			return nil, fmt.Errorf("unable to load the profiles: %w", e)
+		}
+		logrus.WithFields(logrus.Fields{
+			"path":     opts.ProfilesPath,
+			"profiles": len(srv.profiles.Profiles),
+			"rules":    len(srv.profiles.Rules),
+			"default":  srv.profiles.Default,
+		}).Infof("Profiles loaded")
+
+		for name, conf := range srv.profiles.Profiles {
+			srv.encoders[name] = conf.Encoders()
+			logrus.WithFields(logrus.Fields{"profile": name, "encoders": srv.encoders[name]}).Debugf("Profile needs encoders")
+		}
+	}
+
+	// load the routes of the files to the workers
+	if opts.RoutesPath != "" {
+		srv.route_table, e = routing.Load(opts.RoutesPath)
+		if e != nil {
+			srv.ldg.Close()
+			return nil, fmt.Errorf("unable to load the routes: %w", e)
+		}
+		logrus.WithFields(logrus.Fields{
+			"path":     opts.RoutesPath,
+			"routes":   len(srv.route_table.Routes),
+			"fallback": srv.route_table.Fallback.String(),
+		}).Infof("Routes loaded")
+	}
+
+	return srv, nil
+}
+
+// Scheduler gives the live queue and leases
+func (srv *Server) Scheduler() *Scheduler {
+	return srv.sched
+}
+
+// record writes the outcome reported by a worker to the ledger
+func (srv *Server) record(state ledger.State, req protocol.Request) {
+	srv.recordWork(state, req, 0)
+}
+
+// recordWork records the report with the work done, to measure the speed of
+// the worker again after a restart
+func (srv *Server) recordWork(state ledger.State, req protocol.Request, work float64) {
+	report := req.Report
+	_, e := srv.ldg.Update(report.Path, func(entry *ledger.Entry) {
+		entry.State = state
+		entry.Hostname = req.Worker.Hostname
+		entry.PID = req.Worker.PID
+		entry.FinishedAt = time.Now()
+		entry.ElapsedTime = time.Duration(report.Elapsed).Seconds()
+		entry.Work = work
+		entry.Error, entry.ErrorClass = "", ""
+		if report.Error != nil {
+			entry.Error = report.Error.Message
+			entry.ErrorClass = report.Error.Class
+		}
+	})
+	if e != nil {
+		logrus.WithFields(logrus.Fields{"path": report.Path, "error": e}).Errorf("Unable to update the ledger")
+	}
+	if state.IsTerminal() {
+		srv.estimates.forget(report.Path)
+	}
+}
+
+// retryDelay decides whether a failed job runs again and when.
+// Only transient failures are retried, with exponential backoff.
+func (srv *Server) retryDelay(fp, error_class string) (time.Duration, bool) {
+	if error_class != transcode.FailTransient {
+		return 0, false
+	}
+
+	entry, _ := srv.ldg.Get(fp)
+	if entry.Attempts >= srv.opts.RetryMax {
+		return 0, false
+	}
+
+	attempts := entry.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	return srv.opts.RetryBackoff * time.Duration(1<<uint(attempts-1)), true
+}
+
+// isWanted decides whether a file found on the disk should be queued
+func (srv *Server) isWanted(fp string, info os.FileInfo) bool {
+	if srv.sched.Contains(fp) || srv.splitting(fp) {
+		return false
+	}
+
+	// finished, failed or skipped before, and not modified since then
+	if entry, ok := srv.ldg.Get(fp); ok && entry.State.IsTerminal() && !info.ModTime().After(entry.FinishedAt) {
+		logrus.WithFields(logrus.Fields{"path": fp, "state": entry.State}).Tracef("Already handled")
+		return false
+	}
+
+	return true
+}
+
+// resolveProfile picks the transcoding profile of a file; "" leaves it to the worker
+func (srv *Server) resolveProfile(ctx context.Context, fp string) string {
+	if srv.profiles == nil {
+		return ""
+	}
+	name, e := srv.profiles.Resolve(ctx, srv.opts.ProbeRunner, fp)
+	if e != nil {
+		logrus.WithFields(logrus.Fields{"path": fp, "default": srv.profiles.Default, "error": e}).
+			Warnf("Unable to resolve the profile, use the default")
+		return srv.profiles.Default
+	}
+	return name
+}
+
+// finish releases the lease of a reported job and counts the report.
+// It tells whether the job was cancelled by Cancel.
+func (srv *Server) finish(req protocol.Request) bool {
+	report := req.Report
+	if !srv.sched.release(report.Path, req.Worker.Hostname, req.Worker.PID) {
+		logrus.WithFields(logrus.Fields{
+			"hostname": req.Worker.Hostname,
+			"pid":      req.Worker.PID,
+			"path":     report.Path,
+		}).Warnf("Got a report from a worker not holding the lease")
+	}
+	srv.metrics.observeReport(req.Kind, report)
+	srv.board.report(req.Worker.Hostname, req.Worker.PID, string(req.Kind), time.Duration(report.Elapsed).Seconds())
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.committed[report.Path] == req.Worker {
+		delete(srv.committed, report.Path)
+	}
+	cancelled := srv.cancelled[report.Path]
+	delete(srv.cancelled, report.Path)
+	return cancelled
+}
+
+// Enqueue queues a file which is not queued, leased or waiting for a retry yet.
+// Unlike the files found in Directory, it is queued again even if the ledger has
+// it as done. ctx bounds the probing of the file.
+func (srv *Server) Enqueue(ctx context.Context, fp string) bool {
+	fp = util.PathSanitize(fp)
+	if srv.sched.Contains(fp) || srv.splitting(fp) {
+		return false
+	}
+	srv.enqueue(ctx, fp)
+	return true
+}
+
+func (srv *Server) enqueue(ctx context.Context, fp string) {
+	profile_name := srv.resolveProfile(ctx, fp)
+	_, e := srv.ldg.Update(fp, func(entry *ledger.Entry) {
+		entry.State = ledger.StateQueued
+		entry.QueuedAt = time.Now()
+		entry.Profile = profile_name
+	})
+	if e != nil {
+		logrus.WithFields(logrus.Fields{"path": fp, "error": e}).Errorf("Unable to update the ledger")
+	}
+	cost := srv.estimates.add(ctx, fp, profile_name)
+	srv.sched.Push(fp)
+	logrus.WithFields(logrus.Fields{
+		"path":    fp,
+		"profile": profile_name,
+		"cost":    util.Atof(cost.work()),
+		"probed":  cost.probed,
+	}).Debugf("Enqueue")
+	srv.emit(Event{Kind: EventQueued, Path: fp, Profile: profile_name})
+}
+
+// seek searches the files recursively, once or until the context is done in the watch mode
+func (srv *Server) seek(ctx context.Context) {
+	dir := srv.opts.Directory
+	if srv.opts.Watch {
+		atomic.StoreInt32(&srv.scanning, 0)
+		logrus.WithFields(logrus.Fields{"path": dir, "settle": srv.opts.WatchSettle, "rescan": srv.opts.WatchRescan}).
+			Infof("Start to watch files recursively in the directory")
+		watchDirectory(ctx, dir, srv.opts.WatchSettle, srv.opts.WatchRescan, srv.isWanted, func(fp string) { srv.enqueue(ctx, fp) }, srv.cleanWorkDir)
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{"path": dir}).
+		Infof("Start to seek files recursively in the directory")
+
+	scanDirectory(ctx, dir, func(fp string, info os.FileInfo) {
+		if srv.isWanted(fp, info) {
+			srv.enqueue(ctx, fp)
+		}
+	}, srv.cleanWorkDir)
+	atomic.StoreInt32(&srv.scanning, 0)
+
+	logrus.WithFields(logrus.Fields{"path": dir}).
+		Infof("Complete to seek files recursively in the directory")
+}
+
+// job describes the path for the worker, with its profile
+func (srv *Server) job(fp string, task *protocol.Task) *protocol.Job {
+	result := &protocol.Job{
+		Path:  fp,
+		Lease: protocol.Duration(srv.opts.LeaseTTL),
+		Task:  task,
+	}
+	if entry, _ := srv.ldg.Get(fp); srv.profiles != nil && entry.Profile != "" {
+		conf, _ := srv.profiles.Config(entry.Profile)
+		result.Profile = entry.Profile
+		result.ProfileConfig = json.RawMessage(conf.Raw.Raw)
+	}
+	return result
+}
+
+// reap re-queues the paths whose lease expired and forgets the old replies
+func (srv *Server) reap(ctx context.Context) {
+	interval := time.Second
+	if srv.opts.LeaseTTL/4 < interval {
+		interval = srv.opts.LeaseTTL / 4
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		var now time.Time
+		select {
+		case <-ctx.Done():
+			return
+		case now = <-ticker.C:
+		}
+
+		srv.sched.promote(now)
+		srv.forgetReplies(now)
+		for _, l := range srv.sched.expire(now) {
+			if _, ok := segmentSource(l.Path); ok {
+				srv.segmentExpired(l, now)
+				continue
+			}
+			_, e := srv.ldg.Update(l.Path, func(entry *ledger.Entry) {
+				entry.State = ledger.StateQueued
+				entry.QueuedAt = now
+			})
+			if e != nil {
+				logrus.WithFields(logrus.Fields{"path": l.Path, "error": e}).Errorf("Unable to update the ledger")
+			}
+			logrus.WithFields(logrus.Fields{
+				"hostname":     l.Hostname,
+				"pid":          l.PID,
+				"path":         l.Path,
+				"elapsed_time": util.Atof(now.Sub(l.Start).Seconds()),
+			}).Warnf("Lease expired, re-queue")
+			srv.metrics.jobs.Inc("lease_expired")
+			srv.emit(Event{
+				Kind:     EventLeaseExpired,
+				Time:     now,
+				Path:     l.Path,
+				Hostname: l.Hostname,
+				PID:      l.PID,
+				Elapsed:  now.Sub(l.Start),
+			})
+		}
+	}
+}
+
+// announce wakes up idle workers when there is something new
+func (srv *Server) announce(ctx context.Context, pub *zmq4.Socket) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-srv.sched.wake:
+		}
+		pub.Send("work_available", 0)
+
+		// coalesce bursts, e.g. while walking the directory
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// response starts a reply of the master
+func (srv *Server) response() protocol.Response {
+	return protocol.Response{
+		Version: protocol.Version,
+		Master:  protocol.Peer{Hostname: srv.opts.Hostname, PID: srv.opts.PID},
+	}
+}
+
+// handle answers one request of a worker
+func (srv *Server) handle(req protocol.Request) protocol.Response {
+	res := srv.response()
+	worker := req.Worker
+	srv.board.seen(worker.Hostname, worker.PID)
+
+	// fields of the job reports
+	var fields logrus.Fields
+	if report := req.Report; report != nil {
+		fields = logrus.Fields{
+			"hostname":     worker.Hostname,
+			"pid":          worker.PID,
+			"path":         report.Path,
+			"elapsed_time": util.Atof(time.Duration(report.Elapsed).Seconds()),
+		}
+		if report.Error != nil {
+			fields["error_class"] = report.Error.Class
+		}
+	}
+
+	if report := req.Report; report != nil {
+		if _, ok := segmentSource(report.Path); ok {
+			res.OK = true
+			srv.segmentReport(req, fields)
+			return res
+		}
+		if srv.raceReport(req, fields) {
+			res.OK = true
+			return res
+		}
+	}
+
+	switch req.Kind {
+	case protocol.KindHello:
+		res.OK = true
+		srv.register(worker, registration{caps: req.Capabilities, labels: req.Labels})
+		hello_fields := logrus.Fields{
+			"hostname": worker.Hostname,
+			"pid":      worker.PID,
+			"version":  req.Version,
+			"labels":   routing.Labels(req.Labels).String(),
+		}
+		if caps := req.Capabilities; caps != nil {
+			hello_fields["cores"] = caps.Cores
+			hello_fields["memory"] = caps.Memory
+			hello_fields["temp_free"] = caps.TempFree
+			hello_fields["ffmpeg"] = caps.FFmpegVersion
+			hello_fields["encoders"] = len(caps.Encoders)
+		}
+		logrus.WithFields(hello_fields).Infof("Worker connected")
+
+	case protocol.KindJobWant:
+		reg, ok := srv.registered(worker)
+		if !ok {
+			// e.g. the master restarted; the worker says hello again first
+			res.Register = true
+			logrus.WithFields(logrus.Fields{"hostname": worker.Hostname, "pid": worker.PID}).
+				Infof("Got job request of an unknown worker, ask it to register")
+			break
+		}
+		eligible := func(fp string) bool { return srv.canRun(worker, reg, fp) }
+		if fp, ok := srv.sched.assign(worker.Hostname, worker.PID, eligible); ok {
+			res.OK = true
+			res.Job = srv.job(fp, srv.task(fp))
+			start_fields := logrus.Fields{"hostname": worker.Hostname, "pid": worker.PID, "path": fp}
+			if task := res.Job.Task; task != nil {
+				start_fields["task"] = task.Kind
+				// the segments are followed through their file
+				if task.Kind == protocol.TaskSegment {
+					logrus.WithFields(start_fields).Infof("Start")
+					break
+				}
+			}
+			_, e := srv.ldg.Update(fp, func(entry *ledger.Entry) {
+				entry.State = ledger.StateAssigned
+				entry.Hostname = worker.Hostname
+				entry.PID = worker.PID
+				entry.AssignedAt = time.Now()
+				entry.Attempts++
+			})
+			if e != nil {
+				logrus.WithFields(logrus.Fields{"path": fp, "error": e}).Errorf("Unable to update the ledger")
+			}
+			start_fields["profile"] = res.Job.Profile
+			logrus.WithFields(start_fields).Infof("Start")
+			srv.emit(Event{Kind: EventAssigned, Path: fp, Hostname: worker.Hostname, PID: worker.PID})
+		} else if fp, ok := srv.speculate(worker, reg); ok {
+			// the ledger keeps following the first copy
+			res.OK = true
+			res.Job = srv.job(fp, nil)
+			logrus.WithFields(logrus.Fields{
+				"hostname": worker.Hostname,
+				"pid":      worker.PID,
+				"path":     fp,
+				"profile":  res.Job.Profile,
+			}).Infof("Start a copy of a straggling job")
+			srv.emit(Event{Kind: EventSpeculated, Path: fp, Hostname: worker.Hostname, PID: worker.PID})
+		} else if srv.opts.Watch || srv.opts.Directory == "" || atomic.LoadInt32(&srv.scanning) == 1 || srv.sched.InFlight() > 0 {
+			// more files may show up later, or a running job may fail and be retried
+			wait := srv.opts.IdleWait
+			if retry_wait, ok := srv.sched.nextRetry(); ok && retry_wait < wait {
+				wait = retry_wait
+			}
+			res.RetryAfter = protocol.Duration(wait)
+			logrus.WithFields(logrus.Fields{
+				"hostname":    worker.Hostname,
+				"pid":         worker.PID,
+				"retry_after": wait,
+			}).Debugf("Got job request, but no job for now")
+		} else if wait, ok := srv.sched.nextRetry(); ok {
+			// not done yet, failed jobs are waiting for their retry
+			res.RetryAfter = protocol.Duration(wait)
+			logrus.WithFields(logrus.Fields{
+				"hostname":    worker.Hostname,
+				"pid":         worker.PID,
+				"retry_after": wait,
+			}).Debugf("Got job request, but only retries are left")
+		} else if queued := srv.sched.Snapshot().Queued; queued > 0 {
+			logrus.WithFields(logrus.Fields{
+				"hostname": worker.Hostname,
+				"pid":      worker.PID,
+				"queued":   queued,
+			}).Warnf("Got job request, but the worker cannot run any of the files left")
+		} else {
+			logrus.WithFields(logrus.Fields{
+				"hostname": worker.Hostname,
+				"pid":      worker.PID,
+			}).Warnf("Got job request, but no more job")
+		}
+
+	case protocol.KindHeartbeat:
+		res.OK = srv.sched.renew(req.Path, worker.Hostname, worker.PID)
+		if !res.OK {
+			logrus.WithFields(logrus.Fields{
+				"hostname": worker.Hostname,
+				"pid":      worker.PID,
+				"path":     req.Path,
+			}).Warnf("Got heartbeat for a lease the worker does not hold")
+		}
+
+	case protocol.KindCommit:
+		res.OK = srv.win(worker, req.Path)
+		if !res.OK {
+			logrus.WithFields(logrus.Fields{
+				"hostname": worker.Hostname,
+				"pid":      worker.PID,
+				"path":     req.Path,
+			}).Infof("Another copy finished first, keep the original")
+		}
+
+	case protocol.KindJobDone:
+		res.OK = true
+		cancelled := srv.finish(req)
+		if segments := req.Report.Stats.Segments; segments > 0 {
+			if cancelled {
+				os.RemoveAll(transcode.WorkDir(req.Report.Path))
+				srv.record(ledger.StateKilled, req)
+				logrus.WithFields(fields).Warnf("Split, but cancelled")
+				srv.emit(reportEvent(EventKilled, req))
+				break
+			}
+			// the file is done once its segments are merged
+			srv.startSegments(req.Report.Path, segments)
+			break
+		}
+		// the merge of a split file tells nothing about the speed of the worker
+		work := 0.0
+		if !srv.splitting(req.Report.Path) {
+			work = srv.estimates.observe(worker.String(), req.Report.Path, req.Report.Stats.MediaDuration, time.Duration(req.Report.Elapsed).Seconds())
+		}
+		srv.forgetSplit(req.Report.Path)
+		srv.recordWork(ledger.StateDone, req, work)
+		logrus.WithFields(fields).Infof("Complete")
+		srv.emit(reportEvent(EventDone, req))
+
+	case protocol.KindJobFail:
+		res.OK = true
+		srv.finish(req)
+		error_class := ""
+		if req.Report.Error != nil {
+			error_class = req.Report.Error.Class
+		}
+		ev := reportEvent(EventFailed, req)
+		if delay, ok := srv.retryDelay(req.Report.Path, error_class); ok {
+			srv.record(ledger.StateQueued, req)
+			srv.sched.retryLater(req.Report.Path, worker.Hostname, delay)
+			fields["retry_after"] = delay
+			logrus.WithFields(fields).Warnf("Failed, retry later")
+			ev.Retry, ev.RetryAfter = true, delay
+			srv.emit(ev)
+			break
+		}
+		srv.abandonSplit(req.Report.Path)
+		srv.record(ledger.StateFailed, req)
+		logrus.WithFields(fields).Warnf("Failed")
+		srv.emit(ev)
+
+	case protocol.KindJobSkip:
+		res.OK = true
+		srv.finish(req)
+		srv.abandonSplit(req.Report.Path)
+		srv.record(ledger.StateSkipped, req)
+		logrus.WithFields(fields).Warnf("Skipped")
+		srv.emit(reportEvent(EventSkipped, req))
+
+	case protocol.KindKilled:
+		res.OK = true
+		cancelled := srv.finish(req)
+		srv.record(ledger.StateKilled, req)
+		ev := reportEvent(EventKilled, req)
+		// the worker is gone, not the file, so it is always worth another try
+		// unless the job was cancelled on purpose
+		if delay, ok := srv.retryDelay(req.Report.Path, transcode.FailTransient); ok && !cancelled {
+			srv.sched.retryLater(req.Report.Path, worker.Hostname, delay)
+			ev.Retry, ev.RetryAfter = true, delay
+		} else {
+			srv.abandonSplit(req.Report.Path)
+		}
+		logrus.WithFields(fields).Warnf("Incomplete")
+		srv.emit(ev)
+
+	default:
+		res.Error = fmt.Sprintf("unknown request %q", req.Kind)
+		logrus.WithFields(logrus.Fields{
+			"hostname": worker.Hostname,
+			"pid":      worker.PID,
+			"req":      req.Kind,
+		}).Warnf("Got an unknown request")
+	}
+
+	return res
+}
+
+// how long a reply or a push may wait for the socket
+const flush_interval = 10 * time.Millisecond
+
+// outgoing is a message to the worker of a ROUTER identity
+type outgoing struct {
+	identity, payload string
+}
+
+// send queues a message for the socket; false if the queue is full. A message
+// which cannot be encoded is replaced by an error response.
+func (srv *Server) send(identity string, res protocol.Response) bool {
+	payload, e := protocol.Encode(res)
+	if e != nil {
+		logrus.WithFields(logrus.Fields{"identity": identity, "id": res.ID, "error": e}).Errorf("Unable to encode a message")
+		failure := srv.response()
+		failure.ID = res.ID
+		failure.Error = e.Error()
+		// a plain response always encodes
+		payload, _ = protocol.Encode(failure)
+	}
+
+	select {
+	case srv.out <- outgoing{identity: identity, payload: payload}:
+		return true
+	default:
+		logrus.WithFields(logrus.Fields{"identity": identity}).Errorf("Outgoing queue is full, drop a message")
+		return false
+	}
+}
+
+// push sends a message to a worker which has sent a request before
+func (srv *Server) push(worker protocol.Peer, push *protocol.Push) bool {
+	srv.mu.Lock()
+	identity, ok := srv.routes[worker.String()]
+	srv.mu.Unlock()
+	if !ok {
+		return false
+	}
+	res := srv.response()
+	res.Push = push
+	return srv.send(identity, res)
+}
+
+// Cancel asks the workers holding the lease of the file, or a copy of it, to
+// stop working on it. The file is recorded as killed and not retried. The
+// segments of a split file are cancelled all together. False if nobody holds it.
+func (srv *Server) Cancel(fp string) bool {
+	fp = util.PathSanitize(fp)
+	holders := srv.sched.holders(fp)
+	if len(holders) == 0 {
+		return srv.cancelSplit(fp)
+	}
+
+	srv.mu.Lock()
+	srv.cancelled[fp] = true
+	srv.mu.Unlock()
+
+	sent := false
+	for _, l := range holders {
+		logrus.WithFields(logrus.Fields{"hostname": l.Hostname, "pid": l.PID, "path": fp}).Infof("Cancel")
+		if srv.push(protocol.Peer{Hostname: l.Hostname, PID: l.PID}, &protocol.Push{Kind: protocol.PushCancel, Path: fp}) {
+			sent = true
+		}
+	}
+	return sent
+}
+
+// UpdateConfig sends a transcoding config to the workers, every one heard from if none is given.
+// The workers use it instead of their own for the next jobs without a profile.
+// It returns how many workers it was sent to.
+func (srv *Server) UpdateConfig(config []byte, workers ...protocol.Peer) (int, error) {
+	if _, e := transcode.ParseConfig(gjson.ParseBytes(config)); e != nil {
+		return 0, fmt.Errorf("invalid config: %w", e)
+	}
+
+	if len(workers) == 0 {
+		for _, ws := range srv.board.snapshot() {
+			workers = append(workers, protocol.Peer{Hostname: ws.Hostname, PID: ws.PID})
+		}
+	}
+	sent := 0
+	for _, worker := range workers {
+		if srv.push(worker, &protocol.Push{Kind: protocol.PushConfig, Config: config}) {
+			sent++
+		}
+	}
+	logrus.WithFields(logrus.Fields{"workers": sent}).Infof("Config updated")
+	return sent, nil
+}
+
+// reply answers one message of a worker
+func (srv *Server) reply(identity, recv_json string) protocol.Response {
+	req, e := protocol.DecodeRequest(recv_json)
+	if e != nil {
+		// e.g. a worker of an older or newer build
+		res := srv.response()
+		res.ID = req.ID
+		res.Error = e.Error()
+		logrus.WithFields(logrus.Fields{
+			"hostname": req.Worker.Hostname,
+			"pid":      req.Worker.PID,
+			"error":    e,
+		}).Warnf("Rejected a request")
+		return res
+	}
+
+	// the last identity of a worker; a reconnected worker has a new one
+	srv.mu.Lock()
+	srv.routes[req.Worker.String()] = identity
+	srv.mu.Unlock()
+
+	res := srv.once(identity, req)
+	res.ID = req.ID
+	return res
+}
+
+// serve answers the requests of the workers until the context is done.
+// Every request is handled on its own goroutine; only this one uses the socket.
+func (srv *Server) serve(ctx context.Context, sock *zmq4.Socket) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for ctx.Err() == nil {
+	flush:
+		for {
+			select {
+			case m := <-srv.out:
+				if _, e := sock.SendMessage(m.identity, m.payload); e != nil {
+					logrus.WithFields(logrus.Fields{"identity": m.identity, "error": e}).Warnf("Unable to send a message")
+				}
+			default:
+				break flush
+			}
+		}
+
+		frames, e := sock.RecvMessage(0)
+		if e != nil {
+			if zmq4.AsErrno(e) != zmq4.Errno(syscall.EAGAIN) {
+				logrus.WithFields(logrus.Fields{"error": e}).Errorf("Unable to receive a request")
+			}
+			continue
+		}
+		if len(frames) != 2 {
+			logrus.WithFields(logrus.Fields{"frames": len(frames)}).Warnf("Got a message of an unknown form")
+			continue
+		}
+
+		identity, recv_json := frames[0], frames[1]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			srv.send(identity, srv.reply(identity, recv_json))
+		}()
+	}
+}
+
+// Run serves the workers until the context is done, then closes the ledger
+func (srv *Server) Run(ctx context.Context) error {
+	defer srv.ldg.Close()
+
+	newSocket := zmq4.NewSocket
+	if srv.opts.ZMQ != nil {
+		newSocket = srv.opts.ZMQ.NewSocket
+	}
+	if srv.opts.CurveKeys.Secret != "" {
+		stop, e := srv.startCurve()
+		if e != nil {
+			return e
+		}
+		defer stop()
+	}
+
+	// create zeromq socket
+	sock, e := newSocket(zmq4.ROUTER)
+	if e != nil {
+		return fmt.Errorf("unable to create ZeroMQ socket: %w", e)
+	}
+	defer sock.Close()
+	sock.SetLinger(0)
+	// a worker resending a request reconnects with the same identity
+	sock.SetRouterHandover(true)
+	sock.SetRcvtimeo(flush_interval)
+	if e := srv.secure(sock); e != nil {
+		return e
+	}
+	if e := sock.Bind(srv.opts.Endpoint); e != nil {
+		return fmt.Errorf("unable to bind ZeroMQ socket to %v: %w", srv.opts.Endpoint, e)
+	}
+	logrus.WithFields(logrus.Fields{"endpoint": srv.opts.Endpoint}).Debugf("Bind")
+
+	var pub *zmq4.Socket
+	if srv.opts.NotifyEndpoint != "" {
+		if pub, e = newSocket(zmq4.PUB); e != nil {
+			return fmt.Errorf("unable to create ZeroMQ socket: %w", e)
+		}
+		defer pub.Close()
+		pub.SetLinger(0)
+		if e := srv.secure(pub); e != nil {
+			return e
+		}
+		if e := pub.Bind(srv.opts.NotifyEndpoint); e != nil {
+			return fmt.Errorf("unable to bind ZeroMQ socket to %v: %w", srv.opts.NotifyEndpoint, e)
+		}
+		logrus.WithFields(logrus.Fields{"endpoint": srv.opts.NotifyEndpoint}).Debugf("Bind")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	run := func(fn func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fn()
+		}()
+	}
+
+	if srv.opts.Directory != "" {
+		atomic.StoreInt32(&srv.scanning, 1)
+		run(func() { srv.seek(ctx) })
+	}
+	run(func() { srv.reap(ctx) })
+
+	// status API and dashboard
+	if srv.opts.HTTPAddr != "" {
+		run(func() {
+			if e := srv.serveHTTP(ctx, srv.opts.HTTPAddr); e != nil {
+				logrus.WithFields(logrus.Fields{"address": srv.opts.HTTPAddr, "error": e}).Errorf("Unable to serve HTTP")
+			}
+		})
+	}
+	if pub != nil {
+		run(func() { srv.announce(ctx, pub) })
+	}
+
+	// request handling server
+	srv.serve(ctx, sock)
+	wg.Wait()
+	return nil
+}
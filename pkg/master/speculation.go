@@ -0,0 +1,114 @@
+package master
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"github.com/sunrise2575/dist-ffmpeg/pkg/protocol"
+)
+
+// With Options.Speculate, a worker finding the queue empty gets a copy of the
+// longest running job instead, so one slow worker does not hold the end of a
+// batch back. The first copy to ask with KindCommit replaces the original; the
+// other copies are cancelled and their reports dropped.
+
+// lostCopy is a copy of a job which another worker finished first
+type lostCopy struct {
+	path, worker string
+}
+
+// speculate leases the worker a copy of the longest running job it can run.
+// Only jobs of whole files are copied, and not once a copy started replacing
+// the original.
+func (srv *Server) speculate(worker protocol.Peer, reg registration) (string, bool) {
+	if !srv.opts.Speculate {
+		return "", false
+	}
+	eligible := func(fp string) bool {
+		srv.mu.Lock()
+		_, committed := srv.committed[fp]
+		srv.mu.Unlock()
+		return !committed && srv.task(fp) == nil && srv.canRun(worker, reg, fp)
+	}
+	fp, ok := srv.sched.speculate(worker.Hostname, worker.PID, srv.opts.SpeculateAfter, eligible)
+	if ok {
+		srv.metrics.speculative.Inc("started")
+	}
+	return fp, ok
+}
+
+// win lets the worker replace the original of the file unless another copy of
+// the job did first. The other copies are cancelled.
+func (srv *Server) win(worker protocol.Peer, fp string) bool {
+	holders := srv.sched.holders(fp)
+
+	srv.mu.Lock()
+	if winner, ok := srv.committed[fp]; ok && winner != worker {
+		// unless the winner went silent in the meantime
+		for _, l := range holders {
+			if l.Hostname == winner.Hostname && l.PID == winner.PID {
+				srv.mu.Unlock()
+				return false
+			}
+		}
+	}
+	srv.committed[fp] = worker
+	srv.mu.Unlock()
+
+	for _, l := range holders {
+		loser := protocol.Peer{Hostname: l.Hostname, PID: l.PID}
+		if loser == worker || !srv.sched.release(fp, l.Hostname, l.PID) {
+			continue
+		}
+		srv.mu.Lock()
+		srv.lost[lostCopy{path: fp, worker: loser.String()}] = true
+		srv.mu.Unlock()
+
+		srv.metrics.speculative.Inc("lost")
+		logrus.WithFields(logrus.Fields{
+			"hostname": l.Hostname,
+			"pid":      l.PID,
+			"path":     fp,
+			"winner":   worker.String(),
+		}).Infof("Another copy finished first, cancel")
+		srv.push(loser, &protocol.Push{Kind: protocol.PushCancel, Path: fp})
+	}
+	return true
+}
+
+// raceReport drops the report of a copy which lost to another one, or which
+// did not succeed while another copy goes on. False for the other reports.
+func (srv *Server) raceReport(req protocol.Request, fields logrus.Fields) bool {
+	fp, worker := req.Report.Path, req.Worker
+	key := lostCopy{path: fp, worker: worker.String()}
+	srv.mu.Lock()
+	lost := srv.lost[key]
+	delete(srv.lost, key)
+	srv.mu.Unlock()
+	if lost {
+		logrus.WithFields(fields).Infof("Another copy finished first, drop the report")
+		return true
+	}
+
+	others := 0
+	for _, l := range srv.sched.holders(fp) {
+		if l.Hostname != worker.Hostname || l.PID != worker.PID {
+			others++
+		}
+	}
+	if others == 0 {
+		return false
+	}
+
+	// a worker not asking to commit, e.g. of its own Handler
+	if req.Kind == protocol.KindJobDone {
+		if srv.win(worker, fp) {
+			return false
+		}
+		logrus.WithFields(fields).Infof("Another copy finished first, drop the report")
+		return true
+	}
+
+	srv.sched.release(fp, worker.Hostname, worker.PID)
+	logrus.WithFields(fields).Warnf("A copy did not succeed, the other one goes on")
+	return true
+}
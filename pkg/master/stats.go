@@ -0,0 +1,149 @@
+package master
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sunrise2575/dist-ffmpeg/pkg/protocol"
+)
+
+type workerStats struct {
+	Hostname    string    `json:"hostname"`
+	PID         string    `json:"pid"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+	Done        int       `json:"done"`
+	Failed      int       `json:"failed"`
+	Skipped     int       `json:"skipped"`
+	Killed      int       `json:"killed"`
+	BusySeconds float64   `json:"busy_seconds"`
+
+	// registered with the hello of the worker
+	Capabilities *protocol.Capabilities `json:"capabilities,omitempty"`
+	Labels       map[string]string      `json:"labels,omitempty"`
+	// profile -> the encoders it needs which the worker lacks
+	MissingEncoders map[string][]string `json:"missing_encoders,omitempty"`
+}
+
+// statsBoard keeps per-worker counters of the current master run
+type statsBoard struct {
+	mu      sync.Mutex
+	started time.Time
+	workers map[string]*workerStats
+}
+
+func newStatsBoard() *statsBoard {
+	return &statsBoard{
+		started: time.Now(),
+		workers: map[string]*workerStats{},
+	}
+}
+
+// worker must be called with the lock held
+func (b *statsBoard) worker(hostname, pid string) *workerStats {
+	key := hostname + "/" + pid
+	w, ok := b.workers[key]
+	if !ok {
+		now := time.Now()
+		w = &workerStats{
+			Hostname:  hostname,
+			PID:       pid,
+			FirstSeen: now,
+			LastSeen:  now,
+		}
+		b.workers[key] = w
+	}
+	return w
+}
+
+func (b *statsBoard) seen(hostname, pid string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.worker(hostname, pid).LastSeen = time.Now()
+}
+
+// register keeps the capabilities and the labels of a worker which said hello
+func (b *statsBoard) register(hostname, pid string, caps *protocol.Capabilities, labels map[string]string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	w := b.worker(hostname, pid)
+	w.Capabilities = caps
+	w.Labels = labels
+	w.MissingEncoders = nil
+}
+
+// lacking notes the encoders of a profile the worker lacks; false if already noted
+func (b *statsBoard) lacking(hostname, pid, profile_name string, missing []string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	w := b.worker(hostname, pid)
+	if _, ok := w.MissingEncoders[profile_name]; ok {
+		return false
+	}
+	if w.MissingEncoders == nil {
+		w.MissingEncoders = map[string][]string{}
+	}
+	w.MissingEncoders[profile_name] = missing
+	return true
+}
+
+// report counts a job outcome of the worker; outcome is the request name
+func (b *statsBoard) report(hostname, pid, outcome string, elapsed float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	w := b.worker(hostname, pid)
+	w.LastSeen = time.Now()
+	w.BusySeconds += elapsed
+	switch outcome {
+	case "job_done":
+		w.Done++
+	case "job_fail":
+		w.Failed++
+	case "job_skip":
+		w.Skipped++
+	case "killed":
+		w.Killed++
+	}
+}
+
+func (b *statsBoard) snapshot() []workerStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	result := make([]workerStats, 0, len(b.workers))
+	for _, w := range b.workers {
+		ws := *w
+		if w.MissingEncoders != nil {
+			ws.MissingEncoders = map[string][]string{}
+			for profile_name, missing := range w.MissingEncoders {
+				ws.MissingEncoders[profile_name] = missing
+			}
+		}
+		result = append(result, ws)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Hostname != result[j].Hostname {
+			return result[i].Hostname < result[j].Hostname
+		}
+		return result[i].PID < result[j].PID
+	})
+	return result
+}
+
+// active counts the workers heard from within the window
+func (b *statsBoard) active(now time.Time, window time.Duration) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	count := 0
+	for _, w := range b.workers {
+		if now.Sub(w.LastSeen) <= window {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,201 @@
+package master
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/transcode"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/util"
+)
+
+var (
+	ext_exclude  = util.Slice2Map([]string{".7z", ".rar", ".zip", ".tar", ".lzh", ".bin", ".cue", ".md5", ".mds", ".mdf", ".log", ".txt", ".lrc", ".exe", ".md", ".py", ".sample", ".go", ".mod", ".sum", ".json", ".sh", ".gitignore"})
+	ext_subtitle = util.Slice2Map([]string{".smi", ".srt", ".vtt", ".ass"})
+	ext_video    = util.Slice2Map([]string{".webm"})
+	ext_audio    = util.Slice2Map([]string{".ogg"})
+	ext_image    = util.Slice2Map([]string{".png"})
+)
+
+// isCandidate is the file path sanity check; it drops non-media files and
+// files which are already in the target format
+func isCandidate(fp string) bool {
+	_, name, ext := util.PathSplit(fp)
+	if len(ext) < 2 {
+		return false
+	}
+
+	if len(name) > 0 && name[0] == '.' {
+		return false
+	}
+
+	// a segment of a file split across workers
+	if _, ok := segmentSource(fp); ok {
+		return false
+	}
+
+	ext = strings.ToLower(ext)
+
+	if ext_exclude[ext] || ext_subtitle[ext] {
+		return false
+	}
+
+	if ext_video[ext] || ext_audio[ext] || ext_image[ext] {
+		return false
+	}
+
+	return true
+}
+
+// scanDirectory calls fn for every candidate file under the directory and
+// on_work_dir for every segment work directory, which it does not go into,
+// stopping early when the context is done
+func scanDirectory(ctx context.Context, dir string, fn, on_work_dir func(fp string, info os.FileInfo)) {
+	filepath.Walk(dir, func(fp string, info os.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"path": fp, "error": err}).Warnf("Unable to access")
+			return nil
+		}
+		if info.IsDir() {
+			if _, ok := transcode.SourceOfWorkDir(fp); ok {
+				on_work_dir(fp, info)
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !isCandidate(fp) {
+			return nil
+		}
+		fn(fp, info)
+		return nil
+	})
+}
+
+type candidate struct {
+	size         int64
+	mod_time     time.Time
+	stable_since time.Time
+}
+
+// settler holds new or modified files until their size and mtime stop
+// changing for the settle time, so half-copied downloads are not picked up
+type settler struct {
+	mu      sync.Mutex
+	settle  time.Duration
+	pending map[string]*candidate
+}
+
+func newSettler(settle time.Duration) *settler {
+	return &settler{
+		settle:  settle,
+		pending: map[string]*candidate{},
+	}
+}
+
+func (s *settler) observe(fp string, info os.FileInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.pending[fp]
+	if ok && c.size == info.Size() && c.mod_time.Equal(info.ModTime()) {
+		return
+	}
+	s.pending[fp] = &candidate{
+		size:         info.Size(),
+		mod_time:     info.ModTime(),
+		stable_since: time.Now(),
+	}
+}
+
+// ready returns the files which have been stable long enough
+func (s *settler) ready(now time.Time) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := []string{}
+	for fp, c := range s.pending {
+		info, e := os.Stat(fp)
+		if e != nil {
+			// removed or renamed while waiting
+			delete(s.pending, fp)
+			continue
+		}
+		if info.Size() != c.size || !info.ModTime().Equal(c.mod_time) {
+			c.size, c.mod_time, c.stable_since = info.Size(), info.ModTime(), now
+			continue
+		}
+		if now.Sub(c.stable_since) >= s.settle {
+			result = append(result, fp)
+			delete(s.pending, fp)
+		}
+	}
+	return result
+}
+
+// watchDirectory keeps feeding new or modified files under the directory
+// to enqueue until the context is done; the segment work directories found by
+// every rescan are passed to on_work_dir
+func watchDirectory(ctx context.Context, dir string, settle, rescan time.Duration, wanted func(fp string, info os.FileInfo) bool, enqueue func(fp string), on_work_dir func(dp string, info os.FileInfo)) {
+	stl := newSettler(settle)
+	observe := func(fp string, info os.FileInfo) {
+		if wanted(fp, info) {
+			stl.observe(fp, info)
+		}
+	}
+
+	rescan_now := make(chan struct{}, 1)
+	notify, e := newNotifier()
+	if e != nil {
+		logrus.WithFields(logrus.Fields{"error": e}).Warnf("File system events are unavailable, rely on periodic rescan")
+	} else {
+		go notify.run(ctx, dir, func(fp string) {
+			info, e := os.Stat(fp)
+			if e != nil || info.IsDir() || !isCandidate(fp) {
+				return
+			}
+			observe(fp, info)
+		}, func() {
+			select {
+			case rescan_now <- struct{}{}:
+			default:
+			}
+		})
+	}
+
+	check_interval := settle / 4
+	if check_interval < time.Second {
+		check_interval = time.Second
+	}
+	check := time.NewTicker(check_interval)
+	defer check.Stop()
+	rescan_tick := time.NewTicker(rescan)
+	defer rescan_tick.Stop()
+
+	scan := func() {
+		logrus.WithFields(logrus.Fields{"path": dir}).Debugf("Rescan the directory")
+		scanDirectory(ctx, dir, observe, on_work_dir)
+	}
+	scan()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-check.C:
+			for _, fp := range stl.ready(now) {
+				enqueue(fp)
+			}
+		case <-rescan_tick.C:
+			scan()
+		case <-rescan_now:
+			scan()
+		}
+	}
+}
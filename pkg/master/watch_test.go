@@ -0,0 +1,137 @@
+package master
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/sunrise2575/dist-ffmpeg/pkg/transcode"
+)
+
+func TestIsCandidate(t *testing.T) {
+	dir := t.TempDir()
+	cases := map[string]bool{
+		"movie.mkv":  true,
+		"song.flac":  true,
+		"photo.jpg":  true,
+		"notes.txt":  false,
+		"movie.srt":  false,
+		"movie.ZIP":  false,
+		".movie.mkv": false,
+		// already in the target format
+		"movie.webm": false,
+		"song.ogg":   false,
+		"photo.png":  false,
+		// without an extension
+		"README": false,
+	}
+	for name, want := range cases {
+		if got := isCandidate(filepath.Join(dir, name)); got != want {
+			t.Errorf("%v: %v, want %v", name, got, want)
+		}
+	}
+	if isCandidate(transcode.SegmentPath(filepath.Join(dir, "movie.mkv"), 0)) {
+		t.Error("a segment is a candidate")
+	}
+}
+
+func TestScanDirectory(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.mkv", "sub/b.mp3", "sub/notes.txt", "sub/.c.mkv", ".d.mkv.segments/segment_0.mkv"} {
+		fp := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(fp), 0755)
+		if e := os.WriteFile(fp, []byte(name), 0644); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	found, work_dirs := []string{}, []string{}
+	scanDirectory(context.Background(), dir, func(fp string, info os.FileInfo) {
+		found = append(found, fp)
+	}, func(dp string, info os.FileInfo) {
+		work_dirs = append(work_dirs, dp)
+	})
+	sort.Strings(found)
+	if want := fmt.Sprint([]string{filepath.Join(dir, "a.mkv"), filepath.Join(dir, "sub/b.mp3")}); fmt.Sprint(found) != want {
+		t.Errorf("found %v, want %v", found, want)
+	}
+	if len(work_dirs) != 1 || work_dirs[0] != filepath.Join(dir, ".d.mkv.segments") {
+		t.Errorf("work directories %v", work_dirs)
+	}
+}
+
+// observeFile feeds the settler with the current state of the file
+func observeFile(t *testing.T, s *settler, fp string) {
+	t.Helper()
+	info, e := os.Stat(fp)
+	if e != nil {
+		t.Fatal(e)
+	}
+	s.observe(fp, info)
+}
+
+func TestSettlerReadyOnceStable(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "a.mkv")
+	os.WriteFile(fp, []byte("a"), 0644)
+	s := newSettler(time.Minute)
+	observeFile(t, s, fp)
+
+	now := time.Now()
+	if ready := s.ready(now); len(ready) != 0 {
+		t.Errorf("ready at once: %v", ready)
+	}
+	if ready := s.ready(now.Add(time.Minute)); len(ready) != 1 || ready[0] != fp {
+		t.Errorf("ready after the settle time: %v", ready)
+	}
+	// handed out once
+	if ready := s.ready(now.Add(2 * time.Minute)); len(ready) != 0 {
+		t.Errorf("ready again: %v", ready)
+	}
+}
+
+func TestSettlerWaitsForGrowingFile(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "a.mkv")
+	os.WriteFile(fp, []byte("a"), 0644)
+	s := newSettler(time.Minute)
+	observeFile(t, s, fp)
+
+	// still being copied when the settle time is over
+	os.WriteFile(fp, []byte("more"), 0644)
+	later := time.Now().Add(time.Minute)
+	if ready := s.ready(later); len(ready) != 0 {
+		t.Errorf("ready while growing: %v", ready)
+	}
+	if ready := s.ready(later.Add(time.Minute / 2)); len(ready) != 0 {
+		t.Errorf("ready before the settle time since the last change: %v", ready)
+	}
+	if ready := s.ready(later.Add(time.Minute)); len(ready) != 1 {
+		t.Errorf("not ready once stable: %v", ready)
+	}
+
+	// an event of the same state does not start the wait again
+	os.WriteFile(fp, []byte("a"), 0644)
+	observeFile(t, s, fp)
+	observeFile(t, s, fp)
+	if ready := s.ready(time.Now().Add(time.Minute)); len(ready) != 1 {
+		t.Errorf("not ready after events without a change: %v", ready)
+	}
+}
+
+func TestSettlerDropsRemovedFile(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "a.mkv")
+	os.WriteFile(fp, []byte("a"), 0644)
+	s := newSettler(time.Minute)
+	observeFile(t, s, fp)
+
+	os.Remove(fp)
+	if ready := s.ready(time.Now().Add(time.Minute)); len(ready) != 0 {
+		t.Errorf("ready after removed: %v", ready)
+	}
+	if len(s.pending) != 0 {
+		t.Errorf("still pending: %v", s.pending)
+	}
+}
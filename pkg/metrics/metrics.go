@@ -0,0 +1,312 @@
+// Package metrics is a small Prometheus text exposition of counters, gauges
+// and histograms, enough to be scraped without any client library.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// for durations from a second to a few hours
+	DurationBuckets = []float64{1, 5, 15, 30, 60, 120, 300, 600, 1200, 1800, 3600, 7200, 14400}
+	// for the media duration / wall time ratio
+	RatioBuckets = []float64{0.1, 0.25, 0.5, 0.75, 1, 1.5, 2, 4, 8, 16, 32}
+)
+
+type family interface {
+	write(w *bufio.Writer)
+}
+
+type Registry struct {
+	mu       sync.Mutex
+	families []family
+	names    map[string]bool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names: map[string]bool{}}
+}
+
+// register exports the family; a second one of the same name still counts
+// but is left out of the exposition, which would be rejected otherwise
+func (r *Registry) register(name string, f family) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.names[name] {
+		logrus.WithFields(logrus.Fields{"name": name}).Errorf("Duplicated metric name, not exported")
+		return
+	}
+	r.names[name] = true
+	r.families = append(r.families, f)
+}
+
+// WriteText writes every metric in the Prometheus text format
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	families := append([]family{}, r.families...)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		f.write(bw)
+	}
+	return bw.Flush()
+}
+
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteText(w)
+	})
+}
+
+type series struct {
+	values []string
+	key    string
+}
+
+type vec struct {
+	name, help, kind string
+	labels           []string
+
+	mu     sync.Mutex
+	series map[string]*series
+	order  []string
+}
+
+func newVec(name, help, kind string, labels []string) vec {
+	return vec{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		series: map[string]*series{},
+	}
+}
+
+// lookup must be called with the lock held; nil if the number of values is
+// not the one of the labels, in which case the sample is dropped
+func (v *vec) lookup(values []string) *series {
+	if len(values) != len(v.labels) {
+		logrus.WithFields(logrus.Fields{
+			"name":   v.name,
+			"labels": v.labels,
+			"values": values,
+		}).Errorf("Wrong number of label values, the sample is dropped")
+		return nil
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{values: append([]string{}, values...), key: key}
+		v.series[key] = s
+		v.order = append(v.order, key)
+		sort.Strings(v.order)
+	}
+	return s
+}
+
+func (v *vec) header(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, escapeHelp(v.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, v.kind)
+}
+
+func (v *vec) labelText(values []string, extra ...string) string {
+	pairs := []string{}
+	for i, l := range v.labels {
+		pairs = append(pairs, l+`="`+escapeLabel(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escapeLabel(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+type CounterVec struct {
+	vec
+	counts map[string]float64
+}
+
+func (r *Registry) NewCounter(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{vec: newVec(name, help, "counter", labels), counts: map[string]float64{}}
+	r.register(name, c)
+	return c
+}
+
+// Add increases the counter of the label values; negative values are ignored
+func (c *CounterVec) Add(value float64, label_values ...string) {
+	if value < 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s := c.lookup(label_values); s != nil {
+		c.counts[s.key] += value
+	}
+}
+
+func (c *CounterVec) Inc(label_values ...string) {
+	c.Add(1, label_values...)
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.header(w)
+	for _, key := range c.order {
+		s := c.series[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelText(s.values), formatFloat(c.counts[key]))
+	}
+}
+
+type GaugeVec struct {
+	vec
+	gauges map[string]float64
+	fn     func() float64
+}
+
+func (r *Registry) NewGauge(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{vec: newVec(name, help, "gauge", labels), gauges: map[string]float64{}}
+	r.register(name, g)
+	return g
+}
+
+// NewGaugeFunc is a gauge without labels whose value is taken on every scrape
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) *GaugeVec {
+	g := &GaugeVec{vec: newVec(name, help, "gauge", nil), gauges: map[string]float64{}, fn: fn}
+	r.register(name, g)
+	return g
+}
+
+func (g *GaugeVec) Set(value float64, label_values ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if s := g.lookup(label_values); s != nil {
+		g.gauges[s.key] = value
+	}
+}
+
+func (g *GaugeVec) Add(value float64, label_values ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if s := g.lookup(label_values); s != nil {
+		g.gauges[s.key] += value
+	}
+}
+
+func (g *GaugeVec) write(w *bufio.Writer) {
+	if g.fn != nil {
+		// outside of the lock, fn may take other locks
+		value := g.fn()
+		g.Set(value)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.header(w)
+	for _, key := range g.order {
+		s := g.series[key]
+		fmt.Fprintf(w, "%s%s %s\n", g.name, g.labelText(s.values), formatFloat(g.gauges[key]))
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+type HistogramVec struct {
+	vec
+	buckets    []float64
+	histograms map[string]*histogram
+}
+
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	sorted := append([]float64{}, buckets...)
+	sort.Float64s(sorted)
+	h := &HistogramVec{
+		vec:        newVec(name, help, "histogram", labels),
+		buckets:    sorted,
+		histograms: map[string]*histogram{},
+	}
+	r.register(name, h)
+	return h
+}
+
+func (h *HistogramVec) Observe(value float64, label_values ...string) {
+	if math.IsNaN(value) {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := h.lookup(label_values)
+	if s == nil {
+		return
+	}
+	hist, ok := h.histograms[s.key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.histograms[s.key] = hist
+	}
+	for i, upper := range h.buckets {
+		if value <= upper {
+			hist.counts[i]++
+		}
+	}
+	hist.count++
+	hist.sum += value
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.header(w)
+	for _, key := range h.order {
+		s := h.series[key]
+		hist := h.histograms[key]
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelText(s.values, "le", formatFloat(upper)), hist.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelText(s.values, "le", "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelText(s.values), formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelText(s.values), hist.count)
+	}
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func escapeHelp(text string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(text)
+}
+
+func escapeLabel(text string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(text)
+}
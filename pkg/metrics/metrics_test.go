@@ -0,0 +1,93 @@
+package metrics
+
+import (
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const test_golden = `# HELP test_jobs_total Jobs by "status", a\\b\nnext line
+# TYPE test_jobs_total counter
+test_jobs_total{status="done",path="/a \"b\" \\c\nd"} 1
+test_jobs_total{status="done",path="plain"} 2.5
+test_jobs_total{status="failed",path="plain"} 1
+# HELP test_busy Busy workers
+# TYPE test_busy gauge
+test_busy 3
+# HELP test_queued Queued files
+# TYPE test_queued gauge
+test_queued 7
+# HELP test_duration_seconds Job duration
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{kind="video",le="1"} 2
+test_duration_seconds_bucket{kind="video",le="5"} 3
+test_duration_seconds_bucket{kind="video",le="+Inf"} 4
+test_duration_seconds_sum{kind="video"} 16.5
+test_duration_seconds_count{kind="video"} 4
+test_duration_seconds_bucket{kind="x=\"y\"",le="1"} 0
+test_duration_seconds_bucket{kind="x=\"y\"",le="5"} 0
+test_duration_seconds_bucket{kind="x=\"y\"",le="+Inf"} 1
+test_duration_seconds_sum{kind="x=\"y\""} +Inf
+test_duration_seconds_count{kind="x=\"y\""} 1
+`
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+	jobs := r.NewCounter("test_jobs_total", "Jobs by \"status\", a\\b\nnext line", "status", "path")
+	busy := r.NewGauge("test_busy", "Busy workers")
+	r.NewGaugeFunc("test_queued", "Queued files", func() float64 { return 7 })
+	// the buckets are sorted
+	duration := r.NewHistogram("test_duration_seconds", "Job duration", []float64{5, 1}, "kind")
+
+	jobs.Inc("failed", "plain")
+	jobs.Add(2.5, "done", "plain")
+	jobs.Inc("done", "/a \"b\" \\c\nd")
+	jobs.Add(-1, "done", "plain")
+	busy.Set(1)
+	busy.Add(2)
+	for _, v := range []float64{0.5, 5, 1, 10, math.NaN()} {
+		duration.Observe(v, "video")
+	}
+	duration.Observe(math.Inf(1), `x="y"`)
+
+	var b strings.Builder
+	if e := r.WriteText(&b); e != nil {
+		t.Fatal(e)
+	}
+	if got := b.String(); got != test_golden {
+		t.Errorf("exposition\n%s\nwant\n%s", got, test_golden)
+	}
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Body.String() != test_golden || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("handler %v %q", rec.Header(), rec.Body.String())
+	}
+}
+
+func TestMisuseDoesNotPanic(t *testing.T) {
+	r := NewRegistry()
+	jobs := r.NewCounter("test_jobs_total", "Jobs", "status")
+	// a second family of the same name counts but is not exported
+	again := r.NewGauge("test_jobs_total", "Jobs again")
+	again.Set(5)
+
+	// the samples with a wrong number of label values are dropped
+	jobs.Inc()
+	jobs.Inc("done", "extra")
+	jobs.Inc("done")
+	r.NewHistogram("test_duration_seconds", "Job duration", []float64{1}).Observe(1, "video")
+
+	var b strings.Builder
+	r.WriteText(&b)
+	want := `# HELP test_jobs_total Jobs
+# TYPE test_jobs_total counter
+test_jobs_total{status="done"} 1
+# HELP test_duration_seconds Job duration
+# TYPE test_duration_seconds histogram
+`
+	if got := b.String(); got != want {
+		t.Errorf("exposition\n%s\nwant\n%s", got, want)
+	}
+}
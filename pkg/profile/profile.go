@@ -0,0 +1,189 @@
+package profile
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dlclark/regexp2"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/ffprobe"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/runner"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/transcode"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/util"
+	"github.com/tidwall/gjson"
+)
+
+// Rule selects a profile for a file. Every condition given must hold:
+//   - dir:   the file is under this directory, relative to the profile set file
+//   - path:  the full path matches this regex
+//   - probe: at least one stream matches all of these field regexes,
+//     the same shape as "skip_if" of a transcoding config
+type Rule struct {
+	Profile string
+	Dir     string
+	Path    *regexp2.Regexp
+	Probe   map[string]*regexp2.Regexp
+}
+
+// Set is the collection of transcoding profiles owned by the master
+//
+//	{
+//	  "profiles": {"anime": "./config-anime.json", "movie": {...}},
+//	  "rules": [
+//	    {"profile": "anime", "dir": "/mnt/media/anime"},
+//	    {"profile": "movie", "probe": {"codec_type": "^video$", "height": "^(1080|2160)$"}}
+//	  ],
+//	  "default": "movie"
+//	}
+//
+// A profile is a transcoding config given inline or as a file path relative
+// to the profile set file; either may use "extends" and "include".
+// The first matching rule wins.
+type Set struct {
+	Profiles map[string]*transcode.Config
+	Rules    []Rule
+	Default  string
+}
+
+func compile(regex string) (*regexp2.Regexp, error) {
+	re, e := regexp2.Compile(regex, 0)
+	if e != nil {
+		return nil, fmt.Errorf("invalid regex %q: %v", regex, e)
+	}
+	return re, nil
+}
+
+func Load(fp string) (*Set, error) {
+	root, e := util.ReadJSONFile(fp)
+	if e != nil {
+		return nil, e
+	}
+	if !root.IsObject() {
+		return nil, fmt.Errorf("%v is not a JSON object", fp)
+	}
+
+	set := &Set{
+		Profiles: map[string]*transcode.Config{},
+		Default:  root.Get("default").String(),
+	}
+
+	base := filepath.Dir(fp)
+	for name, v := range root.Get("profiles").Map() {
+		var raw gjson.Result
+		if v.Type == gjson.String {
+			conf_fp := v.String()
+			if !filepath.IsAbs(conf_fp) {
+				conf_fp = filepath.Join(base, conf_fp)
+			}
+			raw, e = transcode.ResolveConfigFile(conf_fp)
+		} else {
+			raw, e = transcode.ResolveConfig(v, base)
+		}
+		if e != nil {
+			return nil, fmt.Errorf("profile %q: %v", name, e)
+		}
+		conf, e := transcode.ParseConfig(raw)
+		if e != nil {
+			return nil, fmt.Errorf("profile %q: %v", name, e)
+		}
+		set.Profiles[name] = conf
+	}
+
+	if _, ok := set.Profiles[set.Default]; set.Default != "" && !ok {
+		return nil, fmt.Errorf("default profile %q is not defined", set.Default)
+	}
+
+	for i, v := range root.Get("rules").Array() {
+		rule := Rule{
+			Profile: v.Get("profile").String(),
+			Dir:     v.Get("dir").String(),
+		}
+		if _, ok := set.Profiles[rule.Profile]; !ok {
+			return nil, fmt.Errorf("rule %v: profile %q is not defined", i, rule.Profile)
+		}
+		if rule.Dir != "" {
+			if !filepath.IsAbs(rule.Dir) {
+				rule.Dir = filepath.Join(base, rule.Dir)
+			}
+			rule.Dir = util.PathSanitize(rule.Dir)
+		}
+		if v.Get("path").Exists() {
+			if rule.Path, e = compile(v.Get("path").String()); e != nil {
+				return nil, fmt.Errorf("rule %v: %v", i, e)
+			}
+		}
+		if v.Get("probe").Exists() {
+			rule.Probe = map[string]*regexp2.Regexp{}
+			probe := v.Get("probe")
+			for key := range util.FlattenJSONKey(probe) {
+				if rule.Probe[key], e = compile(probe.Get(key).String()); e != nil {
+					return nil, fmt.Errorf("rule %v: %v", i, e)
+				}
+			}
+		}
+		set.Rules = append(set.Rules, rule)
+	}
+
+	return set, nil
+}
+
+func match(re *regexp2.Regexp, target string) bool {
+	matched, e := re.MatchString(target)
+	return e == nil && matched
+}
+
+func (rule *Rule) matchStreams(streams []gjson.Result) bool {
+	for _, stream := range streams {
+		all := true
+		for key, re := range rule.Probe {
+			if !match(re, stream.Get(key).String()) {
+				all = false
+				break
+			}
+		}
+		if all {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve returns the name of the profile for the file, or "" if nothing matches
+// and there is no default. The file is probed through r, the real ffprobe if nil,
+// only when a probe rule is reached.
+func (set *Set) Resolve(ctx context.Context, r runner.Runner, fp string) (string, error) {
+	var streams []gjson.Result
+	probed := false
+
+	for _, rule := range set.Rules {
+		if rule.Dir != "" && fp != rule.Dir && !strings.HasPrefix(fp, rule.Dir+string(os.PathSeparator)) {
+			continue
+		}
+		if rule.Path != nil && !match(rule.Path, fp) {
+			continue
+		}
+		if rule.Probe != nil {
+			if !probed {
+				var e error
+				if streams, e = ffprobe.StreamInfoJSON(ctx, r, fp); e != nil {
+					return "", e
+				}
+				probed = true
+			}
+			if !rule.matchStreams(streams) {
+				continue
+			}
+		}
+		return rule.Profile, nil
+	}
+
+	return set.Default, nil
+}
+
+// Config is the transcoding config of the profile
+func (set *Set) Config(name string) (*transcode.Config, bool) {
+	conf, ok := set.Profiles[name]
+	return conf, ok
+}
@@ -0,0 +1,164 @@
+package profile
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sunrise2575/dist-ffmpeg/pkg/runner"
+)
+
+const test_streams = `{"streams": [
+	{"index": 0, "codec_type": "video", "codec_name": "h264", "height": 1080},
+	{"index": 1, "codec_type": "subtitle", "codec_name": "ass"}
+]}`
+
+// load writes the profile set and the files next to it into a directory
+func load(t *testing.T, set string, files map[string]string) (*Set, string) {
+	t.Helper()
+	dir := t.TempDir()
+	files["profiles.json"] = set
+	for name, content := range files {
+		fp := filepath.Join(dir, name)
+		if e := os.MkdirAll(filepath.Dir(fp), 0755); e != nil {
+			t.Fatal(e)
+		}
+		if e := os.WriteFile(fp, []byte(content), 0644); e != nil {
+			t.Fatal(e)
+		}
+	}
+	result, e := Load(filepath.Join(dir, "profiles.json"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	return result, dir
+}
+
+func TestLoadRelativePaths(t *testing.T) {
+	// run from elsewhere, so a path relative to the working directory would be wrong
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+
+	set, dir := load(t, `{
+		"profiles": {
+			"anime": "conf/anime.json",
+			"movie": {"extends": "conf/base.json", "video": {"target_ext": "mkv"}}
+		},
+		"rules": [
+			{"profile": "anime", "dir": "media/anime"},
+			{"profile": "movie", "dir": "/mnt/movie/"}
+		]
+	}`, map[string]string{
+		"conf/base.json":  `{"video": {"ffmpeg_param": "-c:v libx265", "target_ext": "mp4"}}`,
+		"conf/anime.json": `{"extends": "base.json", "video": {"ffmpeg_param": "-c:v libsvtav1"}}`,
+	})
+
+	if got, want := set.Rules[0].Dir, filepath.Join(dir, "media/anime"); got != want {
+		t.Errorf("relative dir %q, want %q", got, want)
+	}
+	if got := set.Rules[1].Dir; got != "/mnt/movie" {
+		t.Errorf("absolute dir %q", got)
+	}
+	if conf, _ := set.Config("anime"); conf.Raw.Get("video.ffmpeg_param").String() != "-c:v libsvtav1" || conf.Section("video").TargetExt != "mp4" {
+		t.Errorf("anime profile %v", conf.Raw.Raw)
+	}
+	if conf, _ := set.Config("movie"); conf.Raw.Get("video.ffmpeg_param").String() != "-c:v libx265" || conf.Section("video").TargetExt != "mkv" {
+		t.Errorf("movie profile %v", conf.Raw.Raw)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	set, dir := load(t, `{
+		"profiles": {
+			"anime": {"video": {"ffmpeg_param": "-c:v libsvtav1", "target_ext": "mkv"}},
+			"movie": {"video": {"ffmpeg_param": "-c:v libx265", "target_ext": "mkv"}},
+			"hevc":  {"video": {"ffmpeg_param": "-c:v copy", "target_ext": "mkv"}}
+		},
+		"rules": [
+			{"profile": "anime", "dir": "media/anime"},
+			{"profile": "movie", "dir": "media/movie", "path": "(?i)\\.mkv$"},
+			{"profile": "hevc", "probe": {"codec_type": "^video$", "codec_name": "^hevc$"}},
+			{"profile": "anime", "probe": {"codec_type": "^subtitle$", "codec_name": "^(ass|ssa)$"}}
+		],
+		"default": "movie"
+	}`, map[string]string{})
+
+	cases := map[string]struct {
+		path string
+		want string
+		// the file is probed, once at most
+		probed bool
+	}{
+		"dir":                  {"media/anime/a.mp4", "anime", false},
+		"deeper in the dir":    {"media/anime/season1/a.mp4", "anime", false},
+		"dir name prefix":      {"media/anime2/a.mp4", "anime", true},
+		"dir and path":         {"media/movie/b.MKV", "movie", false},
+		"dir without the path": {"media/movie/b.mp4", "anime", true},
+		"probe":                {"media/c.mkv", "anime", true},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			rec := &runner.Recorder{Next: &runner.Script{Steps: []runner.Step{
+				{Name: "ffprobe", Has: []string{"-show_streams"}, Stdout: test_streams},
+			}}}
+			got, e := set.Resolve(context.Background(), rec, filepath.Join(dir, tc.path))
+			if e != nil {
+				t.Fatal(e)
+			}
+			if got != tc.want {
+				t.Errorf("profile %q, want %q", got, tc.want)
+			}
+			if calls := rec.Calls(); tc.probed != (len(calls) == 1) || len(calls) > 1 {
+				t.Errorf("ffprobe calls %v", calls)
+			}
+		})
+	}
+
+	// nothing matches
+	script := &runner.Script{Steps: []runner.Step{{Name: "ffprobe", Stdout: `{"streams": [{"codec_type": "audio"}]}`}}}
+	if got, e := set.Resolve(context.Background(), script, filepath.Join(dir, "song.flac")); e != nil || got != "movie" {
+		t.Errorf("profile %q, %v, want the default", got, e)
+	}
+	set.Default = ""
+	if got, e := set.Resolve(context.Background(), script, filepath.Join(dir, "song.flac")); e != nil || got != "" {
+		t.Errorf("profile %q, %v, want none", got, e)
+	}
+
+	// a failed probe is reported instead of guessing
+	script = &runner.Script{Steps: []runner.Step{{Name: "ffprobe", Stderr: "Input/output error", Err: os.ErrClosed}}}
+	if _, e := set.Resolve(context.Background(), script, filepath.Join(dir, "d.mkv")); e == nil || !strings.Contains(e.Error(), "Input/output error") {
+		t.Errorf("error %v", e)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	cases := map[string]struct {
+		set  string
+		want string
+	}{
+		"not an object":     {`[]`, "is not a JSON object"},
+		"missing file":      {`{"profiles": {"a": "nowhere.json"}}`, `profile "a": `},
+		"invalid profile":   {`{"profiles": {"a": {"video": {}}}}`, `profile "a": invalid config: `},
+		"undefined default": {`{"profiles": {}, "default": "a"}`, `default profile "a" is not defined`},
+		"undefined profile": {`{"profiles": {}, "rules": [{"profile": "a"}]}`, `rule 0: profile "a" is not defined`},
+		"bad path": {`{"profiles": {"a": {"video": {"ffmpeg_param": "-an", "target_ext": "mkv"}}},
+			"rules": [{"profile": "a", "path": "(anime"}]}`, `rule 0: invalid regex "(anime"`},
+		"bad probe": {`{"profiles": {"a": {"video": {"ffmpeg_param": "-an", "target_ext": "mkv"}}},
+			"rules": [{"profile": "a"}, {"profile": "a", "probe": {"tags": {"language": "[jpn"}}}]}`, `rule 1: invalid regex "[jpn"`},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			fp := filepath.Join(t.TempDir(), "profiles.json")
+			if e := os.WriteFile(fp, []byte(tc.set), 0644); e != nil {
+				t.Fatal(e)
+			}
+			_, e := Load(fp)
+			if e == nil || !strings.Contains(e.Error(), tc.want) {
+				t.Errorf("error %v, want %q", e, tc.want)
+			}
+		})
+	}
+}
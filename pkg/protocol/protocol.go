@@ -0,0 +1,294 @@
+// Package protocol defines the messages between the master and the workers.
+//
+// Every message is a JSON object carrying the protocol Version. A worker says
+// hello first; the master rejects a worker speaking another version with a
+// Response whose Error tells both versions, and so does the worker with a
+// master speaking another one.
+//
+// The worker talks through a DEALER socket to the ROUTER socket of the master,
+// so requests do not go in lock-step: a Response carries the ID of its Request,
+// and a Response with a Push is sent by the master on its own.
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Version is the protocol spoken by this build. It changes with every
+// incompatible change of the messages.
+const Version = 4
+
+// ErrVersion is wrapped by the errors of a message of another protocol version
+var ErrVersion = errors.New("unsupported protocol version")
+
+// Kind is the name of a request
+type Kind string
+
+const (
+	// the first request of a worker, to check the protocol version
+	KindHello Kind = "hello"
+	// asks for a file to handle
+	KindJobWant Kind = "job_want"
+	// renews the lease of the file being handled
+	KindHeartbeat Kind = "heartbeat"
+	// asks to replace the original of the file; when several workers run copies
+	// of one job, only the first to ask is allowed
+	KindCommit Kind = "commit"
+
+	// the reports of a handled file
+	KindJobDone Kind = "job_done"
+	KindJobFail Kind = "job_fail"
+	KindJobSkip Kind = "job_skip"
+	// the worker was stopped in the middle of the job
+	KindKilled Kind = "killed"
+)
+
+// IsReport tells whether the request reports the outcome of a job
+func (k Kind) IsReport() bool {
+	switch k {
+	case KindJobDone, KindJobFail, KindJobSkip, KindKilled:
+		return true
+	}
+	return false
+}
+
+// Duration is a time.Duration written as a number of seconds
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.FormatFloat(time.Duration(d).Seconds(), 'f', -1, 64)), nil
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	seconds, e := strconv.ParseFloat(string(data), 64)
+	if e != nil {
+		return fmt.Errorf("duration %s is not a number of seconds", data)
+	}
+	*d = Duration(seconds * float64(time.Second))
+	return nil
+}
+
+// Peer identifies a process
+type Peer struct {
+	Hostname string `json:"hostname"`
+	PID      string `json:"pid"`
+}
+
+func (p Peer) String() string {
+	return p.Hostname + "/" + p.PID
+}
+
+// Request is a message of a worker to the master
+type Request struct {
+	Version int `json:"version"`
+	// chosen by the worker, unique among its requests; a resent request keeps it
+	ID     uint64 `json:"id"`
+	Kind   Kind   `json:"kind"`
+	Worker Peer   `json:"worker"`
+
+	// the file of KindHeartbeat and KindCommit
+	Path string `json:"path,omitempty"`
+	// what the worker can run and the labels it is routed by, registered with KindHello
+	Capabilities *Capabilities     `json:"capabilities,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	// of the reports
+	Report *Report `json:"report,omitempty"`
+}
+
+// Capabilities are the resources and the ffmpeg build of a worker
+type Capabilities struct {
+	Cores int `json:"cores"`
+	// in bytes; zero when unknown
+	Memory   int64 `json:"memory,omitempty"`
+	TempFree int64 `json:"temp_free,omitempty"`
+	// the first line of "ffmpeg -version" and "ffprobe -version"
+	FFmpegVersion  string `json:"ffmpeg_version,omitempty"`
+	FFprobeVersion string `json:"ffprobe_version,omitempty"`
+	// the names listed by "ffmpeg -encoders", sorted
+	Encoders []string `json:"encoders,omitempty"`
+}
+
+// MissingEncoders returns the encoders the worker does not have
+func (c *Capabilities) MissingEncoders(encoders []string) []string {
+	have := make(map[string]bool, len(c.Encoders))
+	for _, name := range c.Encoders {
+		have[name] = true
+	}
+	result := []string{}
+	for _, name := range encoders {
+		if !have[name] {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+// Report is the outcome of a job
+type Report struct {
+	Path    string   `json:"path"`
+	Elapsed Duration `json:"elapsed"`
+	Stats   Stats    `json:"stats"`
+	// of KindJobFail and KindKilled
+	Error *Error `json:"error,omitempty"`
+}
+
+// Stats describe a handled file, as far as they are known
+type Stats struct {
+	// video, audio, image, video_and_audio, ...
+	FileType string `json:"file_type,omitempty"`
+	// in seconds
+	MediaDuration float64 `json:"media_duration,omitempty"`
+	// sizes of the original and the transcoded file
+	BytesIn  int64 `json:"bytes_in,omitempty"`
+	BytesOut int64 `json:"bytes_out,omitempty"`
+	// how the streams were handled
+	Streams []Stream `json:"streams,omitempty"`
+	// of a TaskSplit: how many segments the video was cut into; zero when the
+	// file was transcoded whole instead
+	Segments int `json:"segments,omitempty"`
+}
+
+// Stream is how one stream of a file was handled
+type Stream struct {
+	CodecType string `json:"codec_type"`
+	// among the streams of the codec type
+	Index     int    `json:"index"`
+	CodecName string `json:"codec_name,omitempty"`
+	// encode or copy
+	Action string `json:"action"`
+	// index of the matching rule of the config section, -1 for the section default
+	Rule      int      `json:"rule"`
+	Args      []string `json:"args,omitempty"`
+	TargetExt string   `json:"target_ext,omitempty"`
+}
+
+// Error is the failure of a job
+type Error struct {
+	Message string `json:"message"`
+	// transcode.FailTransient, FailPermanent or FailUnknown; decides on a retry
+	Class string `json:"class,omitempty"`
+}
+
+// Response is the reply of the master
+type Response struct {
+	Version int `json:"version"`
+	// of the answered request; zero for a Push
+	ID     uint64 `json:"id,omitempty"`
+	Master Peer   `json:"master"`
+
+	// false when the request is declined: no job for now, a lease the worker does not hold, ...
+	OK bool `json:"ok"`
+	// the request was not understood, e.g. of another protocol version
+	Error string `json:"error,omitempty"`
+
+	// of KindJobWant with OK
+	Job *Job `json:"job,omitempty"`
+	// of KindJobWant without OK: ask again after this. Zero when no more job will come.
+	RetryAfter Duration `json:"retry_after,omitempty"`
+	// the master does not know the worker, e.g. after a restart: say hello again
+	Register bool `json:"register,omitempty"`
+
+	// a message the worker did not ask for
+	Push *Push `json:"push,omitempty"`
+}
+
+// PushKind is the name of a message of the master the worker did not ask for
+type PushKind string
+
+const (
+	// stop the job of Path; it is reported as killed
+	PushCancel PushKind = "cancel"
+	// use Config for the jobs without a profile from now on
+	PushConfig PushKind = "config"
+)
+
+// Push is a message of the master the worker did not ask for
+type Push struct {
+	Kind   PushKind        `json:"kind"`
+	Path   string          `json:"path,omitempty"`
+	Config json.RawMessage `json:"config,omitempty"`
+}
+
+// Job is a file assigned to a worker
+type Job struct {
+	Path string `json:"path"`
+	// the worker has to renew the lease with heartbeats before it runs out
+	Lease Duration `json:"lease"`
+	// the transcoding profile chosen by the master, if any
+	Profile       string          `json:"profile,omitempty"`
+	ProfileConfig json.RawMessage `json:"profile_config,omitempty"`
+	// a part of the transcoding of a file shared by several workers; nil to
+	// transcode the file whole
+	Task *Task `json:"task,omitempty"`
+}
+
+// TaskKind is the part a worker does of a file split across workers
+type TaskKind string
+
+const (
+	// cut the video of Path into about Segments segments and encode the audio,
+	// or transcode Path whole if its video is not encoded
+	TaskSplit TaskKind = "split"
+	// encode the segment Index of Source; Path is the segment
+	TaskSegment TaskKind = "segment"
+	// concatenate the encoded segments of Path, mux the audio in and replace Path
+	TaskMerge TaskKind = "merge"
+)
+
+// Task is a part of the transcoding of a file shared by several workers
+type Task struct {
+	Kind     TaskKind `json:"kind"`
+	Segments int      `json:"segments,omitempty"`
+	Index    int      `json:"index,omitempty"`
+	Source   string   `json:"source,omitempty"`
+}
+
+// CheckVersion fails unless the version is the one of this build
+func CheckVersion(version int) error {
+	if version != Version {
+		return fmt.Errorf("%w %v, this side speaks %v", ErrVersion, version, Version)
+	}
+	return nil
+}
+
+// Encode serializes a message. It fails on a number JSON cannot carry, e.g. a
+// NaN media duration of a broken file.
+func Encode(message interface{}) (string, error) {
+	data, e := json.Marshal(message)
+	if e != nil {
+		return "", fmt.Errorf("unable to encode the message: %w", e)
+	}
+	return string(data), nil
+}
+
+// DecodeRequest parses a request. The request is returned also with a version
+// error, so that the sender can be told apart.
+func DecodeRequest(data string) (Request, error) {
+	req := Request{}
+	if e := json.Unmarshal([]byte(data), &req); e != nil {
+		return req, fmt.Errorf("malformed request: %w", e)
+	}
+	if e := CheckVersion(req.Version); e != nil {
+		return req, e
+	}
+	if req.Kind.IsReport() && req.Report == nil {
+		return req, fmt.Errorf("%v request without a report", req.Kind)
+	}
+	return req, nil
+}
+
+// DecodeResponse parses a response
+func DecodeResponse(data string) (Response, error) {
+	res := Response{}
+	if e := json.Unmarshal([]byte(data), &res); e != nil {
+		return res, fmt.Errorf("malformed response: %w", e)
+	}
+	if e := CheckVersion(res.Version); e != nil {
+		return res, e
+	}
+	return res, nil
+}
@@ -0,0 +1,149 @@
+package protocol
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestRoundTrip(t *testing.T) {
+	req := Request{
+		Version: Version,
+		ID:      3,
+		Kind:    KindJobFail,
+		Worker:  Peer{Hostname: "host-a", PID: "42"},
+		Report: &Report{
+			Path:    "/media/movie.mkv",
+			Elapsed: Duration(1500 * time.Millisecond),
+			Stats: Stats{
+				FileType:      "video_and_audio",
+				MediaDuration: 120,
+				BytesIn:       1 << 30,
+				Streams: []Stream{
+					{CodecType: "audio", CodecName: "aac", Action: "copy", Rule: 0},
+					{CodecType: "video", CodecName: "h264", Action: "encode", Rule: -1, Args: []string{"-c:v", "libvpx-vp9"}, TargetExt: "webm"},
+				},
+			},
+			Error: &Error{Message: "Invalid data found when processing input", Class: "permanent"},
+		},
+	}
+
+	data, e := Encode(req)
+	if e != nil {
+		t.Fatal(e)
+	}
+	// numbers are numbers, durations are seconds
+	for _, want := range []string{`"elapsed":1.5`, `"bytes_in":1073741824`, `"rule":-1`} {
+		if !strings.Contains(data, want) {
+			t.Errorf("%v has no %v", data, want)
+		}
+	}
+
+	got, e := DecodeRequest(data)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if !reflect.DeepEqual(got, req) {
+		t.Errorf("decoded %+v, want %+v", got, req)
+	}
+}
+
+func TestResponseRoundTrip(t *testing.T) {
+	res := Response{
+		Version: Version,
+		ID:      3,
+		Master:  Peer{Hostname: "master", PID: "1"},
+		OK:      true,
+		Job: &Job{
+			Path:          "/media/movie.mkv",
+			Lease:         Duration(time.Minute),
+			Profile:       "anime",
+			ProfileConfig: []byte(`{"video":{"ffmpeg_param":"-c:v libx265","target_ext":"mp4"}}`),
+		},
+	}
+	data, e := Encode(res)
+	if e != nil {
+		t.Fatal(e)
+	}
+	got, e := DecodeResponse(data)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if !reflect.DeepEqual(got, res) {
+		t.Errorf("decoded %+v, want %+v", got, res)
+	}
+
+	// no retry_after when there is no more job
+	if data, _ := Encode(Response{Version: Version}); strings.Contains(data, "retry_after") {
+		t.Errorf("%v", data)
+	}
+}
+
+func TestDecodeRejects(t *testing.T) {
+	cases := map[string]struct {
+		data string
+		want string
+	}{
+		// a worker of the flat map2json messages
+		"unversioned": {`{"req":"job_want","hostname":"host-a","pid":"42"}`, "unsupported protocol version 0"},
+		"older":       {`{"version":3,"kind":"job_want","worker":{"hostname":"host-a","pid":"42"}}`, "unsupported protocol version 3, this side speaks 4"},
+		"newer":       {`{"version":5,"kind":"job_want","worker":{"hostname":"host-a","pid":"42"}}`, "unsupported protocol version 5, this side speaks 4"},
+		"malformed":   {`{"version":4,"kind":"job_done","report":{"elapsed":"1.5"}}`, "malformed request"},
+		"no report":   {`{"version":4,"kind":"job_done","worker":{"hostname":"host-a","pid":"42"}}`, "without a report"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, e := DecodeRequest(tc.data)
+			if e == nil || !strings.Contains(e.Error(), tc.want) {
+				t.Errorf("error %v, want %q", e, tc.want)
+			}
+		})
+	}
+
+	// the sender of a newer version is still known
+	req, e := DecodeRequest(`{"version":5,"id":7,"kind":"job_want","worker":{"hostname":"host-a","pid":"42"}}`)
+	if !errors.Is(e, ErrVersion) || req.Worker.Hostname != "host-a" || req.ID != 7 {
+		t.Errorf("%+v, %v", req, e)
+	}
+}
+
+func TestEncodeRejectsNaN(t *testing.T) {
+	req := Request{
+		Version: Version,
+		Kind:    KindJobDone,
+		Report:  &Report{Path: "/media/broken.mkv", Stats: Stats{MediaDuration: math.NaN()}},
+	}
+	if data, e := Encode(req); e == nil {
+		t.Errorf("encoded %v", data)
+	}
+}
+
+func TestHelloCapabilities(t *testing.T) {
+	req := Request{
+		Version: Version,
+		ID:      1,
+		Kind:    KindHello,
+		Worker:  Peer{Hostname: "host-a", PID: "42"},
+		Capabilities: &Capabilities{
+			Cores:         16,
+			Memory:        32 << 30,
+			TempFree:      500 << 30,
+			FFmpegVersion: "ffmpeg version 6.1.1",
+			Encoders:      []string{"aac", "libopus", "libx264"},
+		},
+		Labels: map[string]string{"cores": "16", "switch": "b"},
+	}
+	data, _ := Encode(req)
+	got, e := DecodeRequest(data)
+	if e != nil || !reflect.DeepEqual(got, req) {
+		t.Errorf("decoded %+v, %v", got, e)
+	}
+
+	missing := req.Capabilities.MissingEncoders([]string{"libopus", "libvpx-vp9", "libsvtav1"})
+	if !reflect.DeepEqual(missing, []string{"libvpx-vp9", "libsvtav1"}) {
+		t.Errorf("missing %v", missing)
+	}
+}
@@ -0,0 +1,142 @@
+package routing
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Labels describe a worker, e.g. {"cores": "64", "switch": "b"}
+type Labels map[string]string
+
+// String writes the labels the way ParseLabels reads them, sorted by key
+func (l Labels) String() string {
+	keys := make([]string, 0, len(l))
+	for key := range l {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	terms := make([]string, 0, len(keys))
+	for _, key := range keys {
+		terms = append(terms, key+"="+l[key])
+	}
+	return strings.Join(terms, ",")
+}
+
+func checkKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("empty label key")
+	}
+	if strings.ContainsAny(key, "=!, \t") {
+		return fmt.Errorf("invalid label key %q", key)
+	}
+	return nil
+}
+
+// ParseLabels reads comma separated key=value pairs, e.g. "cores=64,switch=b"
+func ParseLabels(s string) (Labels, error) {
+	result := Labels{}
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		kv := strings.SplitN(term, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("label %q is not key=value", term)
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if e := checkKey(key); e != nil {
+			return nil, e
+		}
+		if _, ok := result[key]; ok {
+			return nil, fmt.Errorf("label %q is given twice", key)
+		}
+		result[key] = value
+	}
+	return result, nil
+}
+
+type requirement struct {
+	key, value string
+	// "=", "!=", "" for having the key, "!" for not having it
+	op string
+}
+
+// Selector picks workers by their labels. Every comma separated term must hold:
+//
+//	key=value   the label has the value
+//	key!=value  the label is missing or has another value
+//	key         the label is there
+//	!key        the label is missing
+//
+// The empty selector picks every worker.
+type Selector struct {
+	text         string
+	requirements []requirement
+}
+
+// ParseSelector reads a selector such as "cores=64,!gpu"
+func ParseSelector(s string) (Selector, error) {
+	result := Selector{text: strings.TrimSpace(s)}
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+
+		r := requirement{}
+		switch {
+		case strings.Contains(term, "!="):
+			kv := strings.SplitN(term, "!=", 2)
+			r = requirement{key: strings.TrimSpace(kv[0]), value: strings.TrimSpace(kv[1]), op: "!="}
+		case strings.Contains(term, "="):
+			kv := strings.SplitN(term, "=", 2)
+			r = requirement{key: strings.TrimSpace(kv[0]), value: strings.TrimSpace(kv[1]), op: "="}
+		case strings.HasPrefix(term, "!"):
+			r = requirement{key: strings.TrimSpace(term[1:]), op: "!"}
+		default:
+			r = requirement{key: term}
+		}
+		if e := checkKey(r.key); e != nil {
+			return Selector{}, fmt.Errorf("selector %q: %v", s, e)
+		}
+		result.requirements = append(result.requirements, r)
+	}
+	return result, nil
+}
+
+// Matches tells whether the worker of the labels is picked
+func (s Selector) Matches(labels Labels) bool {
+	for _, r := range s.requirements {
+		value, ok := labels[r.key]
+		switch r.op {
+		case "=":
+			if !ok || value != r.value {
+				return false
+			}
+		case "!=":
+			if ok && value == r.value {
+				return false
+			}
+		case "!":
+			if ok {
+				return false
+			}
+		default:
+			if !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Empty tells whether the selector picks every worker
+func (s Selector) Empty() bool {
+	return len(s.requirements) == 0
+}
+
+func (s Selector) String() string {
+	return s.text
+}
@@ -0,0 +1,120 @@
+// Package routing pins files to workers by the labels the workers start with.
+package routing
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dlclark/regexp2"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/transcode"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/util"
+)
+
+// Route sends the files it matches to the workers of the selector. Every
+// condition given must hold:
+//   - dir:       the file is under this directory
+//   - path:      the full path matches this regex
+//   - file_type: image, audio or video, told by the extension
+type Route struct {
+	Dir      string
+	Path     *regexp2.Regexp
+	FileType string
+	Workers  Selector
+}
+
+// Table is the routing config owned by the master
+//
+//	{
+//	  "routes": [
+//	    {"dir": "/mnt/media/4k", "workers": "cores=64"},
+//	    {"file_type": "image", "workers": "size=small"},
+//	    {"path": "^/mnt/nas2/", "workers": "switch=b"}
+//	  ],
+//	  "fallback": "pool=general"
+//	}
+//
+// The first matching route wins; the files no route matches go to the
+// workers of the fallback selector, or to any worker without one.
+type Table struct {
+	Routes   []Route
+	Fallback Selector
+}
+
+func compile(regex string) (*regexp2.Regexp, error) {
+	re, e := regexp2.Compile(regex, 0)
+	if e != nil {
+		return nil, fmt.Errorf("invalid regex %q: %v", regex, e)
+	}
+	return re, nil
+}
+
+func Load(fp string) (*Table, error) {
+	root, e := util.ReadJSONFile(fp)
+	if e != nil {
+		return nil, e
+	}
+	if !root.IsObject() {
+		return nil, fmt.Errorf("%v is not a JSON object", fp)
+	}
+
+	table := &Table{}
+	if table.Fallback, e = ParseSelector(root.Get("fallback").String()); e != nil {
+		return nil, fmt.Errorf("fallback: %v", e)
+	}
+
+	for i, v := range root.Get("routes").Array() {
+		route := Route{
+			Dir:      v.Get("dir").String(),
+			FileType: v.Get("file_type").String(),
+		}
+		if route.Workers, e = ParseSelector(v.Get("workers").String()); e != nil {
+			return nil, fmt.Errorf("route %v: %v", i, e)
+		}
+		if route.Workers.Empty() {
+			return nil, fmt.Errorf("route %v: no workers selector", i)
+		}
+		if route.Dir != "" {
+			route.Dir = util.PathSanitize(route.Dir)
+		}
+		switch route.FileType {
+		case "", "image", "audio", "video":
+		default:
+			return nil, fmt.Errorf("route %v: file_type %q is not one of image, audio, video", i, route.FileType)
+		}
+		if v.Get("path").Exists() {
+			if route.Path, e = compile(v.Get("path").String()); e != nil {
+				return nil, fmt.Errorf("route %v: %v", i, e)
+			}
+		}
+		table.Routes = append(table.Routes, route)
+	}
+
+	return table, nil
+}
+
+func (route *Route) match(fp string) bool {
+	if route.Dir != "" && fp != route.Dir && !strings.HasPrefix(fp, route.Dir+string(os.PathSeparator)) {
+		return false
+	}
+	if route.Path != nil {
+		if matched, e := route.Path.MatchString(fp); e != nil || !matched {
+			return false
+		}
+	}
+	if route.FileType != "" && transcode.ExtFileType(strings.ToLower(filepath.Ext(fp))) != route.FileType {
+		return false
+	}
+	return true
+}
+
+// Resolve returns the selector of the workers the file may go to
+func (table *Table) Resolve(fp string) Selector {
+	for i := range table.Routes {
+		if table.Routes[i].match(fp) {
+			return table.Routes[i].Workers
+		}
+	}
+	return table.Fallback
+}
@@ -0,0 +1,99 @@
+package routing
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseLabels(t *testing.T) {
+	labels, e := ParseLabels(" cores=64, switch=b,empty=")
+	want := Labels{"cores": "64", "switch": "b", "empty": ""}
+	if e != nil || !reflect.DeepEqual(labels, want) {
+		t.Errorf("%v, %v", labels, e)
+	}
+	if s := labels.String(); s != "cores=64,empty=,switch=b" {
+		t.Errorf("string %q", s)
+	}
+
+	for _, bad := range []string{"cores", "=64", "a=1,a=2", "a!b=1"} {
+		if _, e := ParseLabels(bad); e == nil {
+			t.Errorf("%q was accepted", bad)
+		}
+	}
+}
+
+func TestSelector(t *testing.T) {
+	labels := Labels{"cores": "64", "switch": "b"}
+	cases := map[string]bool{
+		"":                   true,
+		"cores=64":           true,
+		"cores=64,switch=b":  true,
+		"cores=16":           false,
+		"switch!=a":          true,
+		"switch!=b":          false,
+		"gpu!=nvidia":        true,
+		"switch":             true,
+		"gpu":                false,
+		"!gpu":               true,
+		"!cores":             false,
+		" cores = 64 , !gpu": true,
+	}
+	for text, want := range cases {
+		s, e := ParseSelector(text)
+		if e != nil {
+			t.Errorf("%q: %v", text, e)
+			continue
+		}
+		if got := s.Matches(labels); got != want {
+			t.Errorf("%q matches %v, want %v", text, got, want)
+		}
+	}
+	if _, e := ParseSelector("cores=64,=b"); e == nil {
+		t.Error("accepted an empty key")
+	}
+}
+
+func TestTableResolve(t *testing.T) {
+	dir := t.TempDir()
+	fp := filepath.Join(dir, "routes.json")
+	os.WriteFile(fp, []byte(`{
+		"routes": [
+			{"dir": "/mnt/media/4k", "workers": "cores=64"},
+			{"file_type": "image", "workers": "size=small"},
+			{"path": "^/mnt/nas2/", "file_type": "video", "workers": "switch=b"}
+		],
+		"fallback": "pool=general"
+	}`), 0644)
+	table, e := Load(fp)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	cases := map[string]string{
+		"/mnt/media/4k/movie.mkv":   "cores=64",
+		"/mnt/media/4k/poster.png":  "cores=64",
+		"/mnt/media/4kids/show.mkv": "pool=general",
+		"/mnt/media/photo.jpg":      "size=small",
+		"/mnt/nas2/show.mp4":        "switch=b",
+		"/mnt/nas2/song.flac":       "pool=general",
+	}
+	for path, want := range cases {
+		if got := table.Resolve(path).String(); got != want {
+			t.Errorf("%v goes to %q, want %q", path, got, want)
+		}
+	}
+
+	for name, content := range map[string]string{
+		"no selector":   `{"routes": [{"dir": "/mnt"}]}`,
+		"bad file type": `{"routes": [{"file_type": "movie", "workers": "a=b"}]}`,
+		"bad regex":     `{"routes": [{"path": "(", "workers": "a=b"}]}`,
+		"bad fallback":  `{"fallback": "=b"}`,
+	} {
+		os.WriteFile(fp, []byte(content), 0644)
+		if _, e := Load(fp); e == nil {
+			t.Errorf("%v: loaded", name)
+		}
+	}
+}
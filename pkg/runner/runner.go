@@ -0,0 +1,170 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Runner runs an external program such as ffmpeg or ffprobe.
+// The pipeline only talks to subprocesses through it, so tests can replace them.
+type Runner interface {
+	Run(ctx context.Context, name string, args []string) (stdout, stderr []byte, e error)
+}
+
+// Or returns r, or the real Exec runner if r is nil
+func Or(r Runner) Runner {
+	if r == nil {
+		return Exec{}
+	}
+	return r
+}
+
+// Exec runs the programs for real; killed when the context is done
+type Exec struct{}
+
+func (Exec) Run(ctx context.Context, name string, args []string) ([]byte, []byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	e := cmd.Run()
+	return stdout.Bytes(), stderr.Bytes(), e
+}
+
+// Call is one program run
+type Call struct {
+	Name string
+	Args []string
+}
+
+// Has reports whether the arguments contain every one of args, in this order and next to each other
+func (c Call) Has(args ...string) bool {
+	if len(args) == 0 {
+		return true
+	}
+	for i := 0; i+len(args) <= len(c.Args); i++ {
+		found := true
+		for j, arg := range args {
+			if c.Args[i+j] != arg {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// Last is the last argument, the output file of an ffmpeg call
+func (c Call) Last() string {
+	if len(c.Args) == 0 {
+		return ""
+	}
+	return c.Args[len(c.Args)-1]
+}
+
+func (c Call) String() string {
+	return c.Name + " " + strings.Join(c.Args, " ")
+}
+
+// Recorder is a fake Runner which keeps every call and passes it on to Next,
+// or succeeds without output if there is no Next
+type Recorder struct {
+	Next Runner
+
+	mu    sync.Mutex
+	calls []Call
+}
+
+func (r *Recorder) Run(ctx context.Context, name string, args []string) ([]byte, []byte, error) {
+	r.mu.Lock()
+	r.calls = append(r.calls, Call{Name: name, Args: append([]string{}, args...)})
+	r.mu.Unlock()
+
+	if r.Next == nil {
+		return nil, nil, ctx.Err()
+	}
+	return r.Next.Run(ctx, name, args)
+}
+
+// Calls returns the calls made so far, in order
+func (r *Recorder) Calls() []Call {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Call{}, r.calls...)
+}
+
+// Step is how a Script answers the calls it matches
+type Step struct {
+	// the program, "" for any
+	Name string
+	// arguments the call must have next to each other, see Call.Has
+	Has []string
+	// an extra condition, nil for none
+	Match func(c Call) bool
+
+	// files to create before answering, as the real program would write its output
+	Create func(c Call) []string
+	// wait until the context is done, like a long encode which gets cancelled
+	Block bool
+
+	Stdout, Stderr string
+	Err            error
+}
+
+func (s *Step) match(c Call) bool {
+	if s.Name != "" && s.Name != c.Name {
+		return false
+	}
+	if !c.Has(s.Has...) {
+		return false
+	}
+	return s.Match == nil || s.Match(c)
+}
+
+// CreateOutput makes a Step create the last argument, the output of most ffmpeg calls
+func CreateOutput(c Call) []string {
+	return []string{c.Last()}
+}
+
+// Script is a fake Runner which answers each call with the first Step matching it.
+// A call no Step matches fails.
+type Script struct {
+	Steps []Step
+}
+
+func (s *Script) Run(ctx context.Context, name string, args []string) ([]byte, []byte, error) {
+	c := Call{Name: name, Args: args}
+	for i := range s.Steps {
+		step := &s.Steps[i]
+		if !step.match(c) {
+			continue
+		}
+		if step.Block {
+			<-ctx.Done()
+			return nil, nil, ctx.Err()
+		}
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		if step.Create != nil {
+			for _, fp := range step.Create(c) {
+				if e := os.MkdirAll(filepath.Dir(fp), 0755); e != nil {
+					return nil, nil, e
+				}
+				if e := os.WriteFile(fp, []byte(c.String()), 0644); e != nil {
+					return nil, nil, e
+				}
+			}
+		}
+		return []byte(step.Stdout), []byte(step.Stderr), step.Err
+	}
+	return nil, nil, fmt.Errorf("unexpected call: %v", c)
+}
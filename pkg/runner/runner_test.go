@@ -0,0 +1,95 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCallHas(t *testing.T) {
+	c := Call{Name: "ffmpeg", Args: []string{"-i", "in.mkv", "-c:v", "copy", "out.mkv"}}
+	cases := []struct {
+		args []string
+		want bool
+	}{
+		{nil, true},
+		{[]string{"-c:v", "copy"}, true},
+		{[]string{"out.mkv"}, true},
+		{[]string{"-i", "copy"}, false},
+		{[]string{"copy", "out.mkv", "x"}, false},
+	}
+	for _, tc := range cases {
+		if got := c.Has(tc.args...); got != tc.want {
+			t.Errorf("Has(%q) = %v, want %v", tc.args, got, tc.want)
+		}
+	}
+	if c.Last() != "out.mkv" {
+		t.Errorf("Last() = %q", c.Last())
+	}
+}
+
+func TestExec(t *testing.T) {
+	stdout, stderr, e := Exec{}.Run(context.Background(), "sh", []string{"-c", "echo out; echo err >&2"})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if string(stdout) != "out\n" || string(stderr) != "err\n" {
+		t.Errorf("stdout %q, stderr %q", stdout, stderr)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, _, e := (Exec{}).Run(ctx, "sleep", []string{"10"}); e == nil {
+		t.Error("sleep outlived its context")
+	}
+}
+
+func TestRecorderScript(t *testing.T) {
+	dir := t.TempDir()
+	fail := errors.New("broken")
+	script := &Script{Steps: []Step{
+		{Name: "ffprobe", Stdout: `{"streams":[]}`},
+		{Name: "ffmpeg", Has: []string{"-i", "bad.mkv"}, Stderr: "Invalid data", Err: fail},
+		{Name: "ffmpeg", Create: CreateOutput},
+	}}
+	rec := &Recorder{Next: script}
+	ctx := context.Background()
+
+	if stdout, _, e := rec.Run(ctx, "ffprobe", []string{"in.mkv"}); e != nil || string(stdout) != `{"streams":[]}` {
+		t.Errorf("ffprobe: %q, %v", stdout, e)
+	}
+	if _, stderr, e := rec.Run(ctx, "ffmpeg", []string{"-i", "bad.mkv", "out.mkv"}); e != fail || string(stderr) != "Invalid data" {
+		t.Errorf("failing step: %q, %v", stderr, e)
+	}
+	out := filepath.Join(dir, "sub", "out.webm")
+	if _, _, e := rec.Run(ctx, "ffmpeg", []string{"-i", "in.mkv", out}); e != nil {
+		t.Errorf("creating step: %v", e)
+	}
+	if _, e := os.Stat(out); e != nil {
+		t.Errorf("output not created: %v", e)
+	}
+	if _, _, e := rec.Run(ctx, "mkvmerge", nil); e == nil || !strings.Contains(e.Error(), "unexpected call") {
+		t.Errorf("unmatched call: %v", e)
+	}
+
+	calls := rec.Calls()
+	if len(calls) != 4 || calls[1].Last() != "out.mkv" || calls[3].Name != "mkvmerge" {
+		t.Errorf("recorded %v", calls)
+	}
+}
+
+func TestScriptBlock(t *testing.T) {
+	script := &Script{Steps: []Step{{Block: true}}}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	if _, _, e := script.Run(ctx, "ffmpeg", nil); !errors.Is(e, context.Canceled) {
+		t.Errorf("blocked step returned %v", e)
+	}
+}
@@ -0,0 +1,124 @@
+package transcode
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/runner"
+)
+
+// SplitArgs splits a command line the way a POSIX shell does, without any expansion:
+// 'single quotes' keep everything, "double quotes" keep everything but \" \\ \$ \`,
+// and a backslash outside quotes keeps the next character.
+func SplitArgs(s string) ([]string, error) {
+	result := []string{}
+	var cur strings.Builder
+	in_word := false
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if in_word {
+				result = append(result, cur.String())
+				cur.Reset()
+				in_word = false
+			}
+		case c == '\\':
+			if i+1 >= len(s) {
+				return nil, fmt.Errorf("trailing backslash in %q", s)
+			}
+			i++
+			// a backslash-newline joins lines
+			if s[i] != '\n' {
+				cur.WriteByte(s[i])
+				in_word = true
+			}
+		case c == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated single quote in %q", s)
+			}
+			cur.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+			in_word = true
+		case c == '"':
+			closed := false
+			for i++; i < len(s); i++ {
+				if s[i] == '"' {
+					closed = true
+					break
+				}
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("\"\\$`", s[i+1]) >= 0 {
+					i++
+				}
+				cur.WriteByte(s[i])
+			}
+			if !closed {
+				return nil, fmt.Errorf("unterminated double quote in %q", s)
+			}
+			in_word = true
+		default:
+			cur.WriteByte(c)
+			in_word = true
+		}
+	}
+	if in_word {
+		result = append(result, cur.String())
+	}
+	return result, nil
+}
+
+var (
+	ffmpeg_common_input_args  = []string{"-hide_banner", "-loglevel", "warning", "-avoid_negative_ts", "1", "-analyzeduration", "2147483647", "-probesize", "2147483647", "-y"}
+	ffmpeg_common_output_args = []string{"-max_muxing_queue_size", "4096"}
+)
+
+// ffmpegCommand builds the argv of every ffmpeg call:
+//
+//	ffmpeg <common input args> [input args] -i <input> ... <common output args> [output args] <output>
+type ffmpegCommand struct {
+	runner runner.Runner
+	args   []string
+}
+
+func newFFmpegCommand(r runner.Runner) *ffmpegCommand {
+	return &ffmpegCommand{runner: runner.Or(r), args: append([]string{}, ffmpeg_common_input_args...)}
+}
+
+// Input adds an input file with the options applying to it
+func (c *ffmpegCommand) Input(fp string, args ...string) *ffmpegCommand {
+	c.args = append(c.args, args...)
+	c.args = append(c.args, "-i", fp)
+	return c
+}
+
+// Output adds the output file with the options applying to it
+func (c *ffmpegCommand) Output(fp string, args ...string) *ffmpegCommand {
+	c.args = append(c.args, ffmpeg_common_output_args...)
+	c.args = append(c.args, args...)
+	c.args = append(c.args, fp)
+	return c
+}
+
+// Run executes ffmpeg; the error carries the arguments and the output for ClassifyError
+func (c *ffmpegCommand) Run(ctx context.Context, fields logrus.Fields) error {
+	stdout, stderr, e := c.runner.Run(ctx, "ffmpeg", c.args)
+	out := append(stdout, stderr...)
+	if e != nil {
+		return fmt.Errorf("error message: %v, ffmpeg arg: %q, ffmpeg output: %v", e, c.args, string(out))
+	}
+
+	log_fields := logrus.Fields{
+		"subproc":        "ffmpeg",
+		"subproc_param":  c.args,
+		"subproc_output": string(out),
+	}
+	for k, v := range fields {
+		log_fields[k] = v
+	}
+	logrus.WithFields(log_fields).Debugf("Subprocess success")
+	return nil
+}
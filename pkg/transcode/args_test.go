@@ -0,0 +1,69 @@
+package transcode
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	cases := map[string]struct {
+		in   string
+		want []string
+	}{
+		"empty":                    {``, []string{}},
+		"blanks only":              {" \t\r\n ", []string{}},
+		"plain words":              {"-c:v  libx264\t-crf 23\n", []string{"-c:v", "libx264", "-crf", "23"}},
+		"single quotes":            {`-vf 'scale=-2:720, fps=30'`, []string{"-vf", "scale=-2:720, fps=30"}},
+		"single quotes keep all":   {`'a\"b\\c $x "d"'`, []string{`a\"b\\c $x "d"`}},
+		"double quotes":            {`-metadata "title=My Movie"`, []string{"-metadata", "title=My Movie"}},
+		"escapes in double quotes": {`"a\"b\\c\$d\` + "`" + `e"`, []string{"a\"b\\c$d`e"}},
+		"other backslash kept":     {`"a\nb\'c"`, []string{`a\nb\'c`}},
+		"single in double":         {`"it's"`, []string{"it's"}},
+		"no escape in single":      {`'a\'`, []string{`a\`}},
+		"double in single":         {`'say "hi"'`, []string{`say "hi"`}},
+		"escapes outside quotes":   {`a\ b \'c\' \"d\" \\e`, []string{"a b", "'c'", `"d"`, `\e`}},
+		"escaped quote":            {`\'`, []string{"'"}},
+		"line continuation":        {"-c:v \\\nlibx264", []string{"-c:v", "libx264"}},
+		"joined by continuation":   {"lib\\\nx264", []string{"libx264"}},
+		"empty single quoted":      {`-metadata '' -an`, []string{"-metadata", "", "-an"}},
+		"empty double quoted":      {`"" ""`, []string{"", ""}},
+		"adjacent parts":           {`-vf=a'b c'"d e"f`, []string{"-vf=ab cd ef"}},
+		"adjacent empty quotes":    {`a''b""c`, []string{"abc"}},
+		"quote then escape":        {`'a'\ b`, []string{"a b"}},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, e := SplitArgs(tc.in)
+			if e != nil {
+				t.Fatalf("SplitArgs(%q): %v", tc.in, e)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("SplitArgs(%q)\n%q\nwant\n%q", tc.in, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSplitArgsErrors(t *testing.T) {
+	cases := map[string]struct {
+		in   string
+		want string
+	}{
+		"unterminated single quote":  {`-vf 'scale=-2:720`, `unterminated single quote in "-vf 'scale=-2:720"`},
+		"unterminated double quote":  {`-metadata "title`, `unterminated double quote in "-metadata \"title"`},
+		"escaped closing double":     {`"a\"`, `unterminated double quote in "\"a\\\""`},
+		"trailing backslash":         {`-an \`, `trailing backslash in "-an \\"`},
+		"backslash in double at end": {`"a\`, `unterminated double quote in "\"a\\"`},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, e := SplitArgs(tc.in)
+			if e == nil {
+				t.Fatalf("SplitArgs(%q) = %q, want an error", tc.in, got)
+			}
+			if e.Error() != tc.want {
+				t.Errorf("error %q, want %q", e.Error(), tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package transcode
+
+import (
+	"context"
+	"errors"
+	"regexp"
+)
+
+const (
+	// the job may succeed if it runs again, e.g. on another worker
+	FailTransient = "transient"
+	// the input or the config is broken; running it again gives the same result
+	FailPermanent = "permanent"
+	FailUnknown   = "unknown"
+)
+
+var (
+	transient_patterns = regexp.MustCompile(`(?i)(input/output error|no space left on device|disk quota exceeded|stale (nfs )?file handle|resource temporarily unavailable|cannot allocate memory|too many open files|connection (timed out|reset|refused)|signal: (killed|terminated|interrupt)|context canceled|context deadline exceeded)`)
+	permanent_patterns = regexp.MustCompile(`(?i)(invalid data found when processing input|unknown encoder|encoder not found|decoder not found|unsupported codec|codec not currently supported|not supported|moov atom not found|could not find codec parameters|invalid argument|no such filter|option not found|unrecognized option)`)
+)
+
+// ClassifyError decides whether a failed job is worth retrying by looking at
+// the error text, which carries the ffmpeg/ffprobe output of the failed subprocess
+func ClassifyError(e error) string {
+	if e == nil {
+		return ""
+	}
+
+	if errors.Is(e, context.Canceled) || errors.Is(e, context.DeadlineExceeded) {
+		return FailTransient
+	}
+
+	// a flaky mount is the root cause even if ffmpeg then complains about the data
+	msg := e.Error()
+	if transient_patterns.MatchString(msg) {
+		return FailTransient
+	}
+	// a broken config or override file stays broken until someone edits it
+	var conf_err *ConfigError
+	if errors.As(e, &conf_err) || errors.Is(e, ErrSidecar) {
+		return FailPermanent
+	}
+	if permanent_patterns.MatchString(msg) {
+		return FailPermanent
+	}
+	return FailUnknown
+}
@@ -0,0 +1,41 @@
+package transcode
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestClassifyError(t *testing.T) {
+	cases := map[string]struct {
+		e    error
+		want string
+	}{
+		"nil":                 {nil, ""},
+		"input/output error":  {errors.New("error message: exit status 1, ffprobe output: /mnt/nas/a.mkv: Input/output error"), FailTransient},
+		"disk full":           {errors.New("av_interleaved_write_frame(): No space left on device"), FailTransient},
+		"stale file handle":   {errors.New("/mnt/nfs/a.mkv: Stale NFS file handle"), FailTransient},
+		"connection reset":    {errors.New("tcp://nas:445: Connection reset by peer"), FailTransient},
+		"connection timeout":  {errors.New("Connection timed out"), FailTransient},
+		"killed":              {errors.New("signal: killed"), FailTransient},
+		"cancelled":           {fmt.Errorf("ffmpeg: %w", context.Canceled), FailTransient},
+		"deadline":            {fmt.Errorf("ffprobe: %w", context.DeadlineExceeded), FailTransient},
+		"invalid data":        {errors.New("error message: exit status 1, ffprobe output: a.mkv: Invalid data found when processing input"), FailPermanent},
+		"unknown encoder":     {errors.New("Unknown encoder 'libsvtav1'"), FailPermanent},
+		"moov atom":           {errors.New("a.mp4: moov atom not found"), FailPermanent},
+		"unrecognized option": {errors.New("Unrecognized option 'crf:x'"), FailPermanent},
+		"config":              {fmt.Errorf("override: %w", &ConfigError{Problems: []string{"video: required by video files"}}), FailPermanent},
+		"sidecar":             {fmt.Errorf("%w: /data/.transcode.json: unexpected end of JSON input", ErrSidecar), FailPermanent},
+		// the I/O error is the cause of the garbage ffmpeg read
+		"transient first": {errors.New("Input/output error\nInvalid data found when processing input"), FailTransient},
+		"unknown":         {errors.New("error message: exit status 1, ffmpeg output: "), FailUnknown},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			if got := ClassifyError(tc.e); got != tc.want {
+				t.Errorf("ClassifyError(%v) = %q, want %q", tc.e, got, tc.want)
+			}
+		})
+	}
+}
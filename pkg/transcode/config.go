@@ -0,0 +1,305 @@
+package transcode
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dlclark/regexp2"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/util"
+	"github.com/tidwall/gjson"
+)
+
+// the config sections; video_and_audio files use both "video" and "audio"
+var config_sections = []string{"image", "audio", "video"}
+
+// Pattern is a set of regexes keyed by ffprobe stream fields, e.g. "tags.language"
+type Pattern map[string]*regexp2.Regexp
+
+// Keys returns the stream fields of the pattern in a stable order
+func (p Pattern) Keys() []string {
+	result := make([]string, 0, len(p))
+	for key := range p {
+		result = append(result, key)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// MatchKey matches one field of the stream. A field the stream does not have never matches.
+func (p Pattern) MatchKey(key string, stream gjson.Result) bool {
+	re, ok := p[key]
+	if !ok {
+		return false
+	}
+	value := stream.Get(key)
+	if !value.Exists() || value.IsObject() || value.IsArray() {
+		return false
+	}
+	matched, e := re.MatchString(value.String())
+	return e == nil && matched
+}
+
+// SectionConfig is how one kind of stream is transcoded
+type SectionConfig struct {
+	// checked in order before falling back to Param; "skip_if" is the first one
+	Rules []*Rule
+	// audio only: the stream whose fields match the earlier priorities wins
+	SelectionPrefer   Pattern
+	SelectionPriority []string
+
+	// the default ffmpeg_param, nil if only the rules have one
+	Param     *Param
+	TargetExt string
+}
+
+// Config is a validated transcoding config
+type Config struct {
+	Sections map[string]*SectionConfig
+
+	// the JSON it was parsed from, for merging overrides
+	Raw gjson.Result
+}
+
+// Section returns the config of the file type, nil if the config does not handle it
+func (conf *Config) Section(name string) *SectionConfig {
+	return conf.Sections[name]
+}
+
+// Encoders lists the ffmpeg encoders the config may use, sorted
+func (conf *Config) Encoders() []string {
+	seen := map[string]bool{}
+	for _, section := range conf.Sections {
+		params := []*Param{section.Param}
+		for _, rule := range section.Rules {
+			params = append(params, rule.Param)
+		}
+		for _, param := range params {
+			if param == nil {
+				continue
+			}
+			for _, name := range param.Encoders() {
+				seen[name] = true
+			}
+		}
+	}
+	result := make([]string, 0, len(seen))
+	for name := range seen {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// ConfigError lists every problem found in a config, each prefixed by its JSON path
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return "invalid config: " + strings.Join(e.Problems, "; ")
+}
+
+type configParser struct {
+	problems []string
+}
+
+func (p *configParser) fail(path, format string, args ...interface{}) {
+	p.problems = append(p.problems, path+": "+fmt.Sprintf(format, args...))
+}
+
+func (p *configParser) pattern(path string, v gjson.Result) Pattern {
+	if !v.IsObject() {
+		p.fail(path, "must be an object of regexes")
+		return nil
+	}
+	result := Pattern{}
+	keys := []string{}
+	for key := range util.FlattenJSONKey(v) {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := v.Get(key)
+		if value.Type != gjson.String {
+			p.fail(path+"."+key, "must be a regex string")
+			continue
+		}
+		re, e := regexp2.Compile(value.String(), 0)
+		if e != nil {
+			p.fail(path+"."+key, "invalid regex %q: %v", value.String(), e)
+			continue
+		}
+		result[key] = re
+	}
+	return result
+}
+
+func (p *configParser) section(name string, v gjson.Result) *SectionConfig {
+	if !v.IsObject() {
+		p.fail(name, "must be an object")
+		return nil
+	}
+	result := &SectionConfig{}
+	var skip_rule *Rule
+	// of result.Rules, which leaves the malformed ones out
+	rule_paths := []string{}
+
+	v.ForEach(func(key, value gjson.Result) bool {
+		path := name + "." + key.String()
+		switch key.String() {
+		case "skip_if":
+			// streams already in the target format are copied instead of encoded
+			skip_rule = &Rule{
+				conditions: p.conditions(path, value),
+				lenient:    true,
+				Action:     ActionCopy,
+			}
+		case "rules":
+			if !value.IsArray() {
+				p.fail(path, "must be an array of rules")
+				break
+			}
+			for i, elem := range value.Array() {
+				rule_path := fmt.Sprintf("%v.%v", path, i)
+				if rule := p.rule(rule_path, elem); rule != nil {
+					result.Rules = append(result.Rules, rule)
+					rule_paths = append(rule_paths, rule_path)
+				}
+			}
+		case "selection_prefer":
+			if name != "audio" {
+				p.fail(path, "only the audio section selects a stream")
+				break
+			}
+			result.SelectionPrefer = p.pattern(path, value)
+		case "selection_priority":
+			if name != "audio" {
+				p.fail(path, "only the audio section selects a stream")
+				break
+			}
+			if !value.IsArray() {
+				p.fail(path, "must be an array of stream fields")
+				break
+			}
+			for i, elem := range value.Array() {
+				if elem.Type != gjson.String || elem.String() == "" {
+					p.fail(fmt.Sprintf("%v.%v", path, i), "must be a stream field name")
+					continue
+				}
+				result.SelectionPriority = append(result.SelectionPriority, elem.String())
+			}
+		case "ffmpeg_param":
+			param, e := parseParam(value)
+			if e != nil {
+				p.fail(path, "%v", e)
+				break
+			}
+			result.Param = param
+		case "target_ext":
+			if value.Type != gjson.String || value.String() == "" {
+				p.fail(path, "must be a non-empty string")
+				break
+			}
+			result.TargetExt = strings.TrimPrefix(value.String(), ".")
+		default:
+			p.fail(path, "unknown key")
+		}
+		return true
+	})
+
+	for i, rule := range result.Rules {
+		if rule.Action == ActionEncode && rule.Param == nil && result.Param == nil {
+			p.fail(rule_paths[i]+".ffmpeg_param", "required unless the section has a default ffmpeg_param")
+		}
+	}
+	if skip_rule != nil {
+		result.Rules = append([]*Rule{skip_rule}, result.Rules...)
+	}
+
+	// without a default, some rule has to match every stream
+	if !v.Get("ffmpeg_param").Exists() && !v.Get("rules").Exists() {
+		p.fail(name+".ffmpeg_param", "required unless there are rules")
+	}
+	if !v.Get("target_ext").Exists() {
+		p.fail(name+".target_ext", "required")
+	}
+
+	if name != "audio" {
+		return result
+	}
+
+	// selection_prefer and selection_priority only work together and on the same fields
+	prefer, priority := v.Get("selection_prefer").Exists(), v.Get("selection_priority").Exists()
+	switch {
+	case prefer && !priority:
+		p.fail(name+".selection_priority", "required by selection_prefer")
+	case !prefer && priority:
+		p.fail(name+".selection_prefer", "required by selection_priority")
+	case prefer && priority:
+		in_priority := util.Slice2Map(result.SelectionPriority)
+		for _, key := range result.SelectionPrefer.Keys() {
+			if !in_priority[key] {
+				p.fail(name+".selection_prefer."+key, "not listed in selection_priority")
+			}
+		}
+		seen := map[string]bool{}
+		for i, key := range result.SelectionPriority {
+			if seen[key] {
+				p.fail(fmt.Sprintf("%v.selection_priority.%v", name, i), "%q is listed twice", key)
+			}
+			seen[key] = true
+		}
+		if len(result.SelectionPriority) > 64 {
+			p.fail(name+".selection_priority", "at most 64 fields")
+		}
+	}
+
+	return result
+}
+
+// ParseConfig validates a transcoding config and precompiles its regexes
+func ParseConfig(raw gjson.Result) (*Config, error) {
+	p := &configParser{}
+	conf := &Config{
+		Sections: map[string]*SectionConfig{},
+		Raw:      raw,
+	}
+
+	if !raw.IsObject() || !gjson.Valid(raw.Raw) {
+		return nil, &ConfigError{Problems: []string{"$: must be a JSON object"}}
+	}
+
+	known := util.Slice2Map(config_sections)
+	raw.ForEach(func(key, value gjson.Result) bool {
+		if !known[key.String()] {
+			p.fail(key.String(), "unknown section, expected one of %v", strings.Join(config_sections, ", "))
+			return true
+		}
+		if section := p.section(key.String(), value); section != nil {
+			conf.Sections[key.String()] = section
+		}
+		return true
+	})
+	if len(conf.Sections) == 0 && len(p.problems) == 0 {
+		p.fail("$", "no section, expected one of %v", strings.Join(config_sections, ", "))
+	}
+
+	if len(p.problems) > 0 {
+		return nil, &ConfigError{Problems: p.problems}
+	}
+	return conf, nil
+}
+
+// LoadConfig reads a transcoding config file with everything it extends or includes, and validates it
+func LoadConfig(fp string) (*Config, error) {
+	raw, e := ResolveConfigFile(fp)
+	if e != nil {
+		return nil, e
+	}
+	conf, e := ParseConfig(raw)
+	if e != nil {
+		return nil, fmt.Errorf("%v: %w", fp, e)
+	}
+	return conf, nil
+}
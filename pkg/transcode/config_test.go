@@ -0,0 +1,143 @@
+package transcode
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dlclark/regexp2"
+	"github.com/tidwall/gjson"
+)
+
+func TestConfigEncoders(t *testing.T) {
+	conf, e := ParseConfig(gjson.Parse(`{
+		"audio": {"ffmpeg_param": "-vn -ac 2 -c:a libopus -b:a 128k", "target_ext": "ogg"},
+		"video": {
+			"skip_if": {"codec_name": "^(vp9)$"},
+			"rules": [
+				{"match": {"height": ">= 2160"}, "ffmpeg_param": ["-vcodec", "libsvtav1", "-crf", "35"]},
+				{"match": {"codec_name": "^(av1)$"}, "ffmpeg_param": "-c copy"}
+			],
+			"ffmpeg_param": "-c:v {{ if gt .Height 720 }}libvpx-vp9{{ else }}libx264{{ end }} -c:s:0 copy",
+			"target_ext": "webm"
+		}
+	}`))
+	if e != nil {
+		t.Fatal(e)
+	}
+	// the template is read as rendered for the 1080p sample stream
+	want := []string{"libopus", "libsvtav1", "libvpx-vp9"}
+	if got := conf.Encoders(); !reflect.DeepEqual(got, want) {
+		t.Errorf("encoders %v, want %v", got, want)
+	}
+}
+
+func TestParseConfigProblems(t *testing.T) {
+	cases := map[string]struct {
+		config string
+		want   []string
+	}{
+		"not an object": {`[]`, []string{
+			"$: must be a JSON object"}},
+		"no section": {`{}`, []string{
+			"$: no section, expected one of image, audio, video"}},
+		"unknown section": {`{"subtitle": {}}`, []string{
+			"subtitle: unknown section, expected one of image, audio, video"}},
+		"section not an object": {`{"video": "-c:v libx264"}`, []string{
+			"video: must be an object"}},
+		"missing keys": {`{"video": {}}`, []string{
+			"video.ffmpeg_param: required unless there are rules",
+			"video.target_ext: required"}},
+		"unknown key and bad target_ext": {`{"video": {"ffmpeg_param": "-an", "target_ext": "", "crf": 27}}`, []string{
+			"video.target_ext: must be a non-empty string",
+			"video.crf: unknown key"}},
+		"bad ffmpeg_param": {`{"video": {"ffmpeg_param": 27, "target_ext": "webm"}}`, []string{
+			"video.ffmpeg_param: must be a string or an array of strings"}},
+		"unbalanced quote": {`{"video": {"ffmpeg_param": "-vf 'scale=-2:720", "target_ext": "webm"}}`, []string{
+			`video.ffmpeg_param: ffmpeg_param: unterminated single quote in "-vf 'scale=-2:720"`}},
+		"selection outside audio": {`{"video": {"ffmpeg_param": "-an", "target_ext": "webm", "selection_prefer": {}, "selection_priority": []}}`, []string{
+			"video.selection_prefer: only the audio section selects a stream",
+			"video.selection_priority: only the audio section selects a stream"}},
+		"selection_prefer alone": {`{"audio": {"ffmpeg_param": "-an", "target_ext": "ogg", "selection_prefer": {"tags": {"language": "jpn"}}}}`, []string{
+			"audio.selection_priority: required by selection_prefer"}},
+		"selection_priority alone": {`{"audio": {"ffmpeg_param": "-an", "target_ext": "ogg", "selection_priority": ["tags.language"]}}`, []string{
+			"audio.selection_prefer: required by selection_priority"}},
+		"selection mismatch": {`{"audio": {"ffmpeg_param": "-an", "target_ext": "ogg",
+			"selection_prefer": {"tags": {"language": "(jpn", "title": "^Main"}},
+			"selection_priority": ["tags.language", "", "tags.language"]}}`, []string{
+			"audio.selection_prefer.tags.language: invalid regex \"(jpn\": " + regexError(t, "(jpn"),
+			"audio.selection_priority.1: must be a stream field name",
+			"audio.selection_prefer.tags.title: not listed in selection_priority",
+			`audio.selection_priority.1: "tags.language" is listed twice`}},
+		"bad rules": {`{"video": {"target_ext": "webm", "rules": [
+			"copy",
+			{"match": {"height": 2160}, "action": "drop"},
+			{"match": {"codec_name": "^vp9$"}, "action": "copy", "ffmpeg_param": "-c copy"},
+			{"match": {"codec_name": "^h264$"}, "crf": 27}
+		]}}`, []string{
+			"video.rules.0: must be an object",
+			"video.rules.1.match.height: must be a regex or a comparison string",
+			`video.rules.1.action: must be "encode" or "copy"`,
+			"video.rules.2.ffmpeg_param: not used by the copy action",
+			"video.rules.3.crf: unknown key",
+			// numbered as in the file, though rule 0 is left out
+			"video.rules.1.ffmpeg_param: required unless the section has a default ffmpeg_param",
+			"video.rules.3.ffmpeg_param: required unless the section has a default ffmpeg_param"}},
+		"rules not an array": {`{"video": {"target_ext": "webm", "rules": {}}}`, []string{
+			"video.rules: must be an array of rules"}},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, e := ParseConfig(gjson.Parse(tc.config))
+			var config_error *ConfigError
+			if !errors.As(e, &config_error) {
+				t.Fatalf("error %v is not a ConfigError", e)
+			}
+			if !reflect.DeepEqual(config_error.Problems, tc.want) {
+				t.Errorf("problems\n%q\nwant\n%q", config_error.Problems, tc.want)
+			}
+			if want := "invalid config: " + strings.Join(tc.want, "; "); e.Error() != want {
+				t.Errorf("error %q, want %q", e.Error(), want)
+			}
+		})
+	}
+}
+
+// regexError is how the regex library reports the pattern
+func regexError(t *testing.T, pattern string) string {
+	t.Helper()
+	_, e := regexp2.Compile(pattern, 0)
+	if e == nil {
+		t.Fatalf("%q compiles", pattern)
+	}
+	return e.Error()
+}
+
+func TestParseConfigAccepts(t *testing.T) {
+	// a field of selection_priority without a regex is only matched by the
+	// configs extending this one
+	for _, name := range []string{"config-base.json", "config-anime.json", "config-movie.json"} {
+		if _, e := LoadConfig(filepath.Join("..", "..", name)); e != nil {
+			t.Errorf("%v: %v", name, e)
+		}
+	}
+
+	conf, e := ParseConfig(gjson.Parse(`{"audio": {
+		"ffmpeg_param": ["-c:a", "libopus"],
+		"target_ext": ".ogg",
+		"selection_prefer": {"tags": {"language": "^jpn$"}},
+		"selection_priority": ["tags.language", "tags.title"]
+	}}`))
+	if e != nil {
+		t.Fatal(e)
+	}
+	audio := conf.Section("audio")
+	if audio.TargetExt != "ogg" || !reflect.DeepEqual(audio.SelectionPriority, []string{"tags.language", "tags.title"}) {
+		t.Errorf("audio section %+v", audio)
+	}
+	if conf.Section("video") != nil {
+		t.Error("a video section out of nothing")
+	}
+}
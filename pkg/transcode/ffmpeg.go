@@ -5,78 +5,42 @@ import (
 	"fmt"
 	"math"
 	"os"
-	"os/exec"
 	"strconv"
-	"strings"
 
 	"github.com/sirupsen/logrus"
 	"github.com/sunrise2575/dist-ffmpeg/pkg/ffprobe"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/runner"
 	"github.com/sunrise2575/dist-ffmpeg/pkg/util"
 )
 
-const (
-	FFMPEG_COMMON_INPUT_ARG  = " -hide_banner -loglevel warning -avoid_negative_ts 1 -analyzeduration 2147483647 -probesize 2147483647 -y "
-	FFMPEG_COMMON_OUTPUT_ARG = " -max_muxing_queue_size 4096 "
-)
-
-func ffmpegEncodeAudioOnly(ctx context.Context, fp_in File, fp_out File, ffmpeg_param string, audio_stream_number int) error {
+func ffmpegEncodeAudioOnly(ctx context.Context, r runner.Runner, fp_in File, fp_out File, ffmpeg_args []string, audio_stream_number int) error {
 	if !(audio_stream_number >= 0) {
 		return fmt.Errorf("should be audio_stream_number >= 0")
 	}
 
-	arg := strings.Fields(FFMPEG_COMMON_INPUT_ARG + "-i")
-	arg = append(arg, fp_in.Join())
-	arg = append(arg, strings.Fields(
-		FFMPEG_COMMON_OUTPUT_ARG+
-			ffmpeg_param+
-			" -map 0:a:"+strconv.Itoa(audio_stream_number))...)
-	arg = append(arg, fp_out.Join())
-
-	out, e := exec.CommandContext(ctx, "ffmpeg", arg...).CombinedOutput()
-	if e != nil {
-		return fmt.Errorf("error message: %v, ffmpeg arg: %v, ffmpeg output: %v", e, arg, string(out))
-	}
-
-	logrus.WithFields(
-		logrus.Fields{
-			"path_input":     fp_in.Join(),
-			"subproc":        "ffmpeg",
-			"subproc_param":  arg,
-			"subproc_output": string(out),
-			"where":          util.GetCurrentFunctionInfo(),
-		}).Debugf("Subprocess success")
-
-	return nil
+	output_args := append(append([]string{}, ffmpeg_args...), "-map", "0:a:"+strconv.Itoa(audio_stream_number))
+	return newFFmpegCommand(r).
+		Input(fp_in.Join()).
+		Output(fp_out.Join(), output_args...).
+		Run(ctx, logrus.Fields{
+			"path_input": fp_in.Join(),
+			"where":      util.GetCurrentFunctionInfo(),
+		})
 }
 
-func ffmpegEncodeVideoOnly(ctx context.Context, fp_in File, fp_out File, ffmpeg_param string, video_stream_number int) error {
-	arg := strings.Fields(FFMPEG_COMMON_INPUT_ARG + "-threads 0 -i")
-	arg = append(arg, fp_in.Join())
-	arg = append(arg, strings.Fields(
-		FFMPEG_COMMON_OUTPUT_ARG+
-			ffmpeg_param+
-			" -map 0:v:"+strconv.Itoa(video_stream_number))...)
-	arg = append(arg, fp_out.Join())
-
-	out, e := exec.CommandContext(ctx, "ffmpeg", arg...).CombinedOutput()
-	if e != nil {
-		return fmt.Errorf("error message: %v, ffmpeg arg: %v, ffmpeg output: %v", e, arg, string(out))
-	}
-
-	logrus.WithFields(
-		logrus.Fields{
-			"path_input":     fp_in.Join(),
-			"subproc":        "ffmpeg",
-			"subproc_param":  arg,
-			"subproc_output": string(out),
-			"where":          util.GetCurrentFunctionInfo(),
-		}).Debugf("Subprocess success")
-
-	return nil
+func ffmpegEncodeVideoOnly(ctx context.Context, r runner.Runner, fp_in File, fp_out File, ffmpeg_args []string, video_stream_number int) error {
+	output_args := append(append([]string{}, ffmpeg_args...), "-map", "0:v:"+strconv.Itoa(video_stream_number))
+	return newFFmpegCommand(r).
+		Input(fp_in.Join(), "-threads", "0").
+		Output(fp_out.Join(), output_args...).
+		Run(ctx, logrus.Fields{
+			"path_input": fp_in.Join(),
+			"where":      util.GetCurrentFunctionInfo(),
+		})
 }
 
-func ffmpegSplitVideo(ctx context.Context, fp_in File, dp_out string, splited_filename_rule File, video_stream_number int, expected_file_count int) ([]File, error) {
-	video_length, e := ffprobe.VideoTime(fp_in.Join())
+func ffmpegSplitVideo(ctx context.Context, r runner.Runner, fp_in File, dp_out string, splited_filename_rule File, video_stream_number int, expected_file_count int) ([]File, error) {
+	video_length, e := ffprobe.VideoTime(ctx, r, fp_in.Join())
 	if e != nil {
 		return nil, e
 	}
@@ -84,27 +48,19 @@ func ffmpegSplitVideo(ctx context.Context, fp_in File, dp_out string, splited_fi
 	unit_time := int(math.Max(16, math.Ceil(video_length/float64(expected_file_count))))
 	expected_file_count = int(math.Ceil(video_length / float64(unit_time)))
 
-	arg := strings.Fields(FFMPEG_COMMON_INPUT_ARG + "-i")
-	arg = append(arg, fp_in.Join())
-	arg = append(arg, strings.Fields(FFMPEG_COMMON_OUTPUT_ARG+
-		"-f segment -segment_time "+strconv.Itoa(unit_time)+
-		" -reset_timestamps 1 -c:v copy -an -map 0:v:"+strconv.Itoa(video_stream_number))...)
-	arg = append(arg, splited_filename_rule.Join())
-
-	out, e := exec.CommandContext(ctx, "ffmpeg", arg...).CombinedOutput()
+	e = newFFmpegCommand(r).
+		Input(fp_in.Join()).
+		Output(splited_filename_rule.Join(),
+			"-f", "segment", "-segment_time", strconv.Itoa(unit_time),
+			"-reset_timestamps", "1", "-c:v", "copy", "-an", "-map", "0:v:"+strconv.Itoa(video_stream_number)).
+		Run(ctx, logrus.Fields{
+			"path_input": fp_in.Join(),
+			"where":      util.GetCurrentFunctionInfo(),
+		})
 	if e != nil {
-		return nil, fmt.Errorf("error message: %v, ffmpeg arg: %v, ffmpeg output: %v", e, arg, string(out))
+		return nil, e
 	}
 
-	logrus.WithFields(
-		logrus.Fields{
-			"path_input":     fp_in.Join(),
-			"subproc":        "ffmpeg",
-			"subproc_param":  arg,
-			"subproc_output": string(out),
-			"where":          util.GetCurrentFunctionInfo(),
-		}).Debugf("Subprocess success")
-
 	temp := []File{}
 	result := []File{}
 
@@ -117,16 +73,28 @@ func ffmpegSplitVideo(ctx context.Context, fp_in File, dp_out string, splited_fi
 		})
 	}
 
-	for _, fp := range temp {
-		if util.PathIsFile(fp.Join()) {
-			result = append(result, fp)
+	// the segments are numbered from 0 without a gap; a hole would silently drop part of the video
+	missing := -1
+	for i, fp := range temp {
+		if !util.PathIsFile(fp.Join()) {
+			if missing < 0 {
+				missing = i
+			}
+			continue
 		}
+		if missing >= 0 {
+			return nil, fmt.Errorf("video segment %v is missing: %v", missing, temp[missing].Join())
+		}
+		result = append(result, fp)
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("ffmpeg split the video into no segment: %v", splited_filename_rule.Join())
 	}
 
 	return result, nil
 }
 
-func ffmpegConcatFiles(ctx context.Context, fps_in []File, fp_text, fp_out File) error {
+func ffmpegConcatFiles(ctx context.Context, r runner.Runner, fps_in []File, fp_text, fp_out File) error {
 	if len(fps_in) == 0 {
 		return fmt.Errorf("length of input file list is 0")
 	}
@@ -148,26 +116,17 @@ func ffmpegConcatFiles(ctx context.Context, fps_in []File, fp_text, fp_out File)
 	f_text.Sync()
 
 	// ffmpeg concat
-	arg := strings.Fields(FFMPEG_COMMON_INPUT_ARG + "-f concat -safe 0 -i")
-	arg = append(arg, fp_text.Join())
-	arg = append(arg, strings.Fields(FFMPEG_COMMON_OUTPUT_ARG+"-c:v copy")...)
-	arg = append(arg, fp_out.Join())
-
-	out, e := exec.CommandContext(ctx, "ffmpeg", arg...).CombinedOutput()
+	e = newFFmpegCommand(r).
+		Input(fp_text.Join(), "-f", "concat", "-safe", "0").
+		Output(fp_out.Join(), "-c:v", "copy").
+		Run(ctx, logrus.Fields{
+			"path_output": fp_out.Join(),
+			"where":       util.GetCurrentFunctionInfo(),
+		})
 	if e != nil {
-		return fmt.Errorf("error message: %v, ffmpeg arg: %v, ffmpeg output: %v", e, arg, string(out))
+		return e
 	}
 
-	logrus.WithFields(
-		logrus.Fields{
-			"path_output":    fp_out.Join(),
-			"subproc":        "ffmpeg",
-			"subproc_param":  arg,
-			"subproc_output": string(out),
-			"error":          e,
-			"where":          util.GetCurrentFunctionInfo(),
-		}).Debugf("Subprocess success")
-
 	for _, fp := range fps_in {
 		e := os.RemoveAll(fp.Join())
 		if e != nil {
@@ -183,27 +142,13 @@ func ffmpegConcatFiles(ctx context.Context, fps_in []File, fp_text, fp_out File)
 	return nil
 }
 
-func ffmpegMuxVideoAudio(ctx context.Context, fp_in_video, fp_in_audio, fp_out File) error {
-	arg := strings.Fields(FFMPEG_COMMON_INPUT_ARG)
-	arg = append(arg, "-i", fp_in_video.Join())
-	arg = append(arg, "-i", fp_in_audio.Join())
-	arg = append(arg, strings.Fields(FFMPEG_COMMON_OUTPUT_ARG+"-c:v copy -c:a copy -map 0:v:0 -map 1:a:0")...)
-	arg = append(arg, fp_out.Join())
-
-	out, e := exec.CommandContext(ctx, "ffmpeg", arg...).CombinedOutput()
-	if e != nil {
-		return fmt.Errorf("error message: %v, ffmpeg arg: %v, ffmpeg output: %v", e, arg, string(out))
-	}
-
-	logrus.WithFields(
-		logrus.Fields{
-			"path_output":    fp_out.Join(),
-			"subproc":        "ffmpeg",
-			"subproc_param":  arg,
-			"subproc_output": string(out),
-			"error":          e,
-			"where":          util.GetCurrentFunctionInfo(),
-		}).Debugf("Subprocess success")
-
-	return nil
+func ffmpegMuxVideoAudio(ctx context.Context, r runner.Runner, fp_in_video, fp_in_audio, fp_out File) error {
+	return newFFmpegCommand(r).
+		Input(fp_in_video.Join()).
+		Input(fp_in_audio.Join()).
+		Output(fp_out.Join(), "-c:v", "copy", "-c:a", "copy", "-map", "0:v:0", "-map", "1:a:0").
+		Run(ctx, logrus.Fields{
+			"path_output": fp_out.Join(),
+			"where":       util.GetCurrentFunctionInfo(),
+		})
 }
@@ -0,0 +1,288 @@
+package transcode
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/tidwall/gjson"
+)
+
+// ffmpeg_param may be a text/template evaluated against the stream being encoded, e.g.
+//
+//	-crf:v {{ ladder .Height 720 31 1080 27 23 }}
+//	{{ if gt .Height 1080 }}-vf scale=-2:1080{{ end }}
+//	-ac {{ min .Channels 2 }}
+//
+// The fields are listed in StreamVars; other ffprobe fields are read with
+// {{ .Field "tags.language" }}.
+
+// StreamVars are the source properties of the stream being encoded
+type StreamVars struct {
+	CodecName  string
+	PixFmt     string
+	Width      int
+	Height     int
+	FPS        float64
+	BitDepth   int
+	Channels   int
+	SampleRate int
+	// seconds, taken from the container if the stream does not tell
+	Duration float64
+
+	stream gjson.Result
+}
+
+// Field returns any ffprobe field of the stream, "" if there is none
+func (v StreamVars) Field(path string) string {
+	return v.stream.Get(path).String()
+}
+
+var pix_fmt_depth = regexp.MustCompile(`p(\d+)(le|be)$`)
+
+func parseRate(rate string) float64 {
+	parts := strings.SplitN(rate, "/", 2)
+	num, e := strconv.ParseFloat(parts[0], 64)
+	if e != nil {
+		return 0
+	}
+	if len(parts) == 1 {
+		return num
+	}
+	den, e := strconv.ParseFloat(parts[1], 64)
+	if e != nil || den == 0 {
+		return 0
+	}
+	return num / den
+}
+
+func newStreamVars(stream gjson.Result, file_duration float64) StreamVars {
+	v := StreamVars{
+		CodecName:  stream.Get("codec_name").String(),
+		PixFmt:     stream.Get("pix_fmt").String(),
+		Width:      int(stream.Get("width").Int()),
+		Height:     int(stream.Get("height").Int()),
+		Channels:   int(stream.Get("channels").Int()),
+		SampleRate: int(stream.Get("sample_rate").Int()),
+		Duration:   stream.Get("duration").Float(),
+		stream:     stream,
+	}
+
+	v.FPS = parseRate(stream.Get("avg_frame_rate").String())
+	if v.FPS == 0 {
+		v.FPS = parseRate(stream.Get("r_frame_rate").String())
+	}
+
+	v.BitDepth = int(stream.Get("bits_per_raw_sample").Int())
+	if v.BitDepth == 0 {
+		v.BitDepth = int(stream.Get("bits_per_sample").Int())
+	}
+	if v.BitDepth == 0 && v.PixFmt != "" {
+		v.BitDepth = 8
+		if m := pix_fmt_depth.FindStringSubmatch(v.PixFmt); m != nil {
+			v.BitDepth, _ = strconv.Atoi(m[1])
+		}
+	}
+
+	if v.Duration == 0 {
+		v.Duration = file_duration
+	}
+	return v
+}
+
+func toFloat(value interface{}) (float64, error) {
+	switch n := value.(type) {
+	case int:
+		return float64(n), nil
+	case int64:
+		return float64(n), nil
+	case float64:
+		return n, nil
+	case string:
+		return strconv.ParseFloat(n, 64)
+	}
+	return 0, fmt.Errorf("not a number: %v", value)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+func arith(op func(a, b float64) float64) func(a, b interface{}) (string, error) {
+	return func(a, b interface{}) (string, error) {
+		x, e := toFloat(a)
+		if e != nil {
+			return "", e
+		}
+		y, e := toFloat(b)
+		if e != nil {
+			return "", e
+		}
+		return formatFloat(op(x, y)), nil
+	}
+}
+
+var param_funcs = template.FuncMap{
+	// ladder value t1 r1 t2 r2 ... [default]: r of the first threshold t >= value,
+	// otherwise the default (or "" without one)
+	"ladder": func(value interface{}, table ...interface{}) (interface{}, error) {
+		x, e := toFloat(value)
+		if e != nil {
+			return nil, e
+		}
+		for i := 0; i+1 < len(table); i += 2 {
+			threshold, e := toFloat(table[i])
+			if e != nil {
+				return nil, fmt.Errorf("ladder threshold: %v", e)
+			}
+			if x <= threshold {
+				return table[i+1], nil
+			}
+		}
+		if len(table)%2 == 1 {
+			return table[len(table)-1], nil
+		}
+		return "", nil
+	},
+	"min": arith(math.Min),
+	"max": arith(math.Max),
+	"add": arith(func(a, b float64) float64 { return a + b }),
+	"sub": arith(func(a, b float64) float64 { return a - b }),
+	"mul": arith(func(a, b float64) float64 { return a * b }),
+	"div": arith(func(a, b float64) float64 {
+		if b == 0 {
+			return 0
+		}
+		return a / b
+	}),
+	// even rounds down to an even integer, as most encoders want for frame sizes
+	"even": func(value interface{}) (int, error) {
+		x, e := toFloat(value)
+		if e != nil {
+			return 0, e
+		}
+		return int(x) / 2 * 2, nil
+	},
+}
+
+// a stream every template is tried with while loading the config
+var sample_stream = gjson.Parse(`{"codec_type":"video","codec_name":"h264","pix_fmt":"yuv420p","width":1920,"height":1080,"avg_frame_rate":"24000/1001","channels":2,"sample_rate":"48000","duration":"1440.0"}`)
+
+// Param is a parsed ffmpeg_param. It is either a shell-style string, split with
+// quoting rules after the template is rendered, or a JSON array whose elements
+// are rendered one by one and passed as they are:
+//
+//	"ffmpeg_param": "-vf 'scale=-2:720:flags=lanczos, format=yuv420p' -metadata title=\"My Title\""
+//	"ffmpeg_param": ["-vf", "scale=-2:720:flags=lanczos, format=yuv420p", "-metadata", "title=My Title"]
+type Param struct {
+	parts []string
+	tmpls []*template.Template // nil for the parts which are not templates
+	array bool
+}
+
+func compileTemplate(text string) (*template.Template, error) {
+	if !strings.Contains(text, "{{") {
+		return nil, nil
+	}
+	return template.New("ffmpeg_param").Funcs(param_funcs).Option("missingkey=error").Parse(text)
+}
+
+// parseParam compiles ffmpeg_param and tries it on a sample stream,
+// so misspelled fields and unbalanced quotes show up now rather than mid-run
+func parseParam(v gjson.Result) (*Param, error) {
+	param := &Param{}
+	switch {
+	case v.Type == gjson.String:
+		param.parts = []string{v.String()}
+	case v.IsArray():
+		param.array = true
+		for i, elem := range v.Array() {
+			if elem.Type != gjson.String {
+				return nil, fmt.Errorf("element %v must be a string", i)
+			}
+			param.parts = append(param.parts, elem.String())
+		}
+	default:
+		return nil, fmt.Errorf("must be a string or an array of strings")
+	}
+
+	for _, part := range param.parts {
+		tmpl, e := compileTemplate(part)
+		if e != nil {
+			return nil, fmt.Errorf("invalid template: %v", e)
+		}
+		param.tmpls = append(param.tmpls, tmpl)
+	}
+
+	if _, e := param.Args(sample_stream, 0); e != nil {
+		return nil, e
+	}
+	return param, nil
+}
+
+// Args renders the parameter for the stream into ffmpeg arguments
+func (param *Param) Args(stream gjson.Result, file_duration float64) ([]string, error) {
+	vars := newStreamVars(stream, file_duration)
+	rendered := make([]string, len(param.parts))
+	for i, part := range param.parts {
+		if param.tmpls[i] == nil {
+			rendered[i] = part
+			continue
+		}
+		var b strings.Builder
+		if e := param.tmpls[i].Execute(&b, vars); e != nil {
+			return nil, fmt.Errorf("ffmpeg_param template: %v", e)
+		}
+		rendered[i] = b.String()
+	}
+
+	if param.array {
+		return rendered, nil
+	}
+	args, e := SplitArgs(rendered[0])
+	if e != nil {
+		return nil, fmt.Errorf("ffmpeg_param: %v", e)
+	}
+	return args, nil
+}
+
+// Encoders lists the encoders the parameter asks for with -c, -codec, -vcodec and
+// the like. A template choosing the encoder by the stream is read as rendered
+// for the sample stream.
+func (param *Param) Encoders() []string {
+	args, e := param.Args(sample_stream, 0)
+	if e != nil {
+		return nil
+	}
+	result := []string{}
+	for i := 0; i+1 < len(args); i++ {
+		option := strings.SplitN(args[i], ":", 2)[0]
+		switch option {
+		case "-c", "-codec", "-vcodec", "-acodec", "-scodec":
+		default:
+			continue
+		}
+		i++
+		if args[i] != "copy" {
+			result = append(result, args[i])
+		}
+	}
+	return result
+}
+
+// nthStream is the n-th stream of the codec type, as in ffmpeg's "-map 0:v:n"
+func (meta *Metadata) nthStream(codec_type string, n int) gjson.Result {
+	for _, info := range meta.StreamInfo {
+		if info.Get("codec_type").String() != codec_type {
+			continue
+		}
+		if n == 0 {
+			return info
+		}
+		n--
+	}
+	return gjson.Result{}
+}
@@ -0,0 +1,96 @@
+package transcode
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+// without a duration of its own, the stream takes the one of the file
+const test_param_stream = `{"codec_type": "video", "codec_name": "hevc", "pix_fmt": "yuv420p10le", "width": 3840, "height": 2160,
+	"avg_frame_rate": "30000/1001", "channels": 6, "sample_rate": "48000", "tags": {"language": "jpn"}}`
+
+func TestParamArgs(t *testing.T) {
+	cases := map[string]struct {
+		param string
+		want  []string
+	}{
+		"no template":            {`"-c:v libx265 -crf 23"`, []string{"-c:v", "libx265", "-crf", "23"}},
+		"ladder default":         {`"-crf {{ ladder .Height 720 31 1080 27 23 }}"`, []string{"-crf", "23"}},
+		"ladder on a threshold":  {`"{{ ladder .Channels 2 \"stereo\" 6 \"surround\" 8 }}"`, []string{"surround"}},
+		"ladder first step":      {`"{{ ladder .Width 4096 \"a\" \"b\" }}"`, []string{"a"}},
+		"ladder without default": {`"-crf {{ ladder .Height 720 31 1080 27 }}"`, []string{"-crf"}},
+		"min":                    {`"-ac {{ min .Channels 2 }}"`, []string{"-ac", "2"}},
+		"max":                    {`"-ac {{ max .Channels 8 }}"`, []string{"-ac", "8"}},
+		"add":                    {`"{{ add .Width 1 }}"`, []string{"3841"}},
+		"sub":                    {`"{{ sub .Height 80 }}"`, []string{"2080"}},
+		"mul":                    {`"{{ mul .Height 0.5 }}"`, []string{"1080"}},
+		"div":                    {`"{{ div .Width 3 }} {{ div 5 2 }}"`, []string{"1280", "2.5"}},
+		"div by zero":            {`"{{ div .Width 0 }}"`, []string{"0"}},
+		"string numbers":         {`"{{ add \"1.5\" (sub .SampleRate 47998) }}"`, []string{"3.5"}},
+		"even":                   {`"-vf scale={{ even (div .Width 7) }}:-2"`, []string{"-vf", "scale=548:-2"}},
+		"derived fields":         {`"{{ printf \"%.3f\" .FPS }} {{ .BitDepth }} {{ .Duration }} {{ .CodecName }} {{ .PixFmt }}"`, []string{"29.970", "10", "90", "hevc", "yuv420p10le"}},
+		"field":                  {`"-metadata:s:a:0 language={{ .Field \"tags.language\" }}"`, []string{"-metadata:s:a:0", "language=jpn"}},
+		"missing field":          {`"{{ .Field \"tags.title\" }}-an"`, []string{"-an"}},
+		"condition":              {`"-c:v libvpx-vp9 {{ if gt .Height 1080 }}-vf scale=-2:1080{{ end }}"`, []string{"-c:v", "libvpx-vp9", "-vf", "scale=-2:1080"}},
+		"quoted after render":    {`"-metadata 'title={{ .Field \"tags.language\" }} audio'"`, []string{"-metadata", "title=jpn audio"}},
+		"array":                  {`["-vf", "scale=-2:{{ min .Height 1080 }}, format=yuv420p", "-metadata", "title=a 'b'"]`, []string{"-vf", "scale=-2:1080, format=yuv420p", "-metadata", "title=a 'b'"}},
+	}
+	stream := gjson.Parse(test_param_stream)
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			param, e := parseParam(gjson.Parse(tc.param))
+			if e != nil {
+				t.Fatal(e)
+			}
+			got, e := param.Args(stream, 90)
+			if e != nil {
+				t.Fatal(e)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("args\n%q\nwant\n%q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseParamErrors(t *testing.T) {
+	cases := map[string]struct {
+		param string
+		// the start and a part of the error
+		prefix, part string
+	}{
+		"unknown function":     {`"-crf {{ crf .Height }}"`, "invalid template: ", `function "crf" not defined`},
+		"unclosed action":      {`"-crf {{ .Height "`, "invalid template: ", "unclosed action"},
+		"unknown field":        {`"-vf scale=-2:{{ .Heigth }}"`, "ffmpeg_param template: ", "can't evaluate field Heigth"},
+		"not a number":         {`"{{ add .CodecName 1 }}"`, "ffmpeg_param template: ", "error calling add"},
+		"bad ladder":           {`"{{ ladder .Height \"low\" 31 }}"`, "ffmpeg_param template: ", "ladder threshold"},
+		"in an array":          {`["-ac", "{{ min .Chanels 2 }}"]`, "ffmpeg_param template: ", "can't evaluate field Chanels"},
+		"unbalanced quote":     {`"-metadata 'title={{ .CodecName }}"`, "ffmpeg_param: ", "unterminated single quote"},
+		"not a string":         {`{"crf": 27}`, "must be a string or an array of strings", ""},
+		"element not a string": {`["-crf", 27]`, "element 1 must be a string", ""},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, e := parseParam(gjson.Parse(tc.param))
+			if e == nil {
+				t.Fatalf("%v parses", tc.param)
+			}
+			if !strings.HasPrefix(e.Error(), tc.prefix) || !strings.Contains(e.Error(), tc.part) {
+				t.Errorf("error %q, want %q ... %q", e.Error(), tc.prefix, tc.part)
+			}
+		})
+	}
+}
+
+func TestParamEncoders(t *testing.T) {
+	param, e := parseParam(gjson.Parse(`"-c:v {{ if gt .Height 720 }}libsvtav1{{ else }}libx264{{ end }} -c:a copy -acodec libopus"`))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if got, want := param.Encoders(), []string{"libsvtav1", "libopus"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("encoders %q, want %q", got, want)
+	}
+}
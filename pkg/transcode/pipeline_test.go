@@ -0,0 +1,406 @@
+package transcode
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sunrise2575/dist-ffmpeg/pkg/runner"
+	"github.com/tidwall/gjson"
+)
+
+const test_streams = `{"streams": [
+	{"index": 0, "codec_type": "video", "codec_name": "h264", "pix_fmt": "yuv420p", "width": 1920, "height": 1080, "duration": "120.0"},
+	{"index": 1, "codec_type": "audio", "codec_name": "aac", "channels": 2, "duration": "120.0", "tags": {"language": "jpn"}}
+]}`
+
+const test_config = `{
+	"video": {"ffmpeg_param": "-c:v libvpx-vp9 -crf:v {{ ladder .Height 720 31 27 }}", "target_ext": "webm"},
+	"audio": {"ffmpeg_param": "-c:a libopus -b:a 128k", "target_ext": "ogg"}
+}`
+
+// segmentCreator fakes "ffmpeg -f segment" writing the numbered segments
+func segmentCreator(indices ...int) func(c runner.Call) []string {
+	return func(c runner.Call) []string {
+		result := []string{}
+		for _, i := range indices {
+			result = append(result, fmt.Sprintf(c.Last(), i))
+		}
+		return result
+	}
+}
+
+// pipeline is a media file set up for transcoding with a faked ffmpeg and ffprobe
+type pipeline struct {
+	meta *Metadata
+	rec  *runner.Recorder
+	dir  string
+}
+
+// newPipeline runs Metadata.Init on a file named name; steps answer the ffmpeg
+// calls before the defaults, which create every output and split into 3 segments
+func newPipeline(t *testing.T, name, streams, config string, steps ...runner.Step) *pipeline {
+	t.Helper()
+	dir, temp_dir := t.TempDir(), t.TempDir()
+	fp_in := filepath.Join(dir, name)
+	if e := os.WriteFile(fp_in, []byte("original"), 0644); e != nil {
+		t.Fatal(e)
+	}
+
+	steps = append(steps,
+		runner.Step{Name: "ffprobe", Has: []string{"-show_streams"}, Stdout: streams},
+		runner.Step{Name: "ffprobe", Has: []string{"-show_entries", "format=duration"}, Stdout: "120.000000\n"},
+		runner.Step{Name: "ffmpeg", Has: []string{"-f", "segment"}, Create: segmentCreator(0, 1, 2)},
+		runner.Step{Name: "ffmpeg", Create: runner.CreateOutput},
+	)
+	rec := &runner.Recorder{Next: &runner.Script{Steps: steps}}
+
+	conf, e := ParseConfig(gjson.Parse(config))
+	if e != nil {
+		t.Fatal(e)
+	}
+	meta := &Metadata{Runner: rec}
+	if e := meta.Init(context.Background(), fp_in, conf, temp_dir); e != nil {
+		t.Fatal(e)
+	}
+	return &pipeline{meta: meta, rec: rec, dir: dir}
+}
+
+// ffmpeg returns the ffmpeg calls having every one of args
+func (p *pipeline) ffmpeg(args ...string) []runner.Call {
+	result := []runner.Call{}
+	for _, c := range p.rec.Calls() {
+		if c.Name == "ffmpeg" && c.Has(args...) {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// segment is the path of the n-th split segment of the source video
+func (p *pipeline) segment(n int) string {
+	return filepath.Join(p.meta.TempDir, fmt.Sprintf(".%v_video_%d%v", p.meta.ID, n, p.meta.FilePath.Ext))
+}
+
+func (p *pipeline) assertUntouched(t *testing.T) {
+	t.Helper()
+	data, e := os.ReadFile(p.meta.FilePath.Join())
+	if e != nil || string(data) != "original" {
+		t.Errorf("the original file was replaced: %q, %v", data, e)
+	}
+	if len(p.ffmpeg("-map", "1:a:0")) != 0 {
+		t.Error("muxed after a failure")
+	}
+}
+
+func TestVideoAndAudio(t *testing.T) {
+	p := newPipeline(t, "movie.mkv", test_streams, test_config)
+	if p.meta.FileType != "video_and_audio" {
+		t.Fatalf("file type %q", p.meta.FileType)
+	}
+
+	if e := VideoAndAudio(context.Background(), p.meta); e != nil {
+		t.Fatal(e)
+	}
+
+	if n := len(p.ffmpeg("-c:a", "libopus", "-b:a", "128k", "-map", "0:a:0")); n != 1 {
+		t.Errorf("%v audio encodes", n)
+	}
+	if n := len(p.ffmpeg("-f", "segment")); n != 1 {
+		t.Errorf("%v splits", n)
+	}
+	// the template sees the 1080p source, not a segment
+	for i := 0; i < 3; i++ {
+		calls := p.ffmpeg("-i", p.segment(i))
+		if len(calls) != 1 || !calls[0].Has("-c:v", "libvpx-vp9", "-crf:v", "27") {
+			t.Errorf("segment %v encoded with %v", i, calls)
+		}
+	}
+	if n := len(p.ffmpeg("-f", "concat")); n != 1 {
+		t.Errorf("%v concats", n)
+	}
+	if n := len(p.ffmpeg("-map", "0:v:0", "-map", "1:a:0")); n != 1 {
+		t.Errorf("%v muxes", n)
+	}
+
+	if p.meta.Output.Join() != filepath.Join(p.dir, "movie.webm") {
+		t.Errorf("output %v", p.meta.Output.Join())
+	}
+	if data, e := os.ReadFile(filepath.Join(p.dir, ".movie.mkv")); e != nil || string(data) != "original" {
+		t.Errorf("the original file was not kept aside: %q, %v", data, e)
+	}
+	if left, _ := os.ReadDir(p.meta.TempDir); len(left) != 0 {
+		names := []string{}
+		for _, f := range left {
+			names = append(names, f.Name())
+		}
+		t.Errorf("temp files left: %v", names)
+	}
+}
+
+func TestVideoAndAudioCopy(t *testing.T) {
+	config := `{
+		"video": {"rules": [{"match": {"codec_name": "^h264$"}, "action": "copy", "target_ext": "mkv"}], "ffmpeg_param": "-c:v libvpx-vp9", "target_ext": "webm"},
+		"audio": {"skip_if": {"codec_name": "^aac$"}, "ffmpeg_param": "-c:a libopus", "target_ext": "m4a"}
+	}`
+	p := newPipeline(t, "movie.mkv", test_streams, config)
+
+	if e := VideoAndAudio(context.Background(), p.meta); e != nil {
+		t.Fatal(e)
+	}
+
+	if n := len(p.ffmpeg("-vn", "-c:a", "copy")); n != 1 {
+		t.Errorf("%v audio copies", n)
+	}
+	if n := len(p.ffmpeg("-an", "-c:v", "copy")); n != 1 {
+		t.Errorf("%v video copies", n)
+	}
+	if n := len(p.ffmpeg("-f", "segment")) + len(p.ffmpeg("-c:v", "libvpx-vp9")) + len(p.ffmpeg("-c:a", "libopus")); n != 0 {
+		t.Errorf("%v encoding calls for copied streams", n)
+	}
+	if p.meta.Output.Join() != filepath.Join(p.dir, "movie.mkv") {
+		t.Errorf("output %v", p.meta.Output.Join())
+	}
+	if d := p.meta.Decisions; len(d) != 2 || d[0].CodecName != "aac" || d[1].CodecName != "h264" || d[1].Action != ActionCopy || d[1].TargetExt != "mkv" {
+		t.Errorf("decisions %+v", d)
+	}
+}
+
+func TestSingleStreamOnlySkip(t *testing.T) {
+	streams := `{"streams": [{"index": 0, "codec_type": "audio", "codec_name": "opus", "channels": 2, "duration": "200.0"}]}`
+	config := `{"audio": {"skip_if": {"codec_name": "^opus$"}, "ffmpeg_param": "-c:a libopus", "target_ext": "ogg"}}`
+	p := newPipeline(t, "song.opus", streams, config)
+
+	if e := SingleStreamOnly(context.Background(), p.meta); e != nil {
+		t.Fatal(e)
+	}
+
+	calls := p.ffmpeg()
+	if len(calls) != 1 || !calls[0].Has("-vn", "-c:a", "copy", "-map", "0:a:0") {
+		t.Errorf("calls %v", calls)
+	}
+	if p.meta.Output.Join() != filepath.Join(p.dir, "song.ogg") {
+		t.Errorf("output %v", p.meta.Output.Join())
+	}
+}
+
+func TestInitMissingSection(t *testing.T) {
+	fp_in := filepath.Join(t.TempDir(), "movie.mkv")
+	if e := os.WriteFile(fp_in, []byte("original"), 0644); e != nil {
+		t.Fatal(e)
+	}
+	conf, e := ParseConfig(gjson.Parse(`{"audio": {"ffmpeg_param": "-c:a libopus", "target_ext": "ogg"}}`))
+	if e != nil {
+		t.Fatal(e)
+	}
+	meta := &Metadata{Runner: &runner.Script{Steps: []runner.Step{
+		{Name: "ffprobe", Has: []string{"-show_streams"}, Stdout: test_streams},
+	}}}
+
+	// a video the config has nothing for is a config problem, not a file to skip
+	e = meta.Init(context.Background(), fp_in, conf, t.TempDir())
+	var conf_err *ConfigError
+	if !errors.As(e, &conf_err) || e.Error() != "invalid config: video: required by video_and_audio files" {
+		t.Fatalf("error %v", e)
+	}
+	if ClassifyError(e) != FailPermanent {
+		t.Errorf("classified %v", ClassifyError(e))
+	}
+}
+
+func TestVideoAndAudioFailingSegment(t *testing.T) {
+	var p *pipeline
+	failing := runner.Step{
+		Name:   "ffmpeg",
+		Match:  func(c runner.Call) bool { return c.Has("-i", p.segment(1)) },
+		Stderr: "segment_1.mkv: Invalid data found when processing input",
+		Err:    errors.New("exit status 1"),
+	}
+	p = newPipeline(t, "movie.mkv", test_streams, test_config, failing)
+
+	e := VideoAndAudio(context.Background(), p.meta)
+	if e == nil {
+		t.Fatal("no error")
+	}
+	// the ffmpeg error, not the cancellation it caused
+	if !strings.Contains(e.Error(), "Invalid data found") {
+		t.Errorf("error %v", e)
+	}
+	if class := ClassifyError(e); class != FailPermanent {
+		t.Errorf("classified as %v", class)
+	}
+	if len(p.ffmpeg("-f", "concat")) != 0 {
+		t.Error("concatenated after a failure")
+	}
+	p.assertUntouched(t)
+}
+
+func TestVideoAndAudioMissingSegment(t *testing.T) {
+	cases := map[string]struct {
+		segments []int
+		want     string
+	}{
+		"gap":  {[]int{0, 1, 3}, "video segment 2 is missing"},
+		"none": {nil, "no segment"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			split := runner.Step{Name: "ffmpeg", Has: []string{"-f", "segment"}, Create: segmentCreator(tc.segments...)}
+			p := newPipeline(t, "movie.mkv", test_streams, test_config, split)
+
+			e := VideoAndAudio(context.Background(), p.meta)
+			if e == nil || !strings.Contains(e.Error(), tc.want) {
+				t.Fatalf("error %v, want %q", e, tc.want)
+			}
+			if n := len(p.ffmpeg("-c:v", "libvpx-vp9")); n != 0 {
+				t.Errorf("%v segments encoded", n)
+			}
+			p.assertUntouched(t)
+		})
+	}
+}
+
+func TestVideoAndAudioCancel(t *testing.T) {
+	started := make(chan struct{})
+	var once sync.Once
+	encoding := runner.Step{
+		Name: "ffmpeg",
+		Match: func(c runner.Call) bool {
+			if !c.Has("-c:v", "libvpx-vp9") {
+				return false
+			}
+			once.Do(func() { close(started) })
+			return true
+		},
+		Block: true,
+	}
+	p := newPipeline(t, "movie.mkv", test_streams, test_config, encoding)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- VideoAndAudio(ctx, p.meta) }()
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no segment encode started")
+	}
+	cancel()
+
+	select {
+	case e := <-done:
+		if !errors.Is(e, context.Canceled) {
+			t.Errorf("error %v", e)
+		}
+		if class := ClassifyError(e); class != FailTransient {
+			t.Errorf("classified as %v", class)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("VideoAndAudio did not return after the cancel")
+	}
+	p.assertUntouched(t)
+}
+
+func TestSplitEncodeSegmentMerge(t *testing.T) {
+	p := newPipeline(t, "movie.mkv", test_streams, test_config)
+	source := p.meta.FilePath.Join()
+	ctx := context.Background()
+
+	n, e := Split(ctx, p.meta, 3)
+	if e != nil || n != 3 {
+		t.Fatalf("%v segments, %v", n, e)
+	}
+	if calls := p.ffmpeg("-c:a", "libopus", "-b:a", "128k", "-map", "0:a:0"); len(calls) != 1 || calls[0].Last() != filepath.Join(WorkDir(source), "audio.ogg") {
+		t.Errorf("audio encodes %v", calls)
+	}
+	manifest, e := ReadManifest(source)
+	if e != nil || manifest.Segments != 3 || manifest.Audio != "audio.ogg" || manifest.VideoExt != "webm" {
+		t.Errorf("manifest %+v, %v", manifest, e)
+	}
+
+	// the other tasks run on other workers, without probing the file
+	for i := 0; i < 3; i++ {
+		meta := &Metadata{Runner: p.rec}
+		meta.FilePath.Fill(source)
+		if e := EncodeSegment(ctx, meta, i); e != nil {
+			t.Fatal(e)
+		}
+		// the template saw the 1080p source when splitting
+		calls := p.ffmpeg("-i", SegmentPath(source, i))
+		if len(calls) != 1 || !calls[0].Has("-c:v", "libvpx-vp9", "-crf:v", "27", "-map", "0:v:0") {
+			t.Errorf("segment %v encoded with %v", i, calls)
+		}
+	}
+	meta := &Metadata{Runner: p.rec}
+	meta.FilePath.Fill(source)
+	if e := EncodeSegment(ctx, meta, 3); e == nil {
+		t.Error("encoded a segment out of range")
+	}
+
+	if e := Merge(ctx, meta); e != nil {
+		t.Fatal(e)
+	}
+	if n := len(p.ffmpeg("-f", "concat")); n != 1 {
+		t.Errorf("%v concats", n)
+	}
+	if n := len(p.ffmpeg("-map", "0:v:0", "-map", "1:a:0")); n != 1 {
+		t.Errorf("%v muxes", n)
+	}
+	if meta.Output.Join() != filepath.Join(p.dir, "movie.webm") {
+		t.Errorf("output %v", meta.Output.Join())
+	}
+	if _, e := os.Stat(WorkDir(source)); !os.IsNotExist(e) {
+		t.Errorf("work directory left: %v", e)
+	}
+}
+
+func TestSplitNotSplittable(t *testing.T) {
+	config := `{
+		"video": {"rules": [{"match": {"codec_name": "^h264$"}, "action": "copy", "target_ext": "mkv"}], "ffmpeg_param": "-c:v libvpx-vp9", "target_ext": "webm"},
+		"audio": {"ffmpeg_param": "-c:a libopus", "target_ext": "ogg"}
+	}`
+	p := newPipeline(t, "movie.mkv", test_streams, config)
+
+	if _, e := Split(context.Background(), p.meta, 3); !errors.Is(e, ErrNotSplittable) {
+		t.Fatalf("error %v", e)
+	}
+	if len(p.ffmpeg()) != 0 || len(p.meta.Decisions) != 0 {
+		t.Errorf("calls %v, decisions %+v", p.ffmpeg(), p.meta.Decisions)
+	}
+	if _, e := os.Stat(WorkDir(p.meta.FilePath.Join())); !os.IsNotExist(e) {
+		t.Errorf("work directory made: %v", e)
+	}
+
+	if source, ok := SourceOfWorkDir(WorkDir("/media/movie.mkv")); !ok || source != "/media/movie.mkv" {
+		t.Errorf("source %v, %v", source, ok)
+	}
+	for _, dp := range []string{"/media/.segments", "/media/movie.mkv.segments", "/media/.movie"} {
+		if _, ok := SourceOfWorkDir(dp); ok {
+			t.Errorf("%v taken for a work directory", dp)
+		}
+	}
+}
+
+func TestSwapNeedsCommit(t *testing.T) {
+	lost := errors.New("another worker finished the file first")
+	p := newPipeline(t, "song.opus", `{"streams": [{"index": 0, "codec_type": "audio", "codec_name": "opus", "channels": 2, "duration": "200.0"}]}`, test_config)
+	p.meta.Commit = func() error { return lost }
+
+	if e := SingleStreamOnly(context.Background(), p.meta); !errors.Is(e, lost) {
+		t.Fatalf("error %v", e)
+	}
+	p.assertUntouched(t)
+	if _, e := os.Stat(filepath.Join(p.dir, "song.ogg")); !os.IsNotExist(e) {
+		t.Errorf("output made: %v", e)
+	}
+	if left, _ := os.ReadDir(p.meta.TempDir); len(left) != 0 {
+		t.Errorf("%v temp files left", len(left))
+	}
+}
@@ -0,0 +1,110 @@
+package transcode
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/sunrise2575/dist-ffmpeg/pkg/util"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// A config may build on other config files:
+//
+//	{
+//	  "extends": "./config-base.json",
+//	  "include": ["./fragments/jpn-audio.json"],
+//	  "video": {"ffmpeg_param": "..."}
+//	}
+//
+// The result is the base deep-merged with every include in order, then with
+// the keys of the config itself. Paths are relative to the file naming them,
+// and the referenced files may extend or include others in turn.
+
+type resolver struct {
+	// absolute paths of the files being resolved, to detect cycles
+	stack []string
+}
+
+func (r *resolver) file(fp string) (gjson.Result, error) {
+	fp = util.PathSanitize(fp)
+	for i, visiting := range r.stack {
+		if visiting == fp {
+			return gjson.Result{}, fmt.Errorf("config inheritance cycle: %v", strings.Join(append(r.stack[i:], fp), " -> "))
+		}
+	}
+
+	raw, e := util.ReadJSONFile(fp)
+	if e != nil {
+		return gjson.Result{}, e
+	}
+	if !gjson.Valid(raw.Raw) {
+		return gjson.Result{}, fmt.Errorf("%v: invalid JSON", fp)
+	}
+
+	r.stack = append(r.stack, fp)
+	defer func() { r.stack = r.stack[:len(r.stack)-1] }()
+
+	result, e := r.config(raw, filepath.Dir(fp))
+	if e != nil {
+		return gjson.Result{}, fmt.Errorf("%v: %w", fp, e)
+	}
+	return result, nil
+}
+
+func (r *resolver) config(raw gjson.Result, dir string) (gjson.Result, error) {
+	extends, include := raw.Get("extends"), raw.Get("include")
+	if !extends.Exists() && !include.Exists() {
+		return raw, nil
+	}
+
+	parents := []string{}
+	if extends.Exists() {
+		if extends.Type != gjson.String || extends.String() == "" {
+			return gjson.Result{}, &ConfigError{Problems: []string{"extends: must be a file path"}}
+		}
+		parents = append(parents, extends.String())
+	}
+	if include.Exists() {
+		if !include.IsArray() {
+			return gjson.Result{}, &ConfigError{Problems: []string{"include: must be an array of file paths"}}
+		}
+		for i, v := range include.Array() {
+			if v.Type != gjson.String || v.String() == "" {
+				return gjson.Result{}, &ConfigError{Problems: []string{fmt.Sprintf("include.%v: must be a file path", i)}}
+			}
+			parents = append(parents, v.String())
+		}
+	}
+
+	result := gjson.Parse("{}")
+	for _, parent := range parents {
+		if !filepath.IsAbs(parent) {
+			parent = filepath.Join(dir, parent)
+		}
+		resolved, e := r.file(parent)
+		if e != nil {
+			return gjson.Result{}, e
+		}
+		if result, e = util.MergeJSON(result, resolved); e != nil {
+			return gjson.Result{}, e
+		}
+	}
+
+	own, _ := sjson.Delete(raw.Raw, "extends")
+	own, _ = sjson.Delete(own, "include")
+	return util.MergeJSON(result, gjson.Parse(own))
+}
+
+// ResolveConfig applies "extends" and "include" of a config found in the directory
+func ResolveConfig(raw gjson.Result, dir string) (gjson.Result, error) {
+	r := &resolver{}
+	return r.config(raw, dir)
+}
+
+// ResolveConfigFile reads a config file and applies its "extends" and "include"
+func ResolveConfigFile(fp string) (gjson.Result, error) {
+	r := &resolver{}
+	return r.file(fp)
+}
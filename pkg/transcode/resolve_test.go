@@ -0,0 +1,130 @@
+package transcode
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestResolveConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"base.json": `{"video": {"ffmpeg_param": "-c:v libx264", "target_ext": "mp4", "skip_if": {"codec_name": "^h264$"}},
+			"audio": {"ffmpeg_param": "-c:a aac", "target_ext": "m4a"}}`,
+		"fragments/vp9.json":      `{"include": ["webm/ext.json"], "video": {"ffmpeg_param": "-c:v libvpx-vp9", "skip_if": {"codec_name": "^vp9$"}}}`,
+		"fragments/webm/ext.json": `{"video": {"target_ext": "webm"}}`,
+		"fragments/opus.json":     `{"audio": {"ffmpeg_param": "-c:a libopus", "target_ext": "ogg"}}`,
+		"shared/diamond.json":     `{"include": ["../fragments/opus.json", "../fragments/opus.json"]}`,
+		"anime/config.json": `{
+			"extends": "../base.json",
+			"include": ["../fragments/vp9.json", "` + filepath.Join(dir, "fragments/opus.json") + `", "../shared/diamond.json"],
+			"audio": {"ffmpeg_param": "-c:a libopus -b:a 96k"}
+		}`,
+	})
+
+	raw, e := ResolveConfigFile(filepath.Join(dir, "anime/config.json"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	cases := map[string]string{
+		// the base, overridden by the includes in order, then by the file itself
+		"video.ffmpeg_param":       "-c:v libvpx-vp9",
+		"video.skip_if.codec_name": "^vp9$",
+		"video.target_ext":         "webm",
+		"audio.target_ext":         "ogg",
+		"audio.ffmpeg_param":       "-c:a libopus -b:a 96k",
+		"extends":                  "",
+		"include":                  "",
+	}
+	for path, want := range cases {
+		if got := raw.Get(path).String(); got != want {
+			t.Errorf("%v: %q, want %q", path, got, want)
+		}
+	}
+	if _, e := ParseConfig(raw); e != nil {
+		t.Errorf("resolved config: %v", e)
+	}
+}
+
+func TestResolveConfigRelativeToDir(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"media/opus.json": `{"audio": {"ffmpeg_param": "-c:a libopus", "target_ext": "ogg"}}`,
+	})
+
+	// a config read from elsewhere, e.g. a sidecar, resolves from its own directory
+	raw, e := ResolveConfig(gjson.Parse(`{"include": ["opus.json"], "audio": {"target_ext": "opus"}}`), filepath.Join(dir, "media"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if raw.Get("audio.ffmpeg_param").String() != "-c:a libopus" || raw.Get("audio.target_ext").String() != "opus" {
+		t.Errorf("resolved %v", raw.Raw)
+	}
+
+	// nothing to resolve
+	raw, e = ResolveConfig(gjson.Parse(`{"video": {"target_ext": "webm"}}`), "/nowhere")
+	if e != nil || raw.Get("video.target_ext").String() != "webm" {
+		t.Errorf("resolved %v, %v", raw.Raw, e)
+	}
+}
+
+func TestResolveConfigErrors(t *testing.T) {
+	cases := map[string]struct {
+		files map[string]string
+		// the error of resolving a.json, with the temporary directory as $
+		want string
+	}{
+		"extends itself": {map[string]string{
+			"a.json": `{"extends": "a.json"}`,
+		}, "$/a.json: config inheritance cycle: $/a.json -> $/a.json"},
+		"A -> B -> A": {map[string]string{
+			"a.json":     `{"extends": "sub/b.json"}`,
+			"sub/b.json": `{"include": ["../a.json"]}`,
+		}, "$/a.json: $/sub/b.json: config inheritance cycle: $/a.json -> $/sub/b.json -> $/a.json"},
+		"longer cycle below": {map[string]string{
+			"a.json": `{"include": ["b.json"]}`,
+			"b.json": `{"extends": "c.json"}`,
+			"c.json": `{"extends": "b.json"}`,
+		}, "$/a.json: $/b.json: $/c.json: config inheritance cycle: $/b.json -> $/c.json -> $/b.json"},
+		"missing file": {map[string]string{
+			"a.json": `{"extends": "b.json"}`,
+		}, "$/a.json: "},
+		"invalid JSON": {map[string]string{
+			"a.json": `{"extends": "b.json"}`,
+			"b.json": `{"video": `,
+		}, "$/a.json: $/b.json: invalid JSON"},
+		"extends not a string": {map[string]string{
+			"a.json": `{"extends": ["b.json"]}`,
+		}, "$/a.json: invalid config: extends: must be a file path"},
+		"include not an array": {map[string]string{
+			"a.json": `{"include": "b.json"}`,
+		}, "$/a.json: invalid config: include: must be an array of file paths"},
+		"empty include": {map[string]string{
+			"a.json": `{"include": ["b.json", ""]}`,
+			"b.json": `{}`,
+		}, "$/a.json: invalid config: include.1: must be a file path"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFiles(t, dir, tc.files)
+			_, e := ResolveConfigFile(filepath.Join(dir, "a.json"))
+			if e == nil {
+				t.Fatal("resolved")
+			}
+			want := strings.ReplaceAll(tc.want, "$", dir)
+			if !strings.HasPrefix(e.Error(), want) {
+				t.Errorf("error %q, want %q", e.Error(), want)
+			}
+			if strings.Contains(tc.want, "invalid config") {
+				var conf_err *ConfigError
+				if !errors.As(e, &conf_err) {
+					t.Errorf("error %v is not a ConfigError", e)
+				}
+			}
+		})
+	}
+}
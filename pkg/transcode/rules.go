@@ -0,0 +1,274 @@
+package transcode
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dlclark/regexp2"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/util"
+	"github.com/tidwall/gjson"
+)
+
+// Every config section may have an ordered list of rules; the first one whose
+// conditions all hold decides how the stream is handled:
+//
+//	"rules": [
+//	  {"match": {"codec_name": "^(vp9)$", "pix_fmt": "^(yuv420p)$"}, "action": "copy"},
+//	  {"match": {"height": ">= 2160"}, "ffmpeg_param": "... -crf:v 31", "target_ext": "webm"},
+//	  {"match": {"pix_fmt": "10le$", "bit_rate": "< 2M"}, "ffmpeg_param": "..."}
+//	]
+//
+// A condition is a regex, or a comparison (<, <=, >, >=, ==, !=) with a number
+// that may end in K, M or G. Besides the ffprobe fields, "fps" and "bit_depth"
+// can be used. The section's own ffmpeg_param and target_ext are used when no
+// rule matches, and fill in what a rule leaves out.
+// "skip_if" is the same as a first rule with the action "copy".
+
+const (
+	ActionEncode = "encode"
+	ActionCopy   = "copy"
+)
+
+type condition struct {
+	key string
+
+	// either a regex or a numeric comparison
+	re     *regexp2.Regexp
+	op     string
+	number float64
+}
+
+var comparison = regexp.MustCompile(`^\s*(<=|>=|==|!=|<|>)\s*([0-9]*\.?[0-9]+)\s*([kKmMgG]?)\s*$`)
+
+var number_suffix = map[string]float64{"": 1, "k": 1e3, "m": 1e6, "g": 1e9}
+
+func parseCondition(key, text string) (condition, error) {
+	if m := comparison.FindStringSubmatch(text); m != nil {
+		number, e := strconv.ParseFloat(m[2], 64)
+		if e != nil {
+			return condition{}, fmt.Errorf("invalid number %q: %v", m[2], e)
+		}
+		return condition{key: key, op: m[1], number: number * number_suffix[strings.ToLower(m[3])]}, nil
+	}
+	re, e := regexp2.Compile(text, 0)
+	if e != nil {
+		return condition{}, fmt.Errorf("invalid regex %q: %v", text, e)
+	}
+	return condition{key: key, re: re}, nil
+}
+
+func (c condition) match(value gjson.Result) bool {
+	if c.re != nil {
+		matched, e := c.re.MatchString(value.String())
+		return e == nil && matched
+	}
+
+	// ffprobe writes many numbers as strings, e.g. "bit_rate": "2000000"
+	x, e := strconv.ParseFloat(value.String(), 64)
+	if e != nil {
+		return false
+	}
+	switch c.op {
+	case "<":
+		return x < c.number
+	case "<=":
+		return x <= c.number
+	case ">":
+		return x > c.number
+	case ">=":
+		return x >= c.number
+	case "==":
+		return x == c.number
+	case "!=":
+		return x != c.number
+	}
+	return false
+}
+
+// Rule is one entry of the "rules" list of a config section
+type Rule struct {
+	conditions []condition
+	// conditions on fields the stream does not have are ignored instead of failing,
+	// which is how "skip_if" always worked
+	lenient bool
+
+	Action    string
+	Param     *Param
+	TargetExt string
+}
+
+// streamField reads a field of the stream; "fps" and "bit_depth" are derived
+// the same way as for ffmpeg_param templates when ffprobe has no such field
+func streamField(stream gjson.Result, key string) gjson.Result {
+	value := stream.Get(key)
+	if value.Exists() {
+		return value
+	}
+	switch key {
+	case "fps":
+		if fps := newStreamVars(stream, 0).FPS; fps > 0 {
+			return gjson.Parse(formatFloat(fps))
+		}
+	case "bit_depth":
+		if depth := newStreamVars(stream, 0).BitDepth; depth > 0 {
+			return gjson.Parse(strconv.Itoa(depth))
+		}
+	}
+	return value
+}
+
+// Match reports whether every condition of the rule holds for the stream
+func (rule *Rule) Match(stream gjson.Result) bool {
+	for _, c := range rule.conditions {
+		value := streamField(stream, c.key)
+		if !value.Exists() || value.IsObject() || value.IsArray() {
+			if rule.lenient {
+				continue
+			}
+			return false
+		}
+		if !c.match(value) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *configParser) conditions(path string, v gjson.Result) []condition {
+	if !v.IsObject() {
+		p.fail(path, "must be an object of conditions")
+		return nil
+	}
+	keys := []string{}
+	for key := range util.FlattenJSONKey(v) {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := []condition{}
+	for _, key := range keys {
+		value := v.Get(key)
+		if value.Type != gjson.String {
+			p.fail(path+"."+key, "must be a regex or a comparison string")
+			continue
+		}
+		c, e := parseCondition(key, value.String())
+		if e != nil {
+			p.fail(path+"."+key, "%v", e)
+			continue
+		}
+		result = append(result, c)
+	}
+	return result
+}
+
+func (p *configParser) rule(path string, v gjson.Result) *Rule {
+	if !v.IsObject() {
+		p.fail(path, "must be an object")
+		return nil
+	}
+	result := &Rule{Action: ActionEncode}
+
+	v.ForEach(func(key, value gjson.Result) bool {
+		path := path + "." + key.String()
+		switch key.String() {
+		case "match":
+			result.conditions = p.conditions(path, value)
+		case "action":
+			switch value.String() {
+			case ActionEncode, ActionCopy:
+				result.Action = value.String()
+			default:
+				p.fail(path, "must be %q or %q", ActionEncode, ActionCopy)
+			}
+		case "ffmpeg_param":
+			param, e := parseParam(value)
+			if e != nil {
+				p.fail(path, "%v", e)
+				break
+			}
+			result.Param = param
+		case "target_ext":
+			if value.Type != gjson.String || value.String() == "" {
+				p.fail(path, "must be a non-empty string")
+				break
+			}
+			result.TargetExt = strings.TrimPrefix(value.String(), ".")
+		default:
+			p.fail(path, "unknown key")
+		}
+		return true
+	})
+
+	if result.Action == ActionCopy && v.Get("ffmpeg_param").Exists() {
+		p.fail(path+".ffmpeg_param", "not used by the copy action")
+	}
+	return result
+}
+
+// Decision is how one stream is handled
+type Decision struct {
+	Action string
+	// ffmpeg arguments of the encode action
+	Args      []string
+	TargetExt string
+	// index of the matched rule, -1 for the section default
+	Rule int
+}
+
+// Decide picks the rule for the stream and renders its ffmpeg_param
+func (section *SectionConfig) Decide(stream gjson.Result, file_duration float64) (Decision, error) {
+	for i, rule := range section.Rules {
+		if !rule.Match(stream) {
+			continue
+		}
+		d := Decision{Action: rule.Action, TargetExt: rule.TargetExt, Rule: i}
+		if d.TargetExt == "" {
+			d.TargetExt = section.TargetExt
+		}
+		if d.Action == ActionCopy {
+			return d, nil
+		}
+		// a rule without ffmpeg_param only changes the target_ext
+		param := rule.Param
+		if param == nil {
+			param = section.Param
+		}
+		args, e := param.Args(stream, file_duration)
+		d.Args = args
+		return d, e
+	}
+
+	if section.Param == nil {
+		return Decision{}, fmt.Errorf("no rule matches the stream and the section has no default ffmpeg_param")
+	}
+	args, e := section.Param.Args(stream, file_duration)
+	return Decision{Action: ActionEncode, Args: args, TargetExt: section.TargetExt, Rule: -1}, e
+}
+
+// StreamDecision is the Decision taken for the n-th stream of a codec type
+type StreamDecision struct {
+	CodecType string
+	N         int
+	CodecName string
+	Decision
+}
+
+// decide picks the rule of the config section for the n-th stream of the codec type
+// and keeps it in meta.Decisions
+func (meta *Metadata) decide(section, codec_type string, n int) (Decision, error) {
+	stream := meta.nthStream(codec_type, n)
+	d, e := meta.Config.Section(section).Decide(stream, meta.Duration())
+	if e == nil {
+		meta.Decisions = append(meta.Decisions, StreamDecision{
+			CodecType: codec_type,
+			N:         n,
+			CodecName: stream.Get("codec_name").String(),
+			Decision:  d,
+		})
+	}
+	return d, e
+}
@@ -0,0 +1,154 @@
+package transcode
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+const test_rule_stream = `{"index": 0, "codec_type": "video", "codec_name": "h264", "pix_fmt": "yuv420p10le",
+	"width": 3840, "height": 2160, "bit_rate": "2500000", "avg_frame_rate": "24000/1001", "tags": {"language": "jpn"}}`
+
+func TestRuleMatch(t *testing.T) {
+	cases := map[string]struct {
+		key, text string
+		want      bool
+	}{
+		"regex":                  {"codec_name", "^h26[45]$", true},
+		"regex not matching":     {"codec_name", "^vp9$", false},
+		"regex on a number":      {"width", "^38", true},
+		"nested field":           {"tags.language", "^jpn$", true},
+		"less":                   {"height", "< 2160", false},
+		"less or equal":          {"height", "<=2160", true},
+		"greater":                {"height", "> 2160", false},
+		"greater or equal":       {"height", ">= 2160", true},
+		"equal":                  {"height", "== 2160", true},
+		"not equal":              {"height", "!= 2160", false},
+		"string number":          {"bit_rate", "== 2500000", true},
+		"K suffix":               {"bit_rate", ">= 2500k", true},
+		"M suffix with fraction": {"bit_rate", "> 2.5M", false},
+		"G suffix":               {"bit_rate", "< 1g", true},
+		"derived fps":            {"fps", "< 24", true},
+		"derived fps above":      {"fps", "> 23.9", true},
+		"derived bit_depth":      {"bit_depth", "== 10", true},
+		"comparison on a string": {"codec_name", "> 1", false},
+		"missing field":          {"sample_rate", ">= 44100", false},
+		"object field":           {"tags", "jpn", false},
+	}
+	stream := gjson.Parse(test_rule_stream)
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			c, e := parseCondition(tc.key, tc.text)
+			if e != nil {
+				t.Fatal(e)
+			}
+			rule := &Rule{conditions: []condition{c}}
+			if got := rule.Match(stream); got != tc.want {
+				t.Errorf("%v %q: %v, want %v", tc.key, tc.text, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRuleMatchAll(t *testing.T) {
+	stream := gjson.Parse(test_rule_stream)
+	conditions := func(texts ...string) []condition {
+		result := []condition{}
+		for i := 0; i < len(texts); i += 2 {
+			c, e := parseCondition(texts[i], texts[i+1])
+			if e != nil {
+				t.Fatal(e)
+			}
+			result = append(result, c)
+		}
+		return result
+	}
+
+	if rule := (&Rule{conditions: conditions("height", ">= 2160", "pix_fmt", "10le$")}); !rule.Match(stream) {
+		t.Errorf("every condition holds")
+	}
+	if rule := (&Rule{conditions: conditions("height", ">= 2160", "pix_fmt", "^yuv420p$")}); rule.Match(stream) {
+		t.Errorf("one condition fails")
+	}
+	if rule := (&Rule{}); !rule.Match(stream) {
+		t.Errorf("no condition")
+	}
+
+	// skip_if ignores the fields the stream does not have, but not the failing ones
+	lenient := &Rule{conditions: conditions("codec_name", "^h264$", "profile", "^High$"), lenient: true}
+	if !lenient.Match(stream) {
+		t.Errorf("lenient rule fails on a missing field")
+	}
+	lenient.conditions = conditions("codec_name", "^vp9$", "profile", "^High$")
+	if lenient.Match(stream) {
+		t.Errorf("lenient rule ignores a failing condition")
+	}
+}
+
+func TestDecide(t *testing.T) {
+	conf, e := ParseConfig(gjson.Parse(`{"video": {
+		"ffmpeg_param": "-c:v libvpx-vp9 -crf:v 31",
+		"target_ext": "webm",
+		"skip_if": {"codec_name": "^vp9$", "profile": "^Main$"},
+		"rules": [
+			{"match": {"height": ">= 2160"}, "ffmpeg_param": "-c:v libsvtav1 -crf 35", "target_ext": "mkv"},
+			{"match": {"height": ">= 1080", "bit_rate": "< 2M"}, "action": "copy"},
+			{"match": {"pix_fmt": "10le$"}, "target_ext": "mkv"},
+			{"match": {"height": ">= 1080"}, "ffmpeg_param": "-c:v libvpx-vp9 -crf:v 27"}
+		]
+	}}`))
+	if e != nil {
+		t.Fatal(e)
+	}
+	section := conf.Section("video")
+
+	cases := map[string]struct {
+		stream string
+		want   Decision
+	}{
+		"skip_if first": {`{"codec_name": "vp9", "height": 2160, "pix_fmt": "yuv420p"}`,
+			Decision{Action: ActionCopy, TargetExt: "webm", Rule: 0}},
+		"first matching rule": {`{"codec_name": "h264", "height": 2160, "bit_rate": "1000000", "pix_fmt": "yuv420p10le"}`,
+			Decision{Action: ActionEncode, Args: []string{"-c:v", "libsvtav1", "-crf", "35"}, TargetExt: "mkv", Rule: 1}},
+		"copy rule": {`{"codec_name": "h264", "height": 1080, "bit_rate": "1500000", "pix_fmt": "yuv420p10le"}`,
+			Decision{Action: ActionCopy, TargetExt: "webm", Rule: 2}},
+		"rule without ffmpeg_param": {`{"codec_name": "h264", "height": 1080, "bit_rate": "5000000", "pix_fmt": "yuv420p10le"}`,
+			Decision{Action: ActionEncode, Args: []string{"-c:v", "libvpx-vp9", "-crf:v", "31"}, TargetExt: "mkv", Rule: 3}},
+		"rule without target_ext": {`{"codec_name": "h264", "height": 1080, "bit_rate": "5000000", "pix_fmt": "yuv420p"}`,
+			Decision{Action: ActionEncode, Args: []string{"-c:v", "libvpx-vp9", "-crf:v", "27"}, TargetExt: "webm", Rule: 4}},
+		"missing field fails the rule": {`{"codec_name": "h264", "height": 1080, "pix_fmt": "yuv420p"}`,
+			Decision{Action: ActionEncode, Args: []string{"-c:v", "libvpx-vp9", "-crf:v", "27"}, TargetExt: "webm", Rule: 4}},
+		"no rule matches": {`{"codec_name": "h264", "height": 720, "pix_fmt": "yuv420p"}`,
+			Decision{Action: ActionEncode, Args: []string{"-c:v", "libvpx-vp9", "-crf:v", "31"}, TargetExt: "webm", Rule: -1}},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, e := section.Decide(gjson.Parse(tc.stream), 120)
+			if e != nil {
+				t.Fatal(e)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("decision\n%+v\nwant\n%+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDecideWithoutDefault(t *testing.T) {
+	conf, e := ParseConfig(gjson.Parse(`{"video": {"target_ext": "webm", "rules": [
+		{"match": {"height": ">= 2160"}, "ffmpeg_param": "-c:v libsvtav1"}
+	]}}`))
+	if e != nil {
+		t.Fatal(e)
+	}
+	section := conf.Section("video")
+
+	if d, e := section.Decide(gjson.Parse(`{"height": 2160}`), 120); e != nil || d.Rule != 0 {
+		t.Errorf("matching rule: %+v, %v", d, e)
+	}
+	_, e = section.Decide(gjson.Parse(`{"height": 720}`), 120)
+	if want := "no rule matches the stream and the section has no default ffmpeg_param"; e == nil || e.Error() != want {
+		t.Errorf("error %v, want %q", e, want)
+	}
+}
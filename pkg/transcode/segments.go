@@ -0,0 +1,241 @@
+package transcode
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// A video may be transcoded by several workers at once: Split cuts its video
+// stream into segments and encodes its audio in a work directory next to the
+// file, where every worker sees them; EncodeSegment encodes one segment, and
+// Merge concatenates the encoded segments, muxes the audio in and replaces the
+// file. Only FilePath, Runner and StageObserver of the Metadata are used by
+// EncodeSegment and Merge, so they run without Init.
+
+// ErrNotSplittable is returned by Split for a file whose video is not encoded,
+// or which has no video; such a file is transcoded whole
+var ErrNotSplittable = errors.New("not splittable")
+
+const (
+	work_dir_suffix = ".segments"
+	manifest_name   = "manifest.json"
+)
+
+// WorkDir is the hidden directory the segments of the file are kept in
+func WorkDir(fp string) string {
+	dir, name := filepath.Split(fp)
+	return filepath.Join(dir, "."+name+work_dir_suffix)
+}
+
+// SourceOfWorkDir returns the file of a WorkDir; false if the directory is not one
+func SourceOfWorkDir(dp string) (string, bool) {
+	dir, name := filepath.Split(filepath.Clean(dp))
+	if !strings.HasPrefix(name, ".") || !strings.HasSuffix(name, work_dir_suffix) || len(name) <= len(work_dir_suffix)+1 {
+		return "", false
+	}
+	return filepath.Join(dir, name[1:len(name)-len(work_dir_suffix)]), true
+}
+
+// SegmentPath is the n-th segment of the file cut by Split
+func SegmentPath(fp string, n int) string {
+	return filepath.Join(WorkDir(fp), fmt.Sprintf("segment_%d%v", n, filepath.Ext(fp)))
+}
+
+// Manifest is how Split cut a file, kept in its WorkDir for the other tasks
+type Manifest struct {
+	Segments int `json:"segments"`
+	// how the video segments are encoded
+	VideoArgs []string `json:"video_args"`
+	VideoExt  string   `json:"video_ext"`
+	// the encoded audio in the WorkDir; empty for a video without audio
+	Audio string `json:"audio,omitempty"`
+}
+
+// ReadManifest reads the manifest Split wrote for the file
+func ReadManifest(fp string) (Manifest, error) {
+	result := Manifest{}
+	data, e := os.ReadFile(filepath.Join(WorkDir(fp), manifest_name))
+	if e != nil {
+		return result, e
+	}
+	if e := json.Unmarshal(data, &result); e != nil {
+		return result, fmt.Errorf("broken segment manifest of %v: %w", fp, e)
+	}
+	return result, nil
+}
+
+// encodedSegment is the n-th segment once encoded
+func encodedSegment(work_dir string, n int, manifest Manifest) File {
+	return File{
+		Dir:  work_dir,
+		Name: fmt.Sprintf("segment_%d_converted", n),
+		Ext:  "." + manifest.VideoExt,
+	}
+}
+
+// Split cuts the video of the file into about n segments, encodes its audio
+// and writes the Manifest, all in the WorkDir. It returns the number of segments.
+// A WorkDir left by an earlier attempt is replaced.
+func Split(ctx context.Context, meta *Metadata, n int) (int, error) {
+	if meta.FileType != "video" && meta.FileType != "video_and_audio" {
+		return 0, ErrNotSplittable
+	}
+
+	// decide both streams before spending any time on encoding,
+	// in the order VideoAndAudio does
+	audio_stream_idx, video_stream_idx := selectAudioStream(meta), 0
+	var audio_decision Decision
+	if meta.FileType == "video_and_audio" {
+		var e error
+		if audio_decision, e = meta.decide("audio", "audio", audio_stream_idx); e != nil {
+			return 0, e
+		}
+	}
+	video_decision, e := meta.decide("video", "video", video_stream_idx)
+	if e != nil {
+		return 0, e
+	}
+	if video_decision.Action == ActionCopy {
+		// decided again by the whole file transcoding
+		meta.Decisions = nil
+		return 0, ErrNotSplittable
+	}
+
+	work_dir := WorkDir(meta.FilePath.Join())
+	if e := os.RemoveAll(work_dir); e != nil {
+		return 0, e
+	}
+	if e := os.MkdirAll(work_dir, 0755); e != nil {
+		return 0, fmt.Errorf("unable to create the segment directory: %w", e)
+	}
+	result, e := func() (int, error) {
+		manifest := Manifest{VideoArgs: video_decision.Args, VideoExt: video_decision.TargetExt}
+
+		if meta.FileType == "video_and_audio" {
+			fp_audio := File{Dir: work_dir, Name: "audio", Ext: "." + audio_decision.TargetExt}
+			if e := <-encodeAudioPart(ctx, meta, fp_audio, audio_stream_idx, audio_decision); e != nil {
+				return 0, e
+			}
+			manifest.Audio = fp_audio.Name + fp_audio.Ext
+		}
+
+		split_file_rule := File{
+			Dir:  work_dir,
+			Name: "segment_%d", // must use %d
+			Ext:  meta.FilePath.Ext,
+		}
+		start := time.Now()
+		fps_video, e := ffmpegSplitVideo(ctx, meta.Runner, meta.FilePath, work_dir, split_file_rule, video_stream_idx, n)
+		meta.observeStage("split", start)
+		if e != nil {
+			logrus.Errorf("ffmpegSplitVideo() failed: %v", e)
+			return 0, e
+		}
+		manifest.Segments = len(fps_video)
+
+		data, _ := json.MarshalIndent(manifest, "", "  ")
+		if e := os.WriteFile(filepath.Join(work_dir, manifest_name), data, 0644); e != nil {
+			return 0, e
+		}
+		return manifest.Segments, nil
+	}()
+	if e != nil {
+		os.RemoveAll(work_dir)
+		return 0, e
+	}
+	return result, nil
+}
+
+// EncodeSegment encodes the n-th segment of the file. The segment is kept, so
+// it can be encoded again; the encoded one replaces an earlier one at once.
+func EncodeSegment(ctx context.Context, meta *Metadata, n int) error {
+	manifest, e := ReadManifest(meta.FilePath.Join())
+	if e != nil {
+		return e
+	}
+	if n < 0 || n >= manifest.Segments {
+		return fmt.Errorf("no segment %v of %v, it has %v", n, meta.FilePath.Join(), manifest.Segments)
+	}
+
+	fp_in := File{}
+	fp_in.Fill(SegmentPath(meta.FilePath.Join(), n))
+	fp_out := encodedSegment(fp_in.Dir, n, manifest)
+
+	// another worker may encode the same segment at the same time
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	fp_temp := File{Dir: fp_out.Dir, Name: fmt.Sprintf(".%v_%x", fp_out.Name, suffix), Ext: fp_out.Ext}
+
+	start := time.Now()
+	e = ffmpegEncodeVideoOnly(ctx, meta.Runner, fp_in, fp_temp, manifest.VideoArgs, 0)
+	meta.observeStage("segment_encode", start)
+	if e != nil {
+		os.Remove(fp_temp.Join())
+		logrus.Errorf("ffmpegEncodeVideoOnly() failed: %v", e)
+		return e
+	}
+	return os.Rename(fp_temp.Join(), fp_out.Join())
+}
+
+// Merge concatenates the encoded segments of the file, muxes the audio in,
+// replaces the file and removes the WorkDir
+func Merge(ctx context.Context, meta *Metadata) error {
+	work_dir := WorkDir(meta.FilePath.Join())
+	manifest, e := ReadManifest(meta.FilePath.Join())
+	if e != nil {
+		return e
+	}
+
+	fps_video_comp := []File{}
+	for i := 0; i < manifest.Segments; i++ {
+		fp := encodedSegment(work_dir, i, manifest)
+		if _, e := os.Stat(fp.Join()); e != nil {
+			return fmt.Errorf("video segment %v is not encoded: %w", i, e)
+		}
+		fps_video_comp = append(fps_video_comp, fp)
+	}
+
+	fp_video := File{Dir: work_dir, Name: "videoconcat", Ext: "." + manifest.VideoExt}
+	fp_text := File{Dir: work_dir, Name: "concatlist", Ext: ".txt"}
+	start := time.Now()
+	e = ffmpegConcatFiles(ctx, meta.Runner, fps_video_comp, fp_text, fp_video)
+	meta.observeStage("concat", start)
+	if e != nil {
+		logrus.Errorf("ffmpegConcatFiles() failed: %v", e)
+		return e
+	}
+
+	fp_out := fp_video
+	if manifest.Audio != "" {
+		fp_audio := File{}
+		fp_audio.Fill(filepath.Join(work_dir, manifest.Audio))
+		fp_out = File{Dir: work_dir, Name: "mux", Ext: fp_video.Ext}
+
+		start = time.Now()
+		e = ffmpegMuxVideoAudio(ctx, meta.Runner, fp_video, fp_audio, fp_out)
+		meta.observeStage("mux", start)
+		if e != nil {
+			logrus.Errorf("ffmpegMuxVideoAudio() failed: %v", e)
+			return e
+		}
+	}
+
+	start = time.Now()
+	e = meta.SwapFileToOriginal(fp_out)
+	meta.observeStage("swap", start)
+	if e != nil {
+		logrus.Errorf("meta.SwapFileToOriginal() failed: %v", e)
+		return e
+	}
+
+	return os.RemoveAll(work_dir)
+}
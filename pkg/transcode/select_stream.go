@@ -1,9 +1,5 @@
 package transcode
 
-import (
-	"github.com/sunrise2575/dist-ffmpeg/pkg/util"
-)
-
 func selectAudioStream(meta *Metadata) int {
 	// check the number of audio streams
 	scoreboard := map[int]uint{}
@@ -23,45 +19,22 @@ func selectAudioStream(meta *Metadata) int {
 		return 0
 	}
 
-	// check the selection_prefer query
-	prefer := meta.Config.Get("audio.selection_prefer")
-	if !prefer.Exists() {
+	// the selection_prefer and selection_priority queries are cross-checked by ParseConfig
+	audio := meta.Config.Section("audio")
+	if audio == nil || audio.SelectionPrefer == nil || len(audio.SelectionPriority) == 0 {
 		return 0
 	}
 
-	if !meta.Config.Get("audio.selection_priority").Exists() {
-		return 0
-	}
-
-	// check the selection_priority query
-	priority_keys := map[string]bool{}
-	priority_keys_slice := []string{}
-	for _, v := range meta.Config.Get("audio.selection_priority").Array() {
-		priority_keys[v.String()] = true
-		priority_keys_slice = append(priority_keys_slice, v.String())
-	}
-
-	// check the key equivalence of two query
-	prefer_keys := util.FlattenJSONKey(prefer)
-	for key := range prefer_keys {
-		if !priority_keys[key] {
-			return 0
-		}
-	}
-
 	// find best-fit
 	for index := range scoreboard {
 		target := meta.StreamInfo[index]
-		target_keys := util.FlattenJSONKey(target)
 		score_unit := 63
 
 		// this part must use a slice (i.e. the slice has an order)
 		// the extracted element may change when using 'range' for map
-		for _, key := range priority_keys_slice {
-			if target_keys[key] {
-				if util.MatchRegexPCRE2(prefer.Get(key).String(), target.Get(key).String()) {
-					scoreboard[index] += (1 << score_unit) // relative to the extracting order by the 'range' statement
-				}
+		for _, key := range audio.SelectionPriority {
+			if audio.SelectionPrefer.MatchKey(key, target) {
+				scoreboard[index] += (1 << score_unit) // relative to the extracting order by the 'range' statement
 			}
 			score_unit--
 			if score_unit < 0 {
@@ -89,27 +62,3 @@ func selectAudioStream(meta *Metadata) int {
 
 	return real_index_map[max_index]
 }
-
-func isSkippable(meta *Metadata, stream_idx int) bool {
-
-	target := meta.StreamInfo[stream_idx]
-	target_keys := util.FlattenJSONKey(target)
-
-	query := meta.Config.Get(meta.FileType).Get("skip_if")
-	query_keys := util.FlattenJSONKey(query)
-
-	if !(target.Exists() && query.Exists()) {
-		return false
-	}
-
-	for query_key := range query_keys {
-		if target_keys[query_key] {
-			if !util.MatchRegexPCRE2(query.Get(query_key).String(), target.Get(query_key).String()) {
-				// not matching
-				return false
-			}
-		}
-	}
-
-	return true
-}
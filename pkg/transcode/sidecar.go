@@ -0,0 +1,76 @@
+package transcode
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/sunrise2575/dist-ffmpeg/pkg/util"
+)
+
+// SIDECAR_NAME overrides the config for every file in its directory and the subdirectories;
+// <name>.dist-ffmpeg.json next to a media file <name>.<ext> overrides it for that file only
+const SIDECAR_NAME = ".dist-ffmpeg.json"
+
+// ErrSidecar is wrapped by errors of unreadable or malformed override files
+var ErrSidecar = errors.New("invalid sidecar config")
+
+// Sidecars lists the override files of the media file, from the least specific
+// (the root directory) to the most specific (the file itself)
+func Sidecars(fp_in string) []string {
+	fp_in = util.PathSanitize(fp_in)
+	dir, name, _ := util.PathSplit(fp_in)
+
+	// every ancestor directory, root first; dir ends with a separator
+	dirs := []string{}
+	for d := filepath.Clean(dir); ; d = filepath.Dir(d) {
+		dirs = append(dirs, d)
+		if parent := filepath.Dir(d); parent == d {
+			break
+		}
+	}
+
+	result := []string{}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if fp := filepath.Join(dirs[i], SIDECAR_NAME); util.PathIsFile(fp) {
+			result = append(result, fp)
+		}
+	}
+	if fp := filepath.Join(dir, name+SIDECAR_NAME); util.PathIsFile(fp) {
+		result = append(result, fp)
+	}
+	return result
+}
+
+// EffectiveConfig deep-merges the sidecar files of the media file over the base config
+// and validates the result. It also returns the sidecar files applied, in order.
+func EffectiveConfig(fp_in string, base *Config) (*Config, []string, error) {
+	sidecars := Sidecars(fp_in)
+	if len(sidecars) == 0 {
+		return base, sidecars, nil
+	}
+
+	raw := base.Raw
+	for _, fp := range sidecars {
+		override, e := util.ReadJSONFile(fp)
+		if e != nil {
+			return nil, nil, fmt.Errorf("%w %v: %v", ErrSidecar, fp, e)
+		}
+		if !override.IsObject() {
+			return nil, nil, fmt.Errorf("%w %v: not a JSON object", ErrSidecar, fp)
+		}
+		if override, e = ResolveConfig(override, filepath.Dir(fp)); e != nil {
+			return nil, nil, fmt.Errorf("%w %v: %v", ErrSidecar, fp, e)
+		}
+		if raw, e = util.MergeJSON(raw, override); e != nil {
+			return nil, nil, fmt.Errorf("%w %v: %v", ErrSidecar, fp, e)
+		}
+	}
+
+	conf, e := ParseConfig(raw)
+	if e != nil {
+		return nil, nil, fmt.Errorf("%w %v: %v", ErrSidecar, strings.Join(sidecars, ", "), e)
+	}
+	return conf, sidecars, nil
+}
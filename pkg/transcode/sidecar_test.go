@@ -0,0 +1,167 @@
+package transcode
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+// writeFiles creates the files under dir, with their directories
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		fp := filepath.Join(dir, name)
+		if e := os.MkdirAll(filepath.Dir(fp), 0755); e != nil {
+			t.Fatal(e)
+		}
+		if e := os.WriteFile(fp, []byte(content), 0644); e != nil {
+			t.Fatal(e)
+		}
+	}
+}
+
+const test_sidecar_base = `{
+	"video": {"ffmpeg_param": "-c:v libvpx-vp9", "target_ext": "webm"},
+	"audio": {"ffmpeg_param": "-c:a libopus", "target_ext": "ogg"}
+}`
+
+func TestSidecars(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"media/.dist-ffmpeg.json":                `{}`,
+		"media/anime/.dist-ffmpeg.json":          `{}`,
+		"media/anime/a.dist-ffmpeg.json":         `{}`,
+		"media/anime/season1/b.dist-ffmpeg.json": `{}`,
+		// a directory named like a sidecar is not one
+		"media/movie/.dist-ffmpeg.json/readme": ``,
+	})
+
+	cases := map[string]struct {
+		path string
+		want []string
+	}{
+		"directory": {"media/c.mkv", []string{
+			"media/.dist-ffmpeg.json"}},
+		"root first": {"media/anime/c.mkv", []string{
+			"media/.dist-ffmpeg.json",
+			"media/anime/.dist-ffmpeg.json"}},
+		"file last": {"media/anime/a.mkv", []string{
+			"media/.dist-ffmpeg.json",
+			"media/anime/.dist-ffmpeg.json",
+			"media/anime/a.dist-ffmpeg.json"}},
+		"subdirectory without its own": {"media/anime/season1/b.mkv", []string{
+			"media/.dist-ffmpeg.json",
+			"media/anime/.dist-ffmpeg.json",
+			"media/anime/season1/b.dist-ffmpeg.json"}},
+		"other file of the directory": {"media/anime/season1/c.mkv", []string{
+			"media/.dist-ffmpeg.json",
+			"media/anime/.dist-ffmpeg.json"}},
+		"not a file": {"media/movie/d.mkv", []string{"media/.dist-ffmpeg.json"}},
+		"none":       {"e.mkv", []string{}},
+		"unsanitized": {"media/anime/../anime/./a.mkv", []string{
+			"media/.dist-ffmpeg.json",
+			"media/anime/.dist-ffmpeg.json",
+			"media/anime/a.dist-ffmpeg.json"}},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			want := []string{}
+			for _, fp := range tc.want {
+				want = append(want, filepath.Join(dir, fp))
+			}
+			if got := Sidecars(filepath.Join(dir, tc.path)); !reflect.DeepEqual(got, want) {
+				t.Errorf("sidecars\n%q\nwant\n%q", got, want)
+			}
+		})
+	}
+}
+
+func TestEffectiveConfig(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"media/.dist-ffmpeg.json":        `{"video": {"ffmpeg_param": "-c:v libx265", "target_ext": "mkv"}}`,
+		"media/anime/.dist-ffmpeg.json":  `{"video": {"ffmpeg_param": "-c:v libsvtav1"}}`,
+		"media/anime/a.dist-ffmpeg.json": `{"video": {"target_ext": "mp4"}, "include": ["../jpn.json"]}`,
+		"media/jpn.json":                 `{"audio": {"selection_prefer": {"tags": {"language": "^jpn$"}}, "selection_priority": ["tags.language"]}}`,
+	})
+	base, e := ParseConfig(gjson.Parse(test_sidecar_base))
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	cases := map[string]struct {
+		path string
+		// the video param and extension, the audio language preferred
+		param, ext, language string
+		sidecars             int
+	}{
+		"directory":         {"media/b.mkv", "-c:v libx265", "mkv", "", 1},
+		"deeper wins":       {"media/anime/b.mkv", "-c:v libsvtav1", "mkv", "", 2},
+		"file wins":         {"media/anime/a.mkv", "-c:v libsvtav1", "mp4", "^jpn$", 3},
+		"other directories": {"media/movie/c.mkv", "-c:v libx265", "mkv", "", 1},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			conf, sidecars, e := EffectiveConfig(filepath.Join(dir, tc.path), base)
+			if e != nil {
+				t.Fatal(e)
+			}
+			if len(sidecars) != tc.sidecars {
+				t.Errorf("sidecars %q, want %v", sidecars, tc.sidecars)
+			}
+			video, audio := conf.Raw.Get("video"), conf.Raw.Get("audio")
+			if video.Get("ffmpeg_param").String() != tc.param || conf.Section("video").TargetExt != tc.ext {
+				t.Errorf("video %v", video.Raw)
+			}
+			// untouched by the overrides
+			if audio.Get("ffmpeg_param").String() != "-c:a libopus" || audio.Get("target_ext").String() != "ogg" {
+				t.Errorf("audio %v", audio.Raw)
+			}
+			if got := audio.Get("selection_prefer.tags.language").String(); got != tc.language {
+				t.Errorf("language %q, want %q", got, tc.language)
+			}
+		})
+	}
+
+	// the base is returned as is without override
+	if conf, sidecars, e := EffectiveConfig(filepath.Join(t.TempDir(), "d.mkv"), base); e != nil || conf != base || len(sidecars) != 0 {
+		t.Errorf("without sidecar: %p %q %v, want the base", conf, sidecars, e)
+	}
+}
+
+func TestEffectiveConfigErrors(t *testing.T) {
+	base, e := ParseConfig(gjson.Parse(test_sidecar_base))
+	if e != nil {
+		t.Fatal(e)
+	}
+	cases := map[string]struct {
+		files map[string]string
+		// a part of the error
+		part string
+	}{
+		"malformed":      {map[string]string{SIDECAR_NAME: `{"video": `}, ""},
+		"not an object":  {map[string]string{SIDECAR_NAME: `["-c:v libx265"]`}, "not a JSON object"},
+		"missing import": {map[string]string{SIDECAR_NAME: `{"extends": "./nowhere.json"}`}, "nowhere.json"},
+		"import cycle": {map[string]string{
+			SIDECAR_NAME:    `{"include": ["shared/a.json"]}`,
+			"shared/a.json": `{"extends": "b.json"}`,
+			"shared/b.json": `{"include": ["./a.json"]}`,
+		}, "config inheritance cycle: "},
+		"invalid result": {map[string]string{SIDECAR_NAME: `{"video": {"target_ext": ""}}`}, "video.target_ext: must be a non-empty string"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFiles(t, dir, tc.files)
+			_, _, e := EffectiveConfig(filepath.Join(dir, "a.mkv"), base)
+			if !errors.Is(e, ErrSidecar) || !strings.Contains(e.Error(), tc.part) {
+				t.Errorf("error %v, want ErrSidecar with %q", e, tc.part)
+			}
+		})
+	}
+}
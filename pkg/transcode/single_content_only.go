@@ -1,56 +1,62 @@
 package transcode
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 func SingleStreamOnly(ctx context.Context, meta *Metadata) error {
+	// audio files keep the preferred audio stream, images and videos the first video stream
+	codec_type, stream_idx := "video", 0
+	if meta.FileType == "audio" {
+		codec_type, stream_idx = "audio", selectAudioStream(meta)
+	}
+
+	decision, e := meta.decide(meta.FileType, codec_type, stream_idx)
+	if e != nil {
+		return e
+	}
+
 	temp := File{
 		Dir:  meta.TempDir,
 		Name: "." + meta.ID,
-		Ext:  "." + meta.Config.Get(meta.FileType).Get("target_ext").String(),
+		Ext:  "." + decision.TargetExt,
 	}
 
-	var e error
-
-	if meta.FileType == "audio" {
-		// audio
-		audio_stream := selectAudioStream(meta)
-		if isSkippable(meta, 0) {
-			e = ffmpegEncodeAudioOnly(
-				ctx,
-				meta.FilePath,
-				temp,
-				"-vn -c:a copy",
-				audio_stream)
-		} else {
-			e = ffmpegEncodeAudioOnly(
-				ctx,
-				meta.FilePath,
-				temp,
-				meta.Config.Get(meta.FileType).Get("ffmpeg_param").String(),
-				audio_stream)
+	start := time.Now()
+	if codec_type == "audio" {
+		args := decision.Args
+		if decision.Action == ActionCopy {
+			args = []string{"-vn", "-c:a", "copy"}
 		}
+		e = ffmpegEncodeAudioOnly(
+			ctx,
+			meta.Runner,
+			meta.FilePath,
+			temp,
+			args,
+			stream_idx)
 	} else {
-		// image, video
-		if isSkippable(meta, 0) {
-			e = ffmpegEncodeVideoOnly(
-				ctx,
-				meta.FilePath,
-				temp,
-				"-an -c:v copy",
-				0)
-		} else {
-			e = ffmpegEncodeVideoOnly(
-				ctx,
-				meta.FilePath,
-				temp,
-				meta.Config.Get(meta.FileType).Get("ffmpeg_param").String(),
-				0)
+		args := decision.Args
+		if decision.Action == ActionCopy {
+			args = []string{"-an", "-c:v", "copy"}
 		}
+		e = ffmpegEncodeVideoOnly(
+			ctx,
+			meta.Runner,
+			meta.FilePath,
+			temp,
+			args,
+			stream_idx)
 	}
 
+	meta.observeStage("encode", start)
+
 	if e != nil {
 		return e
 	}
 
+	start = time.Now()
+	defer meta.observeStage("swap", start)
 	return meta.SwapFileToOriginal(temp)
 }
@@ -1,7 +1,14 @@
 package transcode
 
 import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
 	"github.com/sunrise2575/dist-ffmpeg/pkg/ffprobe"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/runner"
 	"github.com/sunrise2575/dist-ffmpeg/pkg/util"
 	"github.com/tidwall/gjson"
 )
@@ -28,42 +35,112 @@ type Metadata struct {
 	VideoFrame int
 
 	// transcoding decision info.
-	Config   gjson.Result
+	Config   *Config
+	Sidecars []string // override files merged into Config
 	FileType string
 	TempDir  string
+	// how the streams are handled, in the order they were decided
+	Decisions []StreamDecision
+
+	// the transcoded file which replaced the original one
+	Output File
+
+	// called with the elapsed time of every pipeline stage (split, segment_encode, concat, mux, ...)
+	// may be called concurrently
+	StageObserver func(stage string, elapsed time.Duration)
+
+	// runs ffmpeg and ffprobe, the real programs if nil; set it before Init
+	Runner runner.Runner
+
+	// called right before the original is replaced; an error leaves the original
+	// as it is, e.g. when another worker replaced it first. nil to always replace
+	Commit func() error
+}
+
+func (meta *Metadata) observeStage(stage string, start time.Time) {
+	if meta.StageObserver != nil {
+		meta.StageObserver(stage, time.Since(start))
+	}
+}
+
+// Duration is the longest stream duration in seconds, 0 for still images
+func (meta *Metadata) Duration() float64 {
+	result := 0.0
+	for _, info := range meta.StreamInfo {
+		if d := info.Get("duration").Float(); d > result {
+			result = d
+		}
+	}
+	return result
 }
 
-func (meta *Metadata) Init(fp_in string, conf gjson.Result, temp_dir string) error {
+func (meta *Metadata) Init(ctx context.Context, fp_in string, conf *Config, temp_dir string) error {
 	meta.FilePath.Fill(fp_in)
 
 	meta.ID = util.HashFNV64a(meta.FilePath.Name)
 	var e error
-	meta.StreamInfo, e = ffprobe.StreamInfoJSON(meta.FilePath.Join())
+	meta.StreamInfo, e = ffprobe.StreamInfoJSON(ctx, meta.Runner, meta.FilePath.Join())
 	if e != nil {
 		return e
 	}
 
-	meta.FileType, e = meta._DecideFileType()
+	meta.FileType, e = meta._DecideFileType(ctx)
 	if e != nil {
 		return e
 	}
 
-	meta.Config = conf
+	// per-directory and per-file overrides
+	meta.Config, meta.Sidecars, e = EffectiveConfig(fp_in, conf)
+	if e != nil {
+		return e
+	}
+
+	// the sections this file type is transcoded with
+	sections := []string{}
+	switch meta.FileType {
+	case "image", "audio", "video":
+		sections = []string{meta.FileType}
+	case "video_and_audio":
+		sections = []string{"video", "audio"}
+	}
+	for _, name := range sections {
+		if meta.Config.Section(name) == nil {
+			// the file is fine, the config is not: fail it instead of skipping it for good
+			return &ConfigError{Problems: []string{fmt.Sprintf("%v: required by %v files", name, meta.FileType)}}
+		}
+	}
 	meta.TempDir = temp_dir
 
 	return nil
 }
 
-func (meta *Metadata) _DecideFileType() (string, error) {
-	f_type := ""
+var (
+	ext_image = map[string]bool{".bmp": true, ".jpg": true, ".png": true, ".gif": true, ".webp": true}
+	ext_audio = map[string]bool{".m4a": true, ".mp3": true, ".ogg": true, ".opus": true, ".mka": true, ".wav": true, ".flac": true, ".dtshd": true, ".tak": true}
+	ext_video = map[string]bool{".asf": true, ".avi": true, ".bik": true, ".flv": true, ".mkv": true, ".mov": true, ".mp4": true, ".mpeg": true, ".3gp": true, ".ts": true, ".webm": true, ".wmv": true}
+)
 
-	ext_image := map[string]bool{".bmp": true, ".jpg": true, ".png": true, ".gif": true, ".webp": true}
-	ext_audio := map[string]bool{".m4a": true, ".mp3": true, ".ogg": true, ".opus": true, ".mka": true, ".wav": true, ".flac": true, ".dtshd": true, ".tak": true}
-	ext_video := map[string]bool{".asf": true, ".avi": true, ".bik": true, ".flv": true, ".mkv": true, ".mov": true, ".mp4": true, ".mpeg": true, ".3gp": true, ".ts": true, ".webm": true, ".wmv": true}
+// ExtFileType tells the file type by the extension alone: "image", "audio",
+// "video" or "" for the extensions not transcoded. Probing refines "image" into
+// "image_animated" and "video" into "video_and_audio" or "audio".
+func ExtFileType(ext string) string {
+	switch {
+	case ext_image[ext]:
+		return "image"
+	case ext_audio[ext]:
+		return "audio"
+	case ext_video[ext]:
+		return "video"
+	}
+	return ""
+}
+
+func (meta *Metadata) _DecideFileType(ctx context.Context) (string, error) {
+	f_type := ""
 
 	if ext_image[meta.FilePath.Ext] {
 		var e error
-		meta.VideoFrame, e = ffprobe.VideoFrame(meta.FilePath.Join())
+		meta.VideoFrame, e = ffprobe.VideoFrame(ctx, meta.Runner, meta.FilePath.Join())
 		if e != nil {
 			return "", e
 		}
@@ -107,6 +184,13 @@ func (meta *Metadata) _DecideFileType() (string, error) {
 }
 
 func (meta *Metadata) SwapFileToOriginal(fp_new File) error {
+	if meta.Commit != nil {
+		if e := meta.Commit(); e != nil {
+			os.Remove(fp_new.Join())
+			return e
+		}
+	}
+
 	temp := File{
 		Dir:  meta.FilePath.Dir,
 		Name: "." + meta.FilePath.Name,
@@ -121,5 +205,23 @@ func (meta *Metadata) SwapFileToOriginal(fp_new File) error {
 		Name: meta.FilePath.Name,
 		Ext:  fp_new.Ext,
 	}
-	return util.PathMove(fp_new.Join(), temp.Join())
+	if e := util.PathMove(fp_new.Join(), temp.Join()); e != nil {
+		return e
+	}
+	meta.Output = temp
+	return nil
+}
+
+// RemoveTemp removes what transcoding the file left in the temporary directory,
+// e.g. after it failed or was cancelled
+func (meta *Metadata) RemoveTemp() {
+	if meta.TempDir == "" || meta.ID == "" {
+		return
+	}
+	for _, pattern := range []string{"." + meta.ID + ".*", "." + meta.ID + "_*"} {
+		matches, _ := filepath.Glob(filepath.Join(meta.TempDir, pattern))
+		for _, fp := range matches {
+			os.RemoveAll(fp)
+		}
+	}
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"os"
 	"sync"
+	"time"
 
 	"runtime"
 
@@ -15,22 +16,33 @@ type job struct {
 	filepath File
 }
 
-func encodeAudioPart(ctx context.Context, meta *Metadata, fp_audio_out File) chan error {
-	c := make(chan error)
+// firstError keeps the error which made the others cancel,
+// rather than the context.Canceled they fail with afterwards
+type firstError struct {
+	once sync.Once
+	e    error
+}
+
+func (f *firstError) set(e error, cancel context.CancelFunc) {
+	f.once.Do(func() { f.e = e })
+	cancel()
+}
+
+// the chan error helpers below buffer their result, so they finish even if
+// the caller stopped waiting because the context was cancelled
+
+func encodeAudioPart(ctx context.Context, meta *Metadata, fp_audio_out File, audio_stream_idx int, decision Decision) chan error {
+	c := make(chan error, 1)
 	go func() {
 		defer close(c)
 		c <- func() error {
-			audio_stream_idx := selectAudioStream(meta)
-			skip_audio := isSkippable(meta, audio_stream_idx)
+			defer meta.observeStage("audio_encode", time.Now())
 
-			var e error
-
-			if skip_audio {
-				e = ffmpegEncodeAudioOnly(ctx, meta.FilePath, fp_audio_out, "-vn -c:a copy", audio_stream_idx)
-			} else {
-				e = ffmpegEncodeAudioOnly(ctx, meta.FilePath, fp_audio_out, meta.Config.Get("audio.ffmpeg_param").String(), audio_stream_idx)
+			args := decision.Args
+			if decision.Action == ActionCopy {
+				args = []string{"-vn", "-c:a", "copy"}
 			}
-
+			e := ffmpegEncodeAudioOnly(ctx, meta.Runner, meta.FilePath, fp_audio_out, args, audio_stream_idx)
 			if e != nil {
 				logrus.Errorf("ffmpegEncodeAudioOnly() failed: %v", e)
 				return e
@@ -43,13 +55,19 @@ func encodeAudioPart(ctx context.Context, meta *Metadata, fp_audio_out File) cha
 }
 
 func videoSegmentFeeder(ctx context.Context, job_q chan<- job, fps_video []File) chan error {
-	c := make(chan error)
+	c := make(chan error, 1)
 	go func() {
 		defer close(c)
+		defer close(job_q)
 		for index, fp := range fps_video {
-			job_q <- job{
+			select {
+			case job_q <- job{
 				index:    index,
 				filepath: fp,
+			}:
+			case <-ctx.Done():
+				c <- ctx.Err()
+				return
 			}
 		}
 		c <- nil
@@ -57,22 +75,26 @@ func videoSegmentFeeder(ctx context.Context, job_q chan<- job, fps_video []File)
 	return c
 }
 
-func videoSegmentProcessor(ctx context.Context, meta *Metadata, job_q <-chan job, fps_video_comp []File, video_stream_idx int, worker_id int) chan error {
-	c := make(chan error)
+func videoSegmentProcessor(ctx context.Context, meta *Metadata, job_q <-chan job, fps_video_comp []File, decision Decision, video_stream_idx int, worker_id int) chan error {
+	c := make(chan error, 1)
 	go func(worker_id int) {
 		c <- func() error {
 			for j := range job_q {
 				fp_video_temp := File{
 					Dir:  meta.TempDir,
 					Name: j.filepath.Name + "_converted",
-					Ext:  "." + meta.Config.Get("video.target_ext").String(),
+					Ext:  "." + decision.TargetExt,
 				}
-				if e := ffmpegEncodeVideoOnly(
+				start := time.Now()
+				e := ffmpegEncodeVideoOnly(
 					ctx,
+					meta.Runner,
 					j.filepath,
 					fp_video_temp,
-					meta.Config.Get("video.ffmpeg_param").String(),
-					video_stream_idx); e != nil {
+					decision.Args,
+					video_stream_idx)
+				meta.observeStage("segment_encode", start)
+				if e != nil {
 					logrus.Errorf("ffmpegEncodeVideoOnly() failed: %v", e)
 					return e
 				}
@@ -88,22 +110,26 @@ func videoSegmentProcessor(ctx context.Context, meta *Metadata, job_q <-chan job
 	return c
 }
 
-func encodeVideoPart(ctx context.Context, meta *Metadata, fp_video_out File) chan error {
-	c := make(chan error)
+func encodeVideoPart(ctx context.Context, meta *Metadata, fp_video_out File, video_stream_idx int, decision Decision) chan error {
+	c := make(chan error, 1)
 	go func() {
 		defer close(c)
 		c <- func() error {
-			video_stream_idx := 0
-			if isSkippable(meta, video_stream_idx) {
+			if decision.Action == ActionCopy {
+				defer meta.observeStage("video_encode", time.Now())
 				return ffmpegEncodeVideoOnly(
 					ctx,
+					meta.Runner,
 					meta.FilePath,
 					fp_video_out,
-					"-an -c:v copy",
+					[]string{"-an", "-c:v", "copy"},
 					video_stream_idx)
 			}
 
 			workers := runtime.NumCPU() / 6
+			if workers < 1 {
+				workers = 1
+			}
 			splits := workers * 2
 
 			split_file_rule := File{
@@ -111,13 +137,16 @@ func encodeVideoPart(ctx context.Context, meta *Metadata, fp_video_out File) cha
 				Name: "." + meta.ID + "_video_%d", // must use %d
 				Ext:  meta.FilePath.Ext,
 			}
+			start := time.Now()
 			fps_video, e := ffmpegSplitVideo(
 				ctx,
+				meta.Runner,
 				meta.FilePath,
 				meta.TempDir,
 				split_file_rule,
 				video_stream_idx,
 				splits)
+			meta.observeStage("split", start)
 			if e != nil {
 				logrus.Errorf("ffmpegSplitVideo() failed: %v", e)
 				return e
@@ -126,24 +155,18 @@ func encodeVideoPart(ctx context.Context, meta *Metadata, fp_video_out File) cha
 			fps_video_comp := make([]File, len(fps_video))
 			{
 				var wg sync.WaitGroup
+				var failed firstError
 
 				ctx, cancel := context.WithCancel(ctx)
+				defer cancel()
 				job_q := make(chan job, 64)
 
+				// the feeder closes job_q once it stops, so it never sends on a closed channel
 				wg.Add(1)
 				go func() {
-					defer func() {
-						close(job_q)
-						wg.Done()
-					}()
-					select {
-					case <-videoSegmentFeeder(ctx, job_q, fps_video):
-						if e != nil {
-							cancel()
-						}
-					case <-ctx.Done():
-						// canceled
-						logrus.Errorf("videoSegmentFeeder() cancelled: %v", ctx.Err())
+					defer wg.Done()
+					if e := <-videoSegmentFeeder(ctx, job_q, fps_video); e != nil {
+						logrus.Errorf("videoSegmentFeeder() cancelled: %v", e)
 					}
 				}()
 
@@ -153,9 +176,9 @@ func encodeVideoPart(ctx context.Context, meta *Metadata, fp_video_out File) cha
 					go func(worker_id int) {
 						defer wg.Done()
 						select {
-						case e := <-videoSegmentProcessor(ctx, meta, job_q, fps_video_comp, video_stream_idx, worker_id):
+						case e := <-videoSegmentProcessor(ctx, meta, job_q, fps_video_comp, decision, video_stream_idx, worker_id):
 							if e != nil {
-								cancel()
+								failed.set(e, cancel)
 							}
 							// nothing
 						case <-ctx.Done():
@@ -166,6 +189,9 @@ func encodeVideoPart(ctx context.Context, meta *Metadata, fp_video_out File) cha
 
 				wg.Wait()
 
+				if failed.e != nil {
+					return failed.e
+				}
 				if ctx.Err() != nil {
 					return ctx.Err()
 				}
@@ -179,7 +205,10 @@ func encodeVideoPart(ctx context.Context, meta *Metadata, fp_video_out File) cha
 				Ext:  ".txt",
 			}
 
-			if e := ffmpegConcatFiles(ctx, fps_video_comp, fp_text, fp_video_out); e != nil {
+			start = time.Now()
+			e = ffmpegConcatFiles(ctx, meta.Runner, fps_video_comp, fp_text, fp_video_out)
+			meta.observeStage("concat", start)
+			if e != nil {
 				logrus.Errorf("ffmpegConcatFiles() failed: %v", e)
 				return e
 			}
@@ -190,18 +219,32 @@ func encodeVideoPart(ctx context.Context, meta *Metadata, fp_video_out File) cha
 }
 
 func VideoAndAudio(ctx context.Context, meta *Metadata) error {
+	// decide both streams before spending any time on encoding;
+	// the video segments are encoded with the properties of the whole source stream
+	audio_stream_idx, video_stream_idx := selectAudioStream(meta), 0
+	audio_decision, e := meta.decide("audio", "audio", audio_stream_idx)
+	if e != nil {
+		return e
+	}
+	video_decision, e := meta.decide("video", "video", video_stream_idx)
+	if e != nil {
+		return e
+	}
+
 	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var failed firstError
 
 	fp_audio := File{
 		Dir:  meta.TempDir,
 		Name: "." + meta.ID + "_audio",
-		Ext:  "." + meta.Config.Get("audio.target_ext").String(),
+		Ext:  "." + audio_decision.TargetExt,
 	}
 
 	fp_video := File{
 		Dir:  meta.TempDir,
 		Name: "." + meta.ID + "_videoconcat",
-		Ext:  "." + meta.Config.Get("video.target_ext").String(),
+		Ext:  "." + video_decision.TargetExt,
 	}
 
 	var wg sync.WaitGroup
@@ -209,9 +252,9 @@ func VideoAndAudio(ctx context.Context, meta *Metadata) error {
 	go func() {
 		defer wg.Done()
 		select {
-		case e := <-encodeAudioPart(ctx, meta, fp_audio):
+		case e := <-encodeAudioPart(ctx, meta, fp_audio, audio_stream_idx, audio_decision):
 			if e != nil {
-				cancel()
+				failed.set(e, cancel)
 			}
 		case <-ctx.Done():
 			logrus.Errorf("encodeAudioPart() cancelled: %v", ctx.Err())
@@ -222,9 +265,9 @@ func VideoAndAudio(ctx context.Context, meta *Metadata) error {
 	go func() {
 		defer wg.Done()
 		select {
-		case e := <-encodeVideoPart(ctx, meta, fp_video):
+		case e := <-encodeVideoPart(ctx, meta, fp_video, video_stream_idx, video_decision):
 			if e != nil {
-				cancel()
+				failed.set(e, cancel)
 			}
 		case <-ctx.Done():
 			logrus.Errorf("encodeVideoPart() cancelled: %v", ctx.Err())
@@ -233,6 +276,9 @@ func VideoAndAudio(ctx context.Context, meta *Metadata) error {
 
 	wg.Wait()
 
+	if failed.e != nil {
+		return failed.e
+	}
 	if ctx.Err() != nil {
 		return ctx.Err()
 	}
@@ -240,15 +286,21 @@ func VideoAndAudio(ctx context.Context, meta *Metadata) error {
 	fp_mux_out := File{
 		Dir:  meta.TempDir,
 		Name: "." + meta.ID + "_mux",
-		Ext:  "." + meta.Config.Get("video.target_ext").String(),
+		Ext:  "." + video_decision.TargetExt,
 	}
 
-	if e := ffmpegMuxVideoAudio(ctx, fp_video, fp_audio, fp_mux_out); e != nil {
+	start := time.Now()
+	e = ffmpegMuxVideoAudio(ctx, meta.Runner, fp_video, fp_audio, fp_mux_out)
+	meta.observeStage("mux", start)
+	if e != nil {
 		logrus.Errorf("ffmpegMuxVideoAudio() failed: %v", e)
 		return e
 	}
 
-	if e := meta.SwapFileToOriginal(fp_mux_out); e != nil {
+	start = time.Now()
+	e = meta.SwapFileToOriginal(fp_mux_out)
+	meta.observeStage("swap", start)
+	if e != nil {
 		logrus.Errorf("meta.SwapFileToOriginal() failed: %v", e)
 		return e
 	}
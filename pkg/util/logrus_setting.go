@@ -20,7 +20,7 @@ func InitLogrus(log_fp, log_lvl, log_fmt string) {
 					"path_target": log_fp,
 					"error":       e,
 					"where":       GetCurrentFunctionInfo(),
-				}).Fatalf("Unable to create log file", log_fp, e)
+				}).Fatalf("Unable to create log file")
 		}
 		logrus.SetOutput(io.MultiWriter(log_f, os.Stdout))
 	}
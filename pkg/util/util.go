@@ -1,6 +1,7 @@
 package util
 
 import (
+	"encoding/json"
 	"fmt"
 	"hash/fnv"
 	"io/ioutil"
@@ -8,8 +9,6 @@ import (
 	"strconv"
 	"strings"
 
-	"github.com/dlclark/regexp2"
-	"github.com/sirupsen/logrus"
 	"github.com/tidwall/gjson"
 	"github.com/tidwall/sjson"
 )
@@ -75,32 +74,6 @@ func FlattenJSONKey(json gjson.Result) map[string]bool {
 	return complete
 }
 
-func MatchRegexPCRE2(regex string, target string) bool {
-	re, e := regexp2.Compile(regex, 0)
-	if e != nil {
-		logrus.WithFields(
-			logrus.Fields{
-				"regex_regex":     regex,
-				"regex_candidate": target,
-				"error":           e,
-				"where":           GetCurrentFunctionInfo(),
-			}).Fatalf("Failed to compile Regex")
-	}
-
-	matched, e := re.MatchString(target)
-	if e != nil {
-		logrus.WithFields(
-			logrus.Fields{
-				"regex_regex":     regex,
-				"regex_candidate": target,
-				"error":           e,
-				"where":           GetCurrentFunctionInfo(),
-			}).Fatalf("Faled to match Regex")
-	}
-
-	return matched
-}
-
 func HashFNV64a(text string) string {
 	algorithm := fnv.New64a()
 	algorithm.Write([]byte(text))
@@ -126,3 +99,35 @@ func Slice2Map(input []string) map[string]bool {
 	}
 	return result
 }
+
+// MergeJSON deep-merges override over base. Objects are merged key by key,
+// anything else in override (including arrays) replaces the value of base.
+func MergeJSON(base, override gjson.Result) (gjson.Result, error) {
+	var base_v, override_v interface{}
+	if base.Exists() {
+		if e := json.Unmarshal([]byte(base.Raw), &base_v); e != nil {
+			return gjson.Result{}, e
+		}
+	}
+	if e := json.Unmarshal([]byte(override.Raw), &override_v); e != nil {
+		return gjson.Result{}, e
+	}
+
+	b, e := json.Marshal(mergeValue(base_v, override_v))
+	if e != nil {
+		return gjson.Result{}, e
+	}
+	return gjson.ParseBytes(b), nil
+}
+
+func mergeValue(base, override interface{}) interface{} {
+	base_m, ok_b := base.(map[string]interface{})
+	override_m, ok_o := override.(map[string]interface{})
+	if !ok_b || !ok_o {
+		return override
+	}
+	for k, v := range override_m {
+		base_m[k] = mergeValue(base_m[k], v)
+	}
+	return base_m
+}
@@ -0,0 +1,71 @@
+package worker
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/protocol"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/runner"
+)
+
+// Capabilities is what the worker registers with the master
+type Capabilities = protocol.Capabilities
+
+// ProbeCapabilities measures the machine and asks ffmpeg and ffprobe, through r
+// (the real ones if nil), what they can do. What cannot be found out is left zero.
+func ProbeCapabilities(ctx context.Context, r runner.Runner, temp_dir string) Capabilities {
+	r = runner.Or(r)
+	caps := Capabilities{
+		Cores:    runtime.NumCPU(),
+		Memory:   totalMemory(),
+		TempFree: freeSpace(temp_dir),
+	}
+
+	version := func(name string) string {
+		stdout, _, e := r.Run(ctx, name, []string{"-hide_banner", "-version"})
+		if e != nil {
+			logrus.WithFields(logrus.Fields{"subproc": name, "error": e}).Warnf("Unable to get the version")
+			return ""
+		}
+		line, _, _ := bufio.NewReader(bytes.NewReader(stdout)).ReadLine()
+		return strings.TrimSpace(string(line))
+	}
+	caps.FFmpegVersion = version("ffmpeg")
+	caps.FFprobeVersion = version("ffprobe")
+
+	stdout, _, e := r.Run(ctx, "ffmpeg", []string{"-hide_banner", "-encoders"})
+	if e != nil {
+		logrus.WithFields(logrus.Fields{"subproc": "ffmpeg", "error": e}).Warnf("Unable to list the encoders")
+		return caps
+	}
+	caps.Encoders = parseEncoders(string(stdout))
+	return caps
+}
+
+// parseEncoders reads the output of "ffmpeg -encoders": a legend, a line of
+// dashes, then a line of flags, name and description for each encoder
+func parseEncoders(out string) []string {
+	result := []string{}
+	listed := false
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if !listed {
+			listed = strings.HasPrefix(fields[0], "---")
+			continue
+		}
+		if len(fields) >= 2 {
+			result = append(result, fields[1])
+		}
+	}
+	sort.Strings(result)
+	return result
+}
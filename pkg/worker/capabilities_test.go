@@ -0,0 +1,40 @@
+package worker
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/sunrise2575/dist-ffmpeg/pkg/runner"
+)
+
+const ffmpeg_encoders = `Encoders:
+ V..... = Video
+ A..... = Audio
+ S..... = Subtitle
+ .F.... = Frame-level multithreading
+ ------
+ V....D libx264              libx264 H.264 / AVC / MPEG-4 AVC / MPEG-4 part 10 (codec h264)
+ V....D libvpx-vp9           libvpx VP9 (codec vp9)
+ A....D aac                  AAC (Advanced Audio Coding)
+ S..... ass                  ASS (Advanced SubStation Alpha) subtitle
+`
+
+func TestProbeCapabilities(t *testing.T) {
+	r := &runner.Script{Steps: []runner.Step{
+		{Name: "ffmpeg", Has: []string{"-encoders"}, Stdout: ffmpeg_encoders},
+		{Name: "ffmpeg", Has: []string{"-version"}, Stdout: "ffmpeg version 6.1.1 Copyright (c) 2000-2023\nbuilt with gcc 13\n"},
+		{Name: "ffprobe", Has: []string{"-version"}, Stdout: "ffprobe version 6.1.1 Copyright (c) 2007-2023\n"},
+	}}
+	caps := ProbeCapabilities(context.Background(), r, t.TempDir())
+
+	if caps.Cores < 1 {
+		t.Errorf("%v cores", caps.Cores)
+	}
+	if caps.FFmpegVersion != "ffmpeg version 6.1.1 Copyright (c) 2000-2023" || caps.FFprobeVersion != "ffprobe version 6.1.1 Copyright (c) 2007-2023" {
+		t.Errorf("versions %q, %q", caps.FFmpegVersion, caps.FFprobeVersion)
+	}
+	if want := []string{"aac", "ass", "libvpx-vp9", "libx264"}; !reflect.DeepEqual(caps.Encoders, want) {
+		t.Errorf("encoders %v, want %v", caps.Encoders, want)
+	}
+}
@@ -0,0 +1,193 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pebbe/zmq4"
+	"github.com/sirupsen/logrus"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/protocol"
+)
+
+// how long a request may wait for the socket
+const flush_interval = 10 * time.Millisecond
+
+// conn is the DEALER connection of a worker to the master. One goroutine owns
+// the socket; the requests are matched to their replies by ID, so the heartbeats
+// and the job requests share it.
+type conn struct {
+	// creates the sockets, with CURVE if enabled
+	newSocket func(zmq4.Type) (*zmq4.Socket, error)
+	endpoint  string
+	identity  string
+	// a request is sent again over a new socket when no reply comes in time
+	timeout time.Duration
+
+	out       chan string
+	reconnect chan struct{}
+	pushes    chan protocol.Push
+
+	mu      sync.Mutex
+	next_id uint64
+	waiting map[uint64]chan string
+}
+
+func newConn(newSocket func(zmq4.Type) (*zmq4.Socket, error), endpoint, identity string, timeout time.Duration) *conn {
+	return &conn{
+		newSocket: newSocket,
+		endpoint:  endpoint,
+		identity:  identity,
+		timeout:   timeout,
+		out:       make(chan string, 16),
+		reconnect: make(chan struct{}, 1),
+		pushes:    make(chan protocol.Push, 16),
+		waiting:   map[uint64]chan string{},
+	}
+}
+
+func (c *conn) open() (*zmq4.Socket, error) {
+	sock, e := c.newSocket(zmq4.DEALER)
+	if e != nil {
+		return nil, e
+	}
+	sock.SetLinger(0)
+	sock.SetIdentity(c.identity)
+	sock.SetRcvtimeo(flush_interval)
+	sock.SetSndtimeo(flush_interval)
+	if e := sock.Connect(c.endpoint); e != nil {
+		sock.Close()
+		return nil, fmt.Errorf("unable to connect ZeroMQ socket to %v: %w", c.endpoint, e)
+	}
+	logrus.WithFields(logrus.Fields{"endpoint": c.endpoint, "identity": c.identity}).Debugf("Connect")
+	return sock, nil
+}
+
+// run owns the socket until the context is done
+func (c *conn) run(ctx context.Context) error {
+	sock, e := c.open()
+	if e != nil {
+		return e
+	}
+	defer func() { sock.Close() }()
+
+	for ctx.Err() == nil {
+		select {
+		case <-c.reconnect:
+			// a socket of a vanished master may hold stale messages
+			sock.Close()
+			if sock, e = c.open(); e != nil {
+				return e
+			}
+		default:
+		}
+
+	flush:
+		for {
+			select {
+			case m := <-c.out:
+				// a message not taken is sent again after the request timeout
+				if _, e := sock.Send(m, 0); e != nil && !isTimeout(e) {
+					logrus.WithFields(logrus.Fields{"error": e}).Warnf("Unable to send a request")
+				}
+			default:
+				break flush
+			}
+		}
+
+		recv_json, e := sock.Recv(0)
+		if e != nil {
+			if !isTimeout(e) {
+				logrus.WithFields(logrus.Fields{"error": e}).Errorf("Unable to receive from master")
+			}
+			continue
+		}
+
+		// a version error is left to the waiting request
+		res, _ := protocol.DecodeResponse(recv_json)
+		if res.Push != nil {
+			if e := protocol.CheckVersion(res.Version); e != nil {
+				logrus.WithFields(logrus.Fields{"error": e}).Warnf("Ignore a push of the master")
+				continue
+			}
+			select {
+			case c.pushes <- *res.Push:
+			default:
+				logrus.WithFields(logrus.Fields{"push": res.Push.Kind}).Warnf("Too many pushes of the master, drop one")
+			}
+			continue
+		}
+
+		c.mu.Lock()
+		waiter, ok := c.waiting[res.ID]
+		delete(c.waiting, res.ID)
+		c.mu.Unlock()
+		if !ok {
+			// e.g. the reply to a request sent twice
+			logrus.WithFields(logrus.Fields{"id": res.ID}).Debugf("Drop a reply nobody waits for")
+			continue
+		}
+		waiter <- recv_json
+	}
+	return nil
+}
+
+// request sends the request and waits for its reply until the context is done.
+// Every time the master does not answer in time, the connection is made again
+// and the request is sent again with the same ID.
+func (c *conn) request(ctx context.Context, req protocol.Request) (protocol.Response, error) {
+	waiter := make(chan string, 1)
+	c.mu.Lock()
+	c.next_id++
+	req.ID = c.next_id
+	c.waiting[req.ID] = waiter
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.waiting, req.ID)
+		c.mu.Unlock()
+	}()
+
+	payload, e := protocol.Encode(req)
+	if e != nil {
+		return protocol.Response{}, e
+	}
+	for {
+		select {
+		case c.out <- payload:
+		case <-ctx.Done():
+			return protocol.Response{}, ctx.Err()
+		}
+
+		timer := time.NewTimer(c.timeout)
+		select {
+		case recv_json := <-waiter:
+			timer.Stop()
+			return decodeResponse(recv_json)
+		case <-ctx.Done():
+			timer.Stop()
+			return protocol.Response{}, ctx.Err()
+		case <-timer.C:
+		}
+
+		logrus.WithFields(logrus.Fields{"req": req.Kind, "id": req.ID, "timeout": c.timeout}).
+			Warnf("No reply from master, reconnect and send again")
+		select {
+		case c.reconnect <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// decodeResponse parses a reply; a request the master did not understand is an error
+func decodeResponse(recv_json string) (protocol.Response, error) {
+	res, e := protocol.DecodeResponse(recv_json)
+	if res.Error != "" {
+		return res, fmt.Errorf("rejected by the master: %v", res.Error)
+	}
+	if e != nil {
+		return res, fmt.Errorf("unable to understand the master: %w", e)
+	}
+	return res, nil
+}
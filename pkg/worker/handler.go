@@ -0,0 +1,57 @@
+package worker
+
+import (
+	"context"
+	"errors"
+
+	"github.com/sunrise2575/dist-ffmpeg/pkg/protocol"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/transcode"
+)
+
+// Status is the outcome of a job
+type Status string
+
+const (
+	StatusSuccess Status = "success"
+	// not a media file worth transcoding; the master does not retry it
+	StatusSkip Status = "skip"
+	// the error is classified with transcode.ClassifyError to decide on a retry
+	StatusFail Status = "fail"
+	// set by the Worker when a failed job was interrupted by its context
+	StatusKilled Status = "killed"
+)
+
+// ErrLostRace is returned by Job.Commit when another worker finished a copy of the job first
+var ErrLostRace = errors.New("another worker finished the file first")
+
+// Task is the part of a file a job does when the file is shared by several workers
+type Task = protocol.Task
+
+// Job is a file assigned by the master
+type Job struct {
+	Path string
+	// chosen by the master; empty when Config is Options.Config
+	Profile string
+	Config  *transcode.Config
+	// shared by the jobs of the worker, which run one at a time
+	TempDir string
+	// the part of a file shared by several workers; nil to transcode Path whole
+	Task *Task
+	// asks the master whether the original may be replaced, since another worker
+	// may run a copy of the job; ErrLostRace if the other one was first
+	Commit func() error
+}
+
+// Handler handles one job. Stats are filled as far as they are known, also on failure.
+// A panic is recovered and reported as a failure.
+type Handler interface {
+	Handle(ctx context.Context, job Job, stats *Stats) (Status, error)
+}
+
+// HandlerFunc adapts a function to a Handler
+type HandlerFunc func(ctx context.Context, job Job, stats *Stats) (Status, error)
+
+// Handle calls f
+func (f HandlerFunc) Handle(ctx context.Context, job Job, stats *Stats) (Status, error) {
+	return f(ctx, job, stats)
+}
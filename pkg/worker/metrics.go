@@ -0,0 +1,68 @@
+package worker
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/sunrise2575/dist-ffmpeg/pkg/metrics"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/protocol"
+)
+
+var (
+	metric_registry = metrics.NewRegistry()
+
+	metric_jobs = metric_registry.NewCounter(
+		"distffmpeg_worker_jobs_total",
+		"Jobs handled by this worker by outcome",
+		"outcome")
+	metric_job_duration = metric_registry.NewHistogram(
+		"distffmpeg_worker_job_duration_seconds",
+		"Wall time of successful jobs by file type",
+		metrics.DurationBuckets,
+		"file_type")
+	metric_bytes_in = metric_registry.NewCounter(
+		"distffmpeg_worker_bytes_in_total",
+		"Size of the original files of successful jobs")
+	metric_bytes_out = metric_registry.NewCounter(
+		"distffmpeg_worker_bytes_out_total",
+		"Size of the transcoded files of successful jobs")
+	metric_speed = metric_registry.NewHistogram(
+		"distffmpeg_worker_encode_speed_ratio",
+		"Media duration divided by wall time of successful jobs",
+		metrics.RatioBuckets,
+		"file_type")
+	metric_stage_duration = metric_registry.NewHistogram(
+		"distffmpeg_worker_stage_duration_seconds",
+		"Wall time of each transcoding stage",
+		metrics.DurationBuckets,
+		"stage")
+	metric_busy = metric_registry.NewGauge(
+		"distffmpeg_worker_busy",
+		"1 while the worker is working on a job")
+)
+
+// Stats describes a handled file for the metrics and the report to the master
+type Stats = protocol.Stats
+
+func observeStage(stage string, elapsed time.Duration) {
+	metric_stage_duration.Observe(elapsed.Seconds(), stage)
+}
+
+func observeJob(status Status, stats Stats, elapsed time.Duration) {
+	metric_jobs.Inc(string(status))
+	if status != StatusSuccess {
+		return
+	}
+
+	metric_job_duration.Observe(elapsed.Seconds(), stats.FileType)
+	metric_bytes_in.Add(float64(stats.BytesIn))
+	metric_bytes_out.Add(float64(stats.BytesOut))
+	if stats.MediaDuration > 0 && elapsed > 0 {
+		metric_speed.Observe(stats.MediaDuration/elapsed.Seconds(), stats.FileType)
+	}
+}
+
+// MetricsHandler serves the metrics of every worker in the process
+func MetricsHandler() http.Handler {
+	return metric_registry.Handler()
+}
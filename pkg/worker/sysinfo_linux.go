@@ -0,0 +1,42 @@
+//go:build linux
+// +build linux
+
+package worker
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// totalMemory reads MemTotal of /proc/meminfo, in bytes
+func totalMemory() int64 {
+	f, e := os.Open("/proc/meminfo")
+	if e != nil {
+		return 0
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// MemTotal:       32803632 kB
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "MemTotal:" {
+			continue
+		}
+		kb, _ := strconv.ParseInt(fields[1], 10, 64)
+		return kb << 10
+	}
+	return 0
+}
+
+// freeSpace is the space of the file system of dir available to the process, in bytes
+func freeSpace(dir string) int64 {
+	st := syscall.Statfs_t{}
+	if e := syscall.Statfs(dir, &st); e != nil {
+		return 0
+	}
+	return int64(st.Bavail) * int64(st.Bsize)
+}
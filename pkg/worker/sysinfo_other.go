@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package worker
+
+// the master takes zero as unknown
+
+func totalMemory() int64 { return 0 }
+
+func freeSpace(dir string) int64 { return 0 }
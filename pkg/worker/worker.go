@@ -0,0 +1,667 @@
+// Package worker asks a master for files, transcodes them and reports the outcome.
+//
+// The transcoding is done by Transcode unless Options.Handler replaces it:
+//
+//	w, e := worker.New(worker.Options{
+//		Endpoint: "tcp://master:5000",
+//		Config:   conf,
+//		TempDir:  "/tmp/ingest",
+//		Handler: worker.HandlerFunc(func(ctx context.Context, job worker.Job, stats *worker.Stats) (worker.Status, error) {
+//			status, e := worker.Transcode(ctx, job, stats)
+//			if status == worker.StatusSuccess {
+//				publish(job.Path)
+//			}
+//			return status, e
+//		}),
+//	})
+//	e = w.Run(ctx)
+package worker
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pebbe/zmq4"
+	"github.com/sirupsen/logrus"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/keys"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/protocol"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/transcode"
+	"github.com/sunrise2575/dist-ffmpeg/pkg/util"
+	"github.com/tidwall/gjson"
+)
+
+// Options configures a Worker. Durations left zero get the defaults of cmd/worker.
+type Options struct {
+	// ZeroMQ endpoints of the master, e.g. "tcp://master:5000" or "inproc://master";
+	// an empty NotifyEndpoint disables the announcements of new work
+	Endpoint, NotifyEndpoint string
+	// the ZeroMQ context; inproc:// endpoints need the one of the master. nil for a new one
+	ZMQ *zmq4.Context
+
+	// encrypt the connections with CURVE: the public key of the master and the
+	// keypair of the worker, which the master has to allow. Disabled without
+	// CurveServerKey.
+	CurveServerKey string
+	CurveKeys      keys.Keypair
+
+	// used when the master sends no profile
+	Config *transcode.Config
+	// temporary directory for transcoding
+	TempDir string
+
+	// polling interval while the master has no job, doubled up to PollMax
+	PollMin, PollMax time.Duration
+	// a request is sent again over a new connection when the master does not
+	// answer in time, e.g. after a restart of the master
+	RequestTimeout time.Duration
+	// return when the master has no more job instead of waiting
+	ExitWhenEmpty bool
+
+	// identify the worker to the master; the process' by default
+	Hostname, PID string
+	// registered with the master, which assigns only the files the worker can
+	// run; found out by ProbeCapabilities if nil
+	Capabilities *Capabilities
+	// the master may route files only to the workers of some labels
+	Labels map[string]string
+
+	// handles the jobs; Transcode if nil
+	Handler Handler
+}
+
+func (opts *Options) fill() {
+	if opts.PollMin <= 0 {
+		opts.PollMin = 5 * time.Second
+	}
+	if opts.PollMax < opts.PollMin {
+		opts.PollMax = opts.PollMin
+	}
+	if opts.RequestTimeout <= 0 {
+		opts.RequestTimeout = 10 * time.Second
+	}
+	if opts.Hostname == "" {
+		opts.Hostname, _ = os.Hostname()
+	}
+	if opts.PID == "" {
+		opts.PID = strconv.Itoa(os.Getpid())
+	}
+	if opts.Handler == nil {
+		opts.Handler = HandlerFunc(Transcode)
+	}
+}
+
+// Worker handles the jobs of a master one at a time
+type Worker struct {
+	opts Options
+	conn *conn
+
+	mu sync.Mutex
+	// the fallback config, replaced by the master with PushConfig
+	config *transcode.Config
+	// the job in progress
+	current_path   string
+	cancel_current context.CancelFunc
+}
+
+// New checks the options and creates the temporary directory
+func New(opts Options) (*Worker, error) {
+	opts.fill()
+	if opts.Config == nil {
+		return nil, fmt.Errorf("no fallback config")
+	}
+	if opts.CurveServerKey != "" {
+		if e := keys.Check(opts.CurveServerKey); e != nil {
+			return nil, fmt.Errorf("master public key: %w", e)
+		}
+		if e := keys.Check(opts.CurveKeys.Public); e != nil {
+			return nil, fmt.Errorf("worker public key: %w", e)
+		}
+		if e := keys.Check(opts.CurveKeys.Secret); e != nil {
+			return nil, fmt.Errorf("worker secret key: %w", e)
+		}
+	}
+	opts.TempDir = util.PathSanitize(opts.TempDir)
+	if e := os.MkdirAll(opts.TempDir, 0755); e != nil {
+		return nil, fmt.Errorf("unable to create/open the temporary directory: %w", e)
+	}
+	return &Worker{opts: opts, config: opts.Config}, nil
+}
+
+// how often the blocking socket calls wake up to check the context
+const poll_interval = 250 * time.Millisecond
+
+func isTimeout(e error) bool {
+	return zmq4.AsErrno(e) == zmq4.Errno(syscall.EAGAIN)
+}
+
+// request starts a message of the worker
+func (w *Worker) request(kind protocol.Kind) protocol.Request {
+	return protocol.Request{
+		Version: protocol.Version,
+		Kind:    kind,
+		Worker:  protocol.Peer{Hostname: w.opts.Hostname, PID: w.opts.PID},
+	}
+}
+
+// heartbeat renews the lease of the path until the context is done
+func (w *Worker) heartbeat(ctx context.Context, fp string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		req := w.request(protocol.KindHeartbeat)
+		req.Path = fp
+		// the next one goes out on time even if this one is not answered
+		beat_ctx, cancel := context.WithTimeout(ctx, interval)
+		res, e := w.conn.request(beat_ctx, req)
+		cancel()
+		if e != nil {
+			if ctx.Err() == nil {
+				logrus.WithFields(logrus.Fields{"path": fp, "error": e}).Warnf("No heartbeat reply from master")
+			}
+			continue
+		}
+		if !res.OK {
+			logrus.WithFields(logrus.Fields{"path": fp}).Warnf("Lost the lease of the job")
+		}
+	}
+}
+
+// handlePushes follows the messages the master sends on its own
+func (w *Worker) handlePushes(ctx context.Context) {
+	for {
+		var push protocol.Push
+		select {
+		case <-ctx.Done():
+			return
+		case push = <-w.conn.pushes:
+		}
+
+		switch push.Kind {
+		case protocol.PushCancel:
+			w.mu.Lock()
+			if w.current_path == push.Path && w.cancel_current != nil {
+				w.cancel_current()
+				logrus.WithFields(logrus.Fields{"path": push.Path}).Warnf("Cancelled by the master")
+			}
+			w.mu.Unlock()
+
+		case protocol.PushConfig:
+			conf, e := transcode.ParseConfig(gjson.ParseBytes(push.Config))
+			if e != nil {
+				logrus.WithFields(logrus.Fields{"error": e}).Errorf("Got an invalid config from the master")
+				continue
+			}
+			w.mu.Lock()
+			w.config = conf
+			w.mu.Unlock()
+			logrus.Infof("Config updated by the master")
+
+		default:
+			logrus.WithFields(logrus.Fields{"push": push.Kind}).Warnf("Got an unknown push from the master")
+		}
+	}
+}
+
+// socket creates a socket of the context, as a CURVE client if enabled
+func (w *Worker) socket(zctx *zmq4.Context, t zmq4.Type) (*zmq4.Socket, error) {
+	sock, e := zctx.NewSocket(t)
+	if e != nil {
+		return nil, fmt.Errorf("unable to create ZeroMQ socket: %w", e)
+	}
+	if w.opts.CurveServerKey != "" {
+		if e := sock.ClientAuthCurve(w.opts.CurveServerKey, w.opts.CurveKeys.Public, w.opts.CurveKeys.Secret); e != nil {
+			sock.Close()
+			return nil, fmt.Errorf("unable to set up CURVE: %w", e)
+		}
+	}
+	return sock, nil
+}
+
+// subscribe forwards the "work available" announcements of the master to wake
+func (w *Worker) subscribe(ctx context.Context, zctx *zmq4.Context, wake chan<- struct{}) {
+	sock, e := w.socket(zctx, zmq4.SUB)
+	if e != nil {
+		logrus.WithFields(logrus.Fields{"error": e}).Errorf("Unable to subscribe")
+		return
+	}
+	defer sock.Close()
+
+	sock.SetLinger(0)
+	sock.SetRcvtimeo(poll_interval)
+	sock.SetSubscribe("work_available")
+	if e := sock.Connect(w.opts.NotifyEndpoint); e != nil {
+		logrus.WithFields(logrus.Fields{"error": e}).Errorf("Unable to connect ZeroMQ socket")
+		return
+	}
+	logrus.WithFields(logrus.Fields{"endpoint": w.opts.NotifyEndpoint}).Debugf("Subscribe")
+
+	for ctx.Err() == nil {
+		if _, e := sock.Recv(0); e != nil {
+			if isTimeout(e) {
+				continue
+			}
+			logrus.WithFields(logrus.Fields{"error": e}).Errorf("Unable to receive the announcement")
+			return
+		}
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// idle waits for the next poll, or until the master announces new work
+func idle(ctx context.Context, wait time.Duration, wake <-chan struct{}) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	case <-wake:
+		logrus.Debugf("Woken up by the master")
+	}
+}
+
+// identity names the connection of a worker to the master; it is unique even
+// for several workers of one process
+func identity(hostname, pid string) string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%v/%v/%x", hostname, pid, b)
+}
+
+// hello checks the protocol version with the master and registers the capabilities
+func (w *Worker) hello(ctx context.Context, conn_done <-chan error) (protocol.Response, error) {
+	req := w.request(protocol.KindHello)
+	if w.opts.Capabilities != nil {
+		req.Capabilities = w.opts.Capabilities
+	} else {
+		caps := ProbeCapabilities(ctx, nil, w.opts.TempDir)
+		req.Capabilities = &caps
+	}
+	req.Labels = w.opts.Labels
+
+	type result struct {
+		res protocol.Response
+		e   error
+	}
+	c := make(chan result, 1)
+	go func() {
+		res, e := w.conn.request(ctx, req)
+		c <- result{res, e}
+	}()
+
+	select {
+	case r := <-c:
+		return r.res, r.e
+	case e := <-conn_done:
+		// unable to connect at all
+		return protocol.Response{}, e
+	}
+}
+
+// Run asks for jobs until the context is done, or the master runs out of jobs with ExitWhenEmpty.
+// A job interrupted by the context is reported as killed.
+func (w *Worker) Run(ctx context.Context) error {
+	zctx := w.opts.ZMQ
+	if zctx == nil {
+		var e error
+		if zctx, e = zmq4.NewContext(); e != nil {
+			return fmt.Errorf("unable to create ZeroMQ context: %w", e)
+		}
+	}
+	// the connection outlives ctx a little, to report the interrupted job
+	newSocket := func(t zmq4.Type) (*zmq4.Socket, error) { return w.socket(zctx, t) }
+	w.conn = newConn(newSocket, w.opts.Endpoint, identity(w.opts.Hostname, w.opts.PID), w.opts.RequestTimeout)
+	conn_ctx, stop_conn := context.WithCancel(context.Background())
+	conn_done := make(chan error, 1)
+	go func() { conn_done <- w.conn.run(conn_ctx) }()
+	defer func() {
+		stop_conn()
+		<-conn_done
+	}()
+	go w.handlePushes(conn_ctx)
+
+	// check that both sides speak the same protocol before anything else
+	res, e := w.hello(ctx, conn_done)
+	if e != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return fmt.Errorf("unable to greet the master: %w", e)
+	}
+	logrus.WithFields(logrus.Fields{
+		"hostname": res.Master.Hostname,
+		"pid":      res.Master.PID,
+		"version":  res.Version,
+	}).Infof("Connected to the master")
+
+	wake := make(chan struct{}, 1)
+	if w.opts.NotifyEndpoint != "" {
+		go w.subscribe(ctx, zctx, wake)
+	}
+	poll_wait := w.opts.PollMin
+
+	for ctx.Err() == nil {
+		// Query to master server
+		res, e := w.conn.request(ctx, w.request(protocol.KindJobWant))
+		if e != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return fmt.Errorf("unable to ask the master for a job: %w", e)
+		}
+		if res.Register {
+			logrus.Infof("The master does not know this worker, register again")
+			if _, e := w.hello(ctx, conn_done); e != nil {
+				if ctx.Err() != nil {
+					break
+				}
+				return fmt.Errorf("unable to greet the master: %w", e)
+			}
+			continue
+		}
+
+		if !res.OK || res.Job == nil {
+			// retry_after means the master expects more jobs later (retries or watch mode)
+			retry_after := time.Duration(res.RetryAfter)
+			if w.opts.ExitWhenEmpty && retry_after <= 0 {
+				logrus.Warnf("No more avaialbe job. Bye.")
+				return nil
+			}
+
+			wait := poll_wait
+			if retry_after > 0 && retry_after < wait {
+				wait = retry_after
+			}
+			logrus.WithFields(logrus.Fields{"wait": wait}).Debugf("No job for now, idle")
+			idle(ctx, wait, wake)
+
+			poll_wait *= 2
+			if poll_wait > w.opts.PollMax {
+				poll_wait = w.opts.PollMax
+			}
+			continue
+		}
+		poll_wait = w.opts.PollMin
+
+		if e := w.runJob(ctx, res.Job); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// commit asks the master whether the job may replace the original file
+func (w *Worker) commit(ctx context.Context, fp string) error {
+	req := w.request(protocol.KindCommit)
+	req.Path = fp
+	res, e := w.conn.request(ctx, req)
+	if e != nil {
+		return fmt.Errorf("unable to ask the master to replace the file: %w", e)
+	}
+	if !res.OK {
+		return ErrLostRace
+	}
+	return nil
+}
+
+// runJob handles a job the master assigned and reports the outcome
+func (w *Worker) runJob(ctx context.Context, job *protocol.Job) error {
+	fp := job.Path
+
+	// the master may choose the transcoding profile of the file
+	w.mu.Lock()
+	job_conf, conf_err := w.config, error(nil)
+	w.mu.Unlock()
+	if len(job.ProfileConfig) > 0 {
+		job_conf, conf_err = transcode.ParseConfig(gjson.ParseBytes(job.ProfileConfig))
+	}
+	fields := logrus.Fields{"path": fp, "profile": job.Profile}
+	if job.Task != nil {
+		fields["task"] = job.Task.Kind
+	}
+	logrus.WithFields(fields).Debugf("Received a job")
+
+	// the master may cancel the job
+	job_ctx, cancel_job := context.WithCancel(ctx)
+	defer cancel_job()
+	w.mu.Lock()
+	w.current_path, w.cancel_current = fp, cancel_job
+	w.mu.Unlock()
+	defer func() {
+		w.mu.Lock()
+		w.current_path, w.cancel_current = "", nil
+		w.mu.Unlock()
+	}()
+
+	// keep the lease alive while working
+	heartbeat_ctx, stop_heartbeat := context.WithCancel(job_ctx)
+	if lease := time.Duration(job.Lease); lease > 0 {
+		go w.heartbeat(heartbeat_ctx, fp, lease/3)
+	}
+
+	start := time.Now()
+	stats := Stats{}
+
+	metric_busy.Set(1)
+	status, e := func() (status Status, e error) {
+		defer stop_heartbeat()
+		defer func() {
+			if p := recover(); p != nil {
+				logrus.WithFields(logrus.Fields{"path": fp, "recover_msg": p}).Warnf("Recovered from panic")
+				status, e = StatusFail, fmt.Errorf("panic: %v", p)
+			}
+		}()
+		if conf_err != nil {
+			return StatusFail, conf_err
+		}
+		return w.opts.Handler.Handle(job_ctx, Job{
+			Path:    fp,
+			Profile: job.Profile,
+			Config:  job_conf,
+			TempDir: w.opts.TempDir,
+			Task:    job.Task,
+			Commit:  func() error { return w.commit(job_ctx, fp) },
+		}, &stats)
+	}()
+	metric_busy.Set(0)
+
+	elapsed := time.Since(start)
+
+	req := w.request("")
+	req.Report = &protocol.Report{
+		Path:    fp,
+		Elapsed: protocol.Duration(elapsed),
+		Stats:   stats,
+	}
+
+	report_ctx := ctx
+	// stopped in the middle by the master, or the worker is stopping and
+	// the master has to give the file to someone else
+	if status == StatusFail && job_ctx.Err() != nil {
+		status = StatusKilled
+	}
+	if ctx.Err() != nil {
+		var cancel context.CancelFunc
+		report_ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+	}
+	observeJob(status, stats, elapsed)
+
+	// Report to master server
+	switch status {
+	case StatusSuccess:
+		logrus.WithFields(logrus.Fields{"path": fp}).Infof("Success")
+		req.Kind = protocol.KindJobDone
+
+	case StatusSkip:
+		logrus.WithFields(logrus.Fields{"path": fp}).Warnf("Skip")
+		req.Kind = protocol.KindJobSkip
+
+	case StatusKilled:
+		logrus.WithFields(logrus.Fields{"path": fp}).Warnf("Incomplete")
+		req.Kind = protocol.KindKilled
+		req.Report.Error = &protocol.Error{Class: transcode.FailTransient}
+		if e != nil {
+			req.Report.Error.Message = e.Error()
+		}
+
+	default:
+		logrus.WithFields(logrus.Fields{"path": fp}).Warnf("Failed")
+		if e == nil {
+			e = fmt.Errorf("unknown status %q", status)
+		}
+		req.Kind = protocol.KindJobFail
+		req.Report.Error = &protocol.Error{Message: e.Error(), Class: transcode.ClassifyError(e)}
+	}
+
+	// a number JSON cannot carry, e.g. a NaN duration of a broken file, must not lose the outcome
+	if _, e := protocol.Encode(req); e != nil {
+		logrus.WithFields(logrus.Fields{"path": fp, "error": e}).Warnf("Unable to encode the stats, report without them")
+		req.Report.Stats = protocol.Stats{FileType: stats.FileType, Segments: stats.Segments}
+	}
+	if _, e := w.conn.request(report_ctx, req); e != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return fmt.Errorf("unable to report %v: %w", fp, e)
+	}
+	logrus.WithFields(logrus.Fields{"path": fp, "req": req.Kind}).Debugf("Report to master")
+	return nil
+}
+
+// Transcode is the default Handler, transcoding the file in place with the config
+// of the job, or doing the task of the job on a file shared by several workers
+func Transcode(ctx context.Context, job Job, stats *Stats) (Status, error) {
+	if info, e := os.Stat(job.Path); e == nil {
+		stats.BytesIn = info.Size()
+	}
+	if job.Task != nil && job.Task.Kind != protocol.TaskSplit {
+		return runTask(ctx, job, stats)
+	}
+
+	meta := transcode.Metadata{StageObserver: observeStage, Commit: job.Commit}
+	if e := meta.Init(ctx, job.Path, job.Config, job.TempDir); e != nil {
+		// not a media file, unless probing failed for a reason worth retrying
+		// or the config or an override file needs fixing
+		var conf_err *transcode.ConfigError
+		if transcode.ClassifyError(e) == transcode.FailTransient || errors.Is(e, transcode.ErrSidecar) || errors.As(e, &conf_err) {
+			return StatusFail, e
+		}
+		return StatusSkip, nil
+	}
+	if meta.FileType == "" {
+		return StatusSkip, nil
+	}
+	stats.FileType = meta.FileType
+	stats.MediaDuration = meta.Duration()
+
+	// cut into segment jobs, unless the video is not encoded
+	if job.Task != nil {
+		n, e := transcode.Split(ctx, &meta, job.Task.Segments)
+		if e == nil {
+			stats.Segments = n
+			stats.Streams = streamStats(meta.Decisions)
+			return StatusSuccess, nil
+		}
+		if !errors.Is(e, transcode.ErrNotSplittable) {
+			logrus.Errorln(e)
+			stats.Streams = streamStats(meta.Decisions)
+			return StatusFail, e
+		}
+		logrus.WithFields(logrus.Fields{"path": job.Path}).Debugf("Not splittable, transcode whole")
+	}
+
+	var e error
+	// transcode
+	switch meta.FileType {
+	case "image":
+		fallthrough
+	case "audio":
+		fallthrough
+	case "video":
+		e = transcode.SingleStreamOnly(ctx, &meta)
+		if e != nil {
+			logrus.Errorln(e)
+		}
+	case "video_and_audio":
+		e = transcode.VideoAndAudio(ctx, &meta)
+		if e != nil {
+			logrus.Errorln(e)
+		}
+	case "image_animated":
+		fallthrough
+	default:
+		return StatusSkip, nil
+	}
+	stats.Streams = streamStats(meta.Decisions)
+
+	if e != nil {
+		meta.RemoveTemp()
+		return StatusFail, e
+	}
+
+	if info, e := os.Stat(meta.Output.Join()); e == nil {
+		stats.BytesOut = info.Size()
+	}
+
+	return StatusSuccess, nil
+}
+
+// runTask encodes a segment of a file or merges the encoded segments into it
+func runTask(ctx context.Context, job Job, stats *Stats) (Status, error) {
+	meta := transcode.Metadata{StageObserver: observeStage, Commit: job.Commit}
+	var e error
+	switch job.Task.Kind {
+	case protocol.TaskSegment:
+		meta.FilePath.Fill(job.Task.Source)
+		e = transcode.EncodeSegment(ctx, &meta, job.Task.Index)
+	case protocol.TaskMerge:
+		meta.FilePath.Fill(job.Path)
+		if e = transcode.Merge(ctx, &meta); e == nil {
+			if info, e := os.Stat(meta.Output.Join()); e == nil {
+				stats.BytesOut = info.Size()
+			}
+		}
+	default:
+		e = fmt.Errorf("unknown task %q", job.Task.Kind)
+	}
+	if e != nil {
+		logrus.Errorln(e)
+		return StatusFail, e
+	}
+	return StatusSuccess, nil
+}
+
+// streamStats tells the master how the streams were handled
+func streamStats(decisions []transcode.StreamDecision) []protocol.Stream {
+	result := []protocol.Stream{}
+	for _, d := range decisions {
+		result = append(result, protocol.Stream{
+			CodecType: d.CodecType,
+			Index:     d.N,
+			CodecName: d.CodecName,
+			Action:    d.Action,
+			Rule:      d.Rule,
+			Args:      d.Args,
+			TargetExt: d.TargetExt,
+		})
+	}
+	return result
+}